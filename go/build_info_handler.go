@@ -0,0 +1,97 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+)
+
+// ビルド情報
+// どのサーバでどのバイナリが動いているかを確かめられるよう、起動時にログに出し、
+// ISUCON13_INITIALIZE_BUILD_INFO=trueの場合は初期化APIのレスポンスのbuildにも入れる
+// ベンチマーカーに返すレスポンスを変えないよう、既定では入れない
+//
+// リビジョンとビルド日時は、Makefileのbuildで -ldflags "-X main.buildRevision=... -X main.buildTime=..." として埋め込む
+// 埋め込まれていなければ、go buildが記録したVCSの情報 (gitの作業ツリーでビルドした場合のみ) を使う
+
+var (
+	buildRevision string
+	buildTime     string
+
+	// trueの場合、初期化APIのレスポンスにbuildを入れる
+	initializeBuildInfo bool
+)
+
+// BuildInfo は、動いているバイナリの情報
+type BuildInfo struct {
+	Revision string `json:"revision"`
+	// 未コミットの変更を含むか。VCSの情報を使った場合のみ分かる
+	Modified  bool   `json:"modified"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+	// 有効になっている機能の名前 (名前順)
+	Features []string `json:"features"`
+}
+
+var (
+	buildInfoOnce sync.Once
+	buildInfo     BuildInfo
+)
+
+// currentBuildInfo は、init()で環境変数を読んだ後に呼ぶ
+func currentBuildInfo() BuildInfo {
+	buildInfoOnce.Do(func() {
+		buildInfo = BuildInfo{
+			Revision:  buildRevision,
+			BuildTime: buildTime,
+			GoVersion: runtime.Version(),
+			Features:  enabledFeatures(),
+		}
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if buildInfo.Revision == "" {
+					buildInfo.Revision = setting.Value
+				}
+			case "vcs.time":
+				if buildInfo.BuildTime == "" {
+					buildInfo.BuildTime = setting.Value
+				}
+			case "vcs.modified":
+				buildInfo.Modified = setting.Value == "true"
+			}
+		}
+	})
+	return buildInfo
+}
+
+// enabledFeatures は、環境変数で切り替えられる機能のうち有効なものを返す
+func enabledFeatures() []string {
+	features := map[string]bool{
+		"dns_registration":         dnsRegistrationEnabled,
+		"dns_wildcard":             dnsWildcard,
+		"jwt_auth":                 jwtAuthEnabled,
+		"redis":                    redisClient != nil,
+		"realtime_relay":           realtimeRelayEnabled,
+		"reaction_burst":           reactionBurstWindow > 0,
+		"response_cache":           responseCacheTTL > 0,
+		"livestream_status_strict": livestreamStatusStrict,
+		"icon_reencode":            iconReencode,
+		"login_verify_memo":        loginVerifyMemoEnabled,
+		"cache_snapshot":           cacheSnapshotPath != "",
+		"db_replica":               dbReplica != nil,
+	}
+	enabled := make([]string, 0, len(features))
+	for name, ok := range features {
+		if ok {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	return enabled
+}
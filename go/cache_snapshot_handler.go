@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// アイコンのハッシュとユーザまわりのキャッシュを、終了時にファイルへ書き出し、起動時に読み戻す
+// ベンチマーク中に再起動しても、キャッシュが空の状態から始まらないようにする
+// 初期化APIでデータが作り直されるとスナップショットは古くなるので、初期化時にファイルを消す
+// 止まっている間に他のサーバで変わったかもしれないので、読み戻したものはcacheSnapshotRestoreTTLの間だけ使う
+// 読み戻したファイルは、リクエストを受け付け始めてから消す (起動に失敗した場合は次の起動でもう一度読む)
+// 存在しないことを覚えているもの (期限付きのもの) は含めない
+
+// 書き出す形式を変えたら上げる
+const cacheSnapshotVersion = 2
+
+// 読み戻したものを、DBから読み直すまで使う時間
+const cacheSnapshotRestoreTTL = 5 * time.Second
+
+var cacheSnapshotPath string
+
+type cacheSnapshot struct {
+	Version    int
+	IconHashes map[int64]string
+	Themes     map[int64]ThemeModel
+	KnownUsers []int64
+}
+
+func saveCacheSnapshot() error {
+	if cacheSnapshotPath == "" {
+		return nil
+	}
+
+	snapshot := cacheSnapshot{
+		Version:    cacheSnapshotVersion,
+		IconHashes: map[int64]string{},
+		Themes:     map[int64]ThemeModel{},
+	}
+	iconHashCache.Range(func(userID int64, hash string) bool {
+		snapshot.IconHashes[userID] = hash
+		return true
+	})
+	userThemes.Range(func(userID int64, theme ThemeModel) bool {
+		snapshot.Themes[userID] = theme
+		return true
+	})
+	knownUsers.Range(func(userID int64, exists bool) bool {
+		if exists {
+			snapshot.KnownUsers = append(snapshot.KnownUsers, userID)
+		}
+		return true
+	})
+
+	// 書き込み途中で落ちても壊れたファイルを読まないよう、一時ファイルに書いてから置き換える
+	f, err := os.CreateTemp(filepath.Dir(cacheSnapshotPath), filepath.Base(cacheSnapshotPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := gob.NewEncoder(f).Encode(&snapshot); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), cacheSnapshotPath)
+}
+
+// restoreCacheSnapshot は、起動時にリクエストを受け付ける前に呼ぶ
+// 読み戻した件数を返す
+func restoreCacheSnapshot() (int, error) {
+	if cacheSnapshotPath == "" {
+		return 0, nil
+	}
+
+	f, err := os.Open(cacheSnapshotPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var snapshot cacheSnapshot
+	if err := gob.NewDecoder(f).Decode(&snapshot); err != nil {
+		return 0, err
+	}
+	if snapshot.Version != cacheSnapshotVersion {
+		return 0, fmt.Errorf("unsupported cache snapshot version %d", snapshot.Version)
+	}
+
+	for userID, hash := range snapshot.IconHashes {
+		iconHashCache.SetWithTTL(userID, hash, cacheSnapshotRestoreTTL)
+	}
+	for userID, theme := range snapshot.Themes {
+		userThemes.SetWithTTL(userID, theme, cacheSnapshotRestoreTTL)
+	}
+	for _, userID := range snapshot.KnownUsers {
+		knownUsers.SetWithTTL(userID, true, cacheSnapshotRestoreTTL)
+	}
+	return len(snapshot.IconHashes) + len(snapshot.Themes) + len(snapshot.KnownUsers), nil
+}
+
+// discardCacheSnapshot は、初期化時と、読み戻した後にリクエストを受け付け始めたときに、スナップショットを消す
+func discardCacheSnapshot() error {
+	if cacheSnapshotPath == "" {
+		return nil
+	}
+	if err := os.Remove(cacheSnapshotPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
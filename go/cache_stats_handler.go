@@ -0,0 +1,18 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/isucon/isucon13/webapp/go/internal/cache"
+)
+
+// キャッシュ利用状況取得API
+// GET /api/admin/cache/stats
+// internal/cacheで作ったキャッシュごとに、ヒット数・ミス数・追い出し数・件数を返す
+// チューニング中にどのキャッシュが効いているかを見るためのもので、初期化しても数は戻さない
+// 公開するAPIではないので、/api/admin配下でも公開用のポートではなく内部向けのポート (:6060) で受け付ける
+func getCacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(cache.AllStats())
+}
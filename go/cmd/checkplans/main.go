@@ -0,0 +1,46 @@
+// checkplans は、internal/repositoryの参照メソッドのクエリをEXPLAINし、大きいテーブルを全件走査するものがあれば失敗する
+//
+// クエリを書き換えたときにインデックスが効かなくなっていないかを、本番の初期化とは別に確かめる
+// オプティマイザは行数で計画を変えるので、初期データを入れたDB (init.shを実行したもの) に対して実行すること
+//
+//	go run ./cmd/checkplans -dsn 'isucon:isucon@tcp(127.0.0.1:3306)/isupipe'
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/isucon/isucon13/webapp/go/internal/repository"
+	"github.com/jmoiron/sqlx"
+)
+
+func main() {
+	dsn := flag.String("dsn", "isucon:isucon@tcp(127.0.0.1:3306)/isupipe", "DSN of the isupipe database seeded with the initial data")
+	flag.Parse()
+
+	db, err := open(*dsn)
+	if err != nil {
+		log.Fatalf("failed to connect isupipe database: %v", err)
+	}
+	defer db.Close()
+
+	if err := repository.CheckQueryPlans(context.Background(), db); err != nil {
+		log.Fatalf("query plan check failed: %v", err)
+	}
+	log.Printf("query plans ok")
+}
+
+func open(dsn string) (*sqlx.DB, error) {
+	conf, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	conf.InterpolateParams = true
+	db, err := sqlx.Open("mysql", conf.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	return db, db.Ping()
+}
@@ -0,0 +1,78 @@
+// seeddns は、退会していない全ユーザのサブドメインのAレコードを、PowerDNSのgmysqlバックエンドのテーブルにまとめて登録する
+//
+// pdnsutilでユーザごとに登録すると数千回プロセスを起動することになるので、初期データの投入や作り直しに使う
+// 既にあるAレコードは置き換える (dns.Registrar.AddARecordsと同じ)
+//
+//	go run ./cmd/seeddns -addresses 192.168.0.11,192.168.0.12
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/isucon/isucon13/webapp/go/dns"
+	"github.com/jmoiron/sqlx"
+)
+
+func main() {
+	var (
+		isupipeDSN = flag.String("isupipe-dsn", "isucon:isucon@tcp(127.0.0.1:3306)/isupipe", "DSN of the isupipe database")
+		pdnsDSN    = flag.String("pdns-dsn", os.Getenv("ISUCON13_POWERDNS_MYSQL_DSN"), "DSN of the PowerDNS database (default $ISUCON13_POWERDNS_MYSQL_DSN)")
+		zone       = flag.String("zone", dns.DefaultZone, "zone to register records in")
+		addresses  = flag.String("addresses", os.Getenv("ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"), "comma-separated addresses (default $ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS)")
+		ttl        = flag.Int("ttl", dns.DefaultRecordTTL, "TTL of the records")
+	)
+	flag.Parse()
+
+	config := dns.DefaultConfig()
+	config.Zone = *zone
+	config.RecordTTL = *ttl
+	addrs, err := dns.ParseAddresses(*addresses)
+	if err != nil {
+		log.Fatalf("invalid addresses: %v", err)
+	}
+	config.Addresses = addrs
+	if *pdnsDSN == "" {
+		log.Fatal("-pdns-dsn must be provided")
+	}
+
+	isupipe, err := open(*isupipeDSN)
+	if err != nil {
+		log.Fatalf("failed to connect isupipe database: %v", err)
+	}
+	defer isupipe.Close()
+	pdns, err := open(*pdnsDSN)
+	if err != nil {
+		log.Fatalf("failed to connect PowerDNS database: %v", err)
+	}
+	defer pdns.Close()
+
+	ctx := context.Background()
+	var names []string
+	if err := isupipe.SelectContext(ctx, &names, "SELECT name FROM users WHERE deleted_at IS NULL ORDER BY id"); err != nil {
+		log.Fatalf("failed to get users: %v", err)
+	}
+
+	start := time.Now()
+	if err := dns.NewMySQL(pdns, config).AddARecords(ctx, names); err != nil {
+		log.Fatalf("failed to register records: %v", err)
+	}
+	log.Printf("registered %d names x %d addresses in %s", len(names), len(addrs), time.Since(start))
+}
+
+func open(dsn string) (*sqlx.DB, error) {
+	conf, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	conf.InterpolateParams = true
+	db, err := sqlx.Open("mysql", conf.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	return db, db.Ping()
+}
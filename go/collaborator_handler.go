@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// コラボレーター(共同配信者)
+// 配信者が招待し、招待されたユーザが承諾するとコラボレーターになる
+// コラボレーターは配信者と同じモデレーション権限を持つ
+
+const (
+	collaboratorStatusInvited  = "invited"
+	collaboratorStatusAccepted = "accepted"
+)
+
+type LivestreamCollaboratorModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	UserID       int64  `db:"user_id"`
+	Status       string `db:"status"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type LivestreamCollaborator struct {
+	ID           int64  `json:"id"`
+	LivestreamID int64  `json:"livestream_id"`
+	User         User   `json:"user"`
+	Status       string `json:"status"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+type PostCollaboratorRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+// コラボレーター招待API (配信者向け)
+// POST /api/livestream/:livestream_id/collaborator
+func postCollaboratorHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostCollaboratorRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var ownerID int64
+	if err := tx.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	// 招待できるのは配信者本人のみ
+	if ownerID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "only the owner can invite collaborators")
+	}
+
+	collaboratorModel, err := inviteCollaborator(ctx, tx, int64(livestreamID), ownerID, req.UserID)
+	if err != nil {
+		return err
+	}
+
+	collaborator, err := fillCollaboratorResponse(ctx, tx, collaboratorModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill collaborator: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, collaborator)
+}
+
+// コラボレーター招待承諾API (招待されたユーザ向け)
+// POST /api/livestream/:livestream_id/collaborator/accept
+func acceptCollaboratorHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var collaboratorModel LivestreamCollaboratorModel
+	if err := tx.GetContext(ctx, &collaboratorModel, "SELECT * FROM livestream_collaborators WHERE livestream_id = ? AND user_id = ? FOR UPDATE", livestreamID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "invitation not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborator: "+err.Error())
+	}
+
+	if collaboratorModel.Status != collaboratorStatusAccepted {
+		if _, err := tx.ExecContext(ctx, "UPDATE livestream_collaborators SET status = ? WHERE id = ?", collaboratorStatusAccepted, collaboratorModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update collaborator: "+err.Error())
+		}
+		collaboratorModel.Status = collaboratorStatusAccepted
+	}
+
+	collaborator, err := fillCollaboratorResponse(ctx, tx, collaboratorModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill collaborator: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	livestreamDetails.Delete(int64(livestreamID))
+
+	return c.JSON(http.StatusOK, collaborator)
+}
+
+// inviteCollaborator は、配信にコラボレーターを招待する
+// 返すエラーはecho.HTTPError
+func inviteCollaborator(ctx context.Context, tx *sqlx.Tx, livestreamID int64, ownerID int64, userID int64) (LivestreamCollaboratorModel, error) {
+	if userID == ownerID {
+		return LivestreamCollaboratorModel{}, echo.NewHTTPError(http.StatusBadRequest, "the owner can't be a collaborator")
+	}
+
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userID); err != nil {
+		return LivestreamCollaboratorModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if !exists {
+		return LivestreamCollaboratorModel{}, echo.NewHTTPError(http.StatusBadRequest, "collaborator user not found")
+	}
+
+	collaboratorModel := LivestreamCollaboratorModel{
+		LivestreamID: livestreamID,
+		UserID:       userID,
+		Status:       collaboratorStatusInvited,
+		CreatedAt:    time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_collaborators (livestream_id, user_id, status, created_at) VALUES (:livestream_id, :user_id, :status, :created_at)", collaboratorModel)
+	if isDuplicateEntryError(err) {
+		return LivestreamCollaboratorModel{}, echo.NewHTTPError(http.StatusConflict, "the user is already invited")
+	}
+	if err != nil {
+		return LivestreamCollaboratorModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert collaborator: "+err.Error())
+	}
+	collaboratorID, err := rs.LastInsertId()
+	if err != nil {
+		return LivestreamCollaboratorModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted collaborator id: "+err.Error())
+	}
+	collaboratorModel.ID = collaboratorID
+
+	return collaboratorModel, nil
+}
+
+// isLivestreamModerator は、userIDのユーザが配信者か承諾済みのコラボレーターかどうかを返す
+func isLivestreamModerator(ctx context.Context, db dbQueryer, livestreamModel LivestreamModel, userID int64) (bool, error) {
+	if livestreamModel.UserID == userID {
+		return true, nil
+	}
+
+	var isCollaborator bool
+	if err := db.GetContext(ctx, &isCollaborator, "SELECT EXISTS (SELECT 1 FROM livestream_collaborators WHERE livestream_id = ? AND user_id = ? AND status = ?)", livestreamModel.ID, userID, collaboratorStatusAccepted); err != nil {
+		return false, err
+	}
+	return isCollaborator, nil
+}
+
+// verifyLivestreamModerator は、配信が存在し、userIDのユーザが配信者か承諾済みのコラボレーターであることを検証する
+func verifyLivestreamModerator(ctx context.Context, db dbQueryer, livestreamID int64, userID int64) error {
+	livestreamModel, err := livestreamRepo.FindByID(ctx, db, livestreamID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	ok, err := isLivestreamModerator(ctx, db, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborator: "+err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "A streamer can't moderate livestreams that other streamers own")
+	}
+	return nil
+}
+
+func fillCollaboratorResponse(ctx context.Context, db dbQueryer, collaboratorModel LivestreamCollaboratorModel) (LivestreamCollaborator, error) {
+	user, err := getUserByID(ctx, db, collaboratorModel.UserID)
+	if err != nil {
+		return LivestreamCollaborator{}, err
+	}
+
+	return LivestreamCollaborator{
+		ID:           collaboratorModel.ID,
+		LivestreamID: collaboratorModel.LivestreamID,
+		User:         user,
+		Status:       collaboratorModel.Status,
+		CreatedAt:    collaboratorModel.CreatedAt,
+	}, nil
+}
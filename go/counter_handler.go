@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/cache"
+	"github.com/isucon/isucon13/webapp/go/internal/counter"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信・配信者ごとのリアクション数・ライブコメント数・視聴者数・スパム報告数
+// 統計APIはまずinternal/counterのメモリ上の値を使い、数え直し中などで使えない場合だけMySQLで数える
+// 投稿・報告・入退室のイベント (event_handler.go) で増減を記録し、counterSyncIntervalごとにlivestream_counters・user_countersへ書き出す
+// 件数の元になる行を書き換えるコミットはcounter.Commitで行い、返ったEpochをイベントやcounterDeltasに渡す
+// 行の削除やシャドウバンで件数が変わった場合は、コミット前に減る件数を数えておき、counterDeltasでコミット後に減らす
+// 初期化時 (と1台で動かす場合の起動時) は元の行から数え直すので、落ちて書き出せなかった増減は残らない
+var (
+	livestreamCounters = counter.New(counter.Options{
+		Table: "livestream_counters",
+		Key:   "livestream_id",
+		Columns: []counter.ColumnOptions{
+			{Name: "reactions", Source: "SELECT livestream_id AS id, COUNT(*) AS count FROM reactions GROUP BY livestream_id"},
+			{Name: "viewers", Source: "SELECT livestream_id AS id, COUNT(*) AS count FROM livestream_viewers_history GROUP BY livestream_id"},
+			{Name: "reports", Source: "SELECT livestream_id AS id, COUNT(*) AS count FROM livecomment_reports GROUP BY livestream_id"},
+		},
+	})
+	livestreamReactionCounter = livestreamCounters.Column("reactions")
+	livestreamViewerCounter   = livestreamCounters.Column("viewers")
+	livestreamReportCounter   = livestreamCounters.Column("reports")
+
+	userCounters = counter.New(counter.Options{
+		Table: "user_counters",
+		Key:   "user_id",
+		Columns: []counter.ColumnOptions{
+			{Name: "reactions", Source: "SELECT l.user_id AS id, COUNT(*) AS count FROM reactions r INNER JOIN livestreams l ON l.id = r.livestream_id GROUP BY l.user_id"},
+			{Name: "livecomments", Source: "SELECT l.user_id AS id, COUNT(*) AS count FROM livecomments lc INNER JOIN livestreams l ON l.id = lc.livestream_id WHERE NOT EXISTS (SELECT 1 FROM shadow_bans sb WHERE sb.livestream_id = lc.livestream_id AND sb.user_id = lc.user_id) GROUP BY l.user_id"},
+			{Name: "viewers", Source: "SELECT l.user_id AS id, COUNT(*) AS count FROM livestream_viewers_history h INNER JOIN livestreams l ON l.id = h.livestream_id GROUP BY l.user_id"},
+		},
+	})
+	userReactionCounter    = userCounters.Column("reactions")
+	userLivecommentCounter = userCounters.Column("livecomments")
+	userViewerCounter      = userCounters.Column("viewers")
+)
+
+// 件数を書き出す間隔
+var counterSyncInterval = 500 * time.Millisecond
+
+// trueの場合、複数のアプリサーバで件数の表を共有する
+// 書き出しのたびに他のサーバが書き出した分を読み直し、起動時は数え直さずに表を読み込む
+var counterReload bool
+
+// resetCounters は、初期化でMySQLを作り直す前に、作り直す前の増減を捨てる
+func resetCounters() {
+	counter.ResetAll()
+}
+
+// rebuildCounters は、元の行から数え直す。初期化時に呼ぶ
+func rebuildCounters(ctx context.Context) error {
+	return counter.RebuildAll(ctx, dbConn)
+}
+
+// loadCounters は、起動時に呼ぶ
+// 他のサーバと表を共有する場合は、他のサーバの書き出していない増減と二重にならないよう数え直さない
+func loadCounters(ctx context.Context) error {
+	if counterReload {
+		return counter.LoadAll(ctx, dbConn)
+	}
+	return counter.RebuildAll(ctx, dbConn)
+}
+
+// runCounterSync は、件数を定期的に書き出す
+func runCounterSync(ctx context.Context, logger echo.Logger) {
+	counter.Run(ctx, dbConn, counterSyncInterval, counterReload, func(err error) {
+		logger.Errorf("failed to sync counters: %v", err)
+	})
+}
+
+// runInTxCounted は、コミットをcounter.Commitで行うrunInTx
+func runInTxCounted(ctx context.Context, fn func(tx *sqlx.Tx) error) (counter.Epoch, error) {
+	var e counter.Epoch
+	err := runInTxCommit(ctx, fn, func(tx *sqlx.Tx) error {
+		var err error
+		e, err = counter.Commit(tx.Commit)
+		return err
+	})
+	return e, err
+}
+
+// counterDeltas は、トランザクションの中で数えておき、コミット後にまとめて反映する件数の増減
+type counterDeltas struct {
+	adds []counterAdd
+}
+
+type counterAdd struct {
+	column counter.Column
+	id     int64
+	delta  int64
+}
+
+func (d *counterDeltas) add(column counter.Column, id int64, delta int64) {
+	if delta != 0 {
+		d.adds = append(d.adds, counterAdd{column: column, id: id, delta: delta})
+	}
+}
+
+// addCounts は、主キーの値をid、件数をcountとして返すqueryの結果をsign倍してcolumnに加える
+// 行を削除する場合は、削除する前に同じトランザクションで数えること
+func (d *counterDeltas) addCounts(ctx context.Context, tx *sqlx.Tx, column counter.Column, sign int64, query string, args ...interface{}) error {
+	var rows []struct {
+		ID    int64 `db:"id"`
+		Count int64 `db:"count"`
+	}
+	if err := tx.SelectContext(ctx, &rows, query, args...); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		d.add(column, row.ID, sign*row.Count)
+	}
+	return nil
+}
+
+// apply は、counter.Commitが返したEpochでコミット後に呼ぶ
+func (d *counterDeltas) apply(e counter.Epoch) {
+	for _, a := range d.adds {
+		a.column.Add(e, a.id, a.delta)
+	}
+}
+
+// 配信ID -> 配信者のユーザID (配信者は変わらない)
+var livestreamOwners = cache.New[int64, int64](cache.Options[int64]{Name: "livestream_owners", MaxEntries: 100000})
+
+// addViewerCount は、視聴者の入退室のコミット後に呼ぶ
+func addViewerCount(ctx context.Context, e counter.Epoch, livestreamID int64, delta int64) error {
+	livestreamViewerCounter.Add(e, livestreamID, delta)
+	ownerID, err := livestreamOwners.GetOrLoad(ctx, livestreamID, func(ctx context.Context, livestreamID int64) (int64, error) {
+		var ownerID int64
+		err := dbConn.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID)
+		return ownerID, err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		// 削除済みの配信の視聴者は、削除時に減らしている
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	userViewerCounter.Add(e, ownerID, delta)
+	return nil
+}
+
+func countReaction(ctx context.Context, event ReactionCreated) error {
+	livestreamReactionCounter.Add(event.CounterEpoch, event.Livestream.ID, 1)
+	userReactionCounter.Add(event.CounterEpoch, event.Livestream.UserID, 1)
+	return nil
+}
+
+// countLivecomment は、シャドウバンされたユーザのライブコメントを数えない
+func countLivecomment(ctx context.Context, event LivecommentCreated) error {
+	banned, err := shadowBans.get(ctx, event.Livestream.ID)
+	if err != nil {
+		return err
+	}
+	if _, ok := banned[event.Model.UserID]; !ok {
+		userLivecommentCounter.Add(event.CounterEpoch, event.Livestream.UserID, 1)
+	}
+	return nil
+}
+
+func countReport(ctx context.Context, event ReportCreated) error {
+	livestreamReportCounter.Add(event.CounterEpoch, event.Model.LivestreamID, 1)
+	return nil
+}
+
+func countViewerEntered(ctx context.Context, event ViewerEntered) error {
+	return addViewerCount(ctx, event.CounterEpoch, event.LivestreamID, 1)
+}
+
+func countViewerLeft(ctx context.Context, event ViewerLeft) error {
+	return addViewerCount(ctx, event.CounterEpoch, event.LivestreamID, -1)
+}
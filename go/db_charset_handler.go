@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 接続とテーブルの文字コード・照合順序
+// 接続の照合順序が列と違うと、文字列の比較 (ユーザ名での検索など) でインデックスが使われなくなるうえ、エラーにもならない
+// 起動時と初期化後にauditDBCharsetで確かめ、揃っていなければ起動・初期化を失敗させる
+// スキーマ (sql/initdb.d/10_schema.sql) のCHARACTER SET・COLLATEもこれに揃えること
+const (
+	dbCharset   = "utf8mb4"
+	dbCollation = "utf8mb4_bin"
+)
+
+// auditDBCharset は、接続とDB内のすべてのテーブル・文字列の列がdbCharsetとcollationになっているかを確かめる
+// collationは接続に指定した照合順序 (ISUCON13_MYSQL_DIALCONFIG_COLLATIONで変えた場合はその値)
+// 揃っていないものをすべて並べたエラーを返す
+func auditDBCharset(ctx context.Context, db *sqlx.DB, collation string) error {
+	var problems []string
+
+	var conn struct {
+		Client     string `db:"client"`
+		Connection string `db:"connection"`
+		Results    string `db:"results"`
+		Collation  string `db:"collation"`
+	}
+	if err := db.GetContext(ctx, &conn, "SELECT @@character_set_client AS client, @@character_set_connection AS connection, @@character_set_results AS results, @@collation_connection AS collation"); err != nil {
+		return fmt.Errorf("failed to get connection charset: %w", err)
+	}
+	for _, v := range []struct{ name, charset string }{
+		{"character_set_client", conn.Client},
+		{"character_set_connection", conn.Connection},
+		{"character_set_results", conn.Results},
+	} {
+		if v.charset != dbCharset {
+			problems = append(problems, fmt.Sprintf("connection %s is %s", v.name, v.charset))
+		}
+	}
+	if conn.Collation != collation {
+		problems = append(problems, fmt.Sprintf("connection collation is %s", conn.Collation))
+	}
+
+	var tables []struct {
+		Name      string `db:"TABLE_NAME"`
+		Collation string `db:"TABLE_COLLATION"`
+	}
+	if err := db.SelectContext(ctx, &tables, "SELECT TABLE_NAME, TABLE_COLLATION FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_TYPE = 'BASE TABLE' AND TABLE_COLLATION <> ? ORDER BY TABLE_NAME", collation); err != nil {
+		return fmt.Errorf("failed to get table collations: %w", err)
+	}
+	for _, table := range tables {
+		problems = append(problems, fmt.Sprintf("table %s is %s", table.Name, table.Collation))
+	}
+
+	var columns []struct {
+		Table     string `db:"TABLE_NAME"`
+		Name      string `db:"COLUMN_NAME"`
+		Charset   string `db:"CHARACTER_SET_NAME"`
+		Collation string `db:"COLLATION_NAME"`
+	}
+	if err := db.SelectContext(ctx, &columns, "SELECT c.TABLE_NAME, c.COLUMN_NAME, c.CHARACTER_SET_NAME, c.COLLATION_NAME FROM information_schema.COLUMNS c INNER JOIN information_schema.TABLES t ON t.TABLE_SCHEMA = c.TABLE_SCHEMA AND t.TABLE_NAME = c.TABLE_NAME WHERE c.TABLE_SCHEMA = DATABASE() AND t.TABLE_TYPE = 'BASE TABLE' AND c.CHARACTER_SET_NAME IS NOT NULL AND (c.CHARACTER_SET_NAME <> ? OR c.COLLATION_NAME <> ?) ORDER BY c.TABLE_NAME, c.ORDINAL_POSITION", dbCharset, collation); err != nil {
+		return fmt.Errorf("failed to get column collations: %w", err)
+	}
+	for _, column := range columns {
+		problems = append(problems, fmt.Sprintf("column %s.%s is %s/%s", column.Table, column.Name, column.Charset, column.Collation))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("charset/collation must be %s/%s: %s", dbCharset, collation, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// auditDBCharsets は、プライマリとレプリカ (指定されている場合) をauditDBCharsetで確かめる
+func auditDBCharsets(ctx context.Context) error {
+	conf, err := newDBConfig()
+	if err != nil {
+		return err
+	}
+	if err := auditDBCharset(ctx, dbConn, conf.Collation); err != nil {
+		return err
+	}
+	if dbReplica != nil {
+		if err := auditDBCharset(ctx, dbReplica, conf.Collation); err != nil {
+			return fmt.Errorf("replica: %w", err)
+		}
+	}
+	return nil
+}
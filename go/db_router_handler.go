@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/isucon/isucon13/webapp/go/internal/repository"
+	"github.com/jmoiron/sqlx"
+)
+
+// DBの使い分け
+// 書き込みはrunInTxなどでプライマリのトランザクション内で行い、参照だけのハンドラはトランザクションを張らずに読む
+// ISUCON13_MYSQL_REPLICA_DSNが指定されている場合、統計・一覧・検索の参照はreadDB()でレプリカに送る
+// 指定されていない場合はすべてdbConn (プライマリ) に送る
+// レプリカの遅延の分だけ、書き込み直後の参照に反映されないことがある
+// レプリカから読んだ値は、他のリクエストと共有するキャッシュに入れない (古い値や、まだない行を覚えてしまうため)
+// 存在しないことも、レプリカで見つからなかった場合はプライマリで確かめ直してから扱う
+
+// レプリカのDSN。ユーザ・パスワード・DB名などはここで指定し、parseTimeなどの接続設定はプライマリに揃える
+const dbReplicaDSNEnvKey = "ISUCON13_MYSQL_REPLICA_DSN"
+
+var dbReplica *sqlx.DB
+
+// newReplicaDB は、レプリカが指定されていない場合はnilを返す
+func newReplicaDB() (*sqlx.DB, error) {
+	dsn := os.Getenv(dbReplicaDSNEnvKey)
+	if dsn == "" {
+		return nil, nil
+	}
+	conf, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	primary, err := newDBConfig()
+	if err != nil {
+		return nil, err
+	}
+	conf.ParseTime = primary.ParseTime
+	conf.InterpolateParams = primary.InterpolateParams
+	conf.Collation = primary.Collation
+
+	return openAndPingDB(conf)
+}
+
+// readDB は、参照だけの処理に使うDBを返す
+func readDB() *sqlx.DB {
+	if dbReplica != nil {
+		return dbReplica
+	}
+	return dbConn
+}
+
+// isReplica は、dbがレプリカかを返す
+func isReplica(db dbQueryer) bool {
+	d, ok := db.(*sqlx.DB)
+	return ok && dbReplica != nil && d == dbReplica
+}
+
+// isPrimary は、dbがトランザクションでないプライマリかを返す
+// トランザクション内で読んだ値はコミットされていない可能性があるので、これがtrueの場合だけキャッシュに入れてよい
+func isPrimary(db dbQueryer) bool {
+	d, ok := db.(*sqlx.DB)
+	return ok && d == dbConn
+}
+
+// dbQueryer は、*sqlx.DBと*sqlx.Txのどちらからでも参照できるようにする
+// 参照だけのヘルパーはこれを受け取り、書き込み中のトランザクションからも、トランザクションなしでも呼べるようにする
+type dbQueryer = repository.Queryer
+
+// users・livestreams・reactions・livecommentsの読み書きはinternal/repositoryを通す
+var (
+	userRepo        repository.UserRepo
+	livestreamRepo  repository.LivestreamRepo
+	reactionRepo    repository.ReactionRepo
+	livecommentRepo repository.LivecommentRepo
+)
+
+// トランザクションをやり直す回数と、やり直すまでの待ち時間 (回数ごとに倍にし、ばらつきを加える)
+const (
+	txMaxRetries   = 3
+	txRetryBackoff = 10 * time.Millisecond
+)
+
+// runInTx は、fnをトランザクション内で実行し、エラーがなければコミットする
+// デッドロック (1213) とロック待ちのタイムアウト (1205) の場合は、トランザクションをやり直してfnを最初から呼び直す
+// fnは何度呼ばれてもよいように、ファイルやキャッシュなどDB以外の更新はrunInTxが成功してから行うこと
+// fnが返したエラーはそのまま返す
+// 参照だけの処理はトランザクションを張らず、dbConnやreadDB()から直接読む
+func runInTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	return runInTxCommit(ctx, fn, (*sqlx.Tx).Commit)
+}
+
+// runInTxCommit は、コミットをcommitで行うrunInTx
+// コミットと同時にメモリ上の状態を更新する場合 (予約枠の残数など) に使う
+func runInTxCommit(ctx context.Context, fn func(tx *sqlx.Tx) error, commit func(tx *sqlx.Tx) error) error {
+	for attempt := 0; ; attempt++ {
+		err := runTxOnce(ctx, fn, commit)
+		if err == nil || attempt >= txMaxRetries || !isRetryableTxError(err) {
+			return err
+		}
+		backoff := txRetryBackoff << attempt
+		backoff += time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func runTxOnce(ctx context.Context, fn func(tx *sqlx.Tx) error, commit func(tx *sqlx.Tx) error) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return commit(tx)
+}
+
+// isRetryableTxError は、トランザクションをやり直せば成功しうるエラーかを返す
+// fnの中でDBのエラーを返す場合は、fmt.Errorfの%wなどで元のエラーを辿れるようにすること
+func isRetryableTxError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	switch mysqlErr.Number {
+	case 1213, 1205: // ER_LOCK_DEADLOCK, ER_LOCK_WAIT_TIMEOUT
+		return true
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+// Package dns は、ユーザ登録時に払い出すサブドメインのDNSレコードをPowerDNSに登録・削除する
+//
+// 登録先はバックエンドとして差し替えられる
+//   - pdnsutil: pdnsutilコマンドを実行する (ユーザごとにプロセスを起動するので遅い)
+//   - mysql: PowerDNSのgmysqlバックエンドのテーブルに直接INSERTする
+//   - api: PowerDNSのHTTP APIを呼ぶ
+//
+// PowerDNSを使わず、Serverで自前で応答することもできる
+// レコードを他のサーバに登録させる場合は、何もしないNewNopを使う
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultZone      = "t.isucon.pw"
+	DefaultRecordTTL = 60
+	// 組み込みのDNSサーバが、送信元ごとに10秒間に返すNXDOMAINの上限
+	// 超えた送信元にも登録済みの名前には応答するので、リゾルバ越しの正規の問い合わせは止まらない
+	DefaultDropThreshold = 1000
+
+	// AddARecordsで1回のクエリ・リクエストにまとめる名前の数
+	batchSize = 500
+
+	// Wildcard は、ゾーン内のすべての名前に一致するワイルドカードレコードの名前
+	// ユーザごとにレコードを登録する代わりに、AddARecordsに渡して使う
+	Wildcard = "*"
+)
+
+// Registrar は、ゾーンにAレコードを登録する
+type Registrar interface {
+	// AddARecord は、ゾーン内のnameにConfig.Addressesを指すAレコードを登録する
+	// nameはゾーンからの相対名 (例: "alice")
+	// 登録ジョブの再試行で呼び直されるので、既にあるAレコードは置き換える
+	AddARecord(ctx context.Context, name string) error
+	// AddARecords は、複数の名前のAレコードをまとめて登録する
+	// 初期化後の再投入に使うので、既にあるAレコードは置き換える
+	AddARecords(ctx context.Context, names []string) error
+	// RemoveARecord は、ゾーン内のnameのAレコードを削除する
+	// レコードがない場合はエラーにしない
+	RemoveARecord(ctx context.Context, name string) error
+	// Reset は、ゾーンが作り直された後に呼び、バックエンドが覚えている状態を捨てる
+	Reset()
+	// RecordSettings は、これから登録するAレコードのTTLとアドレスを返す
+	RecordSettings() RecordSettings
+	// SetRecordSettings は、これから登録するAレコードのTTLとアドレスを変更する
+	// 登録済みのレコードは変わらないので、必要であればAddARecordsで登録し直す
+	SetRecordSettings(settings RecordSettings) error
+}
+
+type Config struct {
+	// レコードを登録するゾーン (末尾のドットなし)
+	Zone string
+	// 登録するAレコードのTTL (秒) の初期値
+	RecordTTL int
+	// Aレコードが指すアドレスの初期値
+	// 複数ある場合は名前ごとに同じ数のAレコードを登録し、ラウンドロビンさせる
+	Addresses []string
+	// 設定されている場合、レコードを追加するたびにシリアルを更新したSOAに書き換える
+	// バックエンドがシリアルを管理しない場合(mysql)に、セカンダリへ変更を伝えるために使う
+	SOA *SOA
+
+	// 以下は組み込みのDNSサーバ(Server)でのみ使う
+	// 送信元ごとに10秒間に返すNXDOMAINの上限。超えた送信元には存在しない名前に応答しない (0以下の場合は遮断しない)
+	DropThreshold int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Zone:          DefaultZone,
+		RecordTTL:     DefaultRecordTTL,
+		DropThreshold: DefaultDropThreshold,
+	}
+}
+
+// fqdn は、ゾーンからの相対名を末尾のドットなしのFQDNにする
+func (c Config) fqdn(name string) string {
+	return name + "." + c.Zone
+}
+
+// RecordSettings は、登録するAレコードのTTLとアドレス
+// 起動時はConfigの値で、実行中に変更できる
+type RecordSettings struct {
+	TTL       int      `json:"ttl"`
+	Addresses []string `json:"addresses"`
+}
+
+// Validate は、TTLが0以上で、アドレスが1つ以上のIPv4アドレスであることを確かめる
+func (s RecordSettings) Validate() error {
+	if s.TTL < 0 {
+		return fmt.Errorf("ttl must be non-negative: %d", s.TTL)
+	}
+	if len(s.Addresses) == 0 {
+		return fmt.Errorf("at least one address must be given")
+	}
+	for _, address := range s.Addresses {
+		if ip := net.ParseIP(address); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("address must be IPv4: %q", address)
+		}
+	}
+	return nil
+}
+
+// recordSettings は、各バックエンドに埋め込んで実行中に変更できるRecordSettingsを持たせる
+type recordSettings struct {
+	mu       sync.RWMutex
+	settings RecordSettings
+}
+
+func newRecordSettings(config Config) *recordSettings {
+	return &recordSettings{settings: RecordSettings{
+		TTL:       config.RecordTTL,
+		Addresses: config.Addresses,
+	}}
+}
+
+func (s *recordSettings) RecordSettings() RecordSettings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.settings
+}
+
+func (s *recordSettings) SetRecordSettings(settings RecordSettings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	// 呼び出し元のスライスを書き換えられても影響しないようにコピーする
+	settings.Addresses = append([]string(nil), settings.Addresses...)
+	s.mu.Lock()
+	s.settings = settings
+	s.mu.Unlock()
+	return nil
+}
+
+// ParseAddresses は、カンマ区切りのIPv4アドレスをパースする
+func ParseAddresses(s string) ([]string, error) {
+	var addresses []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			addresses = append(addresses, v)
+		}
+	}
+	if err := (RecordSettings{Addresses: addresses}).Validate(); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+// batches は、namesをbatchSizeずつに分ける
+func batches(names []string) [][]string {
+	var bs [][]string
+	for len(names) > batchSize {
+		bs = append(bs, names[:batchSize])
+		names = names[batchSize:]
+	}
+	if len(names) > 0 {
+		bs = append(bs, names)
+	}
+	return bs
+}
+
+// SOA は、シリアル以外のSOAレコードの内容
+type SOA struct {
+	PrimaryNS  string
+	Hostmaster string
+	Refresh    int
+	Retry      int
+	Expire     int
+	Minimum    int
+}
+
+// ParseSOA は、"<primary ns> <hostmaster> <refresh> <retry> <expire> <minimum>"の形式をパースする
+func ParseSOA(s string) (*SOA, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("SOA must have 6 fields (primary ns, hostmaster, refresh, retry, expire, minimum): %q", s)
+	}
+	soa := &SOA{
+		PrimaryNS:  fields[0],
+		Hostmaster: fields[1],
+	}
+	for i, v := range []*int{&soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum} {
+		n, err := strconv.Atoi(fields[i+2])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("SOA timer must be non-negative integer: %q", fields[i+2])
+		}
+		*v = n
+	}
+	return soa, nil
+}
+
+// Content は、PowerDNSのrecords.contentに格納する形式のSOAを返す
+func (s SOA) Content(serial uint32) string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", s.PrimaryNS, s.Hostmaster, serial, s.Refresh, s.Retry, s.Expire, s.Minimum)
+}
+
+// parseSOASerial は、records.contentの形式のSOAからシリアルを取り出す
+func parseSOASerial(content string) (uint32, bool) {
+	fields := strings.Fields(content)
+	if len(fields) < 3 {
+		return 0, false
+	}
+	serial, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(serial), true
+}
@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ランダムなサブドメインを大量に問い合わせる攻撃 (water torture) への対策
+//
+//   - 名前はメモリ上の集合だけで引くので (server.go)、存在しない名前を問い合わせられても外には問い合わせない
+//   - 送信元ごとにNXDOMAINの数を数え、Config.DropThresholdを超えた送信元には、しばらく存在しない名前に応答しない
+//
+// リゾルバ経由の問い合わせでは正規の利用者も同じ送信元になるので、遮断中でも登録済みの名前には応答する
+// (止めるのはNXDOMAINの応答だけなので、同じリゾルバからの正規の名前解決は失敗しない)
+const (
+	// 送信元ごとのNXDOMAINを数える区間
+	dropWindow = 10 * time.Second
+	// 遮断した送信元に、存在しない名前への応答を返さない時間
+	dropDuration = time.Minute
+	// 覚えておく送信元の上限
+	// 超えた場合は期限切れのものを捨て、それでも足りなければすべて捨てる
+	maxGuardEntries = 100000
+)
+
+// Metrics は、組み込みのDNSサーバの応答数など
+type Metrics struct {
+	Queries        uint64 `json:"queries"`
+	NXDomain       uint64 `json:"nxdomain"`
+	Dropped        uint64 `json:"dropped"`
+	DroppedSources int    `json:"dropped_sources"`
+}
+
+type sourceStats struct {
+	windowStart time.Time
+	nxdomain    int
+	dropUntil   time.Time
+}
+
+type guard struct {
+	dropThreshold int
+
+	mu      sync.Mutex
+	sources map[string]*sourceStats
+
+	queries  atomic.Uint64
+	nxdomain atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+func newGuard(config Config) *guard {
+	return &guard{
+		dropThreshold: config.DropThreshold,
+		sources:       map[string]*sourceStats{},
+	}
+}
+
+// isDropped は、送信元が遮断中かを返す。存在しない名前への問い合わせでだけ呼ぶ
+func (g *guard) isDropped(source string, now time.Time) bool {
+	if g.dropThreshold <= 0 {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st, ok := g.sources[source]
+	if !ok || now.After(st.dropUntil) {
+		return false
+	}
+	g.dropped.Add(1)
+	return true
+}
+
+// countNXDomain は、送信元にNXDOMAINを返したことを数え、閾値を超えたら遮断する
+func (g *guard) countNXDomain(source string, now time.Time) {
+	g.nxdomain.Add(1)
+	if g.dropThreshold <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st, ok := g.sources[source]
+	if !ok {
+		if len(g.sources) >= maxGuardEntries {
+			g.pruneSources(now)
+		}
+		st = &sourceStats{windowStart: now}
+		g.sources[source] = st
+	}
+	if now.Sub(st.windowStart) > dropWindow {
+		st.windowStart = now
+		st.nxdomain = 0
+	}
+	st.nxdomain++
+	if st.nxdomain > g.dropThreshold {
+		st.dropUntil = now.Add(dropDuration)
+	}
+}
+
+func (g *guard) pruneSources(now time.Time) {
+	for source, st := range g.sources {
+		if now.Sub(st.windowStart) > dropWindow && now.After(st.dropUntil) {
+			delete(g.sources, source)
+		}
+	}
+	if len(g.sources) >= maxGuardEntries {
+		g.sources = map[string]*sourceStats{}
+	}
+}
+
+func (g *guard) reset() {
+	g.mu.Lock()
+	g.sources = map[string]*sourceStats{}
+	g.mu.Unlock()
+}
+
+func (g *guard) metrics() Metrics {
+	now := time.Now()
+	g.mu.Lock()
+	droppedSources := 0
+	for _, st := range g.sources {
+		if now.Before(st.dropUntil) {
+			droppedSources++
+		}
+	}
+	g.mu.Unlock()
+
+	return Metrics{
+		Queries:        g.queries.Load(),
+		NXDomain:       g.nxdomain.Load(),
+		Dropped:        g.dropped.Load(),
+		DroppedSources: droppedSources,
+	}
+}
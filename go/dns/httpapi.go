@@ -0,0 +1,119 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type httpAPIRegistrar struct {
+	*recordSettings
+	client  *http.Client
+	baseURL string
+	apiKey  string
+	config  Config
+}
+
+// NewHTTPAPI は、PowerDNSのHTTP APIでレコードを登録するRegistrarを返す
+// baseURLはサーバまでのURL (例: http://127.0.0.1:8081/api/v1/servers/localhost)
+// シリアルはゾーンのSOA-EDIT-API設定に従ってPowerDNSが更新するので、Config.SOAは使わない
+func NewHTTPAPI(baseURL string, apiKey string, config Config) Registrar {
+	return &httpAPIRegistrar{
+		recordSettings: newRecordSettings(config),
+		client:         &http.Client{Timeout: 5 * time.Second},
+		baseURL:        strings.TrimSuffix(baseURL, "/"),
+		apiKey:         apiKey,
+		config:         config,
+	}
+}
+
+type rrsetPatch struct {
+	RRSets []rrset `json:"rrsets"`
+}
+
+type rrset struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	TTL        int      `json:"ttl,omitempty"`
+	ChangeType string   `json:"changetype"`
+	Records    []record `json:"records,omitempty"`
+}
+
+type record struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+func (r *httpAPIRegistrar) AddARecord(ctx context.Context, name string) error {
+	return r.patchRRSets(ctx, []rrset{r.replaceRRSet(name)})
+}
+
+func (r *httpAPIRegistrar) AddARecords(ctx context.Context, names []string) error {
+	for _, batch := range batches(names) {
+		sets := make([]rrset, len(batch))
+		for i, name := range batch {
+			sets[i] = r.replaceRRSet(name)
+		}
+		if err := r.patchRRSets(ctx, sets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *httpAPIRegistrar) replaceRRSet(name string) rrset {
+	settings := r.RecordSettings()
+	records := make([]record, len(settings.Addresses))
+	for i, address := range settings.Addresses {
+		records[i] = record{Content: address}
+	}
+	return rrset{
+		Name:       r.config.fqdn(name) + ".",
+		Type:       "A",
+		TTL:        settings.TTL,
+		ChangeType: "REPLACE",
+		Records:    records,
+	}
+}
+
+func (r *httpAPIRegistrar) RemoveARecord(ctx context.Context, name string) error {
+	return r.patchRRSets(ctx, []rrset{{
+		Name:       r.config.fqdn(name) + ".",
+		Type:       "A",
+		ChangeType: "DELETE",
+	}})
+}
+
+func (r *httpAPIRegistrar) patchRRSets(ctx context.Context, sets []rrset) error {
+	body, err := json.Marshal(rrsetPatch{RRSets: sets})
+	if err != nil {
+		return err
+	}
+
+	endpoint := r.baseURL + "/zones/" + url.PathEscape(r.config.Zone+".")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", r.apiKey)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request PowerDNS API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("PowerDNS API responded %d: %s", resp.StatusCode, string(msg))
+	}
+	return nil
+}
+
+func (r *httpAPIRegistrar) Reset() {}
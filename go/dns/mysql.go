@@ -0,0 +1,170 @@
+package dns
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/bulk"
+	"github.com/jmoiron/sqlx"
+)
+
+type mysqlRegistrar struct {
+	*recordSettings
+	db     *sqlx.DB
+	config Config
+
+	mu       sync.Mutex
+	domainID int64
+}
+
+// NewMySQL は、PowerDNSのgmysqlバックエンドのテーブルに直接書き込むRegistrarを返す
+// dbはPowerDNSのデータベースに接続していること
+func NewMySQL(db *sqlx.DB, config Config) Registrar {
+	return &mysqlRegistrar{recordSettings: newRecordSettings(config), db: db, config: config}
+}
+
+// AddARecord は、nameのAレコードを置き換える
+// ジョブの再試行で同じ名前を登録し直しても重複しないよう、削除と登録とSOAの更新を1つのトランザクションで行う
+func (r *mysqlRegistrar) AddARecord(ctx context.Context, name string) error {
+	domainID, err := r.getDomainID(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM records WHERE domain_id = ? AND type = 'A' AND name = ?", domainID, r.config.fqdn(name)); err != nil {
+		return fmt.Errorf("failed to delete records: %w", err)
+	}
+	if err := r.insertRecords(ctx, tx, domainID, []string{name}); err != nil {
+		return err
+	}
+	if err := r.bumpSOA(ctx, tx, domainID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddARecords は、すべての名前のAレコードとSOAを1つのトランザクションで置き換える
+// 途中で失敗した場合に、一部の名前だけが登録し直された状態を残さない
+func (r *mysqlRegistrar) AddARecords(ctx context.Context, names []string) error {
+	domainID, err := r.getDomainID(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, batch := range batches(names) {
+		fqdns := make([]string, len(batch))
+		for i, name := range batch {
+			fqdns[i] = r.config.fqdn(name)
+		}
+		query, args, err := sqlx.In("DELETE FROM records WHERE domain_id = ? AND type = 'A' AND name IN (?)", domainID, fqdns)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to delete records: %w", err)
+		}
+		if err := r.insertRecords(ctx, tx, domainID, batch); err != nil {
+			return err
+		}
+	}
+	if err := r.bumpSOA(ctx, tx, domainID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertRecords は、names それぞれにConfig.Addressesの数だけAレコードを1回のINSERTで登録する
+func (r *mysqlRegistrar) insertRecords(ctx context.Context, db sqlx.ExecerContext, domainID int64, names []string) error {
+	settings := r.RecordSettings()
+	rows := make([][]interface{}, 0, len(names)*len(settings.Addresses))
+	for _, name := range names {
+		for _, address := range settings.Addresses {
+			rows = append(rows, []interface{}{domainID, r.config.fqdn(name), "A", address, settings.TTL, 0, 0, 1})
+		}
+	}
+	if err := bulk.Insert(ctx, db, "records", []string{"domain_id", "name", "type", "content", "ttl", "prio", "disabled", "auth"}, rows); err != nil {
+		return fmt.Errorf("failed to insert records: %w", err)
+	}
+	return nil
+}
+
+func (r *mysqlRegistrar) RemoveARecord(ctx context.Context, name string) error {
+	domainID, err := r.getDomainID(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM records WHERE domain_id = ? AND name = ? AND type = 'A'", domainID, r.config.fqdn(name)); err != nil {
+		return fmt.Errorf("failed to delete record: %w", err)
+	}
+	if err := r.bumpSOA(ctx, tx, domainID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// bumpSOA は、Config.SOAが設定されている場合にシリアルを進めたSOAへ書き換える
+// シリアルは現在時刻にするが、同じ秒に複数回更新した場合や他のサーバの時計が進んでいる場合でも減らないよう、
+// 今のシリアルより必ず大きくする。SOAの行はtxが終わるまでロックする
+func (r *mysqlRegistrar) bumpSOA(ctx context.Context, tx *sqlx.Tx, domainID int64) error {
+	if r.config.SOA == nil {
+		return nil
+	}
+	var content string
+	if err := tx.GetContext(ctx, &content, "SELECT content FROM records WHERE domain_id = ? AND type = 'SOA' LIMIT 1 FOR UPDATE", domainID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to get SOA: %w", err)
+	}
+	serial := uint32(time.Now().Unix())
+	if current, ok := parseSOASerial(content); ok && current >= serial {
+		serial = current + 1
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE records SET content = ? WHERE domain_id = ? AND type = 'SOA'", r.config.SOA.Content(serial), domainID); err != nil {
+		return fmt.Errorf("failed to update SOA: %w", err)
+	}
+	return nil
+}
+
+// getDomainID は、ゾーンのdomains.idを返す
+// ゾーンは初期化(pdnsutil load-zone)で作り直されることがあるので、見つからなかった場合は覚えない
+func (r *mysqlRegistrar) getDomainID(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.domainID != 0 {
+		return r.domainID, nil
+	}
+
+	var domainID int64
+	if err := r.db.GetContext(ctx, &domainID, "SELECT id FROM domains WHERE name = ?", r.config.Zone); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("zone %s not found", r.config.Zone)
+		}
+		return 0, fmt.Errorf("failed to get domain: %w", err)
+	}
+	r.domainID = domainID
+	return domainID, nil
+}
+
+func (r *mysqlRegistrar) Reset() {
+	r.mu.Lock()
+	r.domainID = 0
+	r.mu.Unlock()
+}
@@ -0,0 +1,21 @@
+package dns
+
+import "context"
+
+type nopRegistrar struct {
+	*recordSettings
+}
+
+// NewNop は、何も登録しないRegistrarを返す
+// PowerDNSのないサーバで、DNSレコードの登録を他のサーバに任せる場合に使う
+func NewNop(config Config) Registrar {
+	return &nopRegistrar{recordSettings: newRecordSettings(config)}
+}
+
+func (r *nopRegistrar) AddARecord(ctx context.Context, name string) error { return nil }
+
+func (r *nopRegistrar) AddARecords(ctx context.Context, names []string) error { return nil }
+
+func (r *nopRegistrar) RemoveARecord(ctx context.Context, name string) error { return nil }
+
+func (r *nopRegistrar) Reset() {}
@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	mdns "github.com/miekg/dns"
+)
+
+type pdnsutilRegistrar struct {
+	*recordSettings
+	config Config
+
+	// AddARecordsがゾーンを読んでから読み込み直すまでの間に、他の登録・削除が消されないようにする
+	mu sync.Mutex
+}
+
+// NewPdnsutil は、pdnsutilコマンドでレコードを登録するRegistrarを返す
+// pdnsutilがゾーンのシリアルを管理するので、Config.SOAは使わない
+func NewPdnsutil(config Config) Registrar {
+	return &pdnsutilRegistrar{recordSettings: newRecordSettings(config), config: config}
+}
+
+// AddARecord は、ジョブの再試行で同じ名前を登録し直しても重複しないよう、replace-rrsetで置き換える
+func (r *pdnsutilRegistrar) AddARecord(ctx context.Context, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.run(ctx, "replace-rrset", name)
+}
+
+// AddARecords は、名前ごとにpdnsutilを起動すると初期ユーザの数だけプロセスを作ることになるので、
+// 今のゾーンを書き出し、namesのAレコードを置き換えたゾーンを1回で読み込み直す
+// 同じプロセスからの登録・削除とは排他にするが、他のプロセスからのゾーンの変更は考慮しない
+func (r *pdnsutilRegistrar) AddARecords(ctx context.Context, names []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out, err := exec.CommandContext(ctx, "pdnsutil", "list-zone", r.config.Zone).Output()
+	if err != nil {
+		return fmt.Errorf("failed to list zone: %w", err)
+	}
+	zone, err := r.replaceARecords(out, names)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp("", "isupipe-zone-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(zone); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if out, err := exec.CommandContext(ctx, "pdnsutil", "load-zone", r.config.Zone, f.Name()).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to load zone: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+// replaceARecords は、list-zoneの出力からnamesのAレコードを除き、今の設定のAレコードを加えたゾーンファイルを返す
+func (r *pdnsutilRegistrar) replaceARecords(listed []byte, names []string) ([]byte, error) {
+	origin := mdns.Fqdn(strings.ToLower(r.config.Zone))
+	replaced := make(map[string]struct{}, len(names))
+	fqdns := make([]string, 0, len(names))
+	for _, name := range names {
+		fqdn := mdns.Fqdn(strings.ToLower(r.config.fqdn(name)))
+		if _, ok := replaced[fqdn]; ok {
+			continue
+		}
+		replaced[fqdn] = struct{}{}
+		fqdns = append(fqdns, fqdn)
+	}
+
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	fmt.Fprintf(bw, "$ORIGIN %s\n", origin)
+	zp := mdns.NewZoneParser(bytes.NewReader(listed), origin, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if _, ok := replaced[strings.ToLower(rr.Header().Name)]; ok && rr.Header().Rrtype == mdns.TypeA {
+			continue
+		}
+		fmt.Fprintln(bw, rr.String())
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse listed zone: %w", err)
+	}
+	settings := r.RecordSettings()
+	for _, fqdn := range fqdns {
+		for _, address := range settings.Addresses {
+			rr := &mdns.A{
+				Hdr: mdns.RR_Header{Name: fqdn, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: uint32(settings.TTL)},
+				A:   net.ParseIP(address),
+			}
+			fmt.Fprintln(bw, rr.String())
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *pdnsutilRegistrar) run(ctx context.Context, command string, name string) error {
+	settings := r.RecordSettings()
+	args := append([]string{command, r.config.Zone, name, "A", strconv.Itoa(settings.TTL)}, settings.Addresses...)
+	out, err := exec.CommandContext(ctx, "pdnsutil", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w", string(out), err)
+	}
+	return nil
+}
+
+func (r *pdnsutilRegistrar) RemoveARecord(ctx context.Context, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out, err := exec.CommandContext(ctx, "pdnsutil", "delete-rrset", r.config.Zone, name, "A").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w", string(out), err)
+	}
+	return nil
+}
+
+func (r *pdnsutilRegistrar) Reset() {}
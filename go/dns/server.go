@@ -0,0 +1,218 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	mdns "github.com/miekg/dns"
+)
+
+// Server は、ゾーンを自前で応答する権威DNSサーバ
+// PowerDNSを使わない場合に、Registrarとしてユーザのサブドメインをメモリ上に持つ
+//
+// ゾーンファイルのレコードは固定で応答し、そのうちAレコードはRecordSettingsのアドレスで応答する
+// 応答のたびにRecordSettingsを参照するので、SetRecordSettingsは登録済みの名前にもすぐ反映される
+// 名前はメモリ上に登録されたものだけで応答し、問い合わせのたびに外に確かめには行かない
+// (存在しない名前を大量に問い合わせられても、DBなどに負荷をかけない)
+// ゾーン転送には対応しないので、Config.SOAは使わずゾーンファイルのSOAをそのまま返す
+type Server struct {
+	*recordSettings
+	config Config
+	origin string
+
+	// ゾーンファイルのAレコード以外のレコード (FQDN -> レコード)
+	static map[string][]mdns.RR
+	// ゾーンファイルのAレコードの名前とTTL
+	staticA map[string]uint32
+	soa     *mdns.SOA
+
+	mu    sync.RWMutex
+	names map[string]struct{}
+
+	guard *guard
+}
+
+// NewServer は、zoneFileのレコードとRegistrarとして登録された名前を応答するServerを返す
+// zoneFileはConfig.Zoneを起点とするゾーンファイルで、SOAレコードを含むこと
+func NewServer(config Config, zoneFile io.Reader) (*Server, error) {
+	s := &Server{
+		recordSettings: newRecordSettings(config),
+		config:         config,
+		origin:         mdns.Fqdn(strings.ToLower(config.Zone)),
+		static:         map[string][]mdns.RR{},
+		staticA:        map[string]uint32{},
+		names:          map[string]struct{}{},
+		guard:          newGuard(config),
+	}
+
+	zp := mdns.NewZoneParser(zoneFile, s.origin, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		if a, ok := rr.(*mdns.A); ok {
+			s.staticA[name] = a.Hdr.Ttl
+			continue
+		}
+		if soa, ok := rr.(*mdns.SOA); ok {
+			s.soa = soa
+		}
+		s.static[name] = append(s.static[name], rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse zone file: %w", err)
+	}
+	if s.soa == nil {
+		return nil, fmt.Errorf("zone file must have SOA record")
+	}
+	return s, nil
+}
+
+// ListenAndServe は、addrでUDPとTCPの問い合わせを受け付ける
+// どちらかが終了するとエラーを返す
+func (s *Server) ListenAndServe(addr string) error {
+	errCh := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &mdns.Server{Addr: addr, Net: network, Handler: s}
+		go func() {
+			errCh <- srv.ListenAndServe()
+		}()
+	}
+	return <-errCh
+}
+
+// ServeDNS は、ゾーン内の問い合わせに権威を持って応答する
+func (s *Server) ServeDNS(w mdns.ResponseWriter, r *mdns.Msg) {
+	s.guard.queries.Add(1)
+	now := time.Now()
+	source := w.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	m := new(mdns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if len(r.Question) != 1 {
+		m.SetRcode(r, mdns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	if !mdns.IsSubDomain(s.origin, name) {
+		m.Authoritative = false
+		m.SetRcode(r, mdns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	rrs, found := s.records(name)
+	if !found {
+		if s.guard.isDropped(source, now) {
+			// 遮断中の送信元には、存在しない名前への応答だけを返さない
+			return
+		}
+		s.guard.countNXDomain(source, now)
+		m.SetRcode(r, mdns.RcodeNameError)
+		m.Ns = []mdns.RR{s.soa}
+		w.WriteMsg(m)
+		return
+	}
+	for _, rr := range rrs {
+		if q.Qtype == mdns.TypeANY || rr.Header().Rrtype == q.Qtype {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if len(m.Answer) == 0 {
+		// 名前はあるが、問い合わせられた種類のレコードがない
+		m.Ns = []mdns.RR{s.soa}
+	}
+	w.WriteMsg(m)
+}
+
+// records は、nameのレコードをすべて返す
+func (s *Server) records(name string) ([]mdns.RR, bool) {
+	rrs, found := s.static[name]
+	if ttl, ok := s.staticA[name]; ok {
+		return append(rrs, s.aRecords(name, ttl)...), true
+	}
+
+	relative := strings.TrimSuffix(name, "."+s.origin)
+	if relative == name || strings.Contains(relative, ".") {
+		return rrs, found
+	}
+	if s.hasWildcard() || s.hasName(relative) {
+		return append(rrs, s.aRecords(name, uint32(s.RecordSettings().TTL))...), true
+	}
+	return rrs, found
+}
+
+// hasWildcard は、ワイルドカードレコードが登録されているかを返す
+func (s *Server) hasWildcard() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.names[Wildcard]
+	return ok
+}
+
+// hasName は、nameが登録されているかを返す
+func (s *Server) hasName(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.names[name]
+	return ok
+}
+
+func (s *Server) aRecords(name string, ttl uint32) []mdns.RR {
+	addresses := s.RecordSettings().Addresses
+	rrs := make([]mdns.RR, 0, len(addresses))
+	for _, address := range addresses {
+		rrs = append(rrs, &mdns.A{
+			Hdr: mdns.RR_Header{Name: name, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: ttl},
+			A:   net.ParseIP(address),
+		})
+	}
+	return rrs
+}
+
+func (s *Server) AddARecord(ctx context.Context, name string) error {
+	name = strings.ToLower(name)
+	s.mu.Lock()
+	s.names[name] = struct{}{}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Server) AddARecords(ctx context.Context, names []string) error {
+	s.mu.Lock()
+	for _, name := range names {
+		s.names[strings.ToLower(name)] = struct{}{}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Server) RemoveARecord(ctx context.Context, name string) error {
+	s.mu.Lock()
+	delete(s.names, strings.ToLower(name))
+	s.mu.Unlock()
+	return nil
+}
+
+// Reset は、登録された名前と、遮断中の送信元を捨てる
+// ゾーンファイルのレコードは残る
+func (s *Server) Reset() {
+	s.mu.Lock()
+	s.names = map[string]struct{}{}
+	s.mu.Unlock()
+	s.guard.reset()
+}
+
+// Metrics は、起動してからの応答数などを返す
+func (s *Server) Metrics() Metrics {
+	return s.guard.metrics()
+}
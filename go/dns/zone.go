@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	mdns "github.com/miekg/dns"
+)
+
+// ZoneNames は、ゾーンファイルに含まれるレコードの名前を、zoneからの相対名で返す
+// ゾーンの頂点は含めない
+func ZoneNames(zoneFile io.Reader, zone string) ([]string, error) {
+	origin := mdns.Fqdn(strings.ToLower(zone))
+	seen := map[string]struct{}{}
+	var names []string
+
+	zp := mdns.NewZoneParser(zoneFile, origin, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		if name == origin {
+			continue
+		}
+		name = strings.TrimSuffix(name, "."+origin)
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse zone file: %w", err)
+	}
+	return names, nil
+}
+
+// WriteZone は、namesのAレコードをBINDのゾーンファイル形式で書き出す
+// 書き出すのはアプリが登録するレコードだけで、SOAやNSなどゾーンファイル由来のレコードは含めない
+func WriteZone(w io.Writer, zone string, settings RecordSettings, names []string) error {
+	origin := mdns.Fqdn(strings.ToLower(zone))
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$ORIGIN %s\n", origin)
+	fmt.Fprintf(bw, "$TTL %d\n", settings.TTL)
+	fmt.Fprintf(bw, "; %d names, %d addresses\n", len(names), len(settings.Addresses))
+	for _, name := range names {
+		for _, address := range settings.Addresses {
+			rr := &mdns.A{
+				Hdr: mdns.RR_Header{Name: name + "." + origin, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: uint32(settings.TTL)},
+				A:   net.ParseIP(address),
+			}
+			fmt.Fprintln(bw, rr.String())
+		}
+	}
+	return bw.Flush()
+}
+
+// CheckZone は、addrのDNSサーバがzoneのSOAを権威を持って返すかを確かめる
+func CheckZone(ctx context.Context, addr string, zone string) error {
+	m := new(mdns.Msg)
+	m.SetQuestion(mdns.Fqdn(zone), mdns.TypeSOA)
+	r, _, err := new(mdns.Client).ExchangeContext(ctx, m, addr)
+	if err != nil {
+		return fmt.Errorf("failed to query SOA of %s to %s: %w", zone, addr, err)
+	}
+	if r.Rcode != mdns.RcodeSuccess {
+		return fmt.Errorf("%s responded %s for SOA of %s", addr, mdns.RcodeToString[r.Rcode], zone)
+	}
+	if !r.Authoritative {
+		return fmt.Errorf("%s is not authoritative for %s", addr, zone)
+	}
+	for _, rr := range r.Answer {
+		if _, ok := rr.(*mdns.SOA); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s responded no SOA for %s", addr, zone)
+}
+
+// HasARecord は、addrのDNSサーバがnameのAレコードを返すかを確かめる
+// nameはゾーンからの相対名
+func HasARecord(ctx context.Context, addr string, zone string, name string) (bool, error) {
+	m := new(mdns.Msg)
+	m.SetQuestion(mdns.Fqdn(name+"."+zone), mdns.TypeA)
+	r, _, err := new(mdns.Client).ExchangeContext(ctx, m, addr)
+	if err != nil {
+		return false, fmt.Errorf("failed to query A of %s to %s: %w", name, addr, err)
+	}
+	for _, rr := range r.Answer {
+		if _, ok := rr.(*mdns.A); ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/dns"
+)
+
+// DNSレコード設定
+// ユーザのサブドメインのAレコードのTTLとアドレスを、再起動せずに変更する
+// 公開するAPIではないので、プロファイラと同じ内部向けのポートで受け付ける (internal_auth_handler.go)
+// 設定はプロセスごとに持つので、複数台で動かす場合はすべてのサーバで変更する
+
+// DNSレコード設定取得API
+// GET /debug/dns/records
+func getDNSRecordSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(dnsRegistrar.RecordSettings())
+}
+
+// DNSレコード設定変更API
+// PUT /debug/dns/records
+// 変更後、登録済みのユーザのレコードも新しい設定で登録し直す
+func putDNSRecordSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var settings dns.RecordSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "failed to decode the request body as json", http.StatusBadRequest)
+		return
+	}
+	if err := dnsRegistrar.SetRecordSettings(settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := reseedDNSRecords(r.Context()); err != nil {
+		http.Error(w, "failed to reseed dns records: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(dnsRegistrar.RecordSettings())
+}
+
+// DNSメトリクス取得API
+// GET /debug/dns/metrics
+// 組み込みのDNSサーバの問い合わせ数・NXDOMAIN数・遮断数などを返す
+func getDNSMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	server, ok := dnsRegistrar.(*dns.Server)
+	if !ok {
+		http.Error(w, "dns backend is not builtin", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(server.Metrics())
+}
+
+// DNSゾーン出力API
+// GET /debug/dns/zone
+// アプリが登録しているはずのAレコードをBINDのゾーンファイル形式で返す
+// 登録待ちのユーザは含めないので、PowerDNSなどの実際の状態と比べる際に使う
+func getDNSZoneHandler(w http.ResponseWriter, r *http.Request) {
+	names := []string{dns.Wildcard}
+	if !dnsWildcard {
+		names = nil
+		if err := dbConn.SelectContext(r.Context(), &names, "SELECT name FROM users u WHERE deleted_at IS NULL AND NOT EXISTS (SELECT 1 FROM dns_record_jobs j WHERE j.user_id = u.id) ORDER BY id"); err != nil {
+			http.Error(w, "failed to get users: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/dns; charset=UTF-8")
+	dns.WriteZone(w, dnsZone, dnsRegistrar.RecordSettings(), names)
+}
+
+// DNSレコードの登録を任されたサーバへの転送
+// PowerDNSのないサーバ (ISUCON13_ENABLE_DNS_REGISTRATION=false) は、ジョブを積んだことと初期化をISUCON13_DNS_OWNER_URLのサーバに知らせる
+// ジョブの通知が失敗しても、登録するサーバの定期的な走査で拾われる
+var dnsOwnerClient = &http.Client{Timeout: 10 * time.Second}
+
+// DNSレコードジョブ通知API
+// POST /debug/dns/jobs/{user_id}
+func postDNSRecordJobHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.PathValue("user_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "user_id in path must be integer", http.StatusBadRequest)
+		return
+	}
+	if !dnsRegistrationEnabled {
+		http.Error(w, "dns registration is disabled on this server", http.StatusConflict)
+		return
+	}
+	notifyDNSRecord(userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DNS初期化API
+// POST /debug/dns/initialize
+// 初期化APIを受けたサーバにPowerDNSがない場合に呼ばれ、ゾーンを作り直してからレコードを登録し直す
+func postDNSInitializeHandler(w http.ResponseWriter, r *http.Request) {
+	if !dnsRegistrationEnabled {
+		http.Error(w, "dns registration is disabled on this server", http.StatusConflict)
+		return
+	}
+	if _, builtin := dnsRegistrar.(*dns.Server); !builtin {
+		if out, err := exec.CommandContext(r.Context(), "bash", "../pdns/init_zone.sh").CombinedOutput(); err != nil {
+			http.Error(w, fmt.Sprintf("init_zone.sh failed: %v: %s", err, out), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := initializeDNS(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forwardDNSRecordJob は、登録するサーバにジョブを積んだことを知らせる
+func forwardDNSRecordJob(userID int64) error {
+	return postDNSOwner(context.Background(), fmt.Sprintf("/debug/dns/jobs/%d", userID))
+}
+
+// forwardDNSInitialize は、登録するサーバにDNSの初期化を任せる
+func forwardDNSInitialize(ctx context.Context) error {
+	return postDNSOwner(ctx, "/debug/dns/initialize")
+}
+
+func postDNSOwner(ctx context.Context, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dnsOwnerURL+path, nil)
+	if err != nil {
+		return err
+	}
+	setInternalAuthorization(req)
+	resp, err := dnsOwnerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s responded %d: %s", dnsOwnerURL+path, resp.StatusCode, msg)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// サブドメインのDNSレコードの非同期登録・削除
+// ユーザ登録API・退会APIはユーザの更新と同じトランザクションでdns_record_jobsに積むだけにして、PowerDNSへの反映を待たない
+// ユーザごとに反映待ちのジョブは1つだけで、後から積んだ操作で置き換える
+// ジョブは積んだサーバに通知するほか、失敗したものや他のサーバで積まれた分を定期的に拾ってやり直す
+// 失敗したジョブはnext_attempt_atまで間隔を倍々に空けてやり直し、dnsRecordMaxAttempts回失敗したら諦める
+// (諦めたジョブは状況APIでfailedになり、退会などで積み直されるまで残る)
+// ジョブはclaimed_untilを進めて受け持ち、PowerDNSへの問い合わせの間は行ロックを持たない
+// 退会で積み直された場合は受け持ちが外れるので、登録の結果で削除を上書きしない
+const (
+	dnsRecordRetryInterval = 5 * time.Second
+	dnsRecordRetryMaxDelay = 5 * time.Minute
+	dnsRecordMaxAttempts   = 10
+	dnsRecordClaimDuration = time.Minute
+
+	dnsRecordOperationAdd    = "add"
+	dnsRecordOperationRemove = "remove"
+
+	dnsRecordStatusPending    = "pending"
+	dnsRecordStatusRegistered = "registered"
+	dnsRecordStatusFailed     = "failed"
+)
+
+var dnsRecordRequests = make(chan int64, 256)
+
+type DNSRecordJobModel struct {
+	UserID    int64          `db:"user_id"`
+	Name      string         `db:"name"`
+	Operation string         `db:"operation"`
+	Attempts  int64          `db:"attempts"`
+	LastError sql.NullString `db:"last_error"`
+	// この時刻 (UNIX秒) までやり直さない
+	NextAttemptAt int64 `db:"next_attempt_at"`
+	ClaimedUntil  int64 `db:"claimed_until"`
+	CreatedAt     int64 `db:"created_at"`
+}
+
+type DNSRecordStatus struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Attempts  int64  `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// enqueueDNSRecord は、ユーザ登録のトランザクション内でDNSレコードの登録を積む
+// コミット後にnotifyDNSRecordを呼ぶ
+func enqueueDNSRecord(ctx context.Context, tx *sqlx.Tx, userID int64, name string) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO dns_record_jobs (user_id, name, operation, created_at) VALUES (?, ?, ?, ?)", userID, name, dnsRecordOperationAdd, time.Now().Unix())
+	return err
+}
+
+// enqueueDNSRecordRemoval は、退会のトランザクション内でDNSレコードの削除を積む
+// 登録がまだ反映されていない場合も、登録を取り消さずに削除で置き換える (登録中の可能性があるため)
+// コミット後にnotifyDNSRecordを呼ぶ
+func enqueueDNSRecordRemoval(ctx context.Context, tx *sqlx.Tx, userID int64, name string) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO dns_record_jobs (user_id, name, operation, created_at) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE name = VALUES(name), operation = VALUES(operation), attempts = 0, last_error = NULL, next_attempt_at = 0, claimed_until = 0, created_at = VALUES(created_at)", userID, name, dnsRecordOperationRemove, time.Now().Unix())
+	return err
+}
+
+// notifyDNSRecord は、ワーカーにジョブを知らせる
+// 溢れた場合は定期的な走査で拾う
+// このサーバで登録しない場合は、登録するサーバに知らせる
+func notifyDNSRecord(userID int64) {
+	if !dnsRegistrationEnabled {
+		if dnsOwnerURL != "" {
+			go func() {
+				if err := forwardDNSRecordJob(userID); err != nil {
+					log.Printf("failed to forward dns record job of user %d: %v", userID, err)
+				}
+			}()
+		}
+		return
+	}
+	select {
+	case dnsRecordRequests <- userID:
+	default:
+	}
+}
+
+// runDNSRecordWorker は、積まれたDNSレコードの登録・削除を反映する
+func runDNSRecordWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(dnsRecordRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case userID := <-dnsRecordRequests:
+			if err := applyDNSRecordJob(ctx, userID); err != nil {
+				logger.Errorf("failed to apply dns record job of user %d: %v", userID, err)
+			}
+		case <-ticker.C:
+			var userIDs []int64
+			if err := dbConn.SelectContext(ctx, &userIDs, "SELECT user_id FROM dns_record_jobs WHERE attempts < ? AND next_attempt_at <= ? ORDER BY created_at", dnsRecordMaxAttempts, time.Now().Unix()); err != nil {
+				logger.Errorf("failed to get dns record jobs: %v", err)
+				continue
+			}
+			for _, userID := range userIDs {
+				if err := applyDNSRecordJob(ctx, userID); err != nil {
+					logger.Errorf("failed to apply dns record job of user %d: %v", userID, err)
+				}
+			}
+		}
+	}
+}
+
+// applyDNSRecordJob は、ジョブを受け持ってレコードを登録・削除し、ジョブを消す
+// 退会APIは同じ行を削除のジョブで置き換えて受け持ちを外すので、登録と並行しても退会後にレコードが残ることはない
+// 失敗した場合は試行回数とエラーを記録して、間隔を空けてやり直す
+func applyDNSRecordJob(ctx context.Context, userID int64) error {
+	now := time.Now()
+	result, err := dbConn.ExecContext(ctx, "UPDATE dns_record_jobs SET claimed_until = ? WHERE user_id = ? AND claimed_until < ? AND attempts < ? AND next_attempt_at <= ?", now.Add(dnsRecordClaimDuration).Unix(), userID, now.Unix(), dnsRecordMaxAttempts, now.Unix())
+	if err != nil {
+		return err
+	}
+	if claimed, err := result.RowsAffected(); err != nil {
+		return err
+	} else if claimed == 0 {
+		// 登録済みか、他のサーバが処理中か、やり直す時刻になっていない
+		return nil
+	}
+
+	job := DNSRecordJobModel{}
+	if err := dbConn.GetContext(ctx, &job, "SELECT * FROM dns_record_jobs WHERE user_id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	if job.Operation == dnsRecordOperationRemove {
+		err = dnsRegistrar.RemoveARecord(ctx, job.Name)
+	} else {
+		err = dnsRegistrar.AddARecord(ctx, job.Name)
+	}
+	if err != nil {
+		nextAttemptAt := time.Now().Add(dnsRecordRetryDelay(job.Attempts + 1)).Unix()
+		// 受け持ち中に積み直されていれば、新しいジョブの試行回数を進めない
+		if _, uerr := dbConn.ExecContext(ctx, "UPDATE dns_record_jobs SET attempts = attempts + 1, last_error = ?, next_attempt_at = ?, claimed_until = 0 WHERE user_id = ? AND claimed_until = ?", err.Error(), nextAttemptAt, userID, job.ClaimedUntil); uerr != nil {
+			return errors.Join(err, uerr)
+		}
+		return err
+	}
+
+	// 受け持ち中に積み直されていれば、新しいジョブは残す
+	_, err = dbConn.ExecContext(ctx, "DELETE FROM dns_record_jobs WHERE user_id = ? AND claimed_until = ?", userID, job.ClaimedUntil)
+	return err
+}
+
+// dnsRecordRetryDelay は、attempts回失敗したジョブをやり直すまでの間隔
+func dnsRecordRetryDelay(attempts int64) time.Duration {
+	delay := dnsRecordRetryInterval
+	for i := int64(1); i < attempts && delay < dnsRecordRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, dnsRecordRetryMaxDelay)
+}
+
+// DNSレコード登録状況API
+// GET /api/user/me/dns
+func getMyDNSRecordStatusHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	username, _ := sess.Values[defaultUsernameKey].(string)
+
+	job := DNSRecordJobModel{}
+	if err := dbConn.GetContext(ctx, &job, "SELECT * FROM dns_record_jobs WHERE user_id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.JSON(http.StatusOK, DNSRecordStatus{
+				Name:   username,
+				Status: dnsRecordStatusRegistered,
+			})
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get dns record job: "+err.Error())
+	}
+
+	status := dnsRecordStatusPending
+	if job.Attempts >= dnsRecordMaxAttempts {
+		status = dnsRecordStatusFailed
+	}
+	return c.JSON(http.StatusOK, DNSRecordStatus{
+		Name:      job.Name,
+		Status:    status,
+		Attempts:  job.Attempts,
+		LastError: job.LastError.String,
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/counter"
+	"github.com/isucon/isucon13/webapp/go/internal/eventbus"
+)
+
+// 書き込みAPIの後の処理
+// 投稿・報告・入退室のハンドラは、コミット後にイベントをPublishするだけにする
+// 件数・ランキング・リアルタイム配信はsubscribeEventsで購読し、eventBusのワーカーで処理する
+// 購読者で行うのは元の行から作り直せるものだけにし、通知のように失えないものは投稿のトランザクションで書く
+// イベントのキーは配信IDなので、同じ配信のイベントは順に処理される
+// レスポンスを返してから反映されるので、投稿の直後の統計・ランキングにはまだ含まれないことがある
+// 件数を減らす場合 (counterDeltas) と、ランキングの作り直し (invalidateRankings) は、これまでどおりハンドラで直接行う
+// 件数の元になる行を書き換えたイベントは、counter.Commitが返したEpochをCounterEpochに入れる
+// 初期化ではeventBusをFlushしてから数え直し、終了時はCloseしてから件数を書き出す
+
+const (
+	eventBusQueueSize = 4096
+	// 1つのイベントの購読者をまとめて待つ時間。DBやRedisが詰まってもワーカーが止まり続けないようにする
+	eventBusHandlerTimeout = 5 * time.Second
+)
+
+// イベントを処理するワーカーの数
+var eventBusWorkers = 4
+
+// ReactionCreated は、リアクションの投稿のコミット後に送る
+type ReactionCreated struct {
+	Livestream LivestreamModel
+	Model      ReactionModel
+	// 投稿APIのレスポンスと同じもの
+	Reaction     Reaction
+	CounterEpoch counter.Epoch
+}
+
+// LivecommentCreated は、ライブコメントの投稿のコミット後に送る
+// シャドウバンされたユーザの投稿も送るので、購読者ごとに扱いを決める
+type LivecommentCreated struct {
+	Livestream LivestreamModel
+	Model      LivecommentModel
+	// 投稿APIのレスポンスと同じもの
+	Livecomment  Livecomment
+	CounterEpoch counter.Epoch
+}
+
+// ReportCreated は、ライブコメントの報告を新しく作ったコミット後に送る (報告済みの場合は送らない)
+type ReportCreated struct {
+	Model        LivecommentReportModel
+	CounterEpoch counter.Epoch
+}
+
+// ViewerEntered は、視聴者が入室して視聴者数が増えたコミット後に送る (視聴中の再入室では送らない)
+type ViewerEntered struct {
+	LivestreamID int64
+	UserID       int64
+	CounterEpoch counter.Epoch
+}
+
+// ViewerLeft は、退室・ハートビート切れで視聴者数が減ったコミット後に送る
+type ViewerLeft struct {
+	LivestreamID int64
+	UserID       int64
+	CounterEpoch counter.Epoch
+}
+
+var (
+	eventBus = eventbus.New(eventbus.Options{
+		QueueSize:      eventBusQueueSize,
+		HandlerTimeout: eventBusHandlerTimeout,
+		OnError: func(topic string, subscriber string, err error) {
+			log.Printf("failed to handle %s in %s: %v", topic, subscriber, err)
+		},
+	})
+
+	reactionCreated    = eventbus.NewTopic[ReactionCreated](eventBus, "ReactionCreated")
+	livecommentCreated = eventbus.NewTopic[LivecommentCreated](eventBus, "LivecommentCreated")
+	reportCreated      = eventbus.NewTopic[ReportCreated](eventBus, "ReportCreated")
+	viewerEntered      = eventbus.NewTopic[ViewerEntered](eventBus, "ViewerEntered")
+	viewerLeft         = eventbus.NewTopic[ViewerLeft](eventBus, "ViewerLeft")
+)
+
+// subscribeEvents は、起動時にリクエストを受け付ける前に1回だけ呼ぶ
+// 購読者は登録順に呼ばれるので、リアルタイム配信が更新後の件数を送れるよう件数を先にする
+func subscribeEvents() {
+	reactionCreated.Subscribe("counters", countReaction)
+	reactionCreated.Subscribe("rankings", scoreReaction)
+	reactionCreated.Subscribe("realtime", streamReaction)
+
+	livecommentCreated.Subscribe("counters", countLivecomment)
+	livecommentCreated.Subscribe("rankings", scoreLivecomment)
+	livecommentCreated.Subscribe("realtime", streamLivecomment)
+
+	reportCreated.Subscribe("counters", countReport)
+	reportCreated.Subscribe("realtime", streamReport)
+
+	viewerEntered.Subscribe("counters", countViewerEntered)
+	viewerEntered.Subscribe("realtime", streamViewerEntered)
+
+	viewerLeft.Subscribe("counters", countViewerLeft)
+	viewerLeft.Subscribe("realtime", streamViewerLeft)
+}
@@ -0,0 +1,17 @@
+//go:build fgprof
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/felixge/fgprof"
+)
+
+// プロファイラ (fgprof)
+// 本番のバイナリには含めず、計測するときだけ -tags fgprof を付けてビルドする (make build BUILD_TAGS=fgprof)
+// 内部向けのポート (:6060) で、他のデバッグ用のエンドポイントと同じ認証を通す
+
+func init() {
+	http.DefaultServeMux.Handle("/debug/fgprof", fgprof.Handler())
+}
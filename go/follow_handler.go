@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信者のフォロー
+// users.follower_countはfollowsの件数を非正規化したもので、フォロー・解除と同じトランザクションで更新する
+
+const (
+	defaultFollowingFeedLimit = 20
+	maxFollowingFeedLimit     = 100
+)
+
+// フォローAPI
+// POST /api/user/:username/follow
+func postFollowHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	targetModel, err := getFollowTarget(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+	if targetModel.ID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't follow yourself")
+	}
+
+	status := http.StatusCreated
+	if _, err := tx.ExecContext(ctx, "INSERT INTO follows (user_id, target_user_id, created_at) VALUES (?, ?, ?)", userID, targetModel.ID, time.Now().Unix()); err != nil {
+		if !isDuplicateEntryError(err) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert follow: "+err.Error())
+		}
+		// フォロー済み
+		status = http.StatusOK
+	} else {
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET follower_count = follower_count + 1 WHERE id = ?", targetModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update follower_count: "+err.Error())
+		}
+		targetModel.FollowerCount++
+	}
+
+	target, err := fillUserResponse(ctx, targetModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(status, target)
+}
+
+// フォロー解除API
+// DELETE /api/user/:username/follow
+func deleteFollowHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	targetModel, err := getFollowTarget(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	rs, err := tx.ExecContext(ctx, "DELETE FROM follows WHERE user_id = ? AND target_user_id = ?", userID, targetModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete follow: "+err.Error())
+	}
+	deleted, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+	if deleted > 0 {
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET follower_count = follower_count - 1 WHERE id = ?", targetModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update follower_count: "+err.Error())
+		}
+		targetModel.FollowerCount--
+	}
+
+	target, err := fillUserResponse(ctx, targetModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, target)
+}
+
+// getFollowTarget は、フォロー対象のユーザを行ロックを取って取得する
+// follower_countの更新が並列なフォローと競合しないようにするため
+func getFollowTarget(ctx context.Context, tx *sqlx.Tx, username string) (UserModel, error) {
+	userModel, err := userRepo.FindByNameForUpdate(ctx, tx, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserModel{}, echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return UserModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if userModel.DeletedAt.Valid {
+		return UserModel{}, echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+	}
+	return userModel, nil
+}
+
+// フォロー中の配信者のライブ配信一覧API
+// GET /api/livestream/following?cursor=&limit=
+func getFollowingLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	query := "SELECT l.* FROM livestreams l INNER JOIN follows f ON f.target_user_id = l.user_id WHERE f.user_id = ?"
+	args := []interface{}{userID}
+	if c.QueryParam("cursor") != "" {
+		// 前ページ最後の配信IDより古いものを返す
+		cursor, err := strconv.ParseInt(c.QueryParam("cursor"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "cursor query parameter must be integer")
+		}
+		query += " AND l.id < ?"
+		args = append(args, cursor)
+	}
+	limit := defaultFollowingFeedLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+		if limit > maxFollowingFeedLimit {
+			limit = maxFollowingFeedLimit
+		}
+	}
+	query += fmt.Sprintf(" ORDER BY l.id DESC LIMIT %d", limit)
+
+	var livestreamModels []LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	livestreams, err := fillLivestreamResponses(ctx, dbConn, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/isucon/isucon13/webapp/go/internal/hub"
+)
+
+// LivestreamConnections は、配信ごとのリアルタイム配信の接続数
+type LivestreamConnections struct {
+	LivestreamID int64 `json:"livestream_id"`
+	// Hubの名前 -> 購読の数 (ロングポーリングで待っているものを含む)
+	Hubs  map[string]int `json:"hubs"`
+	Total int            `json:"total"`
+}
+
+// リアルタイム配信の状況取得API
+// GET /debug/hub/stats
+// internal/hubで作ったHubごとに、購読数・送った数・落とした数・切った数・死活確認で閉じた数を配信ごとに返す
+// 負荷試験中にどの配信で受信が追いついていないかを見るためのもので、初期化しても数は戻さない
+// 公開するAPIではないので、内部向けのポートで受け付ける
+func getHubStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(hub.AllStats())
+}
+
+// リアルタイム配信の接続数取得API
+// GET /debug/hub/connections
+// 今購読のある配信だけを、接続数の多い順に返す (このサーバの分のみ)
+func getHubConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	byLivestream := map[int64]*LivestreamConnections{}
+	for _, stats := range hub.AllStats() {
+		for _, room := range stats.Rooms {
+			if room.Subscribers == 0 {
+				continue
+			}
+			// Hubのキーはすべて配信ID
+			livestreamID, err := strconv.ParseInt(room.Key, 10, 64)
+			if err != nil {
+				continue
+			}
+			connections := byLivestream[livestreamID]
+			if connections == nil {
+				connections = &LivestreamConnections{LivestreamID: livestreamID, Hubs: map[string]int{}}
+				byLivestream[livestreamID] = connections
+			}
+			connections.Hubs[stats.Name] += room.Subscribers
+			connections.Total += room.Subscribers
+		}
+	}
+
+	res := make([]LivestreamConnections, 0, len(byLivestream))
+	for _, connections := range byLivestream {
+		res = append(res, *connections)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Total != res[j].Total {
+			return res[i].Total > res[j].Total
+		}
+		return res[i].LivestreamID < res[j].LivestreamID
+	})
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(res)
+}
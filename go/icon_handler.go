@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/imageproc"
+	"github.com/isucon/isucon13/webapp/go/internal/cache"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// アイコン画像は内容のsha256をキーとしてicon_imagesに保存し、iconsにはハッシュのみ持つ
+// 各サーバはiconDirに<sha256>.jpgとしてキャッシュし、なければicon_imagesから読んで置く
+// (他のサーバでアップロードされた画像も配信できるよう、正はMySQLに置く)
+// 同じ画像は同じファイルを共有するので、差し替えられても古いファイルは消さない
+// 縮小版は<sha256>_thumb.jpgとして隣に保存する。ハッシュは元の画像のもの
+// 通常はアップロードされたバイト列をそのまま保存し、縮小版は初めて要求されたときに作る
+// (アップロードのたびにデコードしないよう、また画像として検証して弾かないようにする)
+// iconReencodeの場合だけ、PNG・GIFも受け付けてJPEGに変換し、そのときに縮小版も作る
+
+const (
+	maxIconSize = 2 * 1024 * 1024
+	// 縮小版の縦横の最大ピクセル数
+	iconThumbnailSize = 128
+)
+
+// 配信するアイコンのハッシュと画像ファイルのパス
+// フォールバック画像の場合、pathは空でメモリ上の画像を返す
+type userIcon struct {
+	hash string
+	path string
+}
+
+var (
+	iconDir = "../icons"
+	// ISUCON13_ICON_REENCODEで有効にする
+	// 有効な場合はアップロードされた画像をJPEGに変換し直すので、icon_hashは変換後の画像のものになる
+	iconReencode bool
+	// username -> userIcon (アイコンを設定したユーザのみ)
+	// アイコン未設定のユーザは、他のサーバで設定される場合があるので覚えない
+	iconHashMap sync.Map
+)
+
+// user_id -> アイコンのsha256
+// レスポンスのicon_hashを組み立てる際に参照する。アイコン未設定のユーザは空文字列として持つ
+// フォールバック画像は初期化で差し替わることがあるので、ハッシュは参照時に埋める
+// 他のサーバでのアップロードは、iconHashCacheTTLが過ぎて読み直したときに反映される
+const iconHashCacheTTL = 2 * time.Second
+
+var iconHashCache = cache.New[int64, string](cache.Options[string]{Name: "icon_hashes", TTL: iconHashCacheTTL})
+
+// getIconHashes は、ユーザのアイコンのハッシュをまとめて返す
+// キャッシュにないユーザはDBから読み込み、アイコン未設定のユーザはフォールバック画像のハッシュになる
+func getIconHashes(ctx context.Context, userIDs []int64) (map[int64]string, error) {
+	hashes, err := iconHashCache.GetOrLoadMany(ctx, userIDs, func(ctx context.Context, userIDs []int64) (map[int64]string, error) {
+		var icons []struct {
+			UserID int64  `db:"user_id"`
+			Hash   string `db:"hash"`
+		}
+		query, args, err := sqlx.In("SELECT user_id, hash FROM icons WHERE user_id IN (?)", userIDs)
+		if err != nil {
+			return nil, err
+		}
+		if err := dbConn.SelectContext(ctx, &icons, dbConn.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		hashes := make(map[int64]string, len(userIDs))
+		for _, userID := range userIDs {
+			hashes[userID] = ""
+		}
+		for _, icon := range icons {
+			hashes[icon.UserID] = icon.Hash
+		}
+		return hashes, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fallback := currentFallbackIcon()
+	for userID, hash := range hashes {
+		if hash == "" {
+			hashes[userID] = fallback.hash
+		}
+	}
+	return hashes, nil
+}
+
+func getIconHash(ctx context.Context, userID int64) (string, error) {
+	hashes, err := getIconHashes(ctx, []int64{userID})
+	if err != nil {
+		return "", err
+	}
+	return hashes[userID], nil
+}
+
+func iconPath(hash string) string {
+	return filepath.Join(iconDir, hash+".jpg")
+}
+
+func iconThumbnailPath(hash string) string {
+	return filepath.Join(iconDir, hash+"_thumb.jpg")
+}
+
+// prepareIcon は、保存する画像とその縮小版を返す
+// iconReencodeでない場合は大きさだけ確かめ、画像をそのまま返す。縮小版はnil
+// iconReencodeの場合、変換できない画像はerrInvalidIconを返す
+func prepareIcon(image []byte) ([]byte, []byte, error) {
+	if len(image) > maxIconSize {
+		return nil, nil, fmt.Errorf("%w: icon is too large", errInvalidIcon)
+	}
+	if !iconReencode {
+		return image, nil, nil
+	}
+	image, err := imageproc.ToJPEG(image, imageproc.DefaultJPEGQuality)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", errInvalidIcon, err)
+	}
+	thumbnail, err := imageproc.Thumbnail(image, iconThumbnailSize, imageproc.DefaultJPEGQuality)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", errInvalidIcon, err)
+	}
+	return image, thumbnail, nil
+}
+
+var errInvalidIcon = errors.New("invalid icon")
+
+// saveIcon は、アイコン画像と縮小版を手元に保存してハッシュを返す
+// thumbnailがnilの場合は縮小版を置かず、ensureIconThumbnailで作らせる
+func saveIcon(image []byte, thumbnail []byte) (string, error) {
+	hash := iconHashOf(image)
+	if _, err := os.Stat(iconPath(hash)); err == nil {
+		// 同じ画像が保存済み
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(iconDir, 0o755); err != nil {
+		return "", err
+	}
+	// 縮小版を先に置き、元の画像より古い縮小版が残らないようにする
+	if thumbnail != nil {
+		if err := writeIconFile(iconThumbnailPath(hash), thumbnail); err != nil {
+			return "", err
+		}
+	}
+	if err := writeIconFile(iconPath(hash), image); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// writeIconFile は、配信中の読み出しと競合しないよう、一時ファイルに書いてからrenameする
+func writeIconFile(path string, data []byte) error {
+	f, err := os.CreateTemp(iconDir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func iconHashOf(image []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(image))
+}
+
+// ensureIconFile は、画像が手元になければicon_imagesから読んで保存する
+// 他のサーバでアップロードされた画像や、初期化で消えた画像向け
+func ensureIconFile(ctx context.Context, hash string) error {
+	if _, err := os.Stat(iconPath(hash)); err == nil {
+		return nil
+	}
+	var image []byte
+	if err := dbConn.GetContext(ctx, &image, "SELECT image FROM icon_images WHERE hash = ?", hash); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(iconDir, 0o755); err != nil {
+		return err
+	}
+	return writeIconFile(iconPath(hash), image)
+}
+
+// ensureIconThumbnail は、縮小版がなければ元の画像から作って保存する
+// アップロードでは縮小版を作らないので、初めて要求されたときにここで作る
+// デコードできない画像は、毎回デコードし直さないよう元の画像をそのまま縮小版として置く
+func ensureIconThumbnail(ctx context.Context, hash string) error {
+	if _, err := os.Stat(iconThumbnailPath(hash)); err == nil {
+		return nil
+	}
+	if err := ensureIconFile(ctx, hash); err != nil {
+		return err
+	}
+	image, err := os.ReadFile(iconPath(hash))
+	if err != nil {
+		return err
+	}
+	thumbnail, err := imageproc.Thumbnail(image, iconThumbnailSize, imageproc.DefaultJPEGQuality)
+	if err != nil {
+		thumbnail = image
+	}
+	return writeIconFile(iconThumbnailPath(hash), thumbnail)
+}
+
+// resetIcons は、初期化時に保存済みのアイコン画像とハッシュを削除する
+// フォールバック画像が差し替えられていてもよいよう、読み込み直す
+func resetIcons(ctx context.Context) error {
+	if err := loadFallbackImage(); err != nil {
+		return err
+	}
+	iconHashMap.Range(func(key, _ any) bool {
+		iconHashMap.Delete(key)
+		return true
+	})
+	if err := os.RemoveAll(iconDir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// warmIcons は、resetIconsの後に、DBに残っているアイコンのハッシュを読み込む
+func warmIcons(ctx context.Context) error {
+	var icons []struct {
+		Name string `db:"name"`
+		Hash string `db:"hash"`
+	}
+	if err := dbConn.SelectContext(ctx, &icons, "SELECT u.name, i.hash FROM icons i INNER JOIN users u ON u.id = i.user_id"); err != nil {
+		return err
+	}
+	for _, icon := range icons {
+		iconHashMap.Store(icon.Name, userIcon{hash: icon.Hash, path: iconPath(icon.Hash)})
+	}
+	return nil
+}
+
+// ユーザアイコン取得API
+// GET /api/user/:username/icon?size=thumb|full
+// sizeを省略した場合はfull
+func getIconHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	username := c.Param("username")
+	thumb := false
+	switch c.QueryParam("size") {
+	case "", "full":
+	case "thumb":
+		thumb = true
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "size query parameter must be thumb or full")
+	}
+
+	fallback := currentFallbackIcon()
+	var icon userIcon
+	if cached, ok := iconHashMap.Load(username); ok {
+		icon = cached.(userIcon)
+	} else {
+		var iconHash sql.NullString
+		if err := dbConn.GetContext(ctx, &iconHash, "SELECT i.hash FROM users u LEFT JOIN icons i ON u.id = i.user_id WHERE u.name = ?", username); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+
+		if iconHash.Valid {
+			icon = userIcon{hash: iconHash.String, path: iconPath(iconHash.String)}
+			iconHashMap.Store(username, icon)
+		} else {
+			icon = userIcon{hash: fallback.hash}
+		}
+	}
+
+	// ハッシュはインデックスにあるので、304を返すときは画像を読まない
+	etag := icon.hash
+	if thumb {
+		etag += "-thumb"
+	}
+	c.Response().Header().Set("ETag", `"`+etag+`"`)
+	c.Response().Header().Set("Cache-Control", "public, no-cache")
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	if icon.path == "" {
+		if thumb {
+			return c.Blob(http.StatusOK, "image/jpeg", fallback.thumbnail)
+		}
+		return c.Blob(http.StatusOK, "image/jpeg", fallback.image)
+	}
+	c.Response().Header().Set(echo.HeaderContentType, "image/jpeg")
+	if thumb {
+		if err := ensureIconThumbnail(ctx, icon.hash); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to make icon thumbnail: "+err.Error())
+		}
+		return c.File(iconThumbnailPath(icon.hash))
+	}
+	if err := ensureIconFile(ctx, icon.hash); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load icon: "+err.Error())
+	}
+	return c.File(icon.path)
+}
+
+// etagMatches は、If-None-Matchヘッダの値がhashのETagに一致するか判定する
+// カンマ区切りの複数指定、弱いETag(W/)、"*"を受け付ける
+func etagMatches(ifNoneMatch string, hash string) bool {
+	for _, etag := range strings.Split(ifNoneMatch, ",") {
+		etag = strings.TrimSpace(etag)
+		if etag == "*" {
+			return true
+		}
+		etag = strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+		if etag != "" && etag == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// ユーザアイコン登録API
+// POST /api/icon
+func postIconHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostIconRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	image, thumbnail, err := prepareIcon(req.Image)
+	if err != nil {
+		if errors.Is(err, errInvalidIcon) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to process icon: "+err.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var username string
+	if err := tx.GetContext(ctx, &username, "SELECT name FROM users WHERE id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get username: "+err.Error())
+	}
+
+	// 手元のファイルはキャッシュなので、コミット前に置いておく
+	iconHash, err := saveIcon(image, thumbnail)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save icon: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO icon_images (hash, image) VALUES (?, ?)", iconHash, image); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert icon image: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old user icon: "+err.Error())
+	}
+	rs, err := tx.ExecContext(ctx, "INSERT INTO icons (user_id, hash) VALUES (?, ?)", userID, iconHash)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new user icon: "+err.Error())
+	}
+
+	iconID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted icon id: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	iconHashCache.Set(userID, iconHash)
+	iconHashMap.Store(username, userIcon{hash: iconHash, path: iconPath(iconHash)})
+
+	return c.JSON(http.StatusCreated, &PostIconResponse{
+		ID: iconID,
+	})
+}
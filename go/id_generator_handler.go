@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 投稿の多いテーブルのIDをアプリで採番する
+// IDを決めてからINSERTするので、LastInsertIdに頼らずに複数行をまとめて登録できる
+// IDはid_sequencesの行からidBlockSize個ずつまとめて予約し、サーバのメモリから払い出す
+// 予約は投稿のトランザクションの外で、1文のUPDATEだけで行うので、行のロックはその文の間しか持たない
+// 複数台のアプリサーバで書き込んでも重ならないが、IDの順はサーバをまたぐと投稿の順と一致しない
+// (id > カーソルで読む側は、settledPrefixで後から小さいIDがコミットされうる行を返さずに待つ)
+// 起動時と初期化時に、テーブルとtombstoneテーブルのIDの最大値まで進めておく
+
+const (
+	// 1回の予約で払い出すIDの数
+	idBlockSize = 100
+	// 予約してからこれより経ったIDは使わずに捨てる。サーバをまたいだIDの順と投稿の順のずれをこの幅に抑える
+	idBlockMaxAge = 500 * time.Millisecond
+	// カーソルで読む側が、作成からこれより新しい行を返さずに待つ時間
+	// created_atの切り捨て (1秒)・idBlockMaxAge・払い出しからコミットまでの時間を見込む
+	idCursorGrace = 2 * time.Second
+)
+
+var (
+	reactionIDs    = &idGenerator{name: "reactions", tables: []string{"reactions", "reaction_tombstones"}}
+	livecommentIDs = &idGenerator{name: "livecomments", tables: []string{"livecomments", "livecomment_tombstones"}}
+)
+
+type idGenerator struct {
+	// id_sequencesの行の名前
+	name string
+	// IDを共有するテーブル。削除時にIDを引き継ぐtombstoneテーブルも含める
+	tables []string
+
+	mu sync.Mutex
+	// 予約済みでまだ払い出していない範囲 [nextID, lastID]
+	nextID     int64
+	lastID     int64
+	reservedAt time.Time
+}
+
+// seed は、id_sequencesの行をtablesのIDの最大値まで進める (戻しはしないので、他のサーバが動いていても呼べる)
+// リクエストを受け付ける前に呼ぶこと
+func (g *idGenerator) seed(ctx context.Context) error {
+	var maxID int64
+	for _, table := range g.tables {
+		var id int64
+		// テーブル名は定数なので、そのまま埋め込む
+		if err := dbConn.GetContext(ctx, &id, fmt.Sprintf("SELECT IFNULL(MAX(id), 0) FROM %s", table)); err != nil {
+			return fmt.Errorf("failed to get max id of %s: %w", table, err)
+		}
+		maxID = max(maxID, id)
+	}
+	if _, err := dbConn.ExecContext(ctx, "INSERT INTO id_sequences (name, last_id) VALUES (?, ?) ON DUPLICATE KEY UPDATE last_id = GREATEST(last_id, VALUES(last_id))", g.name, maxID); err != nil {
+		return fmt.Errorf("failed to seed id sequence %s: %w", g.name, err)
+	}
+
+	// 手元に残っている予約は、作り直す前のテーブルに合わせたものなので捨てる
+	g.mu.Lock()
+	g.nextID, g.lastID = 0, 0
+	g.mu.Unlock()
+	return nil
+}
+
+// next は、次のIDを払い出す。予約が尽きたか古くなった場合だけMySQLに問い合わせる
+func (g *idGenerator) next(ctx context.Context) (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.nextID == 0 || g.nextID > g.lastID || time.Since(g.reservedAt) > idBlockMaxAge {
+		if err := g.reserveLocked(ctx); err != nil {
+			return 0, err
+		}
+	}
+	id := g.nextID
+	g.nextID++
+	return id, nil
+}
+
+// reserveLocked は、idBlockSize個のIDを予約する。g.muを持って呼ぶこと
+func (g *idGenerator) reserveLocked(ctx context.Context) error {
+	rs, err := dbConn.ExecContext(ctx, "UPDATE id_sequences SET last_id = LAST_INSERT_ID(last_id + ?) WHERE name = ?", idBlockSize, g.name)
+	if err != nil {
+		return err
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("id sequence %s is not seeded", g.name)
+	}
+	lastID, err := rs.LastInsertId()
+	if err != nil {
+		return err
+	}
+	g.nextID, g.lastID = lastID-idBlockSize+1, lastID
+	g.reservedAt = time.Now()
+	return nil
+}
+
+func seedIDGenerators(ctx context.Context) error {
+	for _, g := range []*idGenerator{reactionIDs, livecommentIDs} {
+		if err := g.seed(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settledPrefix は、IDの順に並んだrowsのうち、それより小さいIDが後からコミットされることのない先頭の部分を返す
+// 作成からidCursorGraceが経っていない行があれば、そこで打ち切り、その行を返せるようになる時刻も返す
+func settledPrefix[T any](rows []T, createdAt func(T) int64, now time.Time) ([]T, time.Time) {
+	for i, row := range rows {
+		settleAt := time.Unix(createdAt(row), 0).Add(idCursorGrace)
+		if settleAt.After(now) {
+			return rows[:i], settleAt
+		}
+	}
+	return rows, time.Time{}
+}
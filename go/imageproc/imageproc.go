@@ -0,0 +1,144 @@
+// Package imageproc は、アップロードされた画像の形式判定・JPEGへの変換・縮小を行う
+//
+// 対応する形式は標準ライブラリでデコードできるJPEG・PNG・GIFのみ
+package imageproc
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+
+	DefaultJPEGQuality = 85
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+var magics = []struct {
+	format string
+	magic  []byte
+}{
+	{FormatJPEG, []byte{0xff, 0xd8, 0xff}},
+	{FormatPNG, []byte("\x89PNG\r\n\x1a\n")},
+	{FormatGIF, []byte("GIF87a")},
+	{FormatGIF, []byte("GIF89a")},
+}
+
+// DetectFormat は、先頭のマジックバイトから画像の形式を判定する
+// 中身が壊れていないかまでは確認しない
+func DetectFormat(data []byte) (string, error) {
+	for _, m := range magics {
+		if bytes.HasPrefix(data, m.magic) {
+			return m.format, nil
+		}
+	}
+	return "", ErrUnsupportedFormat
+}
+
+func decode(data []byte) (image.Image, error) {
+	format, err := DetectFormat(data)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	switch format {
+	case FormatJPEG:
+		return jpeg.Decode(r)
+	case FormatPNG:
+		return png.Decode(r)
+	default:
+		return gif.Decode(r)
+	}
+}
+
+// ToJPEG は、画像をデコードしてJPEGにエンコードし直す
+// 透過部分は白で塗りつぶす
+func ToJPEG(data []byte, quality int) ([]byte, error) {
+	img, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return encodeJPEG(flatten(img), quality)
+}
+
+// Thumbnail は、画像を縦横ともmaxSize以下に縮小したJPEGを返す
+// 縦横比は保ち、もともと小さい画像は拡大しない
+func Thumbnail(data []byte, maxSize int, quality int) ([]byte, error) {
+	img, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	rgba := flatten(img)
+
+	w, h := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	if w > maxSize || h > maxSize {
+		if w >= h {
+			w, h = maxSize, max(1, h*maxSize/w)
+		} else {
+			w, h = max(1, w*maxSize/h), maxSize
+		}
+		rgba = shrink(rgba, w, h)
+	}
+	return encodeJPEG(rgba, quality)
+}
+
+func encodeJPEG(img image.Image, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// flatten は、白地に画像を重ねたRGBA画像を返す
+func flatten(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r, g, bl, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			// 乗算済みアルファなので、白地との合成は(1 - a)分の白を足すだけでよい
+			bg := 0xffff - a
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8((r + bg) >> 8),
+				G: uint8((g + bg) >> 8),
+				B: uint8((bl + bg) >> 8),
+				A: 0xff,
+			})
+		}
+	}
+	return dst
+}
+
+// shrink は、縮小先の1画素に対応する元画像の範囲を平均してw x hに縮小する
+func shrink(src *image.RGBA, w, h int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+			var r, g, b, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := src.RGBAAt(sx, sy)
+					r += uint32(c.R)
+					g += uint32(c.G)
+					b += uint32(c.B)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: 0xff})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sync/errgroup"
+)
+
+// 初期化
+// 互いに依存しない段階は並行に進める
+//  1. 作り直す前の状態が作り直した後に残らないよう、スナップショットを捨て、イベントを処理し終え、件数を無効にする
+//  2. MySQLを作り直す (init.sh) のと並行して、PowerDNSのゾーンを作り直す (init_dns_zone.sh)
+//  3. 作り直したMySQLをもとに、インデックスの確認・IDの採番・DNSレコード・initializeHooksで登録したものを並行して作り直す
+//  4. 他のサーバにも、メモリ上・ディスク上のものを作り直させる (initialize_hook_handler.go)
+// どれかが失敗したら、他の段階を打ち切って500を返す
+// 段階ごとの所要時間をレスポンスのstepsに入れる (ベンチマーカーはlanguageしか見ない)
+// ?verify=trueの場合は作り直さずに確かめるだけ (initialize_verify_handler.go)
+
+type InitializeResponse struct {
+	Language string `json:"language"`
+	// 初期化全体の所要時間
+	ElapsedMs int64            `json:"elapsed_ms"`
+	Steps     []InitializeStep `json:"steps"`
+	// ISUCON13_INITIALIZE_BUILD_INFO=trueの場合のみ入れる
+	Build *BuildInfo `json:"build,omitempty"`
+}
+
+// InitializeStep は、初期化の1段階の所要時間
+type InitializeStep struct {
+	Name string `json:"name"`
+	// 初期化の開始からこの段階を始めるまでの時間
+	StartedMs int64 `json:"started_ms"`
+	ElapsedMs int64 `json:"elapsed_ms"`
+}
+
+// initializeTimer は、段階ごとの所要時間を記録する。複数のgoroutineから使える
+type initializeTimer struct {
+	start time.Time
+
+	mu    sync.Mutex
+	steps []InitializeStep
+}
+
+type initializeStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// run は、stepを実行して所要時間を記録する
+func (t *initializeTimer) run(ctx context.Context, step initializeStep) error {
+	started := time.Now()
+	err := step.run(ctx)
+	elapsed := time.Since(started)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps, InitializeStep{
+		Name:      step.name,
+		StartedMs: started.Sub(t.start).Milliseconds(),
+		ElapsedMs: elapsed.Milliseconds(),
+	})
+	return err
+}
+
+// parallel は、stepsを並行に実行する。どれかが失敗したら、他の段階のctxを終わらせて最初のエラーを返す
+func (t *initializeTimer) parallel(ctx context.Context, steps ...initializeStep) error {
+	g, ctx := errgroup.WithContext(ctx)
+	for _, step := range steps {
+		g.Go(func() error { return t.run(ctx, step) })
+	}
+	return g.Wait()
+}
+
+func initializeHandler(c echo.Context) error {
+	if c.QueryParam("verify") == "true" {
+		return verifyInitializeHandler(c)
+	}
+
+	ctx := c.Request().Context()
+	timer := &initializeTimer{start: time.Now()}
+
+	if err := timer.run(ctx, initializeStep{"prepare", prepareInitialize}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := timer.parallel(ctx,
+		initializeStep{"mysql", func(ctx context.Context) error {
+			return runInitScript(ctx, c.Logger(), "../sql/init.sh", "ISUCON13_INIT_SKIP_DNS_ZONE=true")
+		}},
+		initializeStep{"dns_zone", func(ctx context.Context) error {
+			// 真偽値の解釈がアプリとずれないよう、解釈した結果を渡す
+			return runInitScript(ctx, c.Logger(), "../sql/init_dns_zone.sh", dnsRegistrationEnvKey+"="+strconv.FormatBool(dnsRegistrationEnabled))
+		}},
+	); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := timer.parallel(ctx,
+		initializeStep{"schema", initializeSchema},
+		initializeStep{"id_generators", func(ctx context.Context) error {
+			if err := seedIDGenerators(ctx); err != nil {
+				return fmt.Errorf("failed to seed id generators: %w", err)
+			}
+			return nil
+		}},
+		initializeStep{"dns_records", initializeDNSRecords},
+		initializeStep{"hooks", func(ctx context.Context) error { return runInitializeHooks(ctx, timer, true) }},
+	); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := timer.run(ctx, initializeStep{"publish", publishInitialize}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to publish initialization: "+err.Error())
+	}
+
+	res := InitializeResponse{
+		Language:  "golang",
+		ElapsedMs: time.Since(timer.start).Milliseconds(),
+		Steps:     timer.steps,
+	}
+	if initializeBuildInfo {
+		build := currentBuildInfo()
+		res.Build = &build
+	}
+	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
+	return c.JSON(http.StatusOK, res)
+}
+
+func prepareInitialize(ctx context.Context) error {
+	if err := discardCacheSnapshot(); err != nil {
+		return fmt.Errorf("failed to discard cache snapshot: %w", err)
+	}
+	// 作り直す前の投稿などのイベントが、作り直した後に反映されないようにする
+	if err := eventBus.Flush(ctx); err != nil {
+		return fmt.Errorf("failed to flush events: %w", err)
+	}
+	// 作り直す前の増減を書き出さないようにする
+	resetCounters()
+	return nil
+}
+
+// runInitScript は、envを加えてscriptを実行する。失敗した場合は出力をログに残す
+func runInitScript(ctx context.Context, logger echo.Logger, script string, env ...string) error {
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Env = append(os.Environ(), env...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logger.Warnf("%s failed with err=%s", script, string(out))
+		return fmt.Errorf("failed to initialize: %w", err)
+	}
+	return nil
+}
+
+// initializeSchema は、テーブルがアプリの想定するスキーマかを確かめる
+// init.shはテーブルを作り直さないので、スキーマの流し直し忘れはここで止める
+func initializeSchema(ctx context.Context) error {
+	if _, err := verifySchemaVersion(ctx); err != nil {
+		return fmt.Errorf("failed to verify schema version: %w", err)
+	}
+	if _, err := verifyIndexes(ctx); err != nil {
+		return fmt.Errorf("failed to verify indexes: %w", err)
+	}
+	if err := auditDBCharsets(ctx); err != nil {
+		return fmt.Errorf("failed to audit db charset: %w", err)
+	}
+	return nil
+}
+
+// initializeDNSRecords は、init_dns_zone.shで作り直したゾーンにレコードを登録し直す
+func initializeDNSRecords(ctx context.Context) error {
+	if dnsRegistrationEnabled {
+		if err := initializeDNS(ctx); err != nil {
+			return fmt.Errorf("failed to initialize dns: %w", err)
+		}
+	} else if dnsOwnerURL != "" {
+		// このサーバにはPowerDNSがないので、ゾーンの作り直しから任せる
+		if err := forwardDNSInitialize(ctx); err != nil {
+			return fmt.Errorf("failed to initialize dns: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/isucon/isucon13/webapp/go/internal/cache"
+	"github.com/labstack/echo/v4"
+)
+
+// 初期化時の作り直し
+// メモリ上・Redis上・ディスク上に持つものは、初期化でMySQLを作り直した後に必ず作り直す
+// 新しくキャッシュなどを持つ場合はregisterInitializeHooksに加える。加え忘れると、初期化前のデータが残ったままになる
+// (cache.Newで作ったキャッシュは "caches" でまとめて空にするので、加えなくてよい)
+// resetは登録順に1つずつ呼び、すべて終わってからwarmを並行に呼ぶ
+//
+// 初期化APIを受けたサーバは、作り直しが終わったらinitializationsに新しいトークンを書く
+// 他のサーバはinitializeWatchIntervalごとにトークンを読み、知っているものと違えば、
+// sharedでないフックだけを呼んで自分のメモリ上・ディスク上のものを作り直す
+// (Redis・MySQLなど共有しているものは、初期化APIを受けたサーバが作り直し済み)
+const initializeWatchInterval = time.Second
+
+var (
+	initializeTokenMu sync.Mutex
+	// このサーバが最後に反映した初期化のトークン
+	initializeToken string
+)
+
+type initializeHook struct {
+	name string
+	// 空にする。nilの場合は何もしない
+	reset func(ctx context.Context) error
+	// resetの後に、作り直したMySQLから読み込んでおく。nilの場合は次に参照されたときに読み込む
+	warm func(ctx context.Context) error
+	// trueの場合は全サーバで共有するものを作り直すので、初期化APIを受けたサーバだけが呼ぶ
+	shared bool
+}
+
+var initializeHooks []initializeHook
+
+func registerInitializeHook(hook initializeHook) {
+	initializeHooks = append(initializeHooks, hook)
+}
+
+// resetFunc は、失敗しないresetをinitializeHookに渡せるようにする
+func resetFunc(f func()) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		f()
+		return nil
+	}
+}
+
+// registerInitializeHooks は、起動時にリクエストを受け付ける前に1回だけ呼ぶ
+func registerInitializeHooks() {
+	registerInitializeHook(initializeHook{name: "sessions", reset: resetFunc(sessionStore.reset)})
+	registerInitializeHook(initializeHook{name: "caches", reset: resetFunc(cache.Reset)})
+	// 順位のソート済み集合を含め、Redisのキーをすべて消す
+	registerInitializeHook(initializeHook{
+		name:   "redis",
+		shared: true,
+		reset: func(ctx context.Context) error {
+			resetRedis(ctx)
+			return nil
+		},
+		warm: func(ctx context.Context) error {
+			if !redisClient.Available() {
+				return nil
+			}
+			return rebuildRankings(ctx)
+		},
+	})
+	registerInitializeHook(initializeHook{name: "login_credentials", reset: resetFunc(loginCache.reset)})
+	registerInitializeHook(initializeHook{name: "shadow_bans", reset: resetFunc(shadowBans.reset)})
+	registerInitializeHook(initializeHook{name: "ng_words", reset: resetFunc(ngWords.reset)})
+	// "redis" で中継用のストリームも消えるので、その後に送る
+	// 他のサーバは中継された作り直しで購読を閉じる
+	registerInitializeHook(initializeHook{
+		name:   "realtime",
+		shared: true,
+		reset: func(ctx context.Context) error {
+			resetRealtime(ctx)
+			return nil
+		},
+	})
+	registerInitializeHook(initializeHook{name: "trending", reset: resetFunc(trending.reset)})
+	registerInitializeHook(initializeHook{name: "tag_suggest", reset: resetFunc(tagSuggestIndex.reset)})
+	registerInitializeHook(initializeHook{name: "reservation_slots", reset: resetFunc(reservationSlots.reset)})
+	registerInitializeHook(initializeHook{name: "livestream_settings", reset: resetFunc(livestreamSettings.reset)})
+	registerInitializeHook(initializeHook{name: "notification_preferences", reset: resetFunc(notificationPreferences.reset)})
+	registerInitializeHook(initializeHook{name: "categories", reset: resetFunc(categories.reset)})
+	registerInitializeHook(initializeHook{name: "counters", reset: resetFunc(resetCounters), warm: rebuildCounters})
+	registerInitializeHook(initializeHook{
+		name: "thumbnails",
+		reset: func(ctx context.Context) error {
+			return resetLivestreamThumbnails()
+		},
+	})
+	registerInitializeHook(initializeHook{name: "icons", reset: resetIcons, warm: warmIcons})
+}
+
+// runInitializeHooks は、resetを "hooks/reset" として、warmをそれぞれ "hooks/<name>" として時間を計る
+// sharedがfalseの場合は、sharedなフックを呼ばない
+func runInitializeHooks(ctx context.Context, timer *initializeTimer, shared bool) error {
+	if err := timer.run(ctx, initializeStep{"hooks/reset", func(ctx context.Context) error {
+		for _, hook := range initializeHooks {
+			if hook.reset == nil || (hook.shared && !shared) {
+				continue
+			}
+			if err := hook.reset(ctx); err != nil {
+				return fmt.Errorf("failed to reset %s: %w", hook.name, err)
+			}
+		}
+		return nil
+	}}); err != nil {
+		return err
+	}
+
+	var warms []initializeStep
+	for _, hook := range initializeHooks {
+		if hook.warm == nil || (hook.shared && !shared) {
+			continue
+		}
+		warms = append(warms, initializeStep{"hooks/" + hook.name, func(ctx context.Context) error {
+			if err := hook.warm(ctx); err != nil {
+				return fmt.Errorf("failed to warm %s: %w", hook.name, err)
+			}
+			return nil
+		}})
+	}
+	return timer.parallel(ctx, warms...)
+}
+
+// publishInitialize は、初期化が終わったことを他のサーバに知らせる
+func publishInitialize(ctx context.Context) error {
+	token := uuid.NewString()
+	initializeTokenMu.Lock()
+	initializeToken = token
+	initializeTokenMu.Unlock()
+	_, err := dbConn.ExecContext(ctx, "REPLACE INTO initializations (id, token, initialized_at) VALUES (1, ?, ?)", token, time.Now().Unix())
+	return err
+}
+
+// loadInitializeToken は、最後の初期化のトークンを返す。一度も初期化していなければ空文字列を返す
+func loadInitializeToken(ctx context.Context) (string, error) {
+	var token string
+	err := dbConn.GetContext(ctx, &token, "SELECT token FROM initializations WHERE id = 1")
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return token, err
+}
+
+// runInitializeWatcher は、他のサーバでの初期化を反映する
+// 起動時点のトークンは反映済みとして扱う
+func runInitializeWatcher(ctx context.Context, logger echo.Logger) {
+	if token, err := loadInitializeToken(ctx); err == nil {
+		initializeTokenMu.Lock()
+		if initializeToken == "" {
+			initializeToken = token
+		}
+		initializeTokenMu.Unlock()
+	}
+	ticker := time.NewTicker(initializeWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// 初期化の途中はテーブルがなかったり空だったりするので、次の機会に読み直す
+		token, err := loadInitializeToken(ctx)
+		if err != nil || token == "" {
+			continue
+		}
+		initializeTokenMu.Lock()
+		changed := token != initializeToken
+		initializeToken = token
+		initializeTokenMu.Unlock()
+		if !changed {
+			continue
+		}
+		timer := &initializeTimer{start: time.Now()}
+		if err := runInitializeHooks(ctx, timer, false); err != nil {
+			logger.Errorf("failed to apply initialization from another server: %v", err)
+			continue
+		}
+		logger.Infof("applied initialization from another server in %s", time.Since(timer.start))
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/dns"
+	"github.com/isucon/isucon13/webapp/go/internal/cache"
+	"github.com/labstack/echo/v4"
+)
+
+// 初期化の確認
+// POST /api/initialize?verify=true では、データを作り直さずに、初期化してベンチマークを走らせられる状態かだけを確かめる
+// 本番の直前に、スキーマの入れ替え忘れやDNSの止まっているサーバがないかを見るために使う
+// 確認の結果はokに関わらず200で返す
+
+// 10_schema.sqlのschema_versionと合わせる
+const schemaVersion = 8
+
+const (
+	initializeCheckOK      = "ok"
+	initializeCheckFailed  = "failed"
+	initializeCheckSkipped = "skipped"
+)
+
+// InitializeVerification は、確認の結果
+type InitializeVerification struct {
+	// すべての確認がokかskippedの場合にtrue
+	OK     bool              `json:"ok"`
+	Checks []InitializeCheck `json:"checks"`
+}
+
+type InitializeCheck struct {
+	Name string `json:"name"`
+	// ok, failed, skipped
+	Status string `json:"status"`
+	// failedの場合は理由、それ以外の場合は確かめた内容
+	Detail    string `json:"detail,omitempty"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+// errInitializeCheckSkipped は、このサーバでは確かめられないことを表す。理由はDetailに入れる
+type errInitializeCheckSkipped struct{ reason string }
+
+func (e errInitializeCheckSkipped) Error() string { return e.reason }
+
+type initializeCheck struct {
+	name string
+	// 確かめた内容を返す
+	run func(ctx context.Context) (string, error)
+}
+
+var initializeChecks = []initializeCheck{
+	{"schema_version", verifySchemaVersion},
+	{"indexes", verifyIndexes},
+	{"db_charset", func(ctx context.Context) (string, error) {
+		return "", auditDBCharsets(ctx)
+	}},
+	{"dns_zone", verifyDNSZone},
+	{"cache_registry", verifyCacheRegistry},
+}
+
+// verifyInitializeHandler は、initializeChecksを並行に確かめる。1つが失敗しても他は続ける
+func verifyInitializeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	res := InitializeVerification{OK: true, Checks: make([]InitializeCheck, len(initializeChecks))}
+	var wg sync.WaitGroup
+	for i, check := range initializeChecks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started := time.Now()
+			detail, err := check.run(ctx)
+			result := InitializeCheck{Name: check.name, Status: initializeCheckOK, Detail: detail}
+			var skipped errInitializeCheckSkipped
+			if errors.As(err, &skipped) {
+				result.Status = initializeCheckSkipped
+				result.Detail = skipped.reason
+			} else if err != nil {
+				result.Status = initializeCheckFailed
+				result.Detail = err.Error()
+			}
+			result.ElapsedMs = time.Since(started).Milliseconds()
+			res.Checks[i] = result
+		}()
+	}
+	wg.Wait()
+
+	for _, check := range res.Checks {
+		if check.Status == initializeCheckFailed {
+			res.OK = false
+		}
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func verifySchemaVersion(ctx context.Context) (string, error) {
+	var version int
+	if err := dbConn.GetContext(ctx, &version, "SELECT version FROM schema_version ORDER BY version DESC LIMIT 1"); err != nil {
+		if isTableNotFoundError(err) {
+			return "", errors.New("schema_version table is missing, apply initdb.d/10_schema.sql")
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errors.New("schema_version is empty")
+		}
+		return "", err
+	}
+	if version != schemaVersion {
+		return "", fmt.Errorf("schema version is %d, want %d", version, schemaVersion)
+	}
+	return fmt.Sprintf("version %d", version), nil
+}
+
+func verifyIndexes(ctx context.Context) (string, error) {
+	missing, err := missingIndexes(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(missing) > 0 {
+		names := make([]string, len(missing))
+		for i, index := range missing {
+			names[i] = index.name
+		}
+		return "", fmt.Errorf("missing indexes: %s", strings.Join(names, ", "))
+	}
+	return fmt.Sprintf("%d required indexes", len(requiredIndexes)), nil
+}
+
+// verifyDNSZone は、checkDNSと同じことを、足りないレコードを登録せずに確かめる
+func verifyDNSZone(ctx context.Context) (string, error) {
+	if !dnsRegistrationEnabled {
+		return "", errInitializeCheckSkipped{"dns registration is disabled on this server"}
+	}
+	if dnsCheckAddr == "" {
+		return "", errInitializeCheckSkipped{"dns check address is not set"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	if err := dns.CheckZone(ctx, dnsCheckAddr, dnsZone); err != nil {
+		return "", err
+	}
+	ok, err := dns.HasARecord(ctx, dnsCheckAddr, dnsZone, "pipe")
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("A record of pipe.%s is missing", dnsZone)
+	}
+	return fmt.Sprintf("%s served by %s", dnsZone, dnsCheckAddr), nil
+}
+
+// verifyCacheRegistry は、初期化時に作り直すものが登録されていて、Redisが使える状態かを確かめる
+func verifyCacheRegistry(ctx context.Context) (string, error) {
+	if len(initializeHooks) == 0 {
+		return "", errors.New("no initialize hooks are registered")
+	}
+	seen := map[string]bool{}
+	for _, hook := range initializeHooks {
+		if hook.reset == nil && hook.warm == nil {
+			return "", fmt.Errorf("initialize hook %s has neither reset nor warm", hook.name)
+		}
+		if seen[hook.name] {
+			return "", fmt.Errorf("initialize hook %s is registered twice", hook.name)
+		}
+		seen[hook.name] = true
+	}
+	if redisClient != nil && !redisClient.Available() {
+		return "", errors.New("redis is configured but marked down")
+	}
+	return fmt.Sprintf("%d initialize hooks, %d caches", len(initializeHooks), len(cache.AllStats())), nil
+}
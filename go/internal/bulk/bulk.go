@@ -0,0 +1,54 @@
+// Package bulk は、複数行のINSERTを1つの文にまとめて実行する
+//
+// アプリのテーブルとDNSのrecordsテーブルの両方から使う
+package bulk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MySQLのプレースホルダ数の上限
+const maxPlaceholders = 65535
+
+// Insert は、rowsを複数行のINSERTでまとめて登録する
+// rowsの各要素はcolumnsと同じ順に値を並べたもの
+// プレースホルダ数の上限を超える場合は、上限に収まるよう分けて実行する
+// テーブル名・列名はそのまま埋め込むので、定数だけを渡すこと
+func Insert(ctx context.Context, tx sqlx.ExecerContext, table string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("bulk insert into %s: no columns", table)
+	}
+
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", table, strings.Join(columns, ", "))
+	placeholder := "(?" + strings.Repeat(", ?", len(columns)-1) + ")"
+	batchSize := maxPlaceholders / len(columns)
+
+	for len(rows) > 0 {
+		n := min(len(rows), batchSize)
+		var query strings.Builder
+		query.WriteString(prefix)
+		args := make([]interface{}, 0, n*len(columns))
+		for i, row := range rows[:n] {
+			if len(row) != len(columns) {
+				return fmt.Errorf("bulk insert into %s: row has %d values, want %d", table, len(row), len(columns))
+			}
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString(placeholder)
+			args = append(args, row...)
+		}
+		if _, err := tx.ExecContext(ctx, query.String(), args...); err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
@@ -0,0 +1,419 @@
+// Package cache は、アプリサーバのメモリ上に持つキー・値のキャッシュ
+//
+// 有効期間と最大件数を指定でき、最大件数を超えた場合は最も長く参照されていないものから捨てる
+// Newで作ったキャッシュはすべてResetでまとめて空にできるので、初期化APIではResetだけ呼べばよい
+// ヒット数などもNewで作ったキャッシュごとに数えていて、AllStatsでまとめて取れる
+//
+// GetOrLoad・GetOrLoadManyは、読み込み中にDeleteされたキーの値を覚えない
+// (Deleteの前に読んだ古い値が、Deleteの後に覚えられてしまわないように)
+package cache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+type Options[V any] struct {
+	// AllStatsで表示する名前
+	Name string
+	// 0の場合は期限切れにしない
+	TTL time.Duration
+	// 値ごとに有効期間を変える場合に指定する。TTLより優先する
+	// 存在しなかったことを短い間だけ覚える場合などに使う
+	TTLFunc func(V) time.Duration
+	// 0の場合は上限なし
+	MaxEntries int
+}
+
+// Cache は、複数のgoroutineから使える
+type Cache[K comparable, V any] struct {
+	options Options[V]
+
+	mu sync.Mutex
+	// 先頭ほど最近参照されたもの
+	lru   *list.List
+	items map[K]*list.Element
+	// Resetのたびに進め、Reset前に始まった読み込みの結果を捨てる
+	generation uint64
+	// 読み込み中のDeleteを記録する。clockはDeleteのたびに進め、deletedにはキーごとの最後のDeleteの時点を持つ
+	// 読み込みがなくなったらdeletedは空にする
+	clock   uint64
+	deleted map[K]uint64
+	loading int
+	// Resetでは戻さない
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+
+	group singleflight.Group
+}
+
+type entry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+// Stats は、キャッシュの利用状況
+// Hits・Missesは、GetとGetOrLoad・GetOrLoadManyで探したキーの数を数える
+type Stats struct {
+	Name        string `json:"name"`
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`
+	Expirations uint64 `json:"expirations"`
+	Entries     int    `json:"entries"`
+	MaxEntries  int    `json:"max_entries"`
+}
+
+type registered interface {
+	Reset()
+	Stats() Stats
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []registered
+)
+
+// New は、空のキャッシュを作ってResetの対象に加える
+func New[K comparable, V any](options Options[V]) *Cache[K, V] {
+	c := &Cache[K, V]{
+		options: options,
+		lru:     list.New(),
+		items:   map[K]*list.Element{},
+		deleted: map[K]uint64{},
+	}
+	registryMu.Lock()
+	registry = append(registry, c)
+	registryMu.Unlock()
+	return c
+}
+
+// Reset は、Newで作ったすべてのキャッシュを空にする
+func Reset() {
+	registryMu.Lock()
+	caches := append([]registered(nil), registry...)
+	registryMu.Unlock()
+	for _, c := range caches {
+		c.Reset()
+	}
+}
+
+// AllStats は、Newで作ったすべてのキャッシュの利用状況を名前順に返す
+func AllStats() []Stats {
+	registryMu.Lock()
+	caches := append([]registered(nil), registry...)
+	registryMu.Unlock()
+	stats := make([]Stats, len(caches))
+	for i, c := range caches {
+		stats[i] = c.Stats()
+	}
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookupLocked(key, time.Now())
+}
+
+// lookupLocked は、getLockedにヒット数・ミス数の記録を加えたもの
+// 呼び出し側から見た1回の参照につき1回だけ呼ぶ
+func (c *Cache[K, V]) lookupLocked(key K, now time.Time) (V, bool) {
+	value, ok := c.getLocked(key, now)
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return value, ok
+}
+
+func (c *Cache[K, V]) getLocked(key K, now time.Time) (V, bool) {
+	elem, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	e := elem.Value.(*entry[K, V])
+	if !e.expiresAt.IsZero() && now.After(e.expiresAt) {
+		c.lru.Remove(elem)
+		delete(c.items, key)
+		c.expirations++
+		var zero V
+		return zero, false
+	}
+	c.lru.MoveToFront(elem)
+	return e.value, true
+}
+
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setLocked(key, value, time.Now())
+}
+
+// SetWithTTL は、ttlとキャッシュの有効期間の短い方だけ覚える
+// 確かめていない値 (ファイルから読み戻したものなど) を、すぐに読み直させたい場合に使う
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setWithTTLLocked(key, value, ttl, time.Now())
+}
+
+func (c *Cache[K, V]) setLocked(key K, value V, now time.Time) {
+	c.setWithTTLLocked(key, value, 0, now)
+}
+
+// setWithTTLLocked は、ttlが0の場合はキャッシュの有効期間で覚える
+func (c *Cache[K, V]) setWithTTLLocked(key K, value V, maxTTL time.Duration, now time.Time) {
+	ttl := c.options.TTL
+	if c.options.TTLFunc != nil {
+		ttl = c.options.TTLFunc(value)
+	}
+	if maxTTL > 0 && (ttl <= 0 || ttl > maxTTL) {
+		ttl = maxTTL
+	}
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = now.Add(ttl)
+	}
+
+	if elem, ok := c.items[key]; ok {
+		e := elem.Value.(*entry[K, V])
+		e.value = value
+		e.expiresAt = expiresAt
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.lru.PushFront(&entry[K, V]{key: key, value: value, expiresAt: expiresAt})
+	if c.options.MaxEntries > 0 && c.lru.Len() > c.options.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*entry[K, V]).key)
+		c.evictions++
+	}
+}
+
+func (c *Cache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.items, key)
+	}
+	if c.loading > 0 {
+		c.clock++
+		c.deleted[key] = c.clock
+	}
+}
+
+// beginLoadLocked は、読み込みを始めた時点を返す。読み込みが終わったらendLoadLockedを呼ぶ
+func (c *Cache[K, V]) beginLoadLocked() uint64 {
+	c.loading++
+	return c.clock
+}
+
+func (c *Cache[K, V]) endLoadLocked() {
+	c.loading--
+	if c.loading == 0 {
+		clear(c.deleted)
+	}
+}
+
+// deletedSinceLocked は、keyがstartの後にDeleteされたかを返す
+func (c *Cache[K, V]) deletedSinceLocked(key K, start uint64) bool {
+	return c.deleted[key] > start
+}
+
+// Reset は、このキャッシュだけを空にする
+func (c *Cache[K, V]) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.items = map[K]*list.Element{}
+	c.generation++
+}
+
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// Range は、期限切れでないすべての値についてfを呼ぶ
+// 呼び出し時点の内容を写してから呼ぶので、fの中でこのキャッシュを操作してもよい
+// ヒット数・ミス数には数えない
+func (c *Cache[K, V]) Range(f func(key K, value V) bool) {
+	now := time.Now()
+	c.mu.Lock()
+	entries := make([]entry[K, V], 0, len(c.items))
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*entry[K, V])
+		if !e.expiresAt.IsZero() && now.After(e.expiresAt) {
+			continue
+		}
+		entries = append(entries, *e)
+	}
+	c.mu.Unlock()
+	for _, e := range entries {
+		if !f(e.key, e.value) {
+			return
+		}
+	}
+}
+
+func (c *Cache[K, V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{
+		Name:        c.options.Name,
+		Hits:        c.hits,
+		Misses:      c.misses,
+		Evictions:   c.evictions,
+		Expirations: c.expirations,
+		Entries:     len(c.items),
+		MaxEntries:  c.options.MaxEntries,
+	}
+}
+
+// GetOrLoad は、キャッシュになければloadで読み込んで覚える
+// 同じキーの読み込みが並行した場合は、1回だけloadを呼んで結果を共有する
+// 結果を待つ他の呼び出し元がいるので、loadには最初の呼び出し元のキャンセルを伝えない
+// 読み込み中にSetされた場合はそちらを優先し、Deleteされた場合やloadがエラーを返した場合は何も覚えない
+func (c *Cache[K, V]) GetOrLoad(ctx context.Context, key K, load func(ctx context.Context, key K) (V, error)) (V, error) {
+	if value, ok := c.Get(key); ok {
+		return value, nil
+	}
+
+	v, err, _ := c.group.Do(fmt.Sprint(key), func() (interface{}, error) {
+		c.mu.Lock()
+		generation := c.generation
+		value, ok := c.getLocked(key, time.Now())
+		if ok {
+			c.mu.Unlock()
+			return value, nil
+		}
+		start := c.beginLoadLocked()
+		c.mu.Unlock()
+
+		value, err := load(context.WithoutCancel(ctx), key)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		defer c.endLoadLocked()
+		if err != nil {
+			return value, err
+		}
+		if c.generation != generation || c.deletedSinceLocked(key, start) {
+			return value, nil
+		}
+		if set, ok := c.getLocked(key, time.Now()); ok {
+			// 読み込み中にSetされた値の方が新しい
+			return set, nil
+		}
+		c.setLocked(key, value, time.Now())
+		return value, nil
+	})
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	return v.(V), nil
+}
+
+// GetOrReadMany は、keysのうちキャッシュにないものをまとめてloadで読み込むが、覚えはしない
+// 遅れのあるレプリカなど、覚えてよいか分からない読み込み先から読む場合に使う
+// ヒット数・ミス数はGetOrLoadManyと同じく数える
+func (c *Cache[K, V]) GetOrReadMany(ctx context.Context, keys []K, load func(ctx context.Context, keys []K) (map[K]V, error)) (map[K]V, error) {
+	values := make(map[K]V, len(keys))
+	var missing []K
+	c.mu.Lock()
+	now := time.Now()
+	// 同じキーが複数回渡されても、数えるのも読み込むのも1回にする
+	seen := make(map[K]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if value, ok := c.lookupLocked(key, now); ok {
+			values[key] = value
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	c.mu.Unlock()
+	if len(missing) == 0 {
+		return values, nil
+	}
+
+	loaded, err := load(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range loaded {
+		values[key] = value
+	}
+	return values, nil
+}
+
+// GetOrLoadMany は、keysのうちキャッシュにないものをまとめてloadで読み込んで覚える
+// loadが返さなかったキーは結果に含まれず、覚えもしない
+// 存在しないことも覚えたい場合は、loadでゼロ値などを入れて返すこと
+// まとめて読み込むので、GetOrLoadと違い並行した読み込みは共有しない
+func (c *Cache[K, V]) GetOrLoadMany(ctx context.Context, keys []K, load func(ctx context.Context, keys []K) (map[K]V, error)) (map[K]V, error) {
+	values := make(map[K]V, len(keys))
+	var missing []K
+	c.mu.Lock()
+	generation := c.generation
+	now := time.Now()
+	// 同じキーが複数回渡されても、数えるのも読み込むのも1回にする
+	seen := make(map[K]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if value, ok := c.lookupLocked(key, now); ok {
+			values[key] = value
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		c.mu.Unlock()
+		return values, nil
+	}
+	start := c.beginLoadLocked()
+	c.mu.Unlock()
+
+	loaded, err := load(ctx, missing)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.endLoadLocked()
+	if err != nil {
+		return nil, err
+	}
+	now = time.Now()
+	for key, value := range loaded {
+		if c.generation == generation && !c.deletedSinceLocked(key, start) {
+			if set, ok := c.getLocked(key, now); ok {
+				// 読み込み中にSetされた値の方が新しい
+				value = set
+			} else {
+				c.setLocked(key, value, now)
+			}
+		}
+		values[key] = value
+	}
+	return values, nil
+}
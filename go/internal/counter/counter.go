@@ -0,0 +1,465 @@
+// Package counter は、行ごとの件数をアプリサーバのメモリに持ち、増減分をまとめてMySQLの件数の表に書き出す
+//
+// 件数の表は、主キーの列と件数の列 (BIGINT NOT NULL DEFAULT 0) からなる
+// Addはメモリ上の値を変えるだけで、Syncのたびに増減分をINSERT ... ON DUPLICATE KEY UPDATEでまとめて足し込む
+// GetManyはメモリ上の値をそのまま返す。数え直すまではfalseを返すので、呼び出し元でMySQLから数えること
+// 行の削除などで件数が減った場合も、減った分をAddする
+//
+// 元の行を書き換えるコミットはCommitで行い、返ったEpochをAddに渡す
+// RebuildAllは、実行中のCommitを待ってからEpochを進め、その時点のスナップショットで数え直す
+// 古いEpochのAddはスナップショットに含まれているので捨て、新しいEpochのAddだけを数え直しに足す
+//
+// 落ちた場合の扱い:
+//   - 書き出していない増減 (最大でSyncの間隔の分) は失われる。起動時にRebuildAllすれば残らない
+//   - 書き出しに失敗した増減はメモリに戻し、次のSyncで書き出す
+//   - 複数のアプリサーバで同じ表を使う場合は、Syncで表を読み直して他のサーバの書き出し分を取り込む
+//     数え直しは他のサーバがまだ書き出していない増減を知らないので、全台が同時に作り直す初期化のときだけにし、
+//     起動時はLoadAllで表を読み込むだけにする
+package counter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 1回のINSERTで書き出す行数
+const writeChunkSize = 1000
+
+type Options struct {
+	// 件数の表
+	Table string
+	// 主キーの列
+	Key string
+	// 件数の列
+	Columns []ColumnOptions
+}
+
+type ColumnOptions struct {
+	Name string
+	// 元の行から数えるクエリ。主キーの値をid、件数をcountとして返す
+	Source string
+}
+
+// Table は、複数のgoroutineから使える
+type Table struct {
+	options Options
+
+	// Syncを1つずつ実行する
+	syncMu sync.Mutex
+
+	mu sync.Mutex
+	// 読み込んだ表の値に、書き出していない増減を足したもの
+	values map[int64][]int64
+	// 書き出していない増減
+	deltas map[int64][]int64
+	// falseの場合、valuesは使えない (数え直し前か、ResetAll後)
+	loaded bool
+}
+
+// Newで作った表。ResetAll・RebuildAll・SyncAllでまとめて扱う
+var (
+	tablesMu sync.Mutex
+	tables   []*Table
+)
+
+// Epoch は、数え直しのスナップショットの番号
+// Commitで得たEpochが今のものより古ければ、その書き込みは数え直しに含まれている
+type Epoch uint64
+
+var (
+	// Commitの間は読み取りロックを持ち、RebuildAllがコミット途中の書き込みを挟んでスナップショットを取らないようにする
+	epochMu sync.RWMutex
+	epoch   atomic.Uint64
+	// RebuildAllを1つずつ実行する
+	rebuildMu sync.Mutex
+)
+
+// Commit は、件数の元になる行を書き換えたトランザクションをcommitでコミットし、Addに渡すEpochを返す
+func Commit(commit func() error) (Epoch, error) {
+	epochMu.RLock()
+	defer epochMu.RUnlock()
+	e := Epoch(epoch.Load())
+	return e, commit()
+}
+
+func New(options Options) *Table {
+	t := &Table{
+		options: options,
+		values:  map[int64][]int64{},
+		deltas:  map[int64][]int64{},
+	}
+	tablesMu.Lock()
+	tables = append(tables, t)
+	tablesMu.Unlock()
+	return t
+}
+
+// Column は、件数の列を1つ扱う
+type Column struct {
+	table *Table
+	index int
+}
+
+// Column は、Options.Columnsにない名前の場合はpanicする
+func (t *Table) Column(name string) Column {
+	for i, c := range t.options.Columns {
+		if c.Name == name {
+			return Column{table: t, index: i}
+		}
+	}
+	panic(fmt.Sprintf("counter: unknown column %s.%s", t.options.Table, name))
+}
+
+// Add は、元の行のコミット後に、Commitが返したEpochを渡して呼ぶ
+func (c Column) Add(e Epoch, id int64, delta int64) {
+	t := c.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if uint64(e) < epoch.Load() {
+		// 数え直しに含まれている
+		return
+	}
+	t.row(t.deltas, id)[c.index] += delta
+	if t.loaded {
+		t.row(t.values, id)[c.index] += delta
+	}
+}
+
+// GetMany は、idsの件数を返す。表にないidは0になる
+// 数え直すまではfalseを返す
+func (c Column) GetMany(ids []int64) (map[int64]int64, bool) {
+	t := c.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loaded {
+		return nil, false
+	}
+	counts := make(map[int64]int64, len(ids))
+	for _, id := range ids {
+		if v, ok := t.values[id]; ok {
+			counts[id] = v[c.index]
+		} else {
+			counts[id] = 0
+		}
+	}
+	return counts, true
+}
+
+// Get は、1件だけのGetMany
+func (c Column) Get(id int64) (int64, bool) {
+	counts, ok := c.GetMany([]int64{id})
+	return counts[id], ok
+}
+
+// row は、mのidの行を返す。なければ作る。t.muを持って呼ぶこと
+func (t *Table) row(m map[int64][]int64, id int64) []int64 {
+	v, ok := m[id]
+	if !ok {
+		v = make([]int64, len(t.options.Columns))
+		m[id] = v
+	}
+	return v
+}
+
+// Sync は、増減分を書き出す。数え直す前の表は何もしない
+// reloadがtrueの場合は書き出した後に表を読み直し、他のアプリサーバが書き出した分を取り込む
+func (t *Table) Sync(ctx context.Context, db *sqlx.DB, reload bool) error {
+	t.syncMu.Lock()
+	defer t.syncMu.Unlock()
+
+	t.mu.Lock()
+	loaded := t.loaded
+	t.mu.Unlock()
+	if !loaded {
+		return nil
+	}
+	if err := t.flush(ctx, db); err != nil {
+		return err
+	}
+	if reload {
+		return t.load(ctx, db, Epoch(epoch.Load()))
+	}
+	return nil
+}
+
+// flush は、増減分を表に足し込む
+func (t *Table) flush(ctx context.Context, db *sqlx.DB) error {
+	t.mu.Lock()
+	deltas := t.deltas
+	t.deltas = map[int64][]int64{}
+	e := epoch.Load()
+	t.mu.Unlock()
+
+	rows := make([][]int64, 0, len(deltas))
+	for id, v := range deltas {
+		for _, d := range v {
+			if d != 0 {
+				rows = append(rows, append([]int64{id}, v...))
+				break
+			}
+		}
+	}
+	err := t.write(ctx, db, rows, true)
+	if err != nil {
+		t.mu.Lock()
+		// 書き出せなかった分を戻す。その間に数え直していれば、数え直しに含まれるので捨てる
+		if epoch.Load() == e {
+			for id, v := range deltas {
+				row := t.row(t.deltas, id)
+				for i, d := range v {
+					row[i] += d
+				}
+			}
+		}
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// write は、rows (先頭が主キー、続いて各列の値) をまとめてINSERTする
+// addがtrueの場合は既存の行に足し込み、falseの場合は置き換える
+func (t *Table) write(ctx context.Context, db sqlx.ExecerContext, rows [][]int64, add bool) error {
+	columns := make([]string, len(t.options.Columns))
+	updates := make([]string, len(t.options.Columns))
+	for i, c := range t.options.Columns {
+		columns[i] = c.Name
+		if add {
+			updates[i] = fmt.Sprintf("%s = %s + VALUES(%s)", c.Name, c.Name, c.Name)
+		} else {
+			updates[i] = fmt.Sprintf("%s = VALUES(%s)", c.Name, c.Name)
+		}
+	}
+	placeholder := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)+1), ", ") + ")"
+
+	for len(rows) > 0 {
+		chunk := rows
+		if len(chunk) > writeChunkSize {
+			chunk = chunk[:writeChunkSize]
+		}
+		rows = rows[len(chunk):]
+
+		values := make([]string, len(chunk))
+		args := make([]interface{}, 0, len(chunk)*(len(columns)+1))
+		for i, row := range chunk {
+			values[i] = placeholder
+			for _, v := range row {
+				args = append(args, v)
+			}
+		}
+		// テーブル名・列名は定数なので、そのまま埋め込む
+		query := fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES %s ON DUPLICATE KEY UPDATE %s",
+			t.options.Table, t.options.Key, strings.Join(columns, ", "), strings.Join(values, ", "), strings.Join(updates, ", "))
+		if _, err := db.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to write %s: %w", t.options.Table, err)
+		}
+	}
+	return nil
+}
+
+// count は、スナップショットを取ったconnで元の行から数える
+func (t *Table) count(ctx context.Context, conn *sqlx.Conn) ([][]int64, error) {
+	counts := map[int64][]int64{}
+	for i, c := range t.options.Columns {
+		var rows []struct {
+			ID    int64 `db:"id"`
+			Count int64 `db:"count"`
+		}
+		if err := conn.SelectContext(ctx, &rows, c.Source); err != nil {
+			return nil, fmt.Errorf("failed to count %s.%s: %w", t.options.Table, c.Name, err)
+		}
+		for _, row := range rows {
+			t.row(counts, row.ID)[i] = row.Count
+		}
+	}
+	rows := make([][]int64, 0, len(counts))
+	for id, v := range counts {
+		rows = append(rows, append([]int64{id}, v...))
+	}
+	return rows, nil
+}
+
+// replace は、表をrowsで置き換える
+func (t *Table) replace(ctx context.Context, db *sqlx.DB, rows [][]int64) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+t.options.Table); err != nil {
+		return fmt.Errorf("failed to clear %s: %w", t.options.Table, err)
+	}
+	if err := t.write(ctx, tx, rows, false); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// load は、表を読み込み、書き出していない増減を足してvaluesを置き換える
+// 読み込む間にEpochが進んでいれば何もしない (進めた側が読み込む)
+func (t *Table) load(ctx context.Context, db *sqlx.DB, e Epoch) error {
+	columns := make([]string, len(t.options.Columns))
+	for i, c := range t.options.Columns {
+		columns[i] = c.Name
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT %s, %s FROM %s", t.options.Key, strings.Join(columns, ", "), t.options.Table))
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", t.options.Table, err)
+	}
+	defer rows.Close()
+
+	values := map[int64][]int64{}
+	dest := make([]interface{}, len(columns)+1)
+	for rows.Next() {
+		var id int64
+		v := make([]int64, len(columns))
+		dest[0] = &id
+		for i := range v {
+			dest[i+1] = &v[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return fmt.Errorf("failed to load %s: %w", t.options.Table, err)
+		}
+		values[id] = v
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load %s: %w", t.options.Table, err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if epoch.Load() != uint64(e) {
+		return nil
+	}
+	for id, delta := range t.deltas {
+		row := t.row(values, id)
+		for i, d := range delta {
+			row[i] += d
+		}
+	}
+	t.values = values
+	t.loaded = true
+	return nil
+}
+
+// all は、Newで作ったすべての表を返す
+func all() []*Table {
+	tablesMu.Lock()
+	defer tablesMu.Unlock()
+	return append([]*Table(nil), tables...)
+}
+
+// advance は、Epochを進め、すべての表の増減と値を捨てる
+// epochMuの書き込みロックを持って呼ぶこと
+func advance() Epoch {
+	e := Epoch(epoch.Add(1))
+	for _, t := range all() {
+		t.mu.Lock()
+		t.deltas = map[int64][]int64{}
+		t.values = map[int64][]int64{}
+		t.loaded = false
+		t.mu.Unlock()
+	}
+	return e
+}
+
+// ResetAll は、すべての表の増減を捨て、RebuildAllかLoadAllまでGetManyがfalseを返すようにする
+// 初期化で元の行を作り直す前に呼ぶ
+func ResetAll() {
+	epochMu.Lock()
+	defer epochMu.Unlock()
+	advance()
+}
+
+// RebuildAll は、すべての表を元の行から数え直して置き換える。初期化時と、1台で動かす場合の起動時に呼ぶ
+// 実行中のCommitを待ってからスナップショットを取るので、それより前のコミットはすべて数え直しに含まれる
+func RebuildAll(ctx context.Context, db *sqlx.DB) error {
+	rebuildMu.Lock()
+	defer rebuildMu.Unlock()
+	tables := all()
+	// 数え直す前の増減を、数え直した表に書き出さないようにする
+	for _, t := range tables {
+		t.syncMu.Lock()
+		defer t.syncMu.Unlock()
+	}
+
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	epochMu.Lock()
+	e := advance()
+	_, err = conn.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY")
+	epochMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to start snapshot: %w", err)
+	}
+	counts := make([][][]int64, len(tables))
+	for i, t := range tables {
+		rows, err := t.count(ctx, conn)
+		if err != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+			return err
+		}
+		counts[i] = rows
+	}
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return err
+	}
+
+	for i, t := range tables {
+		if err := t.replace(ctx, db, counts[i]); err != nil {
+			return err
+		}
+		if err := t.load(ctx, db, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadAll は、すべての表を数え直さずに読み込む。複数台で動かす場合の起動時に呼ぶ
+// 表は他のサーバが書き出し続けているので、数え直して置き換えると他のサーバの書き出していない増減と二重になる
+func LoadAll(ctx context.Context, db *sqlx.DB) error {
+	e := Epoch(epoch.Load())
+	for _, t := range all() {
+		if err := t.load(ctx, db, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncAll は、Newで作ったすべての表をSyncする
+func SyncAll(ctx context.Context, db *sqlx.DB, reload bool) error {
+	for _, t := range all() {
+		if err := t.Sync(ctx, db, reload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run は、ctxが終わるまでintervalごとにSyncAllする
+// 終了時の書き出しは、処理中のリクエストを待ってから呼び出し元でSyncAllすること
+func Run(ctx context.Context, db *sqlx.DB, interval time.Duration, reload bool, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := SyncAll(ctx, db, reload); err != nil {
+				onError(err)
+			}
+		}
+	}
+}
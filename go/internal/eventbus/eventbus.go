@@ -0,0 +1,172 @@
+// Package eventbus は、アプリサーバ内で書き込みの後の処理を非同期に行うイベントバス
+//
+// イベントの型ごとにTopicを作り、購読者を登録しておく。PublishはイベントをBusのワーカーのキューに積むだけで、
+// 購読者はワーカーのgoroutineで登録順に呼ばれる
+// 同じキーのイベントは同じワーカーが順に処理するので、キーごとの順序は保たれる
+// キューが埋まっている場合、Publishは空くまで待つ (件数などがずれないよう、イベントは捨てない)
+// ワーカーが動いていない間 (Start前とClose後) のPublishは、呼び出したgoroutineでその場で処理する
+// キューが埋まると待つので、購読者の中からPublishしないこと
+package eventbus
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	// ワーカーごとのキューの長さ
+	QueueSize int
+	// 1つのイベントの購読者に渡すctxの期限。0の場合は期限なし
+	HandlerTimeout time.Duration
+	// 購読者がエラーを返した場合に呼ぶ
+	OnError func(topic string, subscriber string, err error)
+}
+
+// Bus は、複数のgoroutineから使える
+type Bus struct {
+	options Options
+
+	// キューへの送信中は読み取りロックを持ち、Closeが送信中のキューを閉じないようにする
+	mu     sync.RWMutex
+	queues []chan func()
+	wg     sync.WaitGroup
+}
+
+// New は、ワーカーが動いていないBusを作る
+func New(options Options) *Bus {
+	return &Bus{options: options}
+}
+
+// Start は、workers個のワーカーを起動する (1未満の場合は1)。Closeするまでは2回呼ばないこと
+func (b *Bus) Start(workers int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queues = make([]chan func(), max(workers, 1))
+	for i := range b.queues {
+		queue := make(chan func(), b.options.QueueSize)
+		b.queues[i] = queue
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			for f := range queue {
+				f()
+			}
+		}()
+	}
+}
+
+// dispatch は、keyのワーカーでfを実行する。ワーカーが動いていなければその場で実行する
+func (b *Bus) dispatch(key int64, f func()) {
+	b.mu.RLock()
+	if len(b.queues) == 0 {
+		b.mu.RUnlock()
+		f()
+		return
+	}
+	b.queues[uint64(key)%uint64(len(b.queues))] <- f
+	b.mu.RUnlock()
+}
+
+func (b *Bus) reportError(topic string, subscriber string, err error) {
+	if b.options.OnError != nil {
+		b.options.OnError(topic, subscriber, err)
+	}
+}
+
+// Flush は、呼び出す前にPublishされたイベントがすべて処理されるまで待つ
+// 初期化の前などに、古いイベントが後から反映されないようにするために呼ぶ
+func (b *Bus) Flush(ctx context.Context) error {
+	b.mu.RLock()
+	queues := b.queues
+	done := make(chan struct{}, len(queues))
+	for _, queue := range queues {
+		select {
+		case queue <- func() { done <- struct{}{} }:
+		case <-ctx.Done():
+			b.mu.RUnlock()
+			return ctx.Err()
+		}
+	}
+	b.mu.RUnlock()
+	for range queues {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Close は、ワーカーを止める。キューに残っているイベントは処理してから止める
+// ctxが終わった場合はワーカーを待たずに返る
+func (b *Bus) Close(ctx context.Context) error {
+	b.mu.Lock()
+	for _, queue := range b.queues {
+		close(queue)
+	}
+	b.queues = nil
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Topic は、1つのイベントの型の購読者
+type Topic[E any] struct {
+	bus  *Bus
+	name string
+
+	mu          sync.RWMutex
+	subscribers []subscriber[E]
+}
+
+type subscriber[E any] struct {
+	name   string
+	handle func(ctx context.Context, event E) error
+}
+
+// NewTopic は、busで配るTopicを作る。nameはエラーの報告に使う
+func NewTopic[E any](bus *Bus, name string) *Topic[E] {
+	return &Topic[E]{bus: bus, name: name}
+}
+
+// Subscribe は、購読者を登録する。Publishより前に登録すること
+func (t *Topic[E]) Subscribe(name string, handle func(ctx context.Context, event E) error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.subscribers = append(t.subscribers, subscriber[E]{name: name, handle: handle})
+}
+
+// Publish は、eventを購読者に配る。keyが同じイベントは、Publishした順に処理される
+func (t *Topic[E]) Publish(key int64, event E) {
+	t.mu.RLock()
+	subscribers := t.subscribers
+	t.mu.RUnlock()
+	if len(subscribers) == 0 {
+		return
+	}
+	t.bus.dispatch(key, func() {
+		ctx := context.Background()
+		if timeout := t.bus.options.HandlerTimeout; timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		for _, s := range subscribers {
+			if err := s.handle(ctx, event); err != nil {
+				t.bus.reportError(t.name, s.name, err)
+			}
+		}
+	})
+}
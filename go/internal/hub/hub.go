@@ -0,0 +1,368 @@
+// Package hub は、アプリサーバのメモリ上のトピック (配信ごとの部屋など) ごとのpub/sub
+//
+// Publishは受信側を待たない。受信側のバッファが埋まっている場合、そのイベントはその購読には届かない (落とす)
+// 落としたイベントがDropLimitを超えた購読は閉じて以降の配信を止める (SSEなどでは、接続を切ってクライアントに再接続させる)
+// ReplaySizeを指定すると、トピックごとに直近のイベントを貯めておき、SubscribeAfterで再接続時に途切れなく送り直せる
+// 貯めるのは購読がある間と、最後の購読が閉じてからReplayTTLの間だけ (過ぎた分はReapで消す)
+// 受信側は、相手が生きていることを確かめるたびにTouchを呼ぶ。Reapで、しばらくTouchされていない購読を閉じる
+// 送った・落とした・閉じた数は購読のあるトピックごとに数えていて、Newで作ったHubの分をAllStatsでまとめて取れる
+// 購読がなくなったトピックの数は消す
+// 同じアプリサーバで購読したものにしか届かないので、複数台で受け付ける場合は振り分けに注意すること
+package hub
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Options struct {
+	// AllStatsで表示する名前
+	Name string
+	// 購読ごとに貯められるイベントの数
+	BufferSize int
+	// 購読ごとに落としてよいイベントの数。0の場合は、1件でも落としたら閉じる
+	// 取りこぼすと困るもの (ライブコメントなど) は0にして、再接続時に取り直させる
+	// 最新の値だけ分かればよいもの (視聴者数など) は大きくしてよい
+	DropLimit int
+	// トピックごとに貯めておく直近のイベントの数。0の場合は貯めない
+	ReplaySize int
+	// 最後の購読が閉じてから貯めたイベントを残しておく時間。再接続までの間に送ったものを送り直せるようにする
+	// 0の場合は、購読がなくなったらすぐに消す
+	ReplayTTL time.Duration
+}
+
+// Hub は、複数のgoroutineから使える
+type Hub[K comparable, E any] struct {
+	options Options
+
+	mu   sync.Mutex
+	subs map[K]map[*Subscription[K, E]]struct{}
+	// 購読のあるトピックの配信状況
+	rooms map[K]*RoomStats
+	// ReplaySizeが0の場合はnil
+	replays map[K]*ring[E]
+}
+
+// ring は、直近のcap(events)件のイベントを古い順に持つ
+type ring[E any] struct {
+	events []E
+	// 次に書き込む位置。埋まるまではlen(events)と同じ
+	next int
+	// 最後の購読が閉じた時刻のUnixNano。購読がある間は0
+	idleSince int64
+}
+
+func (r *ring[E]) push(event E) {
+	if len(r.events) < cap(r.events) {
+		r.events = append(r.events, event)
+		return
+	}
+	r.events[r.next] = event
+	r.next = (r.next + 1) % len(r.events)
+}
+
+// snapshot は、古い順に並べたコピーを返す
+func (r *ring[E]) snapshot() []E {
+	events := make([]E, 0, len(r.events))
+	events = append(events, r.events[r.next:]...)
+	return append(events, r.events[:r.next]...)
+}
+
+// Subscription は、1つのトピックの購読
+type Subscription[K comparable, E any] struct {
+	hub *Hub[K, E]
+	key K
+	ch  chan E
+	// 最後にTouchした (または購読した) 時刻のUnixNano
+	lastSeen atomic.Int64
+	// 以下はhub.muで守る
+	dropped int
+	closed  bool
+	kicked  bool
+}
+
+// RoomStats は、1つのトピックの配信状況
+// Delivered・Droppedは購読ごとに数える (購読が3つあるトピックに1件送ると、合わせて3増える)
+type RoomStats struct {
+	Key         string `json:"key"`
+	Subscribers int    `json:"subscribers"`
+	Published   uint64 `json:"published"`
+	Delivered   uint64 `json:"delivered"`
+	Dropped     uint64 `json:"dropped"`
+	Kicked      uint64 `json:"kicked"`
+	Reaped      uint64 `json:"reaped"`
+}
+
+// Stats は、Hubの配信状況。Roomsは落とした数の多い順
+type Stats struct {
+	Name        string      `json:"name"`
+	Subscribers int         `json:"subscribers"`
+	Published   uint64      `json:"published"`
+	Delivered   uint64      `json:"delivered"`
+	Dropped     uint64      `json:"dropped"`
+	Kicked      uint64      `json:"kicked"`
+	Reaped      uint64      `json:"reaped"`
+	Rooms       []RoomStats `json:"rooms"`
+}
+
+type registered interface {
+	Stats() Stats
+	Reap(idle time.Duration) int
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []registered
+)
+
+// New は、Hubを作ってAllStatsの対象に加える
+func New[K comparable, E any](options Options) *Hub[K, E] {
+	h := &Hub[K, E]{
+		options: options,
+		subs:    map[K]map[*Subscription[K, E]]struct{}{},
+		rooms:   map[K]*RoomStats{},
+	}
+	if options.ReplaySize > 0 {
+		h.replays = map[K]*ring[E]{}
+	}
+	registryMu.Lock()
+	registry = append(registry, h)
+	registryMu.Unlock()
+	return h
+}
+
+// AllStats は、Newで作ったすべてのHubの配信状況を名前順に返す
+func AllStats() []Stats {
+	registryMu.Lock()
+	hubs := append([]registered(nil), registry...)
+	registryMu.Unlock()
+	stats := make([]Stats, len(hubs))
+	for i, h := range hubs {
+		stats[i] = h.Stats()
+	}
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// ReapAll は、Newで作ったすべてのHubでReapし、閉じた購読の数を返す
+func ReapAll(idle time.Duration) int {
+	registryMu.Lock()
+	hubs := append([]registered(nil), registry...)
+	registryMu.Unlock()
+	n := 0
+	for _, h := range hubs {
+		n += h.Reap(idle)
+	}
+	return n
+}
+
+// Stats は、このHubの配信状況を返す
+func (h *Hub[K, E]) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := Stats{Name: h.options.Name, Rooms: make([]RoomStats, 0, len(h.rooms))}
+	for key, room := range h.rooms {
+		r := *room
+		r.Subscribers = len(h.subs[key])
+		stats.Subscribers += r.Subscribers
+		stats.Published += r.Published
+		stats.Delivered += r.Delivered
+		stats.Dropped += r.Dropped
+		stats.Kicked += r.Kicked
+		stats.Reaped += r.Reaped
+		stats.Rooms = append(stats.Rooms, r)
+	}
+	sort.Slice(stats.Rooms, func(i, j int) bool {
+		if stats.Rooms[i].Dropped != stats.Rooms[j].Dropped {
+			return stats.Rooms[i].Dropped > stats.Rooms[j].Dropped
+		}
+		return stats.Rooms[i].Key < stats.Rooms[j].Key
+	})
+	return stats
+}
+
+// Subscribe は、keyのトピックを購読する。使い終わったらCloseを呼ぶこと
+func (h *Hub[K, E]) Subscribe(key K) *Subscription[K, E] {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.subscribeLocked(key)
+}
+
+// SubscribeAfter は、keyのトピックを購読し、貯めてあるイベントのうちisLastがtrueを返す最後のイベントより後のものを古い順に返す
+// 返したイベントと購読で届くイベントの間に抜けや重なりはない
+// isLastに当たるイベントがない (追い出された・このサーバで送っていない・購読がないまま消えた・ReplaySizeが0) 場合はokがfalseで、購読だけする
+func (h *Hub[K, E]) SubscribeAfter(key K, isLast func(E) bool) (s *Subscription[K, E], replay []E, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s = h.subscribeLocked(key)
+	r := h.replays[key]
+	if r == nil {
+		return s, nil, false
+	}
+	events := r.snapshot()
+	for i := len(events) - 1; i >= 0; i-- {
+		if isLast(events[i]) {
+			return s, events[i+1:], true
+		}
+	}
+	return s, nil, false
+}
+
+func (h *Hub[K, E]) subscribeLocked(key K) *Subscription[K, E] {
+	s := &Subscription[K, E]{hub: h, key: key, ch: make(chan E, h.options.BufferSize)}
+	s.Touch()
+	if h.subs[key] == nil {
+		h.subs[key] = map[*Subscription[K, E]]struct{}{}
+	}
+	h.subs[key][s] = struct{}{}
+	if h.rooms[key] == nil {
+		h.rooms[key] = &RoomStats{Key: fmt.Sprint(key)}
+	}
+	if h.replays != nil {
+		if r := h.replays[key]; r != nil {
+			r.idleSince = 0
+		} else {
+			h.replays[key] = &ring[E]{events: make([]E, 0, h.options.ReplaySize)}
+		}
+	}
+	return s
+}
+
+// Publish は、keyのトピックの購読すべてにeventを送る
+// 購読のないトピックには、最後の購読が閉じてからReplayTTLの間だけ貯める
+func (h *Hub[K, E]) Publish(key K, event E) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if r := h.replays[key]; r != nil {
+		r.push(event)
+	}
+	subs := h.subs[key]
+	if len(subs) == 0 {
+		return
+	}
+	room := h.rooms[key]
+	room.Published++
+	for s := range subs {
+		select {
+		case s.ch <- event:
+			room.Delivered++
+		default:
+			room.Dropped++
+			s.dropped++
+			if s.dropped > h.options.DropLimit {
+				room.Kicked++
+				s.kicked = true
+				h.closeLocked(s)
+			}
+		}
+	}
+}
+
+// CloseTopic は、keyのトピックの購読をすべて閉じて貯めてあるイベントを消す。トピックの対象が削除された場合に呼ぶ
+func (h *Hub[K, E]) CloseTopic(key K) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs[key] {
+		h.closeLocked(s)
+	}
+	if h.replays != nil {
+		delete(h.replays, key)
+	}
+}
+
+// CloseAll は、すべての購読を閉じて貯めてあるイベントを消す。初期化時やサーバの終了時に呼ぶ
+func (h *Hub[K, E]) CloseAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, subs := range h.subs {
+		for s := range subs {
+			h.closeLocked(s)
+		}
+	}
+	if h.replays != nil {
+		clear(h.replays)
+	}
+}
+
+// Reap は、idleより長くTouchされていない購読を閉じ、その数を返す
+// 受信側のgoroutineが書き込みなどで止まったままでも、購読は片付く
+// 購読がなくなってからReplayTTLを過ぎたトピックの貯めたイベントも消す
+func (h *Hub[K, E]) Reap(idle time.Duration) int {
+	now := time.Now()
+	deadline := now.Add(-idle).UnixNano()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, subs := range h.subs {
+		for s := range subs {
+			if s.lastSeen.Load() < deadline {
+				h.rooms[s.key].Reaped++
+				h.closeLocked(s)
+				n++
+			}
+		}
+	}
+	replayDeadline := now.Add(-h.options.ReplayTTL).UnixNano()
+	for key, r := range h.replays {
+		if r.idleSince != 0 && r.idleSince < replayDeadline {
+			delete(h.replays, key)
+		}
+	}
+	return n
+}
+
+// Subscribers は、keyのトピックの購読の数を返す。送る値を作るのが重い場合に、購読がなければ省くのに使う
+func (h *Hub[K, E]) Subscribers(key K) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs[key])
+}
+
+func (h *Hub[K, E]) closeLocked(s *Subscription[K, E]) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.ch)
+	delete(h.subs[s.key], s)
+	if len(h.subs[s.key]) > 0 {
+		return
+	}
+	delete(h.subs, s.key)
+	delete(h.rooms, s.key)
+	if r := h.replays[s.key]; r != nil {
+		if h.options.ReplayTTL > 0 {
+			r.idleSince = time.Now().UnixNano()
+		} else {
+			delete(h.replays, s.key)
+		}
+	}
+}
+
+// Events は、イベントを受け取るチャネルを返す
+// 購読が閉じられると (DropLimitを超えて落とした場合を含む) チャネルも閉じられる
+func (s *Subscription[K, E]) Events() <-chan E {
+	return s.ch
+}
+
+// Touch は、受信側が生きていることを確かめたときに呼ぶ。ロックを取らないので、送るたびに呼んでよい
+func (s *Subscription[K, E]) Touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// Kicked は、DropLimitを超えて落としたために閉じられた場合にtrueを返す
+func (s *Subscription[K, E]) Kicked() bool {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.kicked
+}
+
+// Close は、購読をやめる。何度呼んでもよい
+func (s *Subscription[K, E]) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.closeLocked(s)
+}
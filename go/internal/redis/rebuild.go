@@ -0,0 +1,276 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// 集計値のキーを作り直す間に届いた加算を取りこぼさないための仕組み
+//
+// 作り直す側は、BeginRebuildで作り直しごとの保留ハッシュを登録集合に加えてから集計を始め、
+// 一時キーに書き込んだあと、保留ハッシュに溜まった加算のうち集計に含まれていないものを一時キーに足し、
+// Commitで新しい加算が届いていなければ一時キーをRENAMEする
+// 加算する側は、IncrRecordingでキーがあれば加算し、登録中のすべての保留ハッシュにも記録する
+//
+// 一時キー・保留ハッシュは作り直しごとに別の名前にするので、複数台で同時に作り直しても混ざらない
+// 登録集合を消すと、実行中の作り直しはCommitでErrRebuildCancelledになり、一時キーは捨てられる
+
+// ErrRebuildCancelled は、作り直しの間に登録集合が消され、結果が古い可能性があることを表す
+var ErrRebuildCancelled = errors.New("redis: rebuild cancelled")
+
+// Incr は、IncrRecordingでの1つの加算
+type Incr struct {
+	Key    string
+	Member string
+	Delta  int64
+	// trueの場合はハッシュのfield、falseの場合はソート済み集合のmemberに足す
+	Hash bool
+}
+
+var (
+	// KEYS: 登録集合, 加算するキー...
+	// ARGV: 記録のID, 記録の内容, 保留ハッシュの有効期限 (秒), (種類, メンバー, 差分)...
+	incrRecording = goredis.NewScript(`
+for i = 2, #KEYS do
+	local base = 3 + (i - 2) * 3
+	if redis.call('EXISTS', KEYS[i]) == 1 then
+		if ARGV[base + 1] == 'h' then
+			redis.call('HINCRBY', KEYS[i], ARGV[base + 2], ARGV[base + 3])
+		else
+			redis.call('ZINCRBY', KEYS[i], ARGV[base + 3], ARGV[base + 2])
+		end
+	end
+end
+for _, pending in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+	redis.call('HSET', pending, ARGV[1], ARGV[2])
+	redis.call('EXPIRE', pending, ARGV[3])
+end
+return 0`)
+	// KEYS: 登録集合, 保留ハッシュ, (一時キー, キー)...
+	// ARGV: 反映済みの記録の件数
+	// 取り消されていれば-1、新しい記録が届いていれば0、置き換えたら1を返す
+	commitRebuild = goredis.NewScript(`
+if redis.call('SISMEMBER', KEYS[1], KEYS[2]) == 0 then
+	redis.call('DEL', KEYS[2])
+	for i = 3, #KEYS, 2 do
+		redis.call('DEL', KEYS[i])
+	end
+	return -1
+end
+if redis.call('HLEN', KEYS[2]) ~= tonumber(ARGV[1]) then
+	return 0
+end
+for i = 3, #KEYS, 2 do
+	if redis.call('EXISTS', KEYS[i]) == 1 then
+		redis.call('RENAME', KEYS[i], KEYS[i + 1])
+		redis.call('PERSIST', KEYS[i + 1])
+	else
+		redis.call('DEL', KEYS[i + 1])
+	end
+end
+redis.call('SREM', KEYS[1], KEYS[2])
+redis.call('DEL', KEYS[2])
+return 1`)
+)
+
+// IncrRecording は、キーがあるものだけincrsを加算し、作り直し中であればentryIDでentryを記録する
+// キーがない場合に一部のメンバーだけのキーができないよう、加算はキーがある場合に限る
+func (c *Client) IncrRecording(ctx context.Context, set string, entryID string, entry string, ttl time.Duration, incrs []Incr) error {
+	keys := make([]string, 0, 1+len(incrs))
+	keys = append(keys, set)
+	args := make([]interface{}, 0, 3+3*len(incrs))
+	args = append(args, entryID, entry, int64(ttl/time.Second))
+	for _, incr := range incrs {
+		keys = append(keys, incr.Key)
+		kind := "z"
+		if incr.Hash {
+			kind = "h"
+		}
+		args = append(args, kind, incr.Member, incr.Delta)
+	}
+	return c.do(ctx, func(rdb *goredis.Client) error {
+		return incrRecording.Run(ctx, rdb, keys, args...).Err()
+	})
+}
+
+// Rebuild は、1回の作り直し。複数のgoroutineから使わないこと
+type Rebuild struct {
+	c       *Client
+	set     string
+	pending string
+	tmps    map[string]string
+	keys    []string
+	applied map[string]struct{}
+}
+
+// BeginRebuild は、keysの作り直しを始める。集計はこのあとに始めること
+// 保留ハッシュはttl、一時キーは1分で消えるので、途中で落ちても残り続けない
+func (c *Client) BeginRebuild(ctx context.Context, set string, keys []string, ttl time.Duration) (*Rebuild, error) {
+	id := uuid.NewString()
+	r := &Rebuild{
+		c:       c,
+		set:     set,
+		pending: set + ":" + id,
+		tmps:    make(map[string]string, len(keys)),
+		keys:    keys,
+		applied: make(map[string]struct{}),
+	}
+	for _, key := range keys {
+		r.tmps[key] = key + ":rebuilding:" + id
+	}
+	if err := c.SAdd(ctx, set, r.pending, ttl); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Rebuild) tmp(key string) string {
+	if tmp, ok := r.tmps[key]; ok {
+		return tmp
+	}
+	panic("redis: rebuild of unregistered key " + key)
+}
+
+// WriteZSet は、keyの一時キーをscoresの内容にする
+func (r *Rebuild) WriteZSet(ctx context.Context, key string, scores map[string]int64) error {
+	tmp := r.tmp(key)
+	return r.c.do(ctx, func(rdb *goredis.Client) error {
+		members := make([]goredis.Z, 0, replaceBatchSize)
+		flush := func() error {
+			if len(members) == 0 {
+				return nil
+			}
+			err := rdb.ZAdd(ctx, tmp, members...).Err()
+			members = members[:0]
+			return err
+		}
+		for member, score := range scores {
+			members = append(members, goredis.Z{Score: float64(score), Member: member})
+			if len(members) >= replaceBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		return rdb.Expire(ctx, tmp, time.Minute).Err()
+	})
+}
+
+// WriteHash は、keyの一時キーをvaluesの内容にする
+// valuesが空でもキーができるよう、空文字列のfieldを置く
+func (r *Rebuild) WriteHash(ctx context.Context, key string, values map[string]int64) error {
+	tmp := r.tmp(key)
+	return r.c.do(ctx, func(rdb *goredis.Client) error {
+		fields := make([]interface{}, 0, 2*replaceBatchSize+2)
+		fields = append(fields, "", 0)
+		flush := func() error {
+			if len(fields) == 0 {
+				return nil
+			}
+			err := rdb.HSet(ctx, tmp, fields...).Err()
+			fields = fields[:0]
+			return err
+		}
+		for field, value := range values {
+			fields = append(fields, field, value)
+			if len(fields) >= 2*replaceBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		return rdb.Expire(ctx, tmp, time.Minute).Err()
+	})
+}
+
+// ZIncrBy は、keyの一時キーのmemberにdeltaを足す
+func (r *Rebuild) ZIncrBy(ctx context.Context, key string, member string, delta int64) error {
+	tmp := r.tmp(key)
+	return r.c.do(ctx, func(rdb *goredis.Client) error {
+		return rdb.ZIncrBy(ctx, tmp, float64(delta), member).Err()
+	})
+}
+
+// HIncrBy は、keyの一時キーのfieldにdeltaを足す
+func (r *Rebuild) HIncrBy(ctx context.Context, key string, field string, delta int64) error {
+	tmp := r.tmp(key)
+	return r.c.do(ctx, func(rdb *goredis.Client) error {
+		return rdb.HIncrBy(ctx, tmp, field, delta).Err()
+	})
+}
+
+// Pending は、前回から新たに記録された加算を、記録のIDから内容へのmapで返す
+// 返した記録は反映済みとして数えるので、Commitの前に一時キーに足すこと
+func (r *Rebuild) Pending(ctx context.Context) (map[string]string, error) {
+	var all map[string]string
+	err := r.c.do(ctx, func(rdb *goredis.Client) error {
+		var err error
+		all, err = rdb.HGetAll(ctx, r.pending).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]string)
+	for id, entry := range all {
+		if _, ok := r.applied[id]; ok {
+			continue
+		}
+		r.applied[id] = struct{}{}
+		entries[id] = entry
+	}
+	return entries, nil
+}
+
+// Commit は、Pendingのあとに新しい加算が届いていなければ、一時キーでキーを置き換えてtrueを返す
+// 届いていればfalseを返すので、もう一度Pendingから反映すること
+func (r *Rebuild) Commit(ctx context.Context) (bool, error) {
+	keys := make([]string, 0, 2+2*len(r.keys))
+	keys = append(keys, r.set, r.pending)
+	for _, key := range r.keys {
+		keys = append(keys, r.tmps[key], key)
+	}
+	var result int64
+	err := r.c.do(ctx, func(rdb *goredis.Client) error {
+		var err error
+		result, err = commitRebuild.Run(ctx, rdb, keys, len(r.applied)).Int64()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	switch result {
+	case -1:
+		return false, ErrRebuildCancelled
+	case 0:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Abort は、作り直しをやめ、一時キーと保留ハッシュを消す
+func (r *Rebuild) Abort(ctx context.Context) error {
+	keys := make([]string, 0, 1+len(r.keys))
+	keys = append(keys, r.pending)
+	for _, key := range r.keys {
+		keys = append(keys, r.tmps[key])
+	}
+	return r.c.do(ctx, func(rdb *goredis.Client) error {
+		_, err := rdb.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+			pipe.SRem(ctx, r.set, r.pending)
+			pipe.Del(ctx, keys...)
+			return nil
+		})
+		return err
+	})
+}
@@ -0,0 +1,332 @@
+// Package redis は、複数台のアプリサーバで共有する状態をRedisに置くための薄いラッパー
+//
+// Redisは任意で、正となるデータは常にMySQLにある。Redisに繋がらない場合はErrUnavailableを返すので、
+// 呼び出し元はMySQLから読むなどして処理を続けること
+// 一度失敗すると、downBackoffの間はRedisに問い合わせずにErrUnavailableを返す
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+const (
+	// 落ちている間にリクエストごとに待たされないよう、短めにする
+	dialTimeout = 200 * time.Millisecond
+	ioTimeout   = 200 * time.Millisecond
+	downBackoff = 5 * time.Second
+	// Rebuildで一時キーに一度に送るメンバー数
+	replaceBatchSize = 1000
+)
+
+// ErrUnavailable は、Redisが設定されていないか、繋がらないことを表す
+var ErrUnavailable = errors.New("redis is unavailable")
+
+// Client は、nilでも使え、その場合は常にErrUnavailableを返す
+type Client struct {
+	rdb *goredis.Client
+
+	mu        sync.Mutex
+	downUntil time.Time
+	down      bool
+}
+
+// New は、redis://形式のURLのRedisに繋ぐClientを返す
+// 接続はリクエスト時に行うので、Redisが起動していなくてもエラーにはならない
+func New(url string) (*Client, error) {
+	opts, err := goredis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse redis url: %w", err)
+	}
+	opts.DialTimeout = dialTimeout
+	opts.ReadTimeout = ioTimeout
+	opts.WriteTimeout = ioTimeout
+	opts.MaxRetries = -1
+	return &Client{rdb: goredis.NewClient(opts)}, nil
+}
+
+// Close は、接続を閉じる。終了時に呼ぶ
+func (c *Client) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.rdb.Close()
+}
+
+// Available は、Redisに問い合わせてよい状態かを返す
+func (c *Client) Available() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !time.Now().Before(c.downUntil)
+}
+
+// do は、fの結果から、Redisが落ちているかを判定する
+// 値がないこと (goredis.Nil)、エラー応答、呼び出し元のキャンセルは落ちているとはみなさない
+func (c *Client) do(ctx context.Context, f func(rdb *goredis.Client) error) error {
+	if !c.Available() {
+		return ErrUnavailable
+	}
+	err := f(c.rdb)
+	var replyErr goredis.Error
+	if err == nil || errors.Is(err, goredis.Nil) || ctx.Err() != nil || errors.As(err, &replyErr) {
+		// Redisからのエラー応答は、繋がってはいる
+		c.markUp()
+		return err
+	}
+	c.markDown(err)
+	return fmt.Errorf("%w: %s", ErrUnavailable, err)
+}
+
+func (c *Client) markUp() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down {
+		c.down = false
+		log.Printf("redis is available again")
+	}
+}
+
+func (c *Client) markDown(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.downUntil = time.Now().Add(downBackoff)
+	if !c.down {
+		c.down = true
+		log.Printf("redis is unavailable, falling back to MySQL: %v", err)
+	}
+}
+
+// Get は、keyの値を返す。keyがない場合はfalseを返す
+func (c *Client) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	var value []byte
+	err := c.do(ctx, func(rdb *goredis.Client) error {
+		var err error
+		value, err = rdb.Get(ctx, key).Bytes()
+		return err
+	})
+	if errors.Is(err, goredis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Set は、ttlが0の場合は期限なしで保存する
+func (c *Client) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.do(ctx, func(rdb *goredis.Client) error {
+		return rdb.Set(ctx, key, value, ttl).Err()
+	})
+}
+
+func (c *Client) Del(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.do(ctx, func(rdb *goredis.Client) error {
+		return rdb.Del(ctx, keys...).Err()
+	})
+}
+
+// SAdd は、集合にmemberを加え、集合の有効期限をttlに延ばす
+func (c *Client) SAdd(ctx context.Context, key string, member string, ttl time.Duration) error {
+	return c.do(ctx, func(rdb *goredis.Client) error {
+		_, err := rdb.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+			pipe.SAdd(ctx, key, member)
+			pipe.Expire(ctx, key, ttl)
+			return nil
+		})
+		return err
+	})
+}
+
+func (c *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	var members []string
+	err := c.do(ctx, func(rdb *goredis.Client) error {
+		var err error
+		members, err = rdb.SMembers(ctx, key).Result()
+		return err
+	})
+	return members, err
+}
+
+// DeletePrefix は、prefixで始まるキーをすべて消す
+func (c *Client) DeletePrefix(ctx context.Context, prefix string) error {
+	return c.do(ctx, func(rdb *goredis.Client) error {
+		iter := rdb.Scan(ctx, 0, prefix+"*", replaceBatchSize).Iterator()
+		var keys []string
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+			if len(keys) >= replaceBatchSize {
+				if err := rdb.Del(ctx, keys...).Err(); err != nil {
+					return err
+				}
+				keys = keys[:0]
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			return rdb.Del(ctx, keys...).Err()
+		}
+		return nil
+	})
+}
+
+// キーがなければ-2、メンバーがなければ-1を返す
+var zrevrankIfExists = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -2
+end
+local rank = redis.call('ZREVRANK', KEYS[1], ARGV[1])
+if rank == false then
+	return -1
+end
+return rank`)
+
+// ZRevRank は、スコアの大きい順でのmemberの順位 (0始まり) を返す
+// 同点の場合はmemberの辞書順で後ろのものが上位になる
+// ソート済み集合がなければkeyExistsがfalse、memberがなければfoundがfalseになる
+func (c *Client) ZRevRank(ctx context.Context, key string, member string) (rank int64, keyExists bool, found bool, err error) {
+	err = c.do(ctx, func(rdb *goredis.Client) error {
+		var err error
+		rank, err = zrevrankIfExists.Run(ctx, rdb, []string{key}, member).Int64()
+		return err
+	})
+	if err != nil {
+		return 0, false, false, err
+	}
+	switch rank {
+	case -2:
+		return 0, false, false, nil
+	case -1:
+		return 0, true, false, nil
+	}
+	return rank, true, true, nil
+}
+
+func (c *Client) ZRem(ctx context.Context, key string, member string) error {
+	return c.do(ctx, func(rdb *goredis.Client) error {
+		return rdb.ZRem(ctx, key, member).Err()
+	})
+}
+
+// HGetInts は、ハッシュのfieldsの値を返す。ハッシュにないfieldは0になる
+// ハッシュがなければkeyExistsがfalseになる
+func (c *Client) HGetInts(ctx context.Context, key string, fields []string) (values map[string]int64, keyExists bool, err error) {
+	var exists int64
+	var raw []interface{}
+	err = c.do(ctx, func(rdb *goredis.Client) error {
+		pipe := rdb.Pipeline()
+		existsCmd := pipe.Exists(ctx, key)
+		var getCmd *goredis.SliceCmd
+		if len(fields) > 0 {
+			getCmd = pipe.HMGet(ctx, key, fields...)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		exists = existsCmd.Val()
+		if getCmd != nil {
+			raw = getCmd.Val()
+		}
+		return nil
+	})
+	if err != nil || exists == 0 {
+		return nil, false, err
+	}
+	values = make(map[string]int64, len(fields))
+	for i, field := range fields {
+		s, ok := raw[i].(string)
+		if !ok {
+			values[field] = 0
+			continue
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, false, err
+		}
+		values[field] = v
+	}
+	return values, true, nil
+}
+
+// StreamMessage は、ストリームの1件
+type StreamMessage struct {
+	ID     string
+	Values map[string]string
+}
+
+// XAdd は、ストリームにvaluesを追加し、そのIDを返す。ストリームはおよそmaxLen件に切り詰める
+func (c *Client) XAdd(ctx context.Context, stream string, maxLen int64, values map[string]string) (string, error) {
+	var id string
+	err := c.do(ctx, func(rdb *goredis.Client) error {
+		var err error
+		id, err = rdb.XAdd(ctx, &goredis.XAddArgs{
+			Stream: stream,
+			MaxLen: maxLen,
+			Approx: true,
+			Values: values,
+		}).Result()
+		return err
+	})
+	return id, err
+}
+
+// XLastID は、ストリームの最後のIDを返す。ストリームが空かなければ"0-0"を返す
+// XReadに渡すと、これより後に追加されたものから読める
+func (c *Client) XLastID(ctx context.Context, stream string) (string, error) {
+	id := "0-0"
+	err := c.do(ctx, func(rdb *goredis.Client) error {
+		messages, err := rdb.XRevRangeN(ctx, stream, "+", "-", 1).Result()
+		if err != nil {
+			return err
+		}
+		if len(messages) > 0 {
+			id = messages[0].ID
+		}
+		return nil
+	})
+	return id, err
+}
+
+// XRead は、ストリームのafterより後のものを最大count件返す。なければblockの間待ち、それでもなければ空を返す
+func (c *Client) XRead(ctx context.Context, stream string, after string, count int64, block time.Duration) ([]StreamMessage, error) {
+	var messages []StreamMessage
+	err := c.do(ctx, func(rdb *goredis.Client) error {
+		streams, err := rdb.XRead(ctx, &goredis.XReadArgs{
+			Streams: []string{stream, after},
+			Count:   count,
+			Block:   block,
+		}).Result()
+		if err != nil {
+			return err
+		}
+		for _, s := range streams {
+			for _, m := range s.Messages {
+				values := make(map[string]string, len(m.Values))
+				for k, v := range m.Values {
+					values[k] = fmt.Sprint(v)
+				}
+				messages = append(messages, StreamMessage{ID: m.ID, Values: values})
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, goredis.Nil) {
+		return nil, nil
+	}
+	return messages, err
+}
@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+)
+
+type LivecommentModel struct {
+	ID           int64         `db:"id"`
+	UserID       int64         `db:"user_id"`
+	LivestreamID int64         `db:"livestream_id"`
+	Comment      string        `db:"comment"`
+	Tip          int64         `db:"tip"`
+	ParentID     sql.NullInt64 `db:"parent_id"`
+	CreatedAt    int64         `db:"created_at"`
+}
+
+// LivecommentRepo は、livecommentsテーブルを読み書きする
+type LivecommentRepo struct{}
+
+func (LivecommentRepo) FindByID(ctx context.Context, db Queryer, id int64) (LivecommentModel, error) {
+	var livecomment LivecommentModel
+	err := db.GetContext(ctx, &livecomment, "SELECT * FROM livecomments WHERE id = ?", id)
+	return livecomment, err
+}
+
+// FindByIDs は、順不同で返す
+func (LivecommentRepo) FindByIDs(ctx context.Context, db Queryer, ids []int64) ([]LivecommentModel, error) {
+	return selectIn[LivecommentModel](ctx, db, "SELECT * FROM livecomments WHERE id IN (?)", ids)
+}
+
+// FindLivestreamID は、ライブコメントが投稿された配信のIDだけを返す
+func (LivecommentRepo) FindLivestreamID(ctx context.Context, db Queryer, id int64) (int64, error) {
+	var livestreamID int64
+	err := db.GetContext(ctx, &livestreamID, "SELECT livestream_id FROM livecomments WHERE id = ?", id)
+	return livestreamID, err
+}
+
+// CountRepliesByParentIDs は、返信先ごとの返信数を返す。返信のないライブコメントは含まない
+func (LivecommentRepo) CountRepliesByParentIDs(ctx context.Context, db Queryer, parentIDs []int64) (map[int64]int64, error) {
+	type countRow struct {
+		ParentID int64 `db:"parent_id"`
+		Count    int64 `db:"count"`
+	}
+	rows, err := selectIn[countRow](ctx, db, "SELECT parent_id, COUNT(*) AS count FROM livecomments WHERE parent_id IN (?) GROUP BY parent_id", parentIDs)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		counts[row.ParentID] = row.Count
+	}
+	return counts, nil
+}
+
+// Insert は、livecomment.IDを採番済みのIDとして登録する
+func (LivecommentRepo) Insert(ctx context.Context, db Execer, livecomment LivecommentModel) error {
+	_, err := db.NamedExecContext(ctx, "INSERT INTO livecomments (id, user_id, livestream_id, comment, tip, parent_id, created_at) VALUES (:id, :user_id, :livestream_id, :comment, :tip, :parent_id, :created_at)", livecomment)
+	return err
+}
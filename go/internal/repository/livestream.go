@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type LivestreamModel struct {
+	ID           int64  `db:"id" json:"id"`
+	UserID       int64  `db:"user_id" json:"user_id"`
+	Title        string `db:"title" json:"title"`
+	Description  string `db:"description" json:"description"`
+	PlaylistUrl  string `db:"playlist_url" json:"playlist_url"`
+	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
+	StartAt      int64  `db:"start_at" json:"start_at"`
+	EndAt        int64  `db:"end_at" json:"end_at"`
+	Status       string `db:"status" json:"status"`
+	Language     string `db:"language" json:"language"`
+	Category     string `db:"category" json:"category"`
+}
+
+// LivestreamRepo は、livestreamsテーブルを読み書きする
+type LivestreamRepo struct{}
+
+func (LivestreamRepo) FindByID(ctx context.Context, db Queryer, id int64) (LivestreamModel, error) {
+	var livestream LivestreamModel
+	err := db.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ?", id)
+	return livestream, err
+}
+
+// FindByIDForUpdate は、txが終わるまで行をロックする
+func (LivestreamRepo) FindByIDForUpdate(ctx context.Context, tx *sqlx.Tx, id int64) (LivestreamModel, error) {
+	var livestream LivestreamModel
+	err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", id)
+	return livestream, err
+}
+
+// FindByIDs は、順不同で返す
+func (LivestreamRepo) FindByIDs(ctx context.Context, db Queryer, ids []int64) ([]LivestreamModel, error) {
+	return selectIn[LivestreamModel](ctx, db, "SELECT * FROM livestreams WHERE id IN (?)", ids)
+}
+
+// ListByUserID は、ユーザが配信者の配信を順不同で返す
+func (LivestreamRepo) ListByUserID(ctx context.Context, db Queryer, userID int64) ([]LivestreamModel, error) {
+	var livestreams []LivestreamModel
+	if err := db.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	return livestreams, nil
+}
+
+// CountViewersByIDs は、配信ごとの視聴者数を返す。視聴者のいない配信は含まない
+func (LivestreamRepo) CountViewersByIDs(ctx context.Context, db Queryer, ids []int64) (map[int64]int64, error) {
+	return countIn(ctx, db, "SELECT livestream_id, COUNT(*) AS count FROM livestream_viewers_history WHERE livestream_id IN (?) GROUP BY livestream_id", ids)
+}
+
+// CountReportsByIDs は、配信ごとのスパム報告数を返す。報告のない配信は含まない
+func (LivestreamRepo) CountReportsByIDs(ctx context.Context, db Queryer, ids []int64) (map[int64]int64, error) {
+	return countIn(ctx, db, "SELECT livestream_id, COUNT(*) AS count FROM livecomment_reports WHERE livestream_id IN (?) GROUP BY livestream_id", ids)
+}
+
+// Insert は、採番されたIDを返す
+func (LivestreamRepo) Insert(ctx context.Context, db Execer, livestream LivestreamModel) (int64, error) {
+	return insertID(db.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, status, language, category) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :status, :language, :category)", livestream))
+}
@@ -0,0 +1,222 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// クエリプランの確認
+// CheckQueryPlansは、このパッケージの参照メソッドを実際に呼び、発行されたクエリをEXPLAINに置き換えて実行する
+// 大きいテーブルを全件走査する (typeがALLかindex) クエリがあればエラーにする
+// クエリを書き換えたときにインデックスが効かなくなっても気付けるようにするためのもので、
+// オプティマイザは行数で計画を変えるので、初期データを入れたDBで呼ぶこと
+// 本番の初期化では呼ばず、planscheckタグ付きのテスト (TestQueryPlans) とcmd/checkplansから呼ぶ
+// FOR UPDATE付きのメソッドは、同じ条件のFOR UPDATEなしのメソッドで代用する
+
+// 全件走査を許さないテーブル
+var planCheckedTables = map[string]bool{
+	"users":        true,
+	"livestreams":  true,
+	"reactions":    true,
+	"livecomments": true,
+}
+
+// QueryPlan は、EXPLAINの結果の1行
+type QueryPlan struct {
+	Query string
+	Table string
+	Type  string
+	Key   string
+}
+
+// errExplained は、explainerがクエリを実行しなかったことを呼び出し元に伝える
+var errExplained = errors.New("repository: query was explained, not executed")
+
+// explainer は、クエリを実行する代わりにEXPLAINし、その結果をplansに貯めるQueryer
+type explainer struct {
+	db    Queryer
+	plans []QueryPlan
+	err   error
+}
+
+func (e *explainer) explain(ctx context.Context, query string, args ...interface{}) {
+	if e.err != nil {
+		return
+	}
+	rows, err := e.db.QueryxContext(ctx, "EXPLAIN "+query, args...)
+	if err != nil {
+		e.err = fmt.Errorf("failed to explain %q: %w", query, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			e.err = fmt.Errorf("failed to scan plan of %q: %w", query, err)
+			return
+		}
+		e.plans = append(e.plans, QueryPlan{
+			Query: query,
+			Table: planColumn(row, "table"),
+			Type:  planColumn(row, "type"),
+			Key:   planColumn(row, "key"),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		e.err = fmt.Errorf("failed to read plan of %q: %w", query, err)
+	}
+}
+
+func planColumn(row map[string]interface{}, name string) string {
+	switch v := row[name].(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return ""
+}
+
+func (e *explainer) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	e.explain(ctx, query, args...)
+	return errExplained
+}
+
+func (e *explainer) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	e.explain(ctx, query, args...)
+	return errExplained
+}
+
+func (e *explainer) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	e.explain(ctx, query, args...)
+	return nil, errExplained
+}
+
+func (e *explainer) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	e.explain(ctx, query, args...)
+	return nil, errExplained
+}
+
+// QueryRowxContext は、*sqlx.Rowにエラーを持たせられないので、EXPLAINの結果をそのまま返す
+func (e *explainer) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	e.explain(ctx, query, args...)
+	return e.db.QueryRowxContext(ctx, "EXPLAIN "+query, args...)
+}
+
+func (e *explainer) Rebind(query string) string {
+	return e.db.Rebind(query)
+}
+
+// planSamples は、EXPLAINに渡す実在する行の値
+type planSamples struct {
+	userID        int64
+	userName      string
+	livestreamID  int64
+	livecommentID int64
+}
+
+func loadPlanSamples(ctx context.Context, db Queryer) (planSamples, error) {
+	// 空のテーブルでもEXPLAINはできるので、行がなければ0や空文字のまま使う
+	var s planSamples
+	for _, q := range []struct {
+		dest  interface{}
+		query string
+	}{
+		{&s.userID, "SELECT id FROM users ORDER BY id LIMIT 1"},
+		{&s.userName, "SELECT name FROM users ORDER BY id LIMIT 1"},
+		{&s.livestreamID, "SELECT id FROM livestreams ORDER BY id LIMIT 1"},
+		{&s.livecommentID, "SELECT id FROM livecomments ORDER BY id LIMIT 1"},
+	} {
+		if err := db.GetContext(ctx, q.dest, q.query); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// planChecks は、確認する参照メソッドの呼び出し。参照メソッドを増やしたらここにも加える
+var planChecks = []func(ctx context.Context, db Queryer, s planSamples) error{
+	func(ctx context.Context, db Queryer, s planSamples) error {
+		_, err := UserRepo{}.FindByID(ctx, db, s.userID)
+		return err
+	},
+	func(ctx context.Context, db Queryer, s planSamples) error {
+		_, err := UserRepo{}.FindByName(ctx, db, s.userName)
+		return err
+	},
+	func(ctx context.Context, db Queryer, s planSamples) error {
+		_, err := UserRepo{}.FindByIDs(ctx, db, []int64{s.userID, s.userID + 1})
+		return err
+	},
+	func(ctx context.Context, db Queryer, s planSamples) error {
+		_, err := LivestreamRepo{}.FindByID(ctx, db, s.livestreamID)
+		return err
+	},
+	func(ctx context.Context, db Queryer, s planSamples) error {
+		_, err := LivestreamRepo{}.FindByIDs(ctx, db, []int64{s.livestreamID, s.livestreamID + 1})
+		return err
+	},
+	func(ctx context.Context, db Queryer, s planSamples) error {
+		_, err := LivestreamRepo{}.ListByUserID(ctx, db, s.userID)
+		return err
+	},
+	func(ctx context.Context, db Queryer, s planSamples) error {
+		_, err := ReactionRepo{}.CountByLivestreamID(ctx, db, s.livestreamID)
+		return err
+	},
+	func(ctx context.Context, db Queryer, s planSamples) error {
+		_, err := ReactionRepo{}.CountByLivestreamIDs(ctx, db, []int64{s.livestreamID, s.livestreamID + 1})
+		return err
+	},
+	func(ctx context.Context, db Queryer, s planSamples) error {
+		_, err := LivecommentRepo{}.FindByID(ctx, db, s.livecommentID)
+		return err
+	},
+	func(ctx context.Context, db Queryer, s planSamples) error {
+		_, err := LivecommentRepo{}.FindByIDs(ctx, db, []int64{s.livecommentID, s.livecommentID + 1})
+		return err
+	},
+	func(ctx context.Context, db Queryer, s planSamples) error {
+		_, err := LivecommentRepo{}.FindLivestreamID(ctx, db, s.livecommentID)
+		return err
+	},
+	func(ctx context.Context, db Queryer, s planSamples) error {
+		_, err := LivecommentRepo{}.CountRepliesByParentIDs(ctx, db, []int64{s.livecommentID, s.livecommentID + 1})
+		return err
+	},
+}
+
+// CheckQueryPlans は、参照メソッドのクエリをEXPLAINし、planCheckedTablesを全件走査するものがあればエラーを返す
+// dbはトランザクションなしのハンドルでよい (EXPLAINしか実行しない)
+func CheckQueryPlans(ctx context.Context, db Queryer) error {
+	samples, err := loadPlanSamples(ctx, db)
+	if err != nil {
+		return fmt.Errorf("failed to load plan samples: %w", err)
+	}
+	e := &explainer{db: db}
+	for _, check := range planChecks {
+		// 実行していないのでerrExplainedが返る
+		if err := check(ctx, e, samples); err != nil && !errors.Is(err, errExplained) {
+			return err
+		}
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	var scans []string
+	for _, plan := range e.plans {
+		if planCheckedTables[plan.Table] && (plan.Type == "ALL" || plan.Type == "index") {
+			scans = append(scans, fmt.Sprintf("%s (table=%s type=%s key=%s)", plan.Query, plan.Table, plan.Type, plan.Key))
+		}
+	}
+	if len(scans) > 0 {
+		return fmt.Errorf("full table scans detected: %s", strings.Join(scans, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+//go:build planscheck
+
+package repository
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// 初期データを入れたDBのDSN
+const planCheckDSNEnvKey = "ISUCON13_PLANSCHECK_DSN"
+
+// TestQueryPlans は、CheckQueryPlansを実行し、大きいテーブルを全件走査するクエリがあれば失敗する
+//
+//	ISUCON13_PLANSCHECK_DSN='isucon:isucon@tcp(127.0.0.1:3306)/isupipe' go test -tags planscheck ./internal/repository/
+func TestQueryPlans(t *testing.T) {
+	dsn, ok := os.LookupEnv(planCheckDSNEnvKey)
+	if !ok {
+		t.Fatalf("%s is not set", planCheckDSNEnvKey)
+	}
+	conf, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("invalid %s: %v", planCheckDSNEnvKey, err)
+	}
+	conf.InterpolateParams = true
+	db, err := sqlx.Open("mysql", conf.FormatDSN())
+	if err != nil {
+		t.Fatalf("failed to open isupipe database: %v", err)
+	}
+	defer db.Close()
+
+	if err := CheckQueryPlans(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+}
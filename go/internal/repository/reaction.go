@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"context"
+)
+
+type ReactionModel struct {
+	ID           int64  `db:"id"`
+	EmojiName    string `db:"emoji_name"`
+	UserID       int64  `db:"user_id"`
+	LivestreamID int64  `db:"livestream_id"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+// ReactionRepo は、reactionsテーブルを読み書きする
+type ReactionRepo struct{}
+
+func (ReactionRepo) CountByLivestreamID(ctx context.Context, db Queryer, livestreamID int64) (int64, error) {
+	var count int64
+	err := db.GetContext(ctx, &count, "SELECT COUNT(*) FROM reactions WHERE livestream_id = ?", livestreamID)
+	return count, err
+}
+
+// CountByLivestreamIDs は、配信ごとのリアクション数を返す。リアクションのない配信は含まない
+func (ReactionRepo) CountByLivestreamIDs(ctx context.Context, db Queryer, livestreamIDs []int64) (map[int64]int64, error) {
+	return countIn(ctx, db, "SELECT livestream_id, COUNT(*) AS count FROM reactions WHERE livestream_id IN (?) GROUP BY livestream_id", livestreamIDs)
+}
+
+// Insert は、reaction.IDを採番済みのIDとして登録する
+func (ReactionRepo) Insert(ctx context.Context, db Execer, reaction ReactionModel) error {
+	_, err := db.NamedExecContext(ctx, "INSERT INTO reactions (id, user_id, livestream_id, emoji_name, created_at) VALUES (:id, :user_id, :livestream_id, :emoji_name, :created_at)", reaction)
+	return err
+}
@@ -0,0 +1,71 @@
+// Package repository は、isupipeの主なテーブル (users, livestreams, reactions, livecomments) の読み書きをまとめる
+//
+// IDや名前での参照、IDの一覧でまとめて読む参照 (FindByIDs)、INSERTはUserRepoなどのメソッドを通す
+// レスポンスの組み立てやキャッシュの読み込みはFindByIDsを使い、ここを1つの入口にする
+// 検索・集計など、1つのハンドラでしか使わないクエリはハンドラに残す
+// DBハンドルは呼び出しごとに渡すので、トランザクション内からも、トランザクションなしでも、レプリカからも使える
+// 見つからない場合、1件を返すメソッドはsql.ErrNoRowsを返し、まとめて読むメソッドは結果に含めない
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Queryer は、*sqlx.DBと*sqlx.Txのどちらでもよい参照用のハンドル
+type Queryer interface {
+	sqlx.QueryerContext
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	Rebind(query string) string
+}
+
+// Execer は、*sqlx.DBと*sqlx.Txのどちらでもよい書き込み用のハンドル
+type Execer interface {
+	sqlx.ExecerContext
+	NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error)
+}
+
+// selectIn は、IN (?) を含むqueryをidsで展開して読む
+// idsが空の場合は問い合わせない
+func selectIn[T any](ctx context.Context, db Queryer, query string, ids []int64) ([]T, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	query, args, err := sqlx.In(query, ids)
+	if err != nil {
+		return nil, err
+	}
+	var rows []T
+	if err := db.SelectContext(ctx, &rows, db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// countIn は、livestream_idとcountの列を返すqueryをidsで展開し、livestream_idごとの数を返す
+func countIn(ctx context.Context, db Queryer, query string, ids []int64) (map[int64]int64, error) {
+	type countRow struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Count        int64 `db:"count"`
+	}
+	rows, err := selectIn[countRow](ctx, db, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		counts[row.LivestreamID] = row.Count
+	}
+	return counts, nil
+}
+
+// insertID は、INSERTの結果から採番されたIDを返す
+func insertID(result sql.Result, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type UserModel struct {
+	ID             int64         `db:"id"`
+	Name           string        `db:"name"`
+	DisplayName    string        `db:"display_name"`
+	Description    string        `db:"description"`
+	HashedPassword string        `db:"password"`
+	FollowerCount  int64         `db:"follower_count"`
+	DeletedAt      sql.NullInt64 `db:"deleted_at"`
+}
+
+// UserRepo は、usersテーブルを読み書きする
+// 退会済み (deleted_atがある) ユーザも返すので、除くかどうかは呼び出し元で決める
+type UserRepo struct{}
+
+func (UserRepo) FindByID(ctx context.Context, db Queryer, id int64) (UserModel, error) {
+	var user UserModel
+	err := db.GetContext(ctx, &user, "SELECT * FROM users WHERE id = ?", id)
+	return user, err
+}
+
+// FindByIDForUpdate は、txが終わるまで行をロックする
+func (UserRepo) FindByIDForUpdate(ctx context.Context, tx *sqlx.Tx, id int64) (UserModel, error) {
+	var user UserModel
+	err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE id = ? FOR UPDATE", id)
+	return user, err
+}
+
+// FindByName は、nameと完全に一致するユーザを返す (users.nameはutf8mb4_bin)
+func (UserRepo) FindByName(ctx context.Context, db Queryer, name string) (UserModel, error) {
+	var user UserModel
+	err := db.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", name)
+	return user, err
+}
+
+// FindByNameForUpdate は、txが終わるまで行をロックする
+func (UserRepo) FindByNameForUpdate(ctx context.Context, tx *sqlx.Tx, name string) (UserModel, error) {
+	var user UserModel
+	err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ? FOR UPDATE", name)
+	return user, err
+}
+
+// FindByIDs は、順不同で返す
+func (UserRepo) FindByIDs(ctx context.Context, db Queryer, ids []int64) ([]UserModel, error) {
+	return selectIn[UserModel](ctx, db, "SELECT * FROM users WHERE id IN (?)", ids)
+}
+
+// Insert は、採番されたIDを返す
+func (UserRepo) Insert(ctx context.Context, db Execer, user UserModel) (int64, error) {
+	return insertID(db.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password) VALUES(:name, :display_name, :description, :password)", user))
+}
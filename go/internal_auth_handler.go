@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// 内部向けのポート (:6060) の認証
+// プロファイラ・DNSの設定変更・初期化の転送などを受け付けるので、公開するAPIと同じように誰でも呼べてはいけない
+// ISUCON13_INTERNAL_TOKENを設定した場合は、Authorization: Bearer <トークン> を付けたリクエストだけを受け付ける
+// 設定していない場合は、同じホストからのリクエストだけを受け付ける
+// 複数台で動かしてISUCON13_DNS_OWNER_URLへ転送する場合は、すべてのサーバに同じトークンを設定する
+
+// internalAuthMiddleware は、内部向けのポートのハンドラを包む
+func internalAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeInternalRequest(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func authorizeInternalRequest(r *http.Request) bool {
+	if internalToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(token), []byte(internalToken)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// setInternalAuthorization は、他のサーバの内部向けのポートへのリクエストにトークンを付ける
+func setInternalAuthorization(req *http.Request) {
+	if internalToken != "" {
+		req.Header.Set("Authorization", "Bearer "+internalToken)
+	}
+}
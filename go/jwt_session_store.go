@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/sessions"
+)
+
+// JWT認証モード (ISUCON13_AUTH_MODE=jwt)
+// セッションの値をHS256で署名したJWTとしてクッキーに載せ、サーバ側には何も持たない
+// どのアプリサーバでもDBやメモリを引かずに検証できる代わりに、有効期限まで失効させられない
+// クッキーのほか、Authorization: Bearerヘッダでも受け付ける
+
+type jwtSessionStore struct {
+	key     []byte
+	Options *sessions.Options
+}
+
+type sessionClaims struct {
+	UserID   int64  `json:"uid"`
+	Username string `json:"name"`
+	jwt.RegisteredClaims
+}
+
+func newJWTSessionStore(key []byte) *jwtSessionStore {
+	return &jwtSessionStore{
+		key: key,
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+}
+
+// Get は、リクエスト内でキャッシュされたセッションを返す
+func (s *jwtSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New は、JWTを検証してセッションの値を復元する
+// 期限切れの場合は、クッキーがない場合と同じく空のセッションを返す
+func (s *jwtSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	token := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	} else if c, err := r.Cookie(name); err == nil {
+		token = c.Value
+	}
+	if token == "" {
+		return session, nil
+	}
+
+	claims := &sessionClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, s.keyFunc, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()})); err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return session, nil
+		}
+		return session, err
+	}
+	if claims.ExpiresAt == nil {
+		return session, errors.New("token has no expiration")
+	}
+
+	session.ID = claims.ID
+	session.Values[defaultSessionIDKey] = claims.ID
+	session.Values[defaultUserIDKey] = claims.UserID
+	session.Values[defaultUsernameKey] = claims.Username
+	session.Values[defaultSessionExpiresKey] = claims.ExpiresAt.Unix()
+	session.IsNew = false
+	return session, nil
+}
+
+// Save は、セッションの値を署名したJWTをクッキーに書き込む
+// MaxAgeが0以下の場合はクッキーを消す
+func (s *jwtSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now()
+	claims := sessionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(session.Options.MaxAge) * time.Second)),
+		},
+	}
+	claims.UserID, _ = session.Values[defaultUserIDKey].(int64)
+	claims.Username, _ = session.Values[defaultUsernameKey].(string)
+	claims.ID, _ = session.Values[defaultSessionIDKey].(string)
+	if expiresAt, ok := session.Values[defaultSessionExpiresKey].(int64); ok {
+		claims.ExpiresAt = jwt.NewNumericDate(time.Unix(expiresAt, 0))
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.key)
+	if err != nil {
+		return err
+	}
+	session.ID = claims.ID
+	http.SetCookie(w, sessions.NewCookie(session.Name(), token, session.Options))
+	return nil
+}
+
+// keyFunc は、HS256以外で署名されたトークンを拒否する
+func (s *jwtSessionStore) keyFunc(token *jwt.Token) (interface{}, error) {
+	if token.Method != jwt.SigningMethodHS256 {
+		return nil, fmt.Errorf("unexpected signing method: %s", token.Header["alg"])
+	}
+	return s.key, nil
+}
@@ -2,45 +2,70 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/isucon/isucon13/webapp/go/internal/counter"
+	"github.com/isucon/isucon13/webapp/go/internal/repository"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
+// チップ額の上限
+// アプリケーションマニュアルのチップレベル表に合わせる
+const maxTip = 20000
+
+const (
+	defaultLivecommentSearchLimit = 50
+	maxLivecommentSearchLimit     = 100
+)
+
+// tipLevelThresholds[i] 以上のチップ額であれば、チップレベル i+1 となる
+var tipLevelThresholds = []int64{1, 500, 1000, 5000, 10000}
+
 type PostLivecommentRequest struct {
 	Comment string `json:"comment"`
 	Tip     int64  `json:"tip"`
+	// ParentID is the id of the livecomment being replied to. nil means a top-level comment.
+	ParentID *int64 `json:"parent_id"`
 }
 
-type LivecommentModel struct {
-	ID           int64  `db:"id"`
-	UserID       int64  `db:"user_id"`
-	LivestreamID int64  `db:"livestream_id"`
-	Comment      string `db:"comment"`
-	Tip          int64  `db:"tip"`
-	CreatedAt    int64  `db:"created_at"`
-}
+type LivecommentModel = repository.LivecommentModel
 
 type Livecomment struct {
-	ID         int64      `json:"id"`
-	User       User       `json:"user"`
-	Livestream Livestream `json:"livestream"`
-	Comment    string     `json:"comment"`
-	Tip        int64      `json:"tip"`
-	CreatedAt  int64      `json:"created_at"`
+	ID           int64      `json:"id"`
+	User         User       `json:"user"`
+	Livestream   Livestream `json:"livestream"`
+	Comment      string     `json:"comment"`
+	Tip          int64      `json:"tip"`
+	TipLevel     int64      `json:"tip_level"`
+	ParentID     *int64     `json:"parent_id,omitempty"`
+	RepliesCount int64      `json:"replies_count"`
+	CreatedAt    int64      `json:"created_at"`
 }
 
+// ライブコメントエクスポートの1行分
+type LivecommentExportRow struct {
+	ID           int64  `json:"id"`
+	UserID       int64  `json:"user_id"`
+	LivestreamID int64  `json:"livestream_id"`
+	Comment      string `json:"comment"`
+	Tip          int64  `json:"tip"`
+	TipLevel     int64  `json:"tip_level"`
+	ParentID     *int64 `json:"parent_id,omitempty"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// エクスポート時に何行ごとにflushするか
+const livecommentExportFlushInterval = 500
+
 type LivecommentReport struct {
 	ID          int64       `json:"id"`
 	Reporter    User        `json:"reporter"`
@@ -81,11 +106,10 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
 
 	type LivestreamWithDetail struct {
 		LivestreamID               int64  `db:"livestream_id"`
@@ -93,15 +117,16 @@ func getLivecommentsHandler(c echo.Context) error {
 		LivestreamOwnerName        string `db:"livestream_owner_name"`
 		LivestreamOwnerDisplayName string `db:"livestream_owner_display_name"`
 		LivestreamOwnerDescription string `db:"livestream_owner_description"`
-		LivestreamOwnerThemeID     int64  `db:"livestream_owner_theme_id"`
-		LivestreamOwnerDarkMode    bool   `db:"livestream_owner_dark_mode"`
-		LivestreamOwnerIconImage   []byte `db:"livestream_owner_icon_image"`
+		LivestreamOwnerFollowers   int64  `db:"livestream_owner_follower_count"`
 		LivestreamTitle            string `db:"livestream_title"`
 		LivestreamDescription      string `db:"livestream_description"`
 		LivestreamPlaylistURL      string `db:"livestream_playlist_url"`
 		LivestreamThumbnailURL     string `db:"livestream_thumbnail_url"`
 		LivestreamStartAt          int64  `db:"livestream_start_at"`
 		LivestreamEndAt            int64  `db:"livestream_end_at"`
+		LivestreamStatus           string `db:"livestream_status"`
+		LivestreamLanguage         string `db:"livestream_language"`
+		LivestreamCategory         string `db:"livestream_category"`
 	}
 	livestream := LivestreamWithDetail{}
 	query := `
@@ -113,41 +138,37 @@ func getLivecommentsHandler(c echo.Context) error {
         ls.thumbnail_url AS livestream_thumbnail_url,
         ls.start_at AS livestream_start_at,
         ls.end_at AS livestream_end_at,
+        ls.status AS livestream_status,
+        ls.language AS livestream_language,
+        ls.category AS livestream_category,
 		o.id AS livestream_owner_id,
         o.name AS livestream_owner_name,
         o.display_name AS livestream_owner_display_name,
         o.description AS livestream_owner_description,
-        ot.id AS livestream_owner_theme_id,
-        ot.dark_mode AS livestream_owner_dark_mode,
-        oi.image AS livestream_owner_icon_image
+        o.follower_count AS livestream_owner_follower_count
     FROM 
         livestreams ls
     INNER JOIN
 		users o ON ls.user_id = o.id
-	LEFT JOIN
-		themes ot ON o.id = ot.user_id
-	LEFT JOIN
-		icons oi ON o.id = oi.user_id
     WHERE 
         ls.id = ?
 `
-	err = tx.GetContext(ctx, &livestream, query, livestreamID)
+	err = dbConn.GetContext(ctx, &livestream, query, livestreamID)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
 
 	type CommentWithDetails struct {
-		CommentID       int64  `db:"comment_id"`
-		Comment         string `db:"comment"`
-		Tip             int64  `db:"tip"`
-		CreatedAt       int64  `db:"created_at"`
-		UserID          int64  `db:"user_id"`
-		UserName        string `db:"user_name"`
-		UserDisplayName string `db:"user_display_name"`
-		UserDescription string `db:"user_description"`
-		UserThemeID     int64  `db:"user_theme_id"`
-		UserDarkMode    bool   `db:"user_dark_mode"`
-		UserIconImage   []byte `db:"user_icon_image"`
+		CommentID       int64         `db:"comment_id"`
+		Comment         string        `db:"comment"`
+		Tip             int64         `db:"tip"`
+		ParentID        sql.NullInt64 `db:"parent_id"`
+		CreatedAt       int64         `db:"created_at"`
+		UserID          int64         `db:"user_id"`
+		UserName        string        `db:"user_name"`
+		UserDisplayName string        `db:"user_display_name"`
+		UserDescription string        `db:"user_description"`
+		UserFollowers   int64         `db:"user_follower_count"`
 	}
 	comments := []CommentWithDetails{}
 	query = `
@@ -155,25 +176,27 @@ func getLivecommentsHandler(c echo.Context) error {
         lc.id AS comment_id,
         lc.comment,
         lc.tip,
+        lc.parent_id,
         lc.created_at,
         u.id AS user_id,
         u.name AS user_name,
         u.display_name AS user_display_name,
         u.description AS user_description,
-        ut.id AS user_theme_id,
-        ut.dark_mode AS user_dark_mode,
-        ui.image AS user_icon_image
+        u.follower_count AS user_follower_count
     FROM 
         livecomments lc
     INNER JOIN 
         users u ON lc.user_id = u.id
-	LEFT JOIN
-		themes ut ON u.id = ut.user_id
-	LEFT JOIN
-		icons ui ON u.id = ui.user_id
     WHERE 
         lc.livestream_id = ?
-    ORDER BY 
+`
+	args := []interface{}{livestreamID}
+	// シャドウバンされたユーザのコメントは本人以外には見せない
+	if hiddenIDs := hiddenUserIDs(c, userID); len(hiddenIDs) > 0 {
+		query += "    AND lc.user_id NOT IN (?)\n"
+		args = append(args, hiddenIDs)
+	}
+	query += `    ORDER BY
         lc.created_at DESC
 `
 	if c.QueryParam("limit") != "" {
@@ -183,8 +206,12 @@ func getLivecommentsHandler(c echo.Context) error {
 		}
 		query += fmt.Sprintf(" LIMIT %d", limit)
 	}
+	query, args, err = sqlx.In(query, args...)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
 
-	err = tx.SelectContext(ctx, &comments, query, livestreamID)
+	err = dbConn.SelectContext(ctx, &comments, query, args...)
 	if errors.Is(err, sql.ErrNoRows) {
 		return c.JSON(http.StatusOK, []*Livecomment{})
 	}
@@ -192,58 +219,59 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
 
-	var tags []Tag
-	query = "SELECT tags.* FROM tags JOIN livestream_tags ON tags.id = livestream_tags.tag_id WHERE livestream_tags.livestream_id = ?"
-	err = tx.SelectContext(ctx, &tags, query, livestreamID)
-	if !errors.Is(err, sql.ErrNoRows) && err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	commentIDs := make([]int64, len(comments))
+	for i := range comments {
+		commentIDs[i] = comments[i].CommentID
+	}
+	repliesCounts, err := livecommentRepo.CountRepliesByParentIDs(ctx, dbConn, commentIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livecomment replies: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	tags, collaborators, err := getLivestreamTagsAndCollaborators(ctx, dbConn, int64(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags and collaborators: "+err.Error())
 	}
 
 	livecomments := make([]Livecomment, len(comments))
 
-	image, err := os.ReadFile(fallbackImage)
+	userIDs := make([]int64, 0, len(comments)+1)
+	userIDs = append(userIDs, livestream.LivestreamOwnerID)
+	for i := range comments {
+		userIDs = append(userIDs, comments[i].UserID)
+	}
+	themeMap, err := getUserThemes(ctx, userIDs)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed read fallback image: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user themes: "+err.Error())
 	}
-
-	fallbackImageHash := fmt.Sprintf("%x", sha256.Sum256(image))
-	livestreamOwnerIconHash := fallbackImageHash
-	if livestream.LivestreamOwnerIconImage != nil {
-		livestreamOwnerIconHash = fmt.Sprintf("%x", sha256.Sum256(livestream.LivestreamOwnerIconImage))
+	iconHashes, err := getIconHashes(ctx, userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load icon hashes: "+err.Error())
 	}
+	livestreamOwnerIconHash := iconHashes[livestream.LivestreamOwnerID]
 
-	userIconHashCache := map[int64]string{}
 	for i := range comments {
-		var userIconHash string
-		if c, ok := userIconHashCache[comments[i].UserID]; ok {
-			userIconHash = c
-		} else {
-			userIconHash = fallbackImageHash
-			if comments[i].UserIconImage != nil {
-				userIconHash = fmt.Sprintf("%x", sha256.Sum256(comments[i].UserIconImage))
-			}
-			userIconHashCache[comments[i].UserID] = userIconHash
-		}
+		userIconHash := iconHashes[comments[i].UserID]
 
 		livecomments[i] = Livecomment{
-			ID:        comments[i].CommentID,
-			Comment:   comments[i].Comment,
-			Tip:       comments[i].Tip,
-			CreatedAt: comments[i].CreatedAt,
+			ID:           comments[i].CommentID,
+			Comment:      comments[i].Comment,
+			Tip:          comments[i].Tip,
+			TipLevel:     computeTipLevel(comments[i].Tip),
+			ParentID:     nullInt64Ptr(comments[i].ParentID),
+			RepliesCount: repliesCounts[comments[i].CommentID],
+			CreatedAt:    comments[i].CreatedAt,
 			User: User{
 				ID:          comments[i].UserID,
 				Name:        comments[i].UserName,
 				DisplayName: comments[i].UserDisplayName,
 				Description: comments[i].UserDescription,
 				Theme: Theme{
-					ID:       comments[i].UserThemeID,
-					DarkMode: comments[i].UserDarkMode,
+					ID:       themeMap[comments[i].UserID].ID,
+					DarkMode: themeMap[comments[i].UserID].DarkMode,
 				},
-				IconHash: userIconHash,
+				IconHash:      userIconHash,
+				FollowerCount: comments[i].UserFollowers,
 			},
 			Livestream: Livestream{
 				ID: livestream.LivestreamID,
@@ -253,18 +281,23 @@ func getLivecommentsHandler(c echo.Context) error {
 					DisplayName: livestream.LivestreamOwnerDisplayName,
 					Description: livestream.LivestreamOwnerDescription,
 					Theme: Theme{
-						ID:       livestream.LivestreamOwnerThemeID,
-						DarkMode: livestream.LivestreamOwnerDarkMode,
+						ID:       themeMap[livestream.LivestreamOwnerID].ID,
+						DarkMode: themeMap[livestream.LivestreamOwnerID].DarkMode,
 					},
-					IconHash: livestreamOwnerIconHash,
+					IconHash:      livestreamOwnerIconHash,
+					FollowerCount: livestream.LivestreamOwnerFollowers,
 				},
-				Title:        livestream.LivestreamTitle,
-				Description:  livestream.LivestreamDescription,
-				PlaylistUrl:  livestream.LivestreamPlaylistURL,
-				ThumbnailUrl: livestream.LivestreamThumbnailURL,
-				StartAt:      livestream.LivestreamStartAt,
-				EndAt:        livestream.LivestreamEndAt,
-				Tags:         tags,
+				Collaborators: collaborators,
+				Title:         livestream.LivestreamTitle,
+				Description:   livestream.LivestreamDescription,
+				PlaylistUrl:   livestream.LivestreamPlaylistURL,
+				ThumbnailUrl:  livestream.LivestreamThumbnailURL,
+				StartAt:       livestream.LivestreamStartAt,
+				EndAt:         livestream.LivestreamEndAt,
+				Status:        livestream.LivestreamStatus,
+				Language:      livestream.LivestreamLanguage,
+				Category:      livestream.LivestreamCategory,
+				Tags:          tags,
 			},
 		}
 	}
@@ -272,6 +305,235 @@ func getLivecommentsHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, livecomments)
 }
 
+// ライブコメントへの返信一覧取得API
+// GET /api/livestream/:livestream_id/livecomment/:livecomment_id/replies
+func getLivecommentRepliesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	parentLivestreamID, err := livecommentRepo.FindLivestreamID(ctx, dbConn, int64(livecommentID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+		}
+	}
+	if parentLivestreamID != int64(livestreamID) {
+		return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+	}
+
+	query := "SELECT * FROM livecomments WHERE parent_id = ?"
+	args := []interface{}{livecommentID}
+	if hiddenIDs := hiddenUserIDs(c, userID); len(hiddenIDs) > 0 {
+		query += " AND user_id NOT IN (?)"
+		args = append(args, hiddenIDs)
+	}
+	query += " ORDER BY created_at ASC, id ASC"
+	if c.QueryParam("limit") != "" {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+		}
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	query, args, err = sqlx.In(query, args...)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+
+	var replyModels []LivecommentModel
+	if err := dbConn.SelectContext(ctx, &replyModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment replies: "+err.Error())
+	}
+
+	replies, err := fillLivecommentResponses(ctx, dbConn, replyModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, replies)
+}
+
+// (配信者向け)ライブコメント検索API
+// GET /api/livestream/:livestream_id/livecomment/search?q=
+func searchLivecommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	keyword := strings.TrimSpace(c.QueryParam("q"))
+	if keyword == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "q query parameter is required")
+	}
+
+	limit := defaultLivecommentSearchLimit
+	if c.QueryParam("limit") != "" {
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		if limit > maxLivecommentSearchLimit {
+			limit = maxLivecommentSearchLimit
+		}
+	}
+	offset := 0
+	if c.QueryParam("offset") != "" {
+		offset, err = strconv.Atoi(c.QueryParam("offset"))
+		if err != nil || offset < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "offset query parameter must be non-negative integer")
+		}
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	db := readDB()
+
+	livestreamModel, err := livestreamRepo.FindByID(ctx, db, int64(livestreamID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+	isModerator, err := isLivestreamModerator(ctx, db, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborator: "+err.Error())
+	}
+	if !isModerator {
+		return echo.NewHTTPError(http.StatusForbidden, "can't search other streamer's livecomments")
+	}
+
+	// ngramのトークンサイズに満たない検索語はFULLTEXTインデックスで引けないのでLIKEで探す
+	var query string
+	var args []interface{}
+	if len([]rune(keyword)) < ngramTokenSize {
+		query = "SELECT * FROM livecomments WHERE livestream_id = ? AND comment LIKE CONCAT('%', ?, '%') ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?"
+		args = []interface{}{livestreamID, keyword, limit, offset}
+	} else {
+		query = "SELECT * FROM livecomments WHERE livestream_id = ? AND MATCH (comment) AGAINST (? IN BOOLEAN MODE) ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?"
+		args = []interface{}{livestreamID, `"` + strings.ReplaceAll(keyword, `"`, " ") + `"`, limit, offset}
+	}
+
+	var livecommentModels []LivecommentModel
+	if err := db.SelectContext(ctx, &livecommentModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to search livecomments: "+err.Error())
+	}
+
+	livecomments, err := fillLivecommentResponses(ctx, db, livecommentModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livecomments)
+}
+
+// (配信者向け)ライブコメントエクスポートAPI
+// GET /api/livestream/:livestream_id/livecomment/export
+// 全件をメモリに載せないよう、1行ずつNDJSONとして書き出す
+func exportLivecommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if err := verifyLivestreamModerator(ctx, dbConn, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	rows, err := dbConn.QueryxContext(ctx, "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at ASC, id ASC", livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	}
+	defer rows.Close()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson; charset=utf-8")
+	res.WriteHeader(http.StatusOK)
+
+	// ここから先はステータスコードを返せないので、エラーはログに残して打ち切る
+	enc := json.NewEncoder(res)
+	written := 0
+	for rows.Next() {
+		var model LivecommentModel
+		if err := rows.StructScan(&model); err != nil {
+			c.Logger().Errorf("failed to scan livecomment for export: %+v", err)
+			return nil
+		}
+		if err := enc.Encode(LivecommentExportRow{
+			ID:           model.ID,
+			UserID:       model.UserID,
+			LivestreamID: model.LivestreamID,
+			Comment:      model.Comment,
+			Tip:          model.Tip,
+			TipLevel:     computeTipLevel(model.Tip),
+			ParentID:     nullInt64Ptr(model.ParentID),
+			CreatedAt:    model.CreatedAt,
+		}); err != nil {
+			c.Logger().Errorf("failed to write livecomment export: %+v", err)
+			return nil
+		}
+		written++
+		if written%livecommentExportFlushInterval == 0 {
+			res.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.Logger().Errorf("failed to iterate livecomments for export: %+v", err)
+		return nil
+	}
+	res.Flush()
+
+	return nil
+}
+
+// NGワード一覧取得API
+// GET /api/livestream/:livestream_id/ngwords
+// 配信者とコラボレーターには、誰が登録したかに関わらず配信のNGワードをすべて返す
+// それ以外のユーザと、存在しない配信には空の配列を返す (エラーにはしない)
 func getNgwords(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -289,14 +551,24 @@ func getNgwords(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	livestreamModel, err := livestreamRepo.FindByID(ctx, dbConn, int64(livestreamID))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.JSON(http.StatusOK, []*NGWord{})
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	// NGワードは配信者とコラボレーターのみが閲覧できる
+	isModerator, err := isLivestreamModerator(ctx, dbConn, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborator: "+err.Error())
+	}
+	if !isModerator {
+		return c.JSON(http.StatusOK, []*NGWord{})
 	}
-	defer tx.Rollback()
 
 	var ngWords []*NGWord
-	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC", userID, livestreamID); err != nil {
+	if err := dbConn.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE livestream_id = ? ORDER BY created_at DESC", livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.JSON(http.StatusOK, []*NGWord{})
 		} else {
@@ -304,10 +576,6 @@ func getNgwords(c echo.Context) error {
 		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
 	return c.JSON(http.StatusOK, ngWords)
 }
 
@@ -333,6 +601,9 @@ func postLivecommentHandler(c echo.Context) error {
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
+	if req.Tip < 0 || req.Tip > maxTip {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("tip must be between 0 and %d", maxTip))
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -340,55 +611,88 @@ func postLivecommentHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var livestreamModel LivestreamModel
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+	stmts := statementsFor(dbConn)
+
+	livestreamModel, err := livestreamRepo.FindByID(ctx, stmts.bind(tx), int64(livestreamID))
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
 		} else {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 		}
 	}
+	if err := verifyLivestreamAcceptsPost(livestreamModel); err != nil {
+		return err
+	}
+	if err := verifyLivecommentAllowed(ctx, tx, livestreamModel, userID, time.Now().Unix()); err != nil {
+		return err
+	}
 
-	// スパム判定
-	var ngwords []*NGWord
-	if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE user_id = ? AND livestream_id = ?", livestreamModel.UserID, livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	// スパム判定 (配信者・コラボレーターが登録したNGワード)
+	matcher, err := ngWords.matcher(ctx, livestreamModel.ID)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
 	}
+	if matcher.match(req.Comment) {
+		return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
+	}
 
-	for _, ngword := range ngwords {
-		if strings.Contains(req.Comment, ngword.Word) {
-			return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
+	// 返信の場合は、返信先が同じ配信のライブコメントであることを検証
+	var parentID sql.NullInt64
+	if req.ParentID != nil {
+		parentLivestreamID, err := livecommentRepo.FindLivestreamID(ctx, stmts.bind(tx), *req.ParentID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusBadRequest, "parent livecomment not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get parent livecomment: "+err.Error())
+			}
+		}
+		if parentLivestreamID != livestreamModel.ID {
+			return echo.NewHTTPError(http.StatusBadRequest, "parent livecomment belongs to another livestream")
 		}
+		parentID = sql.NullInt64{Int64: *req.ParentID, Valid: true}
 	}
 
+	livecommentID, err := livecommentIDs.next(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate livecomment id: "+err.Error())
+	}
 	now := time.Now().Unix()
 	livecommentModel := LivecommentModel{
+		ID:           livecommentID,
 		UserID:       userID,
 		LivestreamID: int64(livestreamID),
 		Comment:      req.Comment,
 		Tip:          req.Tip,
+		ParentID:     parentID,
 		CreatedAt:    now,
 	}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :created_at)", livecommentModel)
-	if err != nil {
+	if err := livecommentRepo.Insert(ctx, stmts.bind(tx), livecommentModel); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment: "+err.Error())
 	}
+	if err := notifyLivecomment(ctx, tx, livestreamModel, livecommentModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert notification: "+err.Error())
+	}
 
-	livecommentID, err := rs.LastInsertId()
+	counterEpoch, err := counter.Commit(tx.Commit)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
-	livecommentModel.ID = livecommentID
 
-	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
+	// ロックを持ったまま組み立てないよう、コミット後にキャッシュとプライマリから組み立てる
+	livecomment, err := fillLivecommentResponse(ctx, dbConn, livecommentModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
 	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
+	// 件数・スコア・リアルタイム配信はイベントの購読者が行う
+	livecommentCreated.Publish(livestreamModel.ID, LivecommentCreated{
+		Livestream:   livestreamModel,
+		Model:        livecommentModel,
+		Livecomment:  livecomment,
+		CounterEpoch: counterEpoch,
+	})
 
 	return c.JSON(http.StatusCreated, livecomment)
 }
@@ -421,8 +725,7 @@ func reportLivecommentHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var livestreamModel LivestreamModel
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+	if _, err := livestreamRepo.FindByID(ctx, tx, int64(livestreamID)); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
 		} else {
@@ -430,8 +733,7 @@ func reportLivecommentHandler(c echo.Context) error {
 		}
 	}
 
-	var livecommentModel LivecommentModel
-	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ?", livecommentID); err != nil {
+	if _, err := livecommentRepo.FindByID(ctx, tx, int64(livecommentID)); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
 		} else {
@@ -439,32 +741,54 @@ func reportLivecommentHandler(c echo.Context) error {
 		}
 	}
 
-	now := time.Now().Unix()
-	reportModel := LivecommentReportModel{
-		UserID:        int64(userID),
-		LivestreamID:  int64(livestreamID),
-		LivecommentID: int64(livecommentID),
-		CreatedAt:     now,
-	}
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", &reportModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment report: "+err.Error())
+	// 同じユーザが同じライブコメントを報告済みなら、既存の報告をそのまま返す
+	statusCode := http.StatusCreated
+	var reportModel LivecommentReportModel
+	err = tx.GetContext(ctx, &reportModel, "SELECT * FROM livecomment_reports WHERE user_id = ? AND livecomment_id = ?", userID, livecommentID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment report: "+err.Error())
 	}
-	reportID, err := rs.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment report id: "+err.Error())
+	if errors.Is(err, sql.ErrNoRows) {
+		reportModel = LivecommentReportModel{
+			UserID:        int64(userID),
+			LivestreamID:  int64(livestreamID),
+			LivecommentID: int64(livecommentID),
+			CreatedAt:     time.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", &reportModel)
+		switch {
+		case isDuplicateEntryError(err):
+			// 並行して同じ報告が作られたので、ロック読み取りで最新の行を取り直す
+			if err := tx.GetContext(ctx, &reportModel, "SELECT * FROM livecomment_reports WHERE user_id = ? AND livecomment_id = ? FOR UPDATE", userID, livecommentID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment report: "+err.Error())
+			}
+			statusCode = http.StatusOK
+		case err != nil:
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment report: "+err.Error())
+		default:
+			reportID, err := rs.LastInsertId()
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment report id: "+err.Error())
+			}
+			reportModel.ID = reportID
+		}
+	} else {
+		statusCode = http.StatusOK
 	}
-	reportModel.ID = reportID
 
 	report, err := fillLivecommentReportResponse(ctx, tx, reportModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
 	}
-	if err := tx.Commit(); err != nil {
+	counterEpoch, err := counter.Commit(tx.Commit)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	if statusCode == http.StatusCreated {
+		reportCreated.Publish(reportModel.LivestreamID, ReportCreated{Model: reportModel, CounterEpoch: counterEpoch})
+	}
 
-	return c.JSON(http.StatusCreated, report)
+	return c.JSON(statusCode, report)
 }
 
 // NGワードを登録
@@ -491,47 +815,87 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
+	var wordID int64
+	var deletedIDs []int64
+	var deltas counterDeltas
+	counterEpoch, err := runInTxCounted(ctx, func(tx *sqlx.Tx) error {
+		deltas = counterDeltas{}
+		// 配信者自身(またはコラボレーター)の配信に対するmoderateなのかを検証
+		if err := verifyLivestreamModerator(ctx, tx, int64(livestreamID), userID); err != nil {
+			var he *echo.HTTPError
+			if errors.As(err, &he) && he.Code != http.StatusInternalServerError {
+				return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
+			}
+			return err
+		}
 
-	// 配信者自身の配信に対するmoderateなのかを検証
-	var ownedLivestreams []LivestreamModel
-	if err := tx.SelectContext(ctx, &ownedLivestreams, "SELECT * FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-	}
-	if len(ownedLivestreams) == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
-	}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
+			UserID:       int64(userID),
+			LivestreamID: int64(livestreamID),
+			Word:         req.NGWord,
+			CreatedAt:    time.Now().Unix(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to insert new NG word: %w", err)
+		}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		Word:         req.NGWord,
-		CreatedAt:    time.Now().Unix(),
-	})
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG word: "+err.Error())
-	}
+		wordID, err = rs.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get last inserted NG word id: %w", err)
+		}
+		if err := insertModerationLog(ctx, tx, int64(livestreamID), userID, moderationActionNGWordAdded, fmt.Sprintf("word_id=%d word=%q", wordID, req.NGWord)); err != nil {
+			return fmt.Errorf("failed to insert moderation log: %w", err)
+		}
 
-	wordID, err := rs.LastInsertId()
+		// ストリーミング中の接続に削除を知らせるため、消す行のIDを先にロックして取る
+		query := `
+			SELECT id FROM livecomments
+			WHERE
+			livestream_id = ? AND
+			comment LIKE CONCAT('%', ?, '%')
+			FOR UPDATE
+		`
+		if err := tx.SelectContext(ctx, &deletedIDs, query, livestreamID, req.NGWord); err != nil {
+			return fmt.Errorf("failed to get old livecomments that hit spams: %w", err)
+		}
+		if len(deletedIDs) > 0 {
+			// 配信者のライブコメント数から、シャドウバンされていないユーザの分を減らす
+			query, args, err := sqlx.In("SELECT l.user_id AS id, COUNT(*) AS count FROM livecomments lc INNER JOIN livestreams l ON l.id = lc.livestream_id WHERE lc.id IN (?) AND NOT EXISTS (SELECT 1 FROM shadow_bans sb WHERE sb.livestream_id = lc.livestream_id AND sb.user_id = lc.user_id) GROUP BY l.user_id", deletedIDs)
+			if err != nil {
+				return fmt.Errorf("failed to build query: %w", err)
+			}
+			if err := deltas.addCounts(ctx, tx, userLivecommentCounter, -1, query, args...); err != nil {
+				return fmt.Errorf("failed to count old livecomments that hit spams: %w", err)
+			}
+			query, args, err = sqlx.In("DELETE FROM livecomments WHERE id IN (?)", deletedIDs)
+			if err != nil {
+				return fmt.Errorf("failed to build query: %w", err)
+			}
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				return fmt.Errorf("failed to delete old livecomments that hit spams: %w", err)
+			}
+			// 消したライブコメントを指す通知が通知一覧に残らないよう、一緒に消す
+			query, args, err = sqlx.In("DELETE FROM notifications WHERE livestream_id = ? AND livecomment_id IN (?)", livestreamID, deletedIDs)
+			if err != nil {
+				return fmt.Errorf("failed to build query: %w", err)
+			}
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				return fmt.Errorf("failed to delete notifications of old livecomments that hit spams: %w", err)
+			}
+			if err := insertModerationLog(ctx, tx, int64(livestreamID), userID, moderationActionLivecommentsDeleted, fmt.Sprintf("deleted %d livecomments that hit NG word %q", len(deletedIDs), req.NGWord)); err != nil {
+				return fmt.Errorf("failed to insert moderation log: %w", err)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error())
+		return err
 	}
-
-	query := `
-		DELETE FROM livecomments
-		WHERE
-		livestream_id = ? AND
-		comment LIKE CONCAT('%', ?, '%');
-	`
-	if _, err := tx.ExecContext(ctx, query, livestreamID, req.NGWord); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
-	}
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	ngWords.bump(int64(livestreamID))
+	if len(deletedIDs) > 0 {
+		deltas.apply(counterEpoch)
+		invalidateRankings(ctx)
+		publishLivecommentDeletion(ctx, int64(livestreamID), deletedIDs)
 	}
 
 	return c.JSON(http.StatusCreated, map[string]interface{}{
@@ -539,52 +903,132 @@ func moderateHandler(c echo.Context) error {
 	})
 }
 
-func fillLivecommentResponse(ctx context.Context, tx *sqlx.Tx, livecommentModel LivecommentModel) (Livecomment, error) {
-	commentOwnerModel := UserModel{}
-	if err := tx.GetContext(ctx, &commentOwnerModel, "SELECT * FROM users WHERE id = ?", livecommentModel.UserID); err != nil {
-		return Livecomment{}, err
-	}
-	commentOwner, err := fillUserResponse(ctx, tx, commentOwnerModel)
+func fillLivecommentResponse(ctx context.Context, db dbQueryer, livecommentModel LivecommentModel) (Livecomment, error) {
+	commentOwner, err := getUserByID(ctx, db, livecommentModel.UserID)
 	if err != nil {
 		return Livecomment{}, err
 	}
 
-	livestreamModel := LivestreamModel{}
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livecommentModel.LivestreamID); err != nil {
+	livestream, err := getLivestreamByID(ctx, db, livecommentModel.LivestreamID)
+	if err != nil {
 		return Livecomment{}, err
 	}
-	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+
+	repliesCounts, err := livecommentRepo.CountRepliesByParentIDs(ctx, db, []int64{livecommentModel.ID})
 	if err != nil {
 		return Livecomment{}, err
 	}
 
 	livecomment := Livecomment{
-		ID:         livecommentModel.ID,
-		User:       commentOwner,
-		Livestream: livestream,
-		Comment:    livecommentModel.Comment,
-		Tip:        livecommentModel.Tip,
-		CreatedAt:  livecommentModel.CreatedAt,
+		ID:           livecommentModel.ID,
+		User:         commentOwner,
+		Livestream:   livestream,
+		Comment:      livecommentModel.Comment,
+		Tip:          livecommentModel.Tip,
+		TipLevel:     computeTipLevel(livecommentModel.Tip),
+		ParentID:     nullInt64Ptr(livecommentModel.ParentID),
+		RepliesCount: repliesCounts[livecommentModel.ID],
+		CreatedAt:    livecommentModel.CreatedAt,
 	}
 
 	return livecomment, nil
 }
 
-func fillLivecommentReportResponse(ctx context.Context, tx *sqlx.Tx, reportModel LivecommentReportModel) (LivecommentReport, error) {
-	reporterModel := UserModel{}
-	if err := tx.GetContext(ctx, &reporterModel, "SELECT * FROM users WHERE id = ?", reportModel.UserID); err != nil {
-		return LivecommentReport{}, err
+// fillLivecommentResponses は、複数のライブコメントをまとめて組み立てる
+// 投稿者・配信・返信数をそれぞれIN句で一括取得する。結果はlivecommentModelsと同じ順に並ぶ
+func fillLivecommentResponses(ctx context.Context, db dbQueryer, livecommentModels []LivecommentModel) ([]Livecomment, error) {
+	livecomments := make([]Livecomment, len(livecommentModels))
+	if len(livecommentModels) == 0 {
+		return livecomments, nil
+	}
+
+	ids := make([]int64, len(livecommentModels))
+	userIDSet := make(map[int64]struct{})
+	livestreamIDSet := make(map[int64]struct{})
+	for i, lm := range livecommentModels {
+		ids[i] = lm.ID
+		userIDSet[lm.UserID] = struct{}{}
+		livestreamIDSet[lm.LivestreamID] = struct{}{}
+	}
+	userIDs := make([]int64, 0, len(userIDSet))
+	for id := range userIDSet {
+		userIDs = append(userIDs, id)
+	}
+	livestreamIDs := make([]int64, 0, len(livestreamIDSet))
+	for id := range livestreamIDSet {
+		livestreamIDs = append(livestreamIDs, id)
+	}
+
+	userMap, err := getUsersByIDs(ctx, db, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	livestreamMap, err := getLivestreamsByIDs(ctx, db, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	repliesCounts, err := livecommentRepo.CountRepliesByParentIDs(ctx, db, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, lm := range livecommentModels {
+		commentOwner, ok := userMap[lm.UserID]
+		if !ok {
+			return nil, fmt.Errorf("user %d not found", lm.UserID)
+		}
+		livestream, ok := livestreamMap[lm.LivestreamID]
+		if !ok {
+			return nil, fmt.Errorf("livestream %d not found", lm.LivestreamID)
+		}
+		livecomments[i] = Livecomment{
+			ID:           lm.ID,
+			User:         commentOwner,
+			Livestream:   livestream,
+			Comment:      lm.Comment,
+			Tip:          lm.Tip,
+			TipLevel:     computeTipLevel(lm.Tip),
+			ParentID:     nullInt64Ptr(lm.ParentID),
+			RepliesCount: repliesCounts[lm.ID],
+			CreatedAt:    lm.CreatedAt,
+		}
+	}
+
+	return livecomments, nil
+}
+
+// computeTipLevel は、チップ額からチップレベルを算出する (チップなしは0)
+func computeTipLevel(tip int64) int64 {
+	var level int64
+	for _, threshold := range tipLevelThresholds {
+		if tip < threshold {
+			break
+		}
+		level++
 	}
-	reporter, err := fillUserResponse(ctx, tx, reporterModel)
+	return level
+}
+
+func nullInt64Ptr(v sql.NullInt64) *int64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Int64
+}
+
+func fillLivecommentReportResponse(ctx context.Context, db dbQueryer, reportModel LivecommentReportModel) (LivecommentReport, error) {
+	reporter, err := getUserByID(ctx, db, reportModel.UserID)
 	if err != nil {
 		return LivecommentReport{}, err
 	}
 
 	livecommentModel := LivecommentModel{}
-	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ?", reportModel.LivecommentID); err != nil {
+	if livecommentModel, err = livecommentRepo.FindByID(ctx, db, reportModel.LivecommentID); err != nil {
 		return LivecommentReport{}, err
 	}
-	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
+	livecomment, err := fillLivecommentResponse(ctx, db, livecommentModel)
 	if err != nil {
 		return LivecommentReport{}, err
 	}
@@ -597,3 +1041,64 @@ func fillLivecommentReportResponse(ctx context.Context, tx *sqlx.Tx, reportModel
 	}
 	return report, nil
 }
+
+// fillLivecommentReportResponses は、複数の報告をまとめて組み立てる
+// 結果はreportModelsと同じ順に並ぶ
+func fillLivecommentReportResponses(ctx context.Context, db dbQueryer, reportModels []LivecommentReportModel) ([]LivecommentReport, error) {
+	reports := make([]LivecommentReport, len(reportModels))
+	if len(reportModels) == 0 {
+		return reports, nil
+	}
+
+	reporterIDSet := make(map[int64]struct{})
+	livecommentIDSet := make(map[int64]struct{})
+	for _, rm := range reportModels {
+		reporterIDSet[rm.UserID] = struct{}{}
+		livecommentIDSet[rm.LivecommentID] = struct{}{}
+	}
+	reporterIDs := make([]int64, 0, len(reporterIDSet))
+	for id := range reporterIDSet {
+		reporterIDs = append(reporterIDs, id)
+	}
+	ids := make([]int64, 0, len(livecommentIDSet))
+	for id := range livecommentIDSet {
+		ids = append(ids, id)
+	}
+
+	reporterMap, err := getUsersByIDs(ctx, db, reporterIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	livecommentModels, err := livecommentRepo.FindByIDs(ctx, db, ids)
+	if err != nil {
+		return nil, err
+	}
+	livecomments, err := fillLivecommentResponses(ctx, db, livecommentModels)
+	if err != nil {
+		return nil, err
+	}
+	livecommentMap := make(map[int64]Livecomment, len(livecomments))
+	for _, l := range livecomments {
+		livecommentMap[l.ID] = l
+	}
+
+	for i, rm := range reportModels {
+		reporter, ok := reporterMap[rm.UserID]
+		if !ok {
+			return nil, fmt.Errorf("user %d not found", rm.UserID)
+		}
+		livecomment, ok := livecommentMap[rm.LivecommentID]
+		if !ok {
+			return nil, fmt.Errorf("livecomment %d not found", rm.LivecommentID)
+		}
+		reports[i] = LivecommentReport{
+			ID:          rm.ID,
+			Reporter:    reporter,
+			Livecomment: livecomment,
+			CreatedAt:   rm.CreatedAt,
+		}
+	}
+
+	return reports, nil
+}
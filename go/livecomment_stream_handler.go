@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/hub"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ライブコメントのストリーミング
+// 投稿のイベントとNGワードでの削除のコミット後にlivecommentStreamsへ送り、購読中の接続がServer-Sent Eventsで書き出す
+// 再接続時にLast-Event-IDがあれば、その後のイベントを送ってから購読分を流す
+// 購読のある配信 (と購読がなくなってlivecommentStreamReplayTTLの間) は、直近livecommentStreamReplayLimit件のイベントをlivecommentStreamsに貯めてあり、そこから送れれば削除も含めて途切れない
+// 貯めてある分より古い場合は、それより後のIDのライブコメントをDBから読んで送る
+// 受信が追いつかずバッファが溢れた接続は切るので、クライアントはLast-Event-IDを付けて再接続する
+// 複数台で受け付ける場合は、ISUCON13_REALTIME_RELAYでサーバ間に中継するか、配信ごとに振り分けること
+
+const (
+	livecommentStreamBufferSize  = 256
+	livecommentStreamReplayLimit = 100
+	// 接続が切れてから再接続するまでの間に送ったイベントを、貯めておく時間
+	livecommentStreamReplayTTL = realtimeIdleTimeout
+
+	livecommentEventCreated = "livecomment"
+	livecommentEventDeleted = "livecomment_deleted"
+)
+
+// LivecommentTombstone は、削除されたライブコメントを知らせるイベント
+type LivecommentTombstone struct {
+	LivestreamID   int64   `json:"livestream_id"`
+	LivecommentIDs []int64 `json:"livecomment_ids"`
+}
+
+type livecommentStreamEvent struct {
+	name string
+	// 投稿の場合のみ。削除の場合は0
+	livecommentID int64
+	authorID      int64
+	// 購読者ごとにJSONにしないよう、送る前に1回だけ作る
+	data []byte
+}
+
+// 配信ID -> 購読
+// 取りこぼすとLast-Event-IDより前が抜けるので、1件でも落としたら切る
+var livecommentStreams = hub.New[int64, livecommentStreamEvent](hub.Options{
+	Name:       "livecomments",
+	BufferSize: livecommentStreamBufferSize,
+	ReplaySize: livecommentStreamReplayLimit,
+	ReplayTTL:  livecommentStreamReplayTTL,
+})
+
+// 他のサーバに中継する形
+type livecommentStreamMessage struct {
+	Name          string          `json:"name"`
+	LivecommentID int64           `json:"livecomment_id,omitempty"`
+	AuthorID      int64           `json:"author_id,omitempty"`
+	Data          json.RawMessage `json:"data"`
+}
+
+var livecommentRelay = newRealtimeTopic("livecomments", livecommentStreams,
+	func(event livecommentStreamEvent) ([]byte, error) {
+		return json.Marshal(livecommentStreamMessage{
+			Name:          event.name,
+			LivecommentID: event.livecommentID,
+			AuthorID:      event.authorID,
+			Data:          event.data,
+		})
+	},
+	func(data []byte) (livecommentStreamEvent, error) {
+		var message livecommentStreamMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			return livecommentStreamEvent{}, err
+		}
+		return livecommentStreamEvent{
+			name:          message.Name,
+			livecommentID: message.LivecommentID,
+			authorID:      message.AuthorID,
+			data:          message.Data,
+		}, nil
+	},
+)
+
+// streamLivecomment は、シャドウバンされたユーザの投稿も送る (購読者ごとに除く)
+func streamLivecomment(ctx context.Context, event LivecommentCreated) error {
+	livecomment := event.Livecomment
+	data, err := json.Marshal(livecomment)
+	if err != nil {
+		return err
+	}
+	livecommentRelay.Publish(ctx, livecomment.Livestream.ID, livecommentStreamEvent{
+		name:          livecommentEventCreated,
+		livecommentID: livecomment.ID,
+		authorID:      livecomment.User.ID,
+		data:          data,
+	})
+	return nil
+}
+
+// publishLivecommentDeletion は、ライブコメントの削除のコミット後に呼ぶ
+func publishLivecommentDeletion(ctx context.Context, livestreamID int64, deletedIDs []int64) {
+	if len(deletedIDs) == 0 {
+		return
+	}
+	data, err := json.Marshal(LivecommentTombstone{LivestreamID: livestreamID, LivecommentIDs: deletedIDs})
+	if err != nil {
+		return
+	}
+	livecommentRelay.Publish(ctx, livestreamID, livecommentStreamEvent{name: livecommentEventDeleted, data: data})
+}
+
+// writeServerSentEvent は、idが0の場合はidを付けない (Last-Event-IDはライブコメントのIDだけにする)
+func writeServerSentEvent(w io.Writer, name string, id int64, data []byte) error {
+	if id != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	return err
+}
+
+// loadLivecommentStreamReplay は、lastEventIDより後のライブコメントをlivecommentStreamReplayLimit件までDBから読む
+// 削除は読めないので、再接続までの間に削除されたものは送れない
+// IDの順と投稿の順はサーバをまたぐとずれる (id_generator_handler.go) ので、再接続の間に別のサーバで投稿された
+// lastEventIDより小さいIDは送れないことがある (ずれはidBlockMaxAgeの間に投稿されたものに限られる)
+func loadLivecommentStreamReplay(ctx context.Context, livestreamID, lastEventID int64) ([]livecommentStreamEvent, error) {
+	var livecommentModels []LivecommentModel
+	if err := dbConn.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? AND id > ? ORDER BY id LIMIT ?", livestreamID, lastEventID, livecommentStreamReplayLimit); err != nil {
+		return nil, err
+	}
+	livecomments, err := fillLivecommentResponses(ctx, dbConn, livecommentModels)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]livecommentStreamEvent, 0, len(livecomments))
+	for _, livecomment := range livecomments {
+		data, err := json.Marshal(livecomment)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, livecommentStreamEvent{
+			name:          livecommentEventCreated,
+			livecommentID: livecomment.ID,
+			authorID:      livecomment.User.ID,
+			data:          data,
+		})
+	}
+	return events, nil
+}
+
+// ライブコメントストリーミングAPI
+// GET /api/livestream/:livestream_id/livecomment/stream
+// シャドウバンされたユーザのライブコメントは、本人以外には送らない
+func streamLivecommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var lastEventID int64
+	if v := c.Request().Header.Get("Last-Event-ID"); v != "" {
+		lastEventID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Last-Event-ID must be integer")
+		}
+	}
+
+	if _, err := livestreamRepo.FindByID(ctx, dbConn, int64(livestreamID)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	var sub *hub.Subscription[int64, livecommentStreamEvent]
+	var replay []livecommentStreamEvent
+	if lastEventID > 0 {
+		// 直近の送信分に再接続前の最後のイベントが残っていれば、その後から途切れなく送れる
+		var ok bool
+		sub, replay, ok = livecommentStreams.SubscribeAfter(int64(livestreamID), func(event livecommentStreamEvent) bool {
+			return event.livecommentID == lastEventID
+		})
+		if !ok {
+			// 残っていない場合 (古すぎる・別のサーバに繋いでいた・再起動した) はDBから読む
+			// 取りこぼさないよう購読してから読むので、読んだものが購読分と重なることがある
+			replay, err = loadLivecommentStreamReplay(ctx, int64(livestreamID), lastEventID)
+			if err != nil {
+				sub.Close()
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+			}
+		}
+	} else {
+		sub = livecommentStreams.Subscribe(int64(livestreamID))
+	}
+	defer sub.Close()
+
+	// シャドウバンされたユーザのライブコメントは、本人以外には送らない
+	visible := func(event livecommentStreamEvent) (bool, error) {
+		if event.name != livecommentEventCreated || event.authorID == userID {
+			return true, nil
+		}
+		banned, err := shadowBans.get(ctx, int64(livestreamID))
+		if err != nil {
+			return false, err
+		}
+		_, ok := banned[event.authorID]
+		return !ok, nil
+	}
+
+	visibleReplay := replay[:0]
+	for _, event := range replay {
+		ok, err := visible(event)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get shadow bans: "+err.Error())
+		}
+		if ok {
+			visibleReplay = append(visibleReplay, event)
+		}
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	// nginxにバッファさせない
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	defer clearWriteDeadline(res)
+
+	// ここから先はステータスコードを返せないので、書き込めなくなったら打ち切る
+	replayed := make(map[int64]struct{}, len(visibleReplay))
+	if err := sendServerSentEvents(res, sub.Touch, func(w io.Writer) error {
+		for _, event := range visibleReplay {
+			if err := writeServerSentEvent(w, event.name, event.livecommentID, event.data); err != nil {
+				return err
+			}
+			if event.livecommentID != 0 {
+				replayed[event.livecommentID] = struct{}{}
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil
+	}
+
+	keepAlive := time.NewTicker(serverSentEventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-keepAlive.C:
+			err = sendServerSentEvents(res, sub.Touch, writeServerSentEventKeepAlive)
+		case event, ok := <-sub.Events():
+			if !ok {
+				// 受信が追いつかず切られた・配信が削除された・死活確認で閉じられた・サーバが終了する
+				return nil
+			}
+			if _, ok := replayed[event.livecommentID]; ok {
+				continue
+			}
+			var show bool
+			show, err = visible(event)
+			if err != nil {
+				c.Logger().Errorf("failed to get shadow bans for stream: %+v", err)
+				return nil
+			}
+			if !show {
+				continue
+			}
+			err = sendServerSentEvents(res, sub.Touch, func(w io.Writer) error {
+				return writeServerSentEvent(w, event.name, event.livecommentID, event.data)
+			})
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
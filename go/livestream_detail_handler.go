@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/cache"
+	"github.com/jmoiron/sqlx"
+)
+
+// 配信のレスポンスのうち、タグとコラボレーターのキャッシュ
+// タグは予約時に決まって変わらず、コラボレーターは承諾・退会・配信の削除でのみ変わるので、そのときに消す
+// 他のアプリサーバでの変更はlivestreamDetailCacheTTLが過ぎるまで反映されない
+// 配信者・コラボレーターはフォロワー数やアイコンが変わるのでユーザIDだけ持ち、レスポンスのたびに組み立てる
+// タイトルや状態などlivestreamsの列も、呼び出し元がトランザクション内で読んだ行の値を使う
+// キャッシュに入れるのはトランザクションを張らずにプライマリから読んだものだけ
+// (トランザクション内ではコミット前の行が見え、レプリカでは古い行が見えるため)
+const (
+	livestreamDetailCacheTTL        = 10 * time.Second
+	livestreamDetailCacheMaxEntries = 10000
+)
+
+type livestreamDetail struct {
+	tags []Tag
+	// 承諾済みのコラボレーター (承諾順)
+	collaboratorIDs []int64
+}
+
+var livestreamDetails = cache.New[int64, livestreamDetail](cache.Options[livestreamDetail]{
+	Name:       "livestream_details",
+	TTL:        livestreamDetailCacheTTL,
+	MaxEntries: livestreamDetailCacheMaxEntries,
+})
+
+// getLivestreamDetails は、配信ごとのタグとコラボレーターを返す
+// キャッシュにない配信はまとめてdbから読み込む。dbがプライマリでなければ覚えない
+func getLivestreamDetails(ctx context.Context, db dbQueryer, livestreamIDs []int64) (map[int64]livestreamDetail, error) {
+	getOrLoad := livestreamDetails.GetOrLoadMany
+	if !isPrimary(db) {
+		getOrLoad = livestreamDetails.GetOrReadMany
+	}
+	return getOrLoad(ctx, livestreamIDs, func(ctx context.Context, livestreamIDs []int64) (map[int64]livestreamDetail, error) {
+		type LivestreamTag struct {
+			LivestreamID int64  `db:"livestream_id"`
+			TagID        int64  `db:"tag_id"`
+			TagName      string `db:"tag_name"`
+		}
+		var livestreamTags []LivestreamTag
+		query, args, err := sqlx.In("SELECT lt.livestream_id, t.id AS tag_id, t.name AS tag_name FROM livestream_tags lt INNER JOIN tags t ON t.id = lt.tag_id WHERE lt.livestream_id IN (?) ORDER BY lt.id", livestreamIDs)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.SelectContext(ctx, &livestreamTags, db.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+
+		var collaboratorModels []LivestreamCollaboratorModel
+		query, args, err = sqlx.In("SELECT * FROM livestream_collaborators WHERE livestream_id IN (?) AND status = ? ORDER BY id", livestreamIDs, collaboratorStatusAccepted)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.SelectContext(ctx, &collaboratorModels, db.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+
+		details := make(map[int64]livestreamDetail, len(livestreamIDs))
+		for _, livestreamID := range livestreamIDs {
+			details[livestreamID] = livestreamDetail{tags: []Tag{}}
+		}
+		for _, lt := range livestreamTags {
+			detail := details[lt.LivestreamID]
+			detail.tags = append(detail.tags, Tag{ID: lt.TagID, Name: lt.TagName})
+			details[lt.LivestreamID] = detail
+		}
+		for _, cm := range collaboratorModels {
+			detail := details[cm.LivestreamID]
+			detail.collaboratorIDs = append(detail.collaboratorIDs, cm.UserID)
+			details[cm.LivestreamID] = detail
+		}
+		return details, nil
+	})
+}
+
+// getLivestreamTagsAndCollaborators は、1配信のタグとコラボレーターを返す
+func getLivestreamTagsAndCollaborators(ctx context.Context, db dbQueryer, livestreamID int64) ([]Tag, []User, error) {
+	details, err := getLivestreamDetails(ctx, db, []int64{livestreamID})
+	if err != nil {
+		return nil, nil, err
+	}
+	detail := details[livestreamID]
+	userMap, err := getUsersByIDs(ctx, db, detail.collaboratorIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return detail.tags, detail.collaborators(userMap), nil
+}
+
+// collaborators は、userMapからコラボレーターを承諾順に並べる
+func (d livestreamDetail) collaborators(userMap map[int64]User) []User {
+	collaborators := make([]User, 0, len(d.collaboratorIDs))
+	for _, userID := range d.collaboratorIDs {
+		if user, ok := userMap[userID]; ok {
+			collaborators = append(collaborators, user)
+		}
+	}
+	return collaborators
+}
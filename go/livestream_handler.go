@@ -8,21 +8,45 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/isucon/isucon13/webapp/go/internal/bulk"
+	"github.com/isucon/isucon13/webapp/go/internal/counter"
+	"github.com/isucon/isucon13/webapp/go/internal/repository"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
 type ReserveLivestreamRequest struct {
-	Tags         []int64 `json:"tags"`
-	Title        string  `json:"title"`
-	Description  string  `json:"description"`
-	PlaylistUrl  string  `json:"playlist_url"`
-	ThumbnailUrl string  `json:"thumbnail_url"`
-	StartAt      int64   `json:"start_at"`
-	EndAt        int64   `json:"end_at"`
+	Tags []int64 `json:"tags"`
+	// コラボレーターとして招待するユーザのID
+	Collaborators []int64 `json:"collaborators"`
+	Title         string  `json:"title"`
+	Description   string  `json:"description"`
+	PlaylistUrl   string  `json:"playlist_url"`
+	ThumbnailUrl  string  `json:"thumbnail_url"`
+	// 指定された場合はアプリで保存し、thumbnail_urlはアプリの配信URLになる
+	Thumbnail []byte `json:"thumbnail"`
+	StartAt   int64  `json:"start_at"`
+	EndAt     int64  `json:"end_at"`
+	// 配信言語 (ja, en-US など)
+	Language string `json:"language"`
+	// categoriesマスタのname
+	Category string `json:"category"`
+}
+
+// nilのフィールドは更新しない
+type PatchLivestreamRequest struct {
+	Title        *string `json:"title"`
+	Description  *string `json:"description"`
+	ThumbnailUrl *string `json:"thumbnail_url"`
+	Thumbnail    []byte  `json:"thumbnail"`
+	// 変更不可 (現在の値と同じであれば受け付ける)
+	StartAt *int64 `json:"start_at"`
+	EndAt   *int64 `json:"end_at"`
 }
 
 type LivestreamViewerModel struct {
@@ -31,29 +55,58 @@ type LivestreamViewerModel struct {
 	CreatedAt    int64 `db:"created_at" json:"created_at"`
 }
 
-type LivestreamModel struct {
-	ID           int64  `db:"id" json:"id"`
-	UserID       int64  `db:"user_id" json:"user_id"`
-	Title        string `db:"title" json:"title"`
-	Description  string `db:"description" json:"description"`
-	PlaylistUrl  string `db:"playlist_url" json:"playlist_url"`
-	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
-	StartAt      int64  `db:"start_at" json:"start_at"`
-	EndAt        int64  `db:"end_at" json:"end_at"`
-}
+type LivestreamModel = repository.LivestreamModel
 
 type Livestream struct {
-	ID           int64  `json:"id"`
-	Owner        User   `json:"owner"`
-	Title        string `json:"title"`
-	Description  string `json:"description"`
-	PlaylistUrl  string `json:"playlist_url"`
-	ThumbnailUrl string `json:"thumbnail_url"`
-	Tags         []Tag  `json:"tags"`
-	StartAt      int64  `json:"start_at"`
-	EndAt        int64  `json:"end_at"`
+	ID            int64  `json:"id"`
+	Owner         User   `json:"owner"`
+	Collaborators []User `json:"collaborators"`
+	Title         string `json:"title"`
+	Description   string `json:"description"`
+	PlaylistUrl   string `json:"playlist_url"`
+	ThumbnailUrl  string `json:"thumbnail_url"`
+	Tags          []Tag  `json:"tags"`
+	StartAt       int64  `json:"start_at"`
+	EndAt         int64  `json:"end_at"`
+	Status        string `json:"status"`
+	Language      string `json:"language"`
+	Category      string `json:"category"`
 }
 
+// 番組表の1枠 (1時間)
+type LivestreamScheduleSlot struct {
+	StartAt     int64        `json:"start_at"`
+	EndAt       int64        `json:"end_at"`
+	Livestreams []Livestream `json:"livestreams"`
+}
+
+// 配信情報に簡易統計のフィールドを加えたもの
+type LivestreamWithStatistics struct {
+	Livestream
+	LivestreamMiniStatistics
+}
+
+// ページングモードの配信検索のレスポンス
+// next_cursorは最終ページではnull
+type SearchLivestreamsPage struct {
+	Livestreams []Livestream `json:"livestreams"`
+	NextCursor  *int64       `json:"next_cursor"`
+}
+
+const (
+	defaultSearchLivestreamsPageLimit = 20
+	maxSearchLivestreamsPageLimit     = 100
+)
+
+// FULLTEXTインデックスのngram_token_size (MySQLの既定値)
+// これより短い検索語はトークンにならずFULLTEXTインデックスで引けないので、LIKEで探す
+const ngramTokenSize = 2
+
+const (
+	scheduleSlotSeconds   = 60 * 60
+	maxScheduleRangeSlots = 24 * 7
+)
+
 type LivestreamTagModel struct {
 	ID           int64 `db:"id" json:"id"`
 	LivestreamID int64 `db:"livestream_id" json:"livestream_id"`
@@ -85,12 +138,21 @@ func reserveLivestreamHandler(c echo.Context) error {
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
-
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	if len(req.Thumbnail) > maxThumbnailSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "thumbnail is too large")
+	}
+	if !isValidLanguage(req.Language) {
+		return echo.NewHTTPError(http.StatusBadRequest, "language must be a language tag such as ja or en-US")
+	}
+	if req.Category != "" {
+		ok, err := categories.exists(ctx, req.Category)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get categories: "+err.Error())
+		}
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown category")
+		}
 	}
-	defer tx.Rollback()
 
 	// 2023/11/25 10:00からの１年間の期間内であるかチェック
 	var (
@@ -103,26 +165,30 @@ func reserveLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
 	}
 
-	// 予約枠をみて、予約が可能か調べる
-	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
-	var slots []*ReservationSlotModel
-	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
-		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
-	}
-	for _, slot := range slots {
-		var count int
-		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	// デッドロックなどでやり直す場合があるので、サムネイルの書き出しはコミットの直前に行う
+	var livestreamModel LivestreamModel
+	err := runInTxCommit(ctx, func(tx *sqlx.Tx) error {
+		// 予約枠を一括で確保する
+		// 残数のある枠だけを減らし、減らせた枠数が区間内の枠数に満たなければ予約できない
+		// NOTE: UPDATEが行ロックを取るので、並列な予約でもoverbookingしない
+		var slotCount int64
+		if err := tx.GetContext(ctx, &slotCount, "SELECT COUNT(*) FROM reservation_slots WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
+			c.Logger().Warnf("予約枠数取得でエラー発生: %+v", err)
+			return fmt.Errorf("failed to count reservation_slots: %w", err)
 		}
-		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
-		if count < 1 {
+		rs, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ? AND slot > 0", req.StartAt, req.EndAt)
+		if err != nil {
+			return fmt.Errorf("failed to update reservation_slot: %w", err)
+		}
+		reservedCount, err := rs.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get affected rows: %w", err)
+		}
+		if reservedCount != slotCount {
 			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
 		}
-	}
 
-	var (
-		livestreamModel = &LivestreamModel{
+		livestreamModel = LivestreamModel{
 			UserID:       int64(userID),
 			Title:        req.Title,
 			Description:  req.Description,
@@ -130,115 +196,208 @@ func reserveLivestreamHandler(c echo.Context) error {
 			ThumbnailUrl: req.ThumbnailUrl,
 			StartAt:      req.StartAt,
 			EndAt:        req.EndAt,
+			Status:       livestreamStatusReserved,
+			Language:     req.Language,
+			Category:     req.Category,
 		}
-	)
+		livestreamID, err := livestreamRepo.Insert(ctx, tx, livestreamModel)
+		if err != nil {
+			return fmt.Errorf("failed to insert livestream: %w", err)
+		}
+		livestreamModel.ID = livestreamID
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
-	}
+		// サムネイル保存
+		if len(req.Thumbnail) > 0 {
+			livestreamModel.ThumbnailUrl = livestreamThumbnailURL(livestreamID)
+			if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET thumbnail_url = ? WHERE id = ?", livestreamModel.ThumbnailUrl, livestreamID); err != nil {
+				return fmt.Errorf("failed to update thumbnail_url: %w", err)
+			}
+		}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
+		// タグ追加
+		tagRows := make([][]interface{}, 0, len(req.Tags))
+		for _, tagID := range req.Tags {
+			tagRows = append(tagRows, []interface{}{livestreamID, tagID})
+		}
+		if err := bulk.Insert(ctx, tx, "livestream_tags", []string{"livestream_id", "tag_id"}, tagRows); err != nil {
+			return fmt.Errorf("failed to insert livestream tag: %w", err)
+		}
+
+		// コラボレーター招待
+		for _, collaboratorID := range req.Collaborators {
+			if _, err := inviteCollaborator(ctx, tx, livestreamID, userID, collaboratorID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(tx *sqlx.Tx) error {
+		// 他の処理が全て成功してからファイルに書き出す
+		if len(req.Thumbnail) > 0 {
+			if err := saveLivestreamThumbnail(livestreamModel.ID, req.Thumbnail); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to save thumbnail: "+err.Error())
+			}
+		}
+		if err := reservationSlots.commitWithDelta(tx, req.StartAt, req.EndAt, -1); err != nil {
+			if len(req.Thumbnail) > 0 {
+				removeLivestreamThumbnail(livestreamModel.ID)
+			}
+			return fmt.Errorf("failed to commit: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
+		return err
 	}
+	livestreamID := livestreamModel.ID
 
-	livestreamID, err := rs.LastInsertId()
+	livestream, err := fillLivestreamResponse(ctx, dbConn, livestreamModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
-	livestreamModel.ID = livestreamID
+	tagSuggestIndex.add(req.Tags, 1)
+	forgetMissingLivestream(livestreamID)
+	addLivestreamToRanking(ctx, livestreamID)
+	purgeResponseCache()
 
-	// タグ追加
-	for _, tagID := range req.Tags {
-		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
-			LivestreamID: livestreamID,
-			TagID:        tagID,
-		}); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+func searchLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	keyTagName := c.QueryParam("tag")
+	keyword := strings.TrimSpace(c.QueryParam("q"))
+
+	query := "SELECT * FROM livestreams WHERE 1 = 1"
+	var args []interface{}
+	if keyTagName != "" {
+		// タグによる取得 (livestream_tags.tag_id のインデックスで引く)
+		query += " AND id IN (SELECT lt.livestream_id FROM livestream_tags lt INNER JOIN tags t ON t.id = lt.tag_id WHERE t.name = ?)"
+		args = append(args, keyTagName)
+	}
+	if language := c.QueryParam("language"); language != "" {
+		query += " AND language = ?"
+		args = append(args, language)
+	}
+	if category := c.QueryParam("category"); category != "" {
+		query += " AND category = ?"
+		args = append(args, category)
+	}
+	if keyword != "" && utf8.RuneCountInString(keyword) < ngramTokenSize {
+		// タイトル・説明文のキーワード検索 (短い検索語はLIKEで探す)
+		pattern := "%" + escapeLikePattern(keyword) + "%"
+		query += " AND (title LIKE ? OR description LIKE ?)"
+		args = append(args, pattern, pattern)
+	} else if keyword != "" {
+		// タイトル・説明文のキーワード検索 (ngramのFULLTEXTインデックスで引く)
+		query += " AND MATCH (title, description) AGAINST (? IN BOOLEAN MODE)"
+		args = append(args, `"`+strings.ReplaceAll(keyword, `"`, " ")+`"`)
+	}
+	// cursorパラメータ(空文字も可)が指定された場合はページングモード
+	// 件数を制限し、次ページのカーソルを含むレスポンスを返す
+	// 指定されない場合は従来どおり配信の配列を返す
+	paginated := c.QueryParams().Has("cursor")
+	if c.QueryParam("cursor") != "" {
+		// 前ページ最後の配信IDより古いものを返す
+		cursor, err := strconv.ParseInt(c.QueryParam("cursor"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "cursor query parameter must be integer")
+		}
+		query += " AND id < ?"
+		args = append(args, cursor)
+	}
+	query += " ORDER BY id DESC"
+	limit := 0
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
 		}
 	}
+	if paginated {
+		if limit <= 0 {
+			limit = defaultSearchLivestreamsPageLimit
+		}
+		limit = min(limit, maxSearchLivestreamsPageLimit)
+	}
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	db := readDB()
+
+	var livestreamModels []LivestreamModel
+	if err := db.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
 
-	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	livestreams, err := fillLivestreamResponses(ctx, db, livestreamModels)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	if !paginated {
+		return c.JSON(http.StatusOK, livestreams)
 	}
-
-	return c.JSON(http.StatusCreated, livestream)
+	resp := SearchLivestreamsPage{Livestreams: livestreams}
+	if len(livestreams) == limit {
+		nextCursor := livestreams[len(livestreams)-1].ID
+		resp.NextCursor = &nextCursor
+	}
+	return c.JSON(http.StatusOK, resp)
 }
 
-func searchLivestreamsHandler(c echo.Context) error {
+// 番組表API
+// GET /api/livestream/schedule?from=&until=
+// 期間と重なる配信を、1時間ごとの枠にまとめて返す
+func getLivestreamScheduleHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	keyTagName := c.QueryParam("tag")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+	}
+	until, err := strconv.ParseInt(c.QueryParam("until"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "until query parameter must be integer")
+	}
+	// 枠の境界に揃える
+	from -= from % scheduleSlotSeconds
+	if until <= from {
+		return echo.NewHTTPError(http.StatusBadRequest, "until must be after from")
+	}
+	if (until-from)/scheduleSlotSeconds > maxScheduleRangeSlots {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("schedule range must be within %d hours", maxScheduleRangeSlots))
 	}
-	defer tx.Rollback()
-
-	var livestreamModels []*LivestreamModel
-	if c.QueryParam("tag") != "" {
-		// タグによる取得
-		var tagIDList []int
-		if err := tx.SelectContext(ctx, &tagIDList, "SELECT id FROM tags WHERE name = ?", keyTagName); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
-		}
 
-		query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE tag_id IN (?) ORDER BY livestream_id DESC", tagIDList)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
-		}
-		var keyTaggedLivestreams []*LivestreamTagModel
-		if err := tx.SelectContext(ctx, &keyTaggedLivestreams, query, params...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error())
-		}
+	db := readDB()
 
-		var livestreamIDs []int64
-		for _, keyTaggedLivestream := range keyTaggedLivestreams {
-			livestreamIDs = append(livestreamIDs, keyTaggedLivestream.LivestreamID)
-		}
+	var livestreamModels []LivestreamModel
+	if err := db.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE start_at < ? AND end_at > ? ORDER BY start_at, id", until, from); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
 
-		query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?) ORDER BY id DESC", livestreamIDs)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
-		}
-		query = tx.Rebind(query)
+	livestreams, err := fillLivestreamResponses(ctx, db, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
 
-		if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	slots := []LivestreamScheduleSlot{}
+	for slotStartAt := from; slotStartAt < until; slotStartAt += scheduleSlotSeconds {
+		slot := LivestreamScheduleSlot{
+			StartAt:     slotStartAt,
+			EndAt:       slotStartAt + scheduleSlotSeconds,
+			Livestreams: []Livestream{},
 		}
-	} else {
-		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
-		if c.QueryParam("limit") != "" {
-			limit, err := strconv.Atoi(c.QueryParam("limit"))
-			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+		for _, livestream := range livestreams {
+			if livestream.StartAt < slot.EndAt && livestream.EndAt > slot.StartAt {
+				slot.Livestreams = append(slot.Livestreams, livestream)
 			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
-		}
-
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 		}
+		slots = append(slots, slot)
 	}
 
-	livestreams := make([]Livestream, len(livestreamModels))
-	livestreamModelsValue := make([]LivestreamModel, len(livestreamModels))
-	for i, model := range livestreamModels {
-		livestreamModelsValue[i] = *model
-	}
-	livestreams, err = fillLivestreamResponses(ctx, tx, livestreamModelsValue)
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
-	return c.JSON(http.StatusOK, livestreams)
+	return c.JSON(http.StatusOK, slots)
 }
 
 func getMyLivestreamsHandler(c echo.Context) error {
@@ -247,33 +406,39 @@ func getMyLivestreamsHandler(c echo.Context) error {
 		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
+	livestreamModels, err := livestreamRepo.ListByUserID(ctx, dbConn, userID)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
-	livestreams := make([]Livestream, len(livestreamModels))
-	livestreamModelsValue := make([]LivestreamModel, len(livestreamModels))
-	for i, model := range livestreamModels {
-		livestreamModelsValue[i] = *model
-	}
-	livestreams, err = fillLivestreamResponses(ctx, tx, livestreamModelsValue)
+	livestreams, err := fillLivestreamResponses(ctx, dbConn, livestreamModels)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	// ダッシュボード向けに、配信ごとの簡易統計を添える
+	if c.QueryParam("with_stats") == "true" {
+		livestreamIDs := make([]int64, len(livestreams))
+		for i := range livestreams {
+			livestreamIDs[i] = livestreams[i].ID
+		}
+		stats, err := getLivestreamsMiniStatistics(ctx, dbConn, livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream statistics: "+err.Error())
+		}
+
+		livestreamsWithStats := make([]LivestreamWithStatistics, len(livestreams))
+		for i := range livestreams {
+			livestreamsWithStats[i] = LivestreamWithStatistics{
+				Livestream:               livestreams[i],
+				LivestreamMiniStatistics: stats[livestreams[i].ID],
+			}
+		}
+		return c.JSON(http.StatusOK, livestreamsWithStats)
 	}
 
 	return c.JSON(http.StatusOK, livestreams)
@@ -287,14 +452,10 @@ func getUserLivestreamsHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
+	db := readDB()
 
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+	user, err := userRepo.FindByName(ctx, db, username)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "user not found")
 		} else {
@@ -302,21 +463,13 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		}
 	}
 
-	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil {
+	var livestreamModels []LivestreamModel
+	if livestreamModels, err = livestreamRepo.ListByUserID(ctx, db, user.ID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
-	livestreams := make([]Livestream, len(livestreamModels))
-	for i := range livestreamModels {
-		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
-		}
-		livestreams[i] = livestream
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	livestreams, err := fillLivestreamResponses(ctx, db, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
 
 	return c.JSON(http.StatusOK, livestreams)
@@ -352,14 +505,34 @@ func enterLivestreamHandler(c echo.Context) error {
 		CreatedAt:    time.Now().Unix(),
 	}
 
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
+	// 同じ視聴者の行は1つだけにする (created_atは再入室時刻で更新)
+	// 視聴中の再入室は、ハートビートを送っている視聴者ならハートビートと同じく生存通知として扱う
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at) ON DUPLICATE KEY UPDATE created_at = VALUES(created_at), heartbeat_at = IF(heartbeat_at IS NULL, NULL, VALUES(created_at))", viewer)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
 	}
+	// 追加した場合は1、既にあった行を更新した場合は2 (変わらなければ0)
+	inserted, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
+	}
+	// 視聴履歴 (退室・期限切れでも消さない)
+	// 視聴中の再入室では増やさない
+	if inserted == 1 {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO livestream_watch_history (user_id, livestream_id, watched_at) VALUES (?, ?, ?)", viewer.UserID, viewer.LivestreamID, viewer.CreatedAt); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_watch_history: "+err.Error())
+		}
+	}
 
-	if err := tx.Commit(); err != nil {
+	counterEpoch, err := counter.Commit(tx.Commit)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if inserted == 1 {
+		viewerEntered.Publish(int64(livestreamID), ViewerEntered{LivestreamID: int64(livestreamID), UserID: userID, CounterEpoch: counterEpoch})
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -386,14 +559,24 @@ func exitLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
+	rs, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
+	}
+	deleted, err := rs.RowsAffected()
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
+	counterEpoch, err := counter.Commit(tx.Commit)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if deleted > 0 {
+		viewerLeft.Publish(int64(livestreamID), ViewerLeft{LivestreamID: int64(livestreamID), UserID: userID, CounterEpoch: counterEpoch})
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -408,38 +591,37 @@ func getLivestreamHandler(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
-
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	if isMissingLivestream(int64(livestreamID)) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
 	}
-	defer tx.Rollback()
 
 	livestreamModel := LivestreamModel{}
-	err = tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID)
+	livestreamModel, err = livestreamRepo.FindByID(ctx, dbConn, int64(livestreamID))
 	if errors.Is(err, sql.ErrNoRows) {
+		rememberMissingLivestream(int64(livestreamID))
 		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
 
-	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	livestream, err := fillLivestreamResponse(ctx, dbConn, livestreamModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
 	return c.JSON(http.StatusOK, livestream)
 }
 
-func getLivecommentReportsHandler(c echo.Context) error {
+// 配信情報更新API (配信者向け)
+// PATCH /api/livestream/:livestream_id
+// 指定されたフィールドだけを更新する
+func patchLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
 
 	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
@@ -448,240 +630,384 @@ func getLivecommentReportsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PatchLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if len(req.Thumbnail) > maxThumbnailSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "thumbnail is too large")
+	}
+	if req.Thumbnail != nil && req.ThumbnailUrl != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "thumbnail and thumbnail_url can't be specified together")
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	var livestreamModel LivestreamModel
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+	livestreamModel := LivestreamModel{}
+	if livestreamModel, err = livestreamRepo.FindByIDForUpdate(ctx, tx, int64(livestreamID)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't update other streamer's livestream")
+	}
 
-	// error already check
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already check
-	userID := sess.Values[defaultUserIDKey].(int64)
+	// 予約時に予約枠を消費しているので、配信時間帯は変更できない
+	if (req.StartAt != nil && *req.StartAt != livestreamModel.StartAt) || (req.EndAt != nil && *req.EndAt != livestreamModel.EndAt) {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at and end_at can't be changed after reservation")
+	}
 
-	if livestreamModel.UserID != userID {
-		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
+	if req.Title != nil {
+		livestreamModel.Title = *req.Title
+	}
+	if req.Description != nil {
+		livestreamModel.Description = *req.Description
+	}
+	if req.ThumbnailUrl != nil {
+		livestreamModel.ThumbnailUrl = *req.ThumbnailUrl
+	}
+	if req.Thumbnail != nil {
+		livestreamModel.ThumbnailUrl = livestreamThumbnailURL(livestreamModel.ID)
 	}
 
-	var reportModels []*LivecommentReportModel
-	if err := tx.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livestream_id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
+	if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description, thumbnail_url = :thumbnail_url WHERE id = :id", livestreamModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
 	}
 
-	reports := make([]LivecommentReport, len(reportModels))
-	for i := range reportModels {
-		report, err := fillLivecommentReportResponse(ctx, tx, *reportModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	// 差し替え前の画像はロールバックで戻せないので、コミット直前に書き出す
+	if req.Thumbnail != nil {
+		if err := saveLivestreamThumbnail(livestreamModel.ID, req.Thumbnail); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to save thumbnail: "+err.Error())
 		}
-		reports[i] = report
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, reports)
+	// メモリ上に保持している配信情報を更新
+	trending.update(livestream)
+	purgeResponseCache()
+
+	return c.JSON(http.StatusOK, livestream)
 }
 
-func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (Livestream, error) {
-	ownerModel := UserModel{}
-	if err := tx.GetContext(ctx, &ownerModel, "SELECT * FROM users WHERE id = ?", livestreamModel.UserID); err != nil {
-		return Livestream{}, err
+// 配信予約取り消しAPI (配信者向け)
+// DELETE /api/livestream/:livestream_id
+// 予約枠を戻し、ライブコメント・リアクションは統計から外すためtombstoneテーブルへ移す
+func cancelLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
-	owner, err := fillUserResponse(ctx, tx, ownerModel)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return Livestream{}, err
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	var livestreamTagModels []*LivestreamTagModel
-	if err := tx.SelectContext(ctx, &livestreamTagModels, "SELECT * FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
-		return Livestream{}, err
-	}
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
 
-	tagIDs := make([]int64, len(livestreamTagModels))
-	for i, tagModel := range livestreamTagModels {
-		tagIDs[i] = tagModel.TagID
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
+	defer tx.Rollback()
 
-	var tags []Tag
-	if len(tagIDs) > 0 {
-		query, args, err := sqlx.In("SELECT id, name FROM tags WHERE id IN (?)", tagIDs)
-		if err != nil {
-			return Livestream{}, err
-		}
-		query = tx.Rebind(query)
-
-		if err := tx.SelectContext(ctx, &tags, query, args...); err != nil {
-			return Livestream{}, err
+	livestreamModel := LivestreamModel{}
+	if livestreamModel, err = livestreamRepo.FindByIDForUpdate(ctx, tx, int64(livestreamID)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
 		}
-	} else {
-
-		tags = []Tag{}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
-
-	livestream := Livestream{
-		ID:           livestreamModel.ID,
-		Owner:        owner,
-		Title:        livestreamModel.Title,
-		Tags:         tags,
-		Description:  livestreamModel.Description,
-		PlaylistUrl:  livestreamModel.PlaylistUrl,
-		ThumbnailUrl: livestreamModel.ThumbnailUrl,
-		StartAt:      livestreamModel.StartAt,
-		EndAt:        livestreamModel.EndAt,
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't cancel other streamer's livestream")
 	}
-	return livestream, nil
-}
-
-func fillLivestreamResponses(ctx context.Context, tx *sqlx.Tx, livestreamModels []LivestreamModel) ([]Livestream, error) {
-	if len(livestreamModels) == 0 {
-		return []Livestream{}, nil
+	if livestreamModel.Status != livestreamStatusReserved {
+		return echo.NewHTTPError(http.StatusConflict, "only reserved livestreams can be cancelled")
+	}
+	// 状態は配信開始APIが呼ばれるまで予約中のままなので、開始時刻でも確かめる
+	now := time.Now().Unix()
+	if livestreamModel.StartAt <= now {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestreams that have already started can't be cancelled")
 	}
 
-	userIDMap := make(map[int64]struct{})
-	for _, lm := range livestreamModels {
-		userIDMap[lm.UserID] = struct{}{}
+	var deltas counterDeltas
+	tagIDs, err := purgeLivestream(ctx, tx, livestreamModel, now, &deltas)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to cancel livestream: "+err.Error())
 	}
-	userIDs := make([]int64, 0, len(userIDMap))
-	for id := range userIDMap {
-		userIDs = append(userIDs, id)
+
+	counterEpoch, err := counter.Commit(func() error {
+		return reservationSlots.commitWithDelta(tx, livestreamModel.StartAt, livestreamModel.EndAt, 1)
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	var userModels []UserModel
-	if len(userIDs) > 0 {
-		query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
-		if err != nil {
-			return nil, err
-		}
-		query = tx.Rebind(query)
+	deltas.apply(counterEpoch)
+	forgetLivestream(livestreamModel.ID, tagIDs)
+	purgeResponseCache()
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// purgeLivestream は、配信と配信に紐づく行を削除し、削除したタグのIDを返す
+// 予約中の配信の場合は予約枠を戻すので、コミットはreservationSlots.commitWithDeltaで行うこと
+// ライブコメント・リアクションは統計から外すためtombstoneテーブルへ移す
+// 減る件数はdeltasに加えるので、コミットはcounter.Commitで行いdeltas.applyすること
+// livestreamModelは行ロックを取って取得しておくこと
+func purgeLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, now int64, deltas *counterDeltas) ([]int64, error) {
+	livestreamID := livestreamModel.ID
 
-		if err := tx.SelectContext(ctx, &userModels, query, args...); err != nil {
+	if livestreamModel.Status == livestreamStatusReserved {
+		if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
 			return nil, err
 		}
 	}
 
-	userMap := make(map[int64]User)
-	for _, um := range userModels {
-		user, err := fillUserResponse(ctx, tx, um)
-		if err != nil {
+	var tagIDs []int64
+	if err := tx.SelectContext(ctx, &tagIDs, "SELECT tag_id FROM livestream_tags WHERE livestream_id = ?", livestreamID); err != nil {
+		return nil, err
+	}
+
+	var counts struct {
+		Reactions    int64 `db:"reactions"`
+		Viewers      int64 `db:"viewers"`
+		Reports      int64 `db:"reports"`
+		Livecomments int64 `db:"livecomments"`
+	}
+	// ライブコメントはシャドウバンされていないユーザの分だけ数えている
+	if err := tx.GetContext(ctx, &counts, `
+		SELECT
+		(SELECT COUNT(*) FROM reactions WHERE livestream_id = ?) AS reactions,
+		(SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?) AS viewers,
+		(SELECT COUNT(*) FROM livecomment_reports WHERE livestream_id = ?) AS reports,
+		(SELECT COUNT(*) FROM livecomments lc WHERE lc.livestream_id = ? AND NOT EXISTS (SELECT 1 FROM shadow_bans sb WHERE sb.livestream_id = lc.livestream_id AND sb.user_id = lc.user_id)) AS livecomments
+	`, livestreamID, livestreamID, livestreamID, livestreamID); err != nil {
+		return nil, err
+	}
+	deltas.add(livestreamReactionCounter, livestreamID, -counts.Reactions)
+	deltas.add(livestreamViewerCounter, livestreamID, -counts.Viewers)
+	deltas.add(livestreamReportCounter, livestreamID, -counts.Reports)
+	deltas.add(userReactionCounter, livestreamModel.UserID, -counts.Reactions)
+	deltas.add(userViewerCounter, livestreamModel.UserID, -counts.Viewers)
+	deltas.add(userLivecommentCounter, livestreamModel.UserID, -counts.Livecomments)
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO livecomment_tombstones (id, user_id, livestream_id, comment, tip, parent_id, created_at, deleted_at) SELECT id, user_id, livestream_id, comment, tip, parent_id, created_at, ? FROM livecomments WHERE livestream_id = ?", now, livestreamID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO reaction_tombstones (id, user_id, livestream_id, emoji_name, created_at, deleted_at) SELECT id, user_id, livestream_id, emoji_name, created_at, ? FROM reactions WHERE livestream_id = ?", now, livestreamID); err != nil {
+		return nil, err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM livecomments WHERE livestream_id = ?",
+		"DELETE FROM reactions WHERE livestream_id = ?",
+		"DELETE FROM livecomment_reports WHERE livestream_id = ?",
+		"DELETE FROM livestream_tags WHERE livestream_id = ?",
+		"DELETE FROM livestream_viewers_history WHERE livestream_id = ?",
+		"DELETE FROM livestream_watch_history WHERE livestream_id = ?",
+		"DELETE FROM livestream_collaborators WHERE livestream_id = ?",
+		"DELETE FROM ng_words WHERE livestream_id = ?",
+		"DELETE FROM shadow_bans WHERE livestream_id = ?",
+		"DELETE FROM moderation_logs WHERE livestream_id = ?",
+		"DELETE FROM livestream_settings WHERE livestream_id = ?",
+		"DELETE FROM notifications WHERE livestream_id = ?",
+		"DELETE FROM livestreams WHERE id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, query, livestreamID); err != nil {
 			return nil, err
 		}
-		userMap[um.ID] = user
 	}
+	return tagIDs, nil
+}
 
-	livestreamIDs := make([]int64, 0, len(livestreamModels))
-	for _, lm := range livestreamModels {
-		livestreamIDs = append(livestreamIDs, lm.ID)
+// forgetLivestream は、purgeLivestreamのコミット後にメモリ上の状態を片付ける
+func forgetLivestream(livestreamID int64, tagIDs []int64) {
+	shadowBans.invalidate(livestreamID)
+	ngWords.bump(livestreamID)
+	livestreamSettings.invalidate(livestreamID)
+	livecommentStreams.CloseTopic(livestreamID)
+	reactionStreams.CloseTopic(livestreamID)
+	presenceStreams.CloseTopic(livestreamID)
+	moderationStreams.CloseTopic(livestreamID)
+	trending.remove(livestreamID)
+	tagSuggestIndex.add(tagIDs, -1)
+	removeLivestreamThumbnail(livestreamID)
+	livestreamDetails.Delete(livestreamID)
+	invalidateRankings(context.Background())
+}
+
+func getLivecommentReportsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
 	}
 
-	var livestreamTagModels []LivestreamTagModel
-	if len(livestreamIDs) > 0 {
-		query, args, err := sqlx.In("SELECT * FROM livestream_tags WHERE livestream_id IN (?)", livestreamIDs)
-		if err != nil {
-			return nil, err
-		}
-		query = tx.Rebind(query)
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
 
-		if err := tx.SelectContext(ctx, &livestreamTagModels, query, args...); err != nil {
-			return nil, err
-		}
+	livestreamModel, err := livestreamRepo.FindByID(ctx, dbConn, int64(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
 
-	tagIDMap := make(map[int64]struct{})
-	livestreamToTagIDs := make(map[int64][]int64)
-	for _, ltm := range livestreamTagModels {
-		tagIDMap[ltm.TagID] = struct{}{}
-		livestreamToTagIDs[ltm.LivestreamID] = append(livestreamToTagIDs[ltm.LivestreamID], ltm.TagID)
+	// error already check
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already check
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	isModerator, err := isLivestreamModerator(ctx, dbConn, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborator: "+err.Error())
 	}
-	tagIDs := make([]int64, 0, len(tagIDMap))
-	for id := range tagIDMap {
-		tagIDs = append(tagIDs, id)
+	if !isModerator {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
 	}
 
-	var tagModels []TagModel
-	if len(tagIDs) > 0 {
-		query, args, err := sqlx.In("SELECT id, name FROM tags WHERE id IN (?)", tagIDs)
-		if err != nil {
-			return nil, err
-		}
-		query = tx.Rebind(query)
+	var reportModels []LivecommentReportModel
+	if err := dbConn.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
+	}
 
-		if err := tx.SelectContext(ctx, &tagModels, query, args...); err != nil {
-			return nil, err
-		}
+	reports, err := fillLivecommentReportResponses(ctx, dbConn, reportModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
+	}
 
-		tagMap := make(map[int64]Tag)
-		for _, tm := range tagModels {
-			tagMap[tm.ID] = Tag{
-				ID:   tm.ID,
-				Name: tm.Name,
-			}
-		}
+	return c.JSON(http.StatusOK, reports)
+}
 
-		livestreamToTags := make(map[int64][]Tag)
-		for lsID, tIDs := range livestreamToTagIDs {
-			for _, tID := range tIDs {
-				if tag, exists := tagMap[tID]; exists {
-					livestreamToTags[lsID] = append(livestreamToTags[lsID], tag)
-				}
-			}
-		}
+// getLivestreamByID は、配信を組み立てて返す
+// 存在しない場合はsql.ErrNoRowsを返す
+func getLivestreamByID(ctx context.Context, db dbQueryer, livestreamID int64) (Livestream, error) {
+	livestreamMap, err := getLivestreamsByIDs(ctx, db, []int64{livestreamID})
+	if err != nil {
+		return Livestream{}, err
+	}
+	livestream, ok := livestreamMap[livestreamID]
+	if !ok {
+		return Livestream{}, sql.ErrNoRows
+	}
+	return livestream, nil
+}
 
-		livestrems := make([]Livestream, 0, len(livestreamModels))
-		for _, lm := range livestreamModels {
-			owner, exists := userMap[lm.UserID]
-			if !exists {
-				return nil, errors.New("owner not found for user_id: " + string(lm.UserID))
-			}
+// getLivestreamsByIDs は、複数の配信をまとめて読み込んで組み立てる
+// 存在しないIDは結果のmapに含まれない
+// リクエスト内のメモにある配信は読み込まない
+func getLivestreamsByIDs(ctx context.Context, db dbQueryer, livestreamIDs []int64) (map[int64]Livestream, error) {
+	livestreamMap, livestreamIDs := requestMemoFrom(ctx).lookupLivestreams(livestreamIDs)
+	if len(livestreamIDs) == 0 {
+		return livestreamMap, nil
+	}
 
-			lsTags, exists := livestreamToTags[lm.ID]
-			if !exists {
-				lsTags = []Tag{}
-			}
+	livestreamModels, err := livestreamRepo.FindByIDs(ctx, db, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	livestreams, err := fillLivestreamResponses(ctx, db, livestreamModels)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range livestreams {
+		livestreamMap[l.ID] = l
+	}
 
-			livestream := Livestream{
-				ID:           lm.ID,
-				Owner:        owner,
-				Title:        lm.Title,
-				Tags:         lsTags,
-				Description:  lm.Description,
-				PlaylistUrl:  lm.PlaylistUrl,
-				ThumbnailUrl: lm.ThumbnailUrl,
-				StartAt:      lm.StartAt,
-				EndAt:        lm.EndAt,
-			}
-			livestrems = append(livestrems, livestream)
-		}
+	return livestreamMap, nil
+}
 
-		return livestrems, nil
+func fillLivestreamResponse(ctx context.Context, db dbQueryer, livestreamModel LivestreamModel) (Livestream, error) {
+	livestreams, err := fillLivestreamResponses(ctx, db, []LivestreamModel{livestreamModel})
+	if err != nil {
+		return Livestream{}, err
 	}
+	return livestreams[0], nil
+}
 
-	livestrems := make([]Livestream, 0, len(livestreamModels))
+// fillLivestreamResponses は、複数の配信をまとめて組み立てる
+// タグ・コラボレーターはlivestreamDetailsから引き、配信者とコラボレーターはIN句で一括取得してN+1クエリを避ける
+func fillLivestreamResponses(ctx context.Context, db dbQueryer, livestreamModels []LivestreamModel) ([]Livestream, error) {
+	if len(livestreamModels) == 0 {
+		return []Livestream{}, nil
+	}
+
+	livestreamIDs := make([]int64, 0, len(livestreamModels))
 	for _, lm := range livestreamModels {
-		owner, exists := userMap[lm.UserID]
-		if !exists {
-			return nil, errors.New("owner not found for user_id: " + string(lm.UserID))
-		}
+		livestreamIDs = append(livestreamIDs, lm.ID)
+	}
+	details, err := getLivestreamDetails(ctx, db, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
 
-		livestream := Livestream{
-			ID:           lm.ID,
-			Owner:        owner,
-			Title:        lm.Title,
-			Tags:         []Tag{}, // タグなし
-			Description:  lm.Description,
-			PlaylistUrl:  lm.PlaylistUrl,
-			ThumbnailUrl: lm.ThumbnailUrl,
-			StartAt:      lm.StartAt,
-			EndAt:        lm.EndAt,
+	// 配信者とコラボレーター
+	userIDSet := make(map[int64]struct{})
+	for _, lm := range livestreamModels {
+		userIDSet[lm.UserID] = struct{}{}
+		for _, userID := range details[lm.ID].collaboratorIDs {
+			userIDSet[userID] = struct{}{}
 		}
-		livestrems = append(livestrems, livestream)
+	}
+	userIDs := make([]int64, 0, len(userIDSet))
+	for id := range userIDSet {
+		userIDs = append(userIDs, id)
+	}
+	userMap, err := getUsersByIDs(ctx, db, userIDs)
+	if err != nil {
+		return nil, err
 	}
 
-	return livestrems, nil
+	livestreams := make([]Livestream, 0, len(livestreamModels))
+	for _, lm := range livestreamModels {
+		owner, exists := userMap[lm.UserID]
+		if !exists {
+			return nil, fmt.Errorf("owner not found for user_id: %d", lm.UserID)
+		}
+		detail := details[lm.ID]
+
+		livestreams = append(livestreams, Livestream{
+			ID:            lm.ID,
+			Owner:         owner,
+			Collaborators: detail.collaborators(userMap),
+			Title:         lm.Title,
+			Tags:          detail.tags,
+			Description:   lm.Description,
+			PlaylistUrl:   lm.PlaylistUrl,
+			ThumbnailUrl:  lm.ThumbnailUrl,
+			StartAt:       lm.StartAt,
+			EndAt:         lm.EndAt,
+			Status:        lm.Status,
+			Language:      lm.Language,
+			Category:      lm.Category,
+		})
+	}
+	requestMemoFrom(ctx).storeLivestreams(livestreams)
+
+	return livestreams, nil
 }
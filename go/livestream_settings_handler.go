@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信ごとのライブコメント・リアクションの制限
+// 行がない配信は制限なし(デフォルト値)として扱う
+// ライブコメントの制限は配信者とコラボレーターにはかけない
+
+const maxSlowModeSeconds = 60 * 60
+
+type LivestreamSettingsModel struct {
+	LivestreamID      int64 `db:"livestream_id"`
+	SlowModeSeconds   int64 `db:"slow_mode_seconds"`
+	SubscribersOnly   bool  `db:"subscribers_only"`
+	ReactionsDisabled bool  `db:"reactions_disabled"`
+	UpdatedAt         int64 `db:"updated_at"`
+}
+
+type LivestreamSettings struct {
+	LivestreamID int64 `json:"livestream_id"`
+	// 同じユーザが連続してライブコメントを投稿できる間隔 (0は制限なし)
+	SlowModeSeconds int64 `json:"slow_mode_seconds"`
+	// 配信者のフォロワーのみライブコメントを投稿できる
+	SubscribersOnly   bool `json:"subscribers_only"`
+	ReactionsDisabled bool `json:"reactions_disabled"`
+}
+
+// nilのフィールドは更新しない
+type PatchLivestreamSettingsRequest struct {
+	SlowModeSeconds   *int64 `json:"slow_mode_seconds"`
+	SubscribersOnly   *bool  `json:"subscribers_only"`
+	ReactionsDisabled *bool  `json:"reactions_disabled"`
+}
+
+// livestream_id -> 設定
+// 読み込み中にinvalidateされた場合に古い設定を覚えないよう、配信ごとの版を比べてから覚える
+type livestreamSettingsCache struct {
+	mu       sync.RWMutex
+	settings map[int64]LivestreamSettingsModel
+	versions map[int64]uint64
+	// resetのたびに進める
+	generation uint64
+}
+
+var livestreamSettings = &livestreamSettingsCache{settings: map[int64]LivestreamSettingsModel{}, versions: map[int64]uint64{}}
+
+func (c *livestreamSettingsCache) get(ctx context.Context, livestreamID int64) (LivestreamSettingsModel, error) {
+	c.mu.RLock()
+	settings, ok := c.settings[livestreamID]
+	version, generation := c.versions[livestreamID], c.generation
+	c.mu.RUnlock()
+	if ok {
+		return settings, nil
+	}
+
+	if err := dbConn.GetContext(ctx, &settings, "SELECT * FROM livestream_settings WHERE livestream_id = ?", livestreamID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return LivestreamSettingsModel{}, err
+		}
+		settings = LivestreamSettingsModel{LivestreamID: livestreamID}
+	}
+
+	c.mu.Lock()
+	if c.versions[livestreamID] == version && c.generation == generation {
+		c.settings[livestreamID] = settings
+	}
+	c.mu.Unlock()
+
+	return settings, nil
+}
+
+// invalidate は、次回参照時にDBから読み直させる
+func (c *livestreamSettingsCache) invalidate(livestreamID int64) {
+	c.mu.Lock()
+	delete(c.settings, livestreamID)
+	c.versions[livestreamID]++
+	c.mu.Unlock()
+}
+
+func (c *livestreamSettingsCache) reset() {
+	c.mu.Lock()
+	c.settings = map[int64]LivestreamSettingsModel{}
+	c.versions = map[int64]uint64{}
+	c.generation++
+	c.mu.Unlock()
+}
+
+// 配信設定取得API
+// GET /api/livestream/:livestream_id/settings
+func getLivestreamSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// 設定の行がないことと配信がないことを区別する
+	if isMissingLivestream(int64(livestreamID)) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	var exists bool
+	if err := dbConn.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM livestreams WHERE id = ?)", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if !exists {
+		rememberMissingLivestream(int64(livestreamID))
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+
+	settingsModel, err := livestreamSettings.get(ctx, int64(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream settings: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, fillLivestreamSettingsResponse(settingsModel))
+}
+
+// 配信設定更新API (配信者向け)
+// PATCH /api/livestream/:livestream_id/settings
+func patchLivestreamSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PatchLivestreamSettingsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.SlowModeSeconds != nil && (*req.SlowModeSeconds < 0 || *req.SlowModeSeconds > maxSlowModeSeconds) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("slow_mode_seconds must be between 0 and %d", maxSlowModeSeconds))
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamModerator(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	settingsModel := LivestreamSettingsModel{LivestreamID: int64(livestreamID)}
+	if err := tx.GetContext(ctx, &settingsModel, "SELECT * FROM livestream_settings WHERE livestream_id = ? FOR UPDATE", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream settings: "+err.Error())
+	}
+	if req.SlowModeSeconds != nil {
+		settingsModel.SlowModeSeconds = *req.SlowModeSeconds
+	}
+	if req.SubscribersOnly != nil {
+		settingsModel.SubscribersOnly = *req.SubscribersOnly
+	}
+	if req.ReactionsDisabled != nil {
+		settingsModel.ReactionsDisabled = *req.ReactionsDisabled
+	}
+	settingsModel.UpdatedAt = time.Now().Unix()
+
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_settings (livestream_id, slow_mode_seconds, subscribers_only, reactions_disabled, updated_at) VALUES (:livestream_id, :slow_mode_seconds, :subscribers_only, :reactions_disabled, :updated_at) ON DUPLICATE KEY UPDATE slow_mode_seconds = VALUES(slow_mode_seconds), subscribers_only = VALUES(subscribers_only), reactions_disabled = VALUES(reactions_disabled), updated_at = VALUES(updated_at)", settingsModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream settings: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	livestreamSettings.invalidate(int64(livestreamID))
+
+	return c.JSON(http.StatusOK, fillLivestreamSettingsResponse(settingsModel))
+}
+
+func fillLivestreamSettingsResponse(settingsModel LivestreamSettingsModel) LivestreamSettings {
+	return LivestreamSettings{
+		LivestreamID:      settingsModel.LivestreamID,
+		SlowModeSeconds:   settingsModel.SlowModeSeconds,
+		SubscribersOnly:   settingsModel.SubscribersOnly,
+		ReactionsDisabled: settingsModel.ReactionsDisabled,
+	}
+}
+
+// verifyLivecommentAllowed は、配信設定に照らしてuserIDのユーザがライブコメントを投稿できるか検証する
+// dbにはライブコメントを登録するトランザクションを渡す
+func verifyLivecommentAllowed(ctx context.Context, db dbQueryer, livestreamModel LivestreamModel, userID int64, now int64) error {
+	settings, err := livestreamSettings.get(ctx, livestreamModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream settings: "+err.Error())
+	}
+	if settings.SlowModeSeconds == 0 && !settings.SubscribersOnly {
+		return nil
+	}
+
+	isModerator, err := isLivestreamModerator(ctx, db, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborator: "+err.Error())
+	}
+	if isModerator {
+		return nil
+	}
+
+	if settings.SubscribersOnly {
+		var isFollower bool
+		if err := db.GetContext(ctx, &isFollower, "SELECT EXISTS (SELECT 1 FROM follows WHERE user_id = ? AND target_user_id = ?)", userID, livestreamModel.UserID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get follow: "+err.Error())
+		}
+		if !isFollower {
+			return echo.NewHTTPError(http.StatusForbidden, "only followers of the streamer can post livecomments")
+		}
+	}
+
+	if settings.SlowModeSeconds > 0 {
+		// 同じユーザの同時の投稿が、どちらも直前の投稿を見ないまま通らないよう、コミットまで配信の行をロックする
+		// 低速モードの配信に限るので、他の配信への投稿は待たされない
+		var lockedID int64
+		if err := db.GetContext(ctx, &lockedID, "SELECT id FROM livestreams WHERE id = ? FOR UPDATE", livestreamModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to lock livestream: "+err.Error())
+		}
+		var lastPostedAt sql.NullInt64
+		if err := db.GetContext(ctx, &lastPostedAt, "SELECT MAX(created_at) FROM livecomments WHERE livestream_id = ? AND user_id = ?", livestreamModel.ID, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last livecomment: "+err.Error())
+		}
+		if lastPostedAt.Valid && now-lastPostedAt.Int64 < settings.SlowModeSeconds {
+			return echo.NewHTTPError(http.StatusTooManyRequests, fmt.Sprintf("slow mode: wait %d seconds between livecomments", settings.SlowModeSeconds))
+		}
+	}
+
+	return nil
+}
+
+// verifyReactionAllowed は、配信設定に照らしてリアクションを投稿できるか検証する
+func verifyReactionAllowed(ctx context.Context, livestreamID int64) error {
+	settings, err := livestreamSettings.get(ctx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream settings: "+err.Error())
+	}
+	if settings.ReactionsDisabled {
+		return echo.NewHTTPError(http.StatusForbidden, "reactions are disabled on this livestream")
+	}
+	return nil
+}
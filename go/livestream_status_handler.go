@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信の状態
+// reserved(予約済み) -> live(配信中) -> ended(終了) の順にのみ遷移する
+const (
+	livestreamStatusReserved = "reserved"
+	livestreamStatusLive     = "live"
+	livestreamStatusEnded    = "ended"
+)
+
+// 配信開始API
+// POST /api/livestream/:livestream_id/start
+func startLivestreamHandler(c echo.Context) error {
+	return transitLivestreamStatus(c, livestreamStatusReserved, livestreamStatusLive)
+}
+
+// 配信終了API
+// POST /api/livestream/:livestream_id/stop
+func stopLivestreamHandler(c echo.Context) error {
+	return transitLivestreamStatus(c, livestreamStatusLive, livestreamStatusEnded)
+}
+
+// transitLivestreamStatus は、配信の状態をfromからtoへ遷移させる
+// 遷移できるのは配信者とコラボレーターのみ
+func transitLivestreamStatus(c echo.Context, from string, to string) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamModerator(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	// 現在の状態を条件にしたUPDATEで、同時リクエストによる二重遷移を防ぐ
+	rs, err := tx.ExecContext(ctx, "UPDATE livestreams SET status = ? WHERE id = ? AND status = ?", to, livestreamID, from)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream status: "+err.Error())
+	}
+	affected, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+	if affected == 0 {
+		return echo.NewHTTPError(http.StatusConflict, "livestream status must be "+from+" to become "+to)
+	}
+
+	livestreamModel := LivestreamModel{}
+	if livestreamModel, err = livestreamRepo.FindByID(ctx, tx, int64(livestreamID)); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	purgeResponseCache()
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// verifyLivestreamAcceptsPost は、配信がライブコメント・リアクションを受け付ける状態かを検証する
+func verifyLivestreamAcceptsPost(livestreamModel LivestreamModel) error {
+	if livestreamModel.Status == livestreamStatusEnded {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream has already ended")
+	}
+	if livestreamStatusStrict && livestreamModel.Status != livestreamStatusLive {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream is not live")
+	}
+	return nil
+}
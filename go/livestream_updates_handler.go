@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/hub"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ライブコメント・リアクションのロングポーリング
+// SSEを張り続けられないクライアント向けに、カーソルより新しいものがあればすぐ返し、なければ投稿を待ってから返す
+// ライブコメントとリアクションはIDの系列が別なので、カーソルもsince_id (ライブコメント) とsince_reaction_id (リアクション) に分ける
+// IDの順と投稿の順はサーバをまたぐとずれる (id_generator_handler.go) ので、作成からidCursorGraceが経つまでは返さずに待つ
+// 待っている間はlivecommentStreams・reactionStreamsを購読し、どちらかに届いたらDBから読み直す
+// リアクションはまとめて送られるので、届くまでに最大でreactionBurstWindowだけ遅れる
+// 削除は返さない (削除を知る必要があるクライアントはストリーミングを使う)
+
+const (
+	defaultLivestreamUpdatesTimeout = 20 * time.Second
+	maxLivestreamUpdatesTimeout     = 30 * time.Second
+	livestreamUpdatesLimit          = 100
+	reactionStreamBufferSize        = 256
+)
+
+type LivestreamUpdates struct {
+	Livecomments []Livecomment `json:"livecomments"`
+	Reactions    []Reaction    `json:"reactions"`
+	// 次のリクエストに渡すカーソル
+	SinceID         int64 `json:"since_id"`
+	SinceReactionID int64 `json:"since_reaction_id"`
+}
+
+// 配信ID -> 購読
+// 溢れた場合は待つのをやめて、その時点の結果を返す
+var reactionStreams = hub.New[int64, ReactionBurst](hub.Options{
+	Name:       "reactions",
+	BufferSize: reactionStreamBufferSize,
+})
+
+var reactionRelay = newRealtimeTopic("reactions", reactionStreams, encodeJSON[ReactionBurst], decodeJSON[ReactionBurst])
+
+// loadLivestreamUpdates は、カーソルより新しいライブコメント・リアクションをそれぞれlivestreamUpdatesLimit件まで返す
+// シャドウバンされたユーザのライブコメントは本人以外には返さないが、カーソルは進める
+// カーソルより小さいIDが後からコミットされないよう、settledPrefixで打ち切った分だけを返す
+// 打ち切った行がある場合は、読み直せば返せるようになる時刻も返す
+func loadLivestreamUpdates(ctx context.Context, livestreamID, viewerID, sinceID, sinceReactionID int64) (LivestreamUpdates, time.Time, error) {
+	updates := LivestreamUpdates{SinceID: sinceID, SinceReactionID: sinceReactionID}
+	now := time.Now()
+
+	var livecommentModels []LivecommentModel
+	if err := dbConn.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? AND id > ? ORDER BY id LIMIT ?", livestreamID, sinceID, livestreamUpdatesLimit); err != nil {
+		return updates, time.Time{}, err
+	}
+	livecommentModels, livecommentsSettleAt := settledPrefix(livecommentModels, func(model LivecommentModel) int64 { return model.CreatedAt }, now)
+	banned, err := shadowBans.get(ctx, livestreamID)
+	if err != nil {
+		return updates, time.Time{}, err
+	}
+	visible := make([]LivecommentModel, 0, len(livecommentModels))
+	for _, model := range livecommentModels {
+		updates.SinceID = max(updates.SinceID, model.ID)
+		if _, ok := banned[model.UserID]; !ok || model.UserID == viewerID {
+			visible = append(visible, model)
+		}
+	}
+	updates.Livecomments, err = fillLivecommentResponses(ctx, dbConn, visible)
+	if err != nil {
+		return updates, time.Time{}, err
+	}
+
+	var reactionModels []ReactionModel
+	if err := dbConn.SelectContext(ctx, &reactionModels, "SELECT * FROM reactions WHERE livestream_id = ? AND id > ? ORDER BY id LIMIT ?", livestreamID, sinceReactionID, livestreamUpdatesLimit); err != nil {
+		return updates, time.Time{}, err
+	}
+	reactionModels, reactionsSettleAt := settledPrefix(reactionModels, func(model ReactionModel) int64 { return model.CreatedAt }, now)
+	updates.Reactions, err = fillReactionResponses(ctx, dbConn, reactionModels)
+	if err != nil {
+		return updates, time.Time{}, err
+	}
+	for _, model := range reactionModels {
+		updates.SinceReactionID = max(updates.SinceReactionID, model.ID)
+	}
+
+	settleAt := livecommentsSettleAt
+	if settleAt.IsZero() || (!reactionsSettleAt.IsZero() && reactionsSettleAt.Before(settleAt)) {
+		settleAt = reactionsSettleAt
+	}
+	return updates, settleAt, nil
+}
+
+// 配信の更新取得API (ロングポーリング)
+// GET /api/livestream/:livestream_id/updates?since_id=&since_reaction_id=&timeout=
+// timeoutは待つ秒数で、maxLivestreamUpdatesTimeoutまで。待っても何もなければ空の配列と同じカーソルを返す
+func getLivestreamUpdatesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var sinceID, sinceReactionID int64
+	if v := c.QueryParam("since_id"); v != "" {
+		sinceID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || sinceID < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "since_id query parameter must be non-negative integer")
+		}
+	}
+	if v := c.QueryParam("since_reaction_id"); v != "" {
+		sinceReactionID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || sinceReactionID < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "since_reaction_id query parameter must be non-negative integer")
+		}
+	}
+	timeout := defaultLivestreamUpdatesTimeout
+	if v := c.QueryParam("timeout"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "timeout query parameter must be non-negative integer")
+		}
+		timeout = min(time.Duration(seconds)*time.Second, maxLivestreamUpdatesTimeout)
+	}
+
+	if _, err := livestreamRepo.FindByID(ctx, dbConn, int64(livestreamID)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	// 取りこぼさないよう、読む前に購読する
+	livecommentSub := livecommentStreams.Subscribe(int64(livestreamID))
+	defer livecommentSub.Close()
+	reactionSub := reactionStreams.Subscribe(int64(livestreamID))
+	defer reactionSub.Close()
+
+	updates, settleAt, err := loadLivestreamUpdates(ctx, int64(livestreamID), userID, sinceID, sinceReactionID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get updates: "+err.Error())
+	}
+	if len(updates.Livecomments) > 0 || len(updates.Reactions) > 0 || timeout == 0 {
+		return c.JSON(http.StatusOK, updates)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		// まだ返せない行があれば、返せるようになった時点で読み直す
+		var settled <-chan time.Time
+		if !settleAt.IsZero() {
+			settled = time.After(time.Until(settleAt))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			return c.JSON(http.StatusOK, updates)
+		case <-settled:
+		case event, ok := <-livecommentSub.Events():
+			if !ok {
+				// 配信の削除・初期化・サーバの終了
+				return c.JSON(http.StatusOK, updates)
+			}
+			// 削除では返さずに待ち続ける
+			if event.name != livecommentEventCreated {
+				continue
+			}
+		case _, ok := <-reactionSub.Events():
+			if !ok {
+				return c.JSON(http.StatusOK, updates)
+			}
+		}
+
+		// 届いた投稿はコミット済みなので、読み直せば含まれる (idCursorGraceが経つまでは返さない)
+		// シャドウバンされたユーザの投稿だけだった場合は、返さずに待ち続ける
+		updates, settleAt, err = loadLivestreamUpdates(ctx, int64(livestreamID), userID, sinceID, sinceReactionID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get updates: "+err.Error())
+		}
+		if len(updates.Livecomments) > 0 || len(updates.Reactions) > 0 {
+			return c.JSON(http.StatusOK, updates)
+		}
+	}
+}
@@ -4,35 +4,125 @@ package main
 // sqlx的な参考: https://jmoiron.github.io/sqlx/
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/sessions"
+	"github.com/isucon/isucon13/webapp/go/dns"
+	"github.com/isucon/isucon13/webapp/go/internal/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	// "github.com/labstack/echo/v4/middleware"
 
-	"github.com/felixge/fgprof"
-	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	echolog "github.com/labstack/gommon/log"
+	"golang.org/x/crypto/bcrypt"
 	_ "net/http/pprof"
 )
 
 const (
 	listenPort                     = 8080
 	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
+	thumbnailDirEnvKey             = "ISUCON13_THUMBNAIL_DIR"
+	iconDirEnvKey                  = "ISUCON13_ICON_DIR"
+	iconReencodeEnvKey             = "ISUCON13_ICON_REENCODE"
+	livestreamStatusStrictEnvKey   = "ISUCON13_LIVESTREAM_STATUS_STRICT"
+	bcryptCostEnvKey               = "ISUCON13_BCRYPT_COST"
+	loginVerifyMemoEnvKey          = "ISUCON13_LOGIN_VERIFY_MEMO"
+	authModeEnvKey                 = "ISUCON13_AUTH_MODE"
+	jwtSecretEnvKey                = "ISUCON13_JWT_SECRET"
+	// サブドメインのDNSレコードの登録先 (pdnsutil(pdns), mysql, api, builtin, none)
+	dnsBackendEnvKey       = "ISUCON13_DNS_BACKEND"
+	dnsZoneEnvKey          = "ISUCON13_DNS_ZONE"
+	dnsRecordTTLEnvKey     = "ISUCON13_DNS_RECORD_TTL"
+	dnsSOAEnvKey           = "ISUCON13_DNS_SOA"
+	powerDNSMySQLDSNEnvKey = "ISUCON13_POWERDNS_MYSQL_DSN"
+	powerDNSAPIURLEnvKey   = "ISUCON13_POWERDNS_API_URL"
+	powerDNSAPIKeyEnvKey   = "ISUCON13_POWERDNS_API_KEY"
+	// trueの場合、初期化後に全ユーザのAレコードをまとめて登録し直す
+	dnsReseedEnvKey = "ISUCON13_DNS_RESEED"
+	// builtinの場合の待ち受けアドレスと、固定のレコードを読むゾーンファイル
+	dnsListenAddrEnvKey = "ISUCON13_DNS_LISTEN_ADDR"
+	dnsZoneFileEnvKey   = "ISUCON13_DNS_ZONE_FILE"
+	// trueの場合、ユーザごとのレコードの代わりにワイルドカードレコードを1つだけ登録する
+	dnsWildcardEnvKey = "ISUCON13_DNS_WILDCARD"
+	// builtinの場合に、送信元へのNXDOMAINの応答を止める10秒間のNXDOMAIN数 (0で止めない)
+	dnsDropThresholdEnvKey = "ISUCON13_DNS_DROP_THRESHOLD"
+	// 初期化時にSOAを問い合わせて確認するDNSサーバ (例: 127.0.0.1:53)
+	// 未設定の場合は確認しない。ただしbuiltinの場合は自分自身を確認する
+	dnsCheckAddrEnvKey = "ISUCON13_DNS_CHECK_ADDR"
+	// falseの場合、このサーバではDNSレコードを登録せず、ISUCON13_DNS_OWNER_URLのサーバに任せる
+	// バックエンドがnoneの場合はfalseになる
+	dnsRegistrationEnvKey = "ISUCON13_ENABLE_DNS_REGISTRATION"
+	// DNSレコードを登録するサーバの内部向けのURL (例: http://192.168.0.11:6060)
+	dnsOwnerURLEnvKey = "ISUCON13_DNS_OWNER_URL"
+	// 内部向けのポート (:6060) へのリクエストに要求するトークン。空の場合は同じホストからのみ受け付ける
+	internalTokenEnvKey = "ISUCON13_INTERNAL_TOKEN"
+	// トップページの一覧APIのレスポンスをキャッシュする時間 (例: 500ms, 0で無効)
+	responseCacheTTLEnvKey = "ISUCON13_RESPONSE_CACHE_TTL"
+	// セッション・統計の順位などを置くRedis (例: redis://127.0.0.1:6379/0)。空の場合はMySQLのみ使う
+	redisURLEnvKey = "ISUCON13_REDIS_URL"
+	// 終了時にキャッシュを書き出し、起動時に読み戻すファイル。空の場合は何もしない
+	cacheSnapshotPathEnvKey = "ISUCON13_CACHE_SNAPSHOT_PATH"
+	// DBのコネクションプールの設定。期間は time.ParseDuration の形式 (例: 10m, 0で無制限)
+	dbMaxOpenConnsEnvKey    = "ISUCON13_DB_MAX_OPEN_CONNS"
+	dbMaxIdleConnsEnvKey    = "ISUCON13_DB_MAX_IDLE_CONNS"
+	dbConnMaxLifetimeEnvKey = "ISUCON13_DB_CONN_MAX_LIFETIME"
+	dbConnMaxIdleTimeEnvKey = "ISUCON13_DB_CONN_MAX_IDLE_TIME"
+	// リクエストごとのDBクエリの期限 (例: 5s, 0で無効) と、経路ごとの上書き (例: "GET /api/livestream/search=2s,POST /api/initialize=0")
+	queryTimeoutEnvKey       = "ISUCON13_DB_QUERY_TIMEOUT"
+	routeQueryTimeoutsEnvKey = "ISUCON13_DB_QUERY_TIMEOUT_ROUTES"
+	// これより遅いクエリを GET /api/admin/slowlog (内部向けのポート) に記録する (例: 100ms, 0で無効)
+	slowQueryThresholdEnvKey = "ISUCON13_SLOW_QUERY_THRESHOLD"
+	// N件に1件のクエリを実行時間・更新行数とともに標準エラーに出す (例: 1000, 0で無効)
+	queryLogSampleRateEnvKey = "ISUCON13_QUERY_LOG_SAMPLE_RATE"
+	// 配信・配信者ごとの件数をMySQLに書き出す間隔 (例: 500ms)
+	counterSyncIntervalEnvKey = "ISUCON13_COUNTER_SYNC_INTERVAL"
+	// trueの場合、件数の表を複数のアプリサーバで共有する (書き出しのたびに読み直し、起動時は数え直さない)
+	counterReloadEnvKey = "ISUCON13_COUNTER_RELOAD"
+	// 終了の合図から、終了処理を諦めて終了するまでの時間 (例: 10s)
+	shutdownTimeoutEnvKey = "ISUCON13_SHUTDOWN_TIMEOUT"
+	// 投稿・入退室などのイベントを処理するワーカーの数 (例: 4)
+	eventBusWorkersEnvKey = "ISUCON13_EVENT_BUS_WORKERS"
+	// redisの場合、ライブコメント・リアクション・視聴者数・モデレーションコンソールのリアルタイム配信をISUCON13_REDIS_URLのRedis Streamsでサーバ間に中継する
+	realtimeRelayEnvKey = "ISUCON13_REALTIME_RELAY"
+	// リアクションのリアルタイム配信で、配信・絵文字ごとに件数をまとめる時間 (例: 200ms, 0でまとめない)
+	reactionBurstWindowEnvKey = "ISUCON13_REACTION_BURST_WINDOW"
+	// trueの場合、初期化APIのレスポンスにビルド情報を入れる
+	initializeBuildInfoEnvKey = "ISUCON13_INITIALIZE_BUILD_INFO"
 )
 
 var (
-	powerDNSSubdomainAddress string
-	dbConn                   *sqlx.DB
-	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
+	dnsRegistrar dns.Registrar
+	dnsZone      string
+	dnsReseed    bool
+	dnsWildcard  bool
+	dnsCheckAddr string
+	dbConn       *sqlx.DB
+	secret       = []byte("isucon13_session_cookiestore_defaultsecret")
+	sessionStore *serverSessionStore
+	// ISUCON13_AUTH_MODE=jwtの場合、サーバサイドセッションの代わりにJWTで認証する
+	// 署名鍵はISUCON13_JWT_SECRETで指定する
+	jwtAuthEnabled bool
+	jwtSecret      []byte
+	// trueの場合、配信中(live)の配信にしかライブコメント・リアクションを投稿できない
+	// falseの場合は終了済み(ended)の配信への投稿のみ拒否する
+	livestreamStatusStrict bool
+	// trueの場合、このサーバでdns_record_jobsを処理する
+	dnsRegistrationEnabled = true
+	dnsOwnerURL            string
+	internalToken          string
 )
 
 func init() {
@@ -40,21 +130,207 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	if v, ok := os.LookupEnv(thumbnailDirEnvKey); ok {
+		thumbnailDir = v
+	}
+	if v, ok := os.LookupEnv(iconDirEnvKey); ok {
+		iconDir = v
+	}
+	if v, ok := os.LookupEnv(iconReencodeEnvKey); ok {
+		iconReencode, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv(livestreamStatusStrictEnvKey); ok {
+		livestreamStatusStrict, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv(bcryptCostEnvKey); ok {
+		// 範囲外の値は無視して既定のコストを使う
+		if cost, err := strconv.Atoi(v); err == nil && cost >= bcrypt.MinCost && cost <= bcrypt.MaxCost {
+			bcryptCost = cost
+		}
+	}
+	if v, ok := os.LookupEnv(loginVerifyMemoEnvKey); ok {
+		loginVerifyMemoEnabled, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv(dnsReseedEnvKey); ok {
+		dnsReseed, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv(dnsWildcardEnvKey); ok {
+		dnsWildcard, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv(dnsCheckAddrEnvKey); ok {
+		dnsCheckAddr = v
+	}
+	if v, ok := os.LookupEnv(dnsRegistrationEnvKey); ok {
+		dnsRegistrationEnabled, _ = strconv.ParseBool(v)
+	}
+	if os.Getenv(dnsBackendEnvKey) == "none" {
+		dnsRegistrationEnabled = false
+	}
+	dnsOwnerURL = os.Getenv(dnsOwnerURLEnvKey)
+	internalToken = os.Getenv(internalTokenEnvKey)
+	if v := os.Getenv(redisURLEnvKey); v != "" {
+		client, err := redis.New(v)
+		if err != nil {
+			log.Printf("ignore invalid %s: %v", redisURLEnvKey, err)
+		} else {
+			redisClient = client
+		}
+	}
+	if v, ok := os.LookupEnv(responseCacheTTLEnvKey); ok {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl < 0 {
+			log.Printf("ignore invalid %s=%q", responseCacheTTLEnvKey, v)
+		} else {
+			responseCacheTTL = ttl
+		}
+	}
+	if v, ok := os.LookupEnv(queryTimeoutEnvKey); ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			log.Printf("ignore invalid %s=%q", queryTimeoutEnvKey, v)
+		} else {
+			queryTimeout = timeout
+		}
+	}
+	if v, ok := os.LookupEnv(routeQueryTimeoutsEnvKey); ok {
+		timeouts, err := parseRouteQueryTimeouts(v)
+		if err != nil {
+			log.Printf("ignore invalid %s=%q: %v", routeQueryTimeoutsEnvKey, v, err)
+		} else {
+			for route, timeout := range timeouts {
+				routeQueryTimeouts[route] = timeout
+			}
+		}
+	}
+	if v, ok := os.LookupEnv(slowQueryThresholdEnvKey); ok {
+		threshold, err := time.ParseDuration(v)
+		if err != nil || threshold < 0 {
+			log.Printf("ignore invalid %s=%q", slowQueryThresholdEnvKey, v)
+		} else {
+			slowQueryThreshold = threshold
+		}
+	}
+	if v, ok := os.LookupEnv(queryLogSampleRateEnvKey); ok {
+		rate, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || rate < 0 {
+			log.Printf("ignore invalid %s=%q", queryLogSampleRateEnvKey, v)
+		} else {
+			queryLogSampleRate = rate
+		}
+	}
+	if v, ok := os.LookupEnv(initializeBuildInfoEnvKey); ok {
+		initializeBuildInfo, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv(shutdownTimeoutEnvKey); ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			log.Printf("ignore invalid %s=%q", shutdownTimeoutEnvKey, v)
+		} else {
+			shutdownTimeout = timeout
+		}
+	}
+	if v, ok := os.LookupEnv(counterSyncIntervalEnvKey); ok {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			log.Printf("ignore invalid %s=%q", counterSyncIntervalEnvKey, v)
+		} else {
+			counterSyncInterval = interval
+		}
+	}
+	if v, ok := os.LookupEnv(counterReloadEnvKey); ok {
+		counterReload, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv(eventBusWorkersEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Printf("ignore invalid %s=%q", eventBusWorkersEnvKey, v)
+		} else {
+			eventBusWorkers = n
+		}
+	}
+	if v, ok := os.LookupEnv(reactionBurstWindowEnvKey); ok {
+		window, err := time.ParseDuration(v)
+		if err != nil || window < 0 {
+			log.Printf("ignore invalid %s=%q", reactionBurstWindowEnvKey, v)
+		} else {
+			reactionBurstWindow = window
+		}
+	}
+	switch v := os.Getenv(realtimeRelayEnvKey); v {
+	case "":
+	case "redis":
+		if redisClient == nil {
+			log.Printf("ignore %s=%q without %s", realtimeRelayEnvKey, v, redisURLEnvKey)
+		} else {
+			realtimeRelayEnabled = true
+		}
+	default:
+		log.Printf("ignore invalid %s=%q", realtimeRelayEnvKey, v)
+	}
+	cacheSnapshotPath = os.Getenv(cacheSnapshotPathEnvKey)
+	jwtAuthEnabled = os.Getenv(authModeEnvKey) == "jwt"
+	jwtSecret = []byte(os.Getenv(jwtSecretEnvKey))
+}
+
+// newDB は、isupipeのDBに接続する
+// 接続の設定はnewDBConfigで環境変数から組み立てる
+// newDB は、ISUCON13_MYSQL_DIALCONFIG_SOCKETが指定されていれば、まずunixソケットでMySQLに繋ぐ
+// 同じホストのMySQLならTCPより接続ごとのオーバーヘッドが小さい
+// ソケットで繋がらなければ、newDBConfigのアドレスにTCPなどで繋ぎ直す (どちらで繋いだかはログに出す)
+func newDB() (*sqlx.DB, error) {
+	const socketEnvKey = "ISUCON13_MYSQL_DIALCONFIG_SOCKET"
+
+	conf, err := newDBConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if socket := os.Getenv(socketEnvKey); socket != "" {
+		socketConf := conf.Clone()
+		socketConf.Net = "unix"
+		socketConf.Addr = socket
+		db, err := openAndPingDB(socketConf)
+		if err == nil {
+			log.Printf("connected to db via unix socket %s", socket)
+			return db, nil
+		}
+		log.Printf("failed to connect db via unix socket %s, falling back to %s %s: %v", socket, conf.Net, conf.Addr, err)
+	}
+
+	db, err := openAndPingDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("connected to db via %s %s", conf.Net, conf.Addr)
+	return db, nil
 }
 
-type InitializeResponse struct {
-	Language string `json:"language"`
+func openAndPingDB(conf *mysql.Config) (*sqlx.DB, error) {
+	db, err := openDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
 }
 
-func connectDB(logger echo.Logger) (*sqlx.DB, error) {
+// newDBConfig は、環境変数からDBの接続設定を作る
+// interpolateParamsを有効にして、プレースホルダをクライアント側で埋め、プリペアドステートメントの往復を省く
+// 接続の照合順序はテーブルに合わせてutf8mb4_binにする (interpolateParamsと併用できる照合順序である必要がある)
+func newDBConfig() (*mysql.Config, error) {
 	const (
-		networkTypeEnvKey = "ISUCON13_MYSQL_DIALCONFIG_NET"
-		addrEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_ADDRESS"
-		portEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_PORT"
-		userEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_USER"
-		passwordEnvKey    = "ISUCON13_MYSQL_DIALCONFIG_PASSWORD"
-		dbNameEnvKey      = "ISUCON13_MYSQL_DIALCONFIG_DATABASE"
-		parseTimeEnvKey   = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
+		networkTypeEnvKey       = "ISUCON13_MYSQL_DIALCONFIG_NET"
+		addrEnvKey              = "ISUCON13_MYSQL_DIALCONFIG_ADDRESS"
+		portEnvKey              = "ISUCON13_MYSQL_DIALCONFIG_PORT"
+		userEnvKey              = "ISUCON13_MYSQL_DIALCONFIG_USER"
+		passwordEnvKey          = "ISUCON13_MYSQL_DIALCONFIG_PASSWORD"
+		dbNameEnvKey            = "ISUCON13_MYSQL_DIALCONFIG_DATABASE"
+		parseTimeEnvKey         = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
+		interpolateParamsEnvKey = "ISUCON13_MYSQL_DIALCONFIG_INTERPOLATE_PARAMS"
+		collationEnvKey         = "ISUCON13_MYSQL_DIALCONFIG_COLLATION"
 	)
 
 	conf := mysql.NewConfig()
@@ -68,6 +344,7 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 	conf.DBName = "isupipe"
 	conf.ParseTime = true
 	conf.InterpolateParams = true
+	conf.Collation = dbCollation
 
 	if v, ok := os.LookupEnv(networkTypeEnvKey); ok {
 		conf.Net = v
@@ -88,77 +365,175 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 	if v, ok := os.LookupEnv(dbNameEnvKey); ok {
 		conf.DBName = v
 	}
-	if v, ok := os.LookupEnv(parseTimeEnvKey); ok {
-		parseTime, err := strconv.ParseBool(v)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", parseTimeEnvKey, err)
+	for key, p := range map[string]*bool{
+		parseTimeEnvKey:         &conf.ParseTime,
+		interpolateParamsEnvKey: &conf.InterpolateParams,
+	} {
+		if v, ok := os.LookupEnv(key); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", key, err)
+			}
+			*p = b
 		}
-		conf.ParseTime = parseTime
 	}
-
-	db, err := sqlx.Open("mysql", conf.FormatDSN())
-	if err != nil {
-		return nil, err
+	if v, ok := os.LookupEnv(collationEnvKey); ok {
+		conf.Collation = v
 	}
-	db.SetMaxOpenConns(100)
-	db.SetMaxIdleConns(100)
 
-	if err := db.Ping(); err != nil {
-		return nil, err
-	}
+	return conf, nil
+}
 
-	return db, nil
+// dbPoolConfig は、DBのコネクションプールの設定
+type dbPoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
 }
 
-func initializeHandler(c echo.Context) error {
-	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
-		c.Logger().Warnf("init.sh failed with err=%s", string(out))
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
+// newDBPoolConfig は、環境変数からコネクションプールの設定を作る
+// 競技環境のアプリサーバ1台あたりの同時リクエスト数を目安に、接続を使い回せるだけ残しておく
+// MySQLのwait_timeoutで切られた接続を掴まないよう、接続ごとの寿命だけは区切る
+func newDBPoolConfig() dbPoolConfig {
+	config := dbPoolConfig{
+		MaxOpenConns:    100,
+		MaxIdleConns:    100,
+		ConnMaxLifetime: 10 * time.Minute,
+		ConnMaxIdleTime: 0,
 	}
+	for key, p := range map[string]*int{
+		dbMaxOpenConnsEnvKey: &config.MaxOpenConns,
+		dbMaxIdleConnsEnvKey: &config.MaxIdleConns,
+	} {
+		if v, ok := os.LookupEnv(key); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				log.Printf("ignore invalid %s=%q", key, v)
+				continue
+			}
+			*p = n
+		}
+	}
+	for key, p := range map[string]*time.Duration{
+		dbConnMaxLifetimeEnvKey: &config.ConnMaxLifetime,
+		dbConnMaxIdleTimeEnvKey: &config.ConnMaxIdleTime,
+	} {
+		if v, ok := os.LookupEnv(key); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				log.Printf("ignore invalid %s=%q", key, v)
+				continue
+			}
+			*p = d
+		}
+	}
+	return config
+}
 
-	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
-	return c.JSON(http.StatusOK, InitializeResponse{
-		Language: "golang",
-	})
+func (config dbPoolConfig) apply(db *sqlx.DB) {
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(config.ConnMaxIdleTime)
 }
 
 func main() {
-	http.DefaultServeMux.Handle("/debug/fgprof", fgprof.Handler())
+	http.DefaultServeMux.HandleFunc("GET /debug/dns/records", getDNSRecordSettingsHandler)
+	http.DefaultServeMux.HandleFunc("PUT /debug/dns/records", putDNSRecordSettingsHandler)
+	http.DefaultServeMux.HandleFunc("GET /debug/dns/metrics", getDNSMetricsHandler)
+	http.DefaultServeMux.HandleFunc("GET /debug/dns/zone", getDNSZoneHandler)
+	http.DefaultServeMux.HandleFunc("POST /debug/dns/jobs/{user_id}", postDNSRecordJobHandler)
+	http.DefaultServeMux.HandleFunc("POST /debug/dns/initialize", postDNSInitializeHandler)
+	http.DefaultServeMux.HandleFunc("GET /debug/ngwords/metrics", getNGWordMetricsHandler)
+	// キャッシュの利用状況
+	http.DefaultServeMux.HandleFunc("GET /api/admin/cache/stats", getCacheStatsHandler)
+	// リアルタイム配信の状況
+	http.DefaultServeMux.HandleFunc("GET /debug/hub/stats", getHubStatsHandler)
+	http.DefaultServeMux.HandleFunc("GET /debug/hub/connections", getHubConnectionsHandler)
+	// アプリ側のスロークエリログ
+	http.DefaultServeMux.HandleFunc("GET /api/admin/slowlog", getSlowQueryLogHandler)
 	go func() {
-		log.Println(http.ListenAndServe(":6060", nil))
+		log.Println(http.ListenAndServe(":6060", internalAuthMiddleware(http.DefaultServeMux)))
 	}()
 
 	e := echo.New()
 	e.Debug = false
 	e.Logger.SetLevel(echolog.ERROR)
+	// ストリーミング・ロングポーリング中の接続は終わらないので、終了時に切ってShutdownが待てるようにする
+	e.Server.RegisterOnShutdown(closeRealtimeHubs)
 	// e.Use(middleware.Logger())
-	cookieStore := sessions.NewCookieStore(secret)
-	cookieStore.Options.Domain = "*.t.isucon.pw"
-	e.Use(session.Middleware(cookieStore))
+	sessionStore = newServerSessionStore(secret)
+	sessionStore.Options.Domain = "*.t.isucon.pw"
+	var store sessions.Store = sessionStore
+	if jwtAuthEnabled {
+		if len(jwtSecret) == 0 {
+			e.Logger.Errorf("environ %s must be provided for auth mode jwt", jwtSecretEnvKey)
+			os.Exit(1)
+		}
+		jwtStore := newJWTSessionStore(jwtSecret)
+		jwtStore.Options.Domain = "*.t.isucon.pw"
+		store = jwtStore
+	}
+	e.Use(session.Middleware(store))
+	e.Use(queryTimeoutMiddleware)
+	e.Use(requestMemoMiddleware)
 	// e.Use(middleware.Recover())
+	if responseCacheTTL > 0 {
+		responseCache = newResponseCache()
+	}
 
 	// 初期化
 	e.POST("/api/initialize", initializeHandler)
 
 	// top
-	e.GET("/api/tag", getTagHandler)
+	e.GET("/api/tag", getTagHandler, responseCacheMiddleware)
+	// タグ補完
+	e.GET("/api/tag/suggest", getTagSuggestionsHandler)
+	// 配信カテゴリ一覧
+	e.GET("/api/category", getCategoriesHandler)
 	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
 
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
-	// list livestream
-	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	// 予約枠の空き状況
+	e.GET("/api/reservation_slots/availability", getReservationSlotAvailabilityHandler)
+	// 配信開始・終了
+	e.POST("/api/livestream/:livestream_id/start", startLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/stop", stopLivestreamHandler)
+	// list livestream (トップページの配信一覧。?cursor=でページングする)
+	e.GET("/api/livestream/search", searchLivestreamsHandler, responseCacheMiddleware)
+	// 番組表
+	e.GET("/api/livestream/schedule", getLivestreamScheduleHandler, responseCacheMiddleware)
+	// トレンド配信一覧
+	e.GET("/api/livestream/trending", getTrendingLivestreamsHandler)
+	// フォロー中の配信者のライブ配信一覧
+	e.GET("/api/livestream/following", getFollowingLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	e.PATCH("/api/livestream/:livestream_id", patchLivestreamHandler)
+	e.DELETE("/api/livestream/:livestream_id", cancelLivestreamHandler)
+	// 配信サムネイル
+	e.GET("/api/livestream/:livestream_id/thumbnail", getLivestreamThumbnailHandler)
 	// get polling livecomment timeline
-	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
+	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler, shadowBanMiddleware)
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
+	// (配信者向け)ライブコメント検索
+	e.GET("/api/livestream/:livestream_id/livecomment/search", searchLivecommentsHandler)
+	// (配信者向け)ライブコメントエクスポート
+	e.GET("/api/livestream/:livestream_id/livecomment/export", exportLivecommentsHandler)
+	// ライブコメントのストリーミング
+	e.GET("/api/livestream/:livestream_id/livecomment/stream", streamLivecommentsHandler)
+	// ライブコメントへの返信一覧
+	e.GET("/api/livestream/:livestream_id/livecomment/:livecomment_id/replies", getLivecommentRepliesHandler, shadowBanMiddleware)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
+	// ライブコメント・リアクションのロングポーリング
+	e.GET("/api/livestream/:livestream_id/updates", getLivestreamUpdatesHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
 	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
@@ -167,21 +542,59 @@ func main() {
 	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
 	// 配信者によるモデレーション (NGワード登録)
 	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler)
+	// 配信者によるモデレーション (シャドウバン)
+	e.GET("/api/livestream/:livestream_id/ban", getShadowBansHandler)
+	e.POST("/api/livestream/:livestream_id/ban", postShadowBanHandler)
+	e.DELETE("/api/livestream/:livestream_id/ban/:user_id", deleteShadowBanHandler)
+	// (配信者向け)モデレーションログ
+	e.GET("/api/livestream/:livestream_id/moderation/logs", getModerationLogsHandler)
+	// (配信者向け)新しい報告・スパムの警告をWebSocketで受け取るモデレーションコンソール
+	e.GET("/api/livestream/:livestream_id/moderation/ws", moderationConsoleHandler)
+	// 配信設定 (スローモード・フォロワー限定・リアクション無効)
+	e.GET("/api/livestream/:livestream_id/settings", getLivestreamSettingsHandler)
+	e.PATCH("/api/livestream/:livestream_id/settings", patchLivestreamSettingsHandler)
+	// コラボレーター(共同配信者)の招待・承諾
+	e.POST("/api/livestream/:livestream_id/collaborator", postCollaboratorHandler)
+	e.POST("/api/livestream/:livestream_id/collaborator/accept", acceptCollaboratorHandler)
 
 	// livestream_viewersにINSERTするため必要
 	// ユーザ視聴開始 (viewer)
 	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
 	// ユーザ視聴終了 (viewer)
 	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	// 視聴継続通知 (ハートビート)
+	e.POST("/api/livestream/:livestream_id/heartbeat", heartbeatLivestreamHandler)
+	// 視聴者数のストリーミング
+	e.GET("/api/livestream/:livestream_id/presence", streamViewerPresenceHandler)
 
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
 	e.GET("/api/user/me", getMeHandler)
+	e.PATCH("/api/user/me", patchMeHandler)
+	e.DELETE("/api/user/me", deleteMeHandler)
+	// ログイン中の端末
+	e.GET("/api/user/me/sessions", getMySessionsHandler)
+	e.DELETE("/api/user/me/sessions/:session_id", deleteMySessionHandler)
+	// 通知
+	e.GET("/api/user/me/notifications", getNotificationsHandler)
+	e.PATCH("/api/user/me/notifications", patchNotificationsHandler)
+	e.GET("/api/user/me/notification_preferences", getNotificationPreferencesHandler)
+	e.PATCH("/api/user/me/notification_preferences", patchNotificationPreferencesHandler)
+	// 視聴履歴
+	e.GET("/api/user/me/history", getWatchHistoryHandler)
+	e.GET("/api/user/me/payout", getMyPayoutHandler)
+	// サブドメインのDNSレコードの登録状況
+	e.GET("/api/user/me/dns", getMyDNSRecordStatusHandler)
+	// ユーザ検索
+	e.GET("/api/user/search", searchUsersHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
+	// 配信者のフォロー
+	e.POST("/api/user/:username/follow", postFollowHandler)
+	e.DELETE("/api/user/:username/follow", deleteFollowHandler)
 	e.POST("/api/icon", postIconHandler)
 
 	// stats
@@ -194,27 +607,338 @@ func main() {
 	e.HTTPErrorHandler = errorResponseHandler
 
 	// DB接続
-	conn, err := connectDB(e.Logger)
+	conn, err := newDB()
 	if err != nil {
 		e.Logger.Errorf("failed to connect db: %v", err)
 		os.Exit(1)
 	}
-	defer conn.Close()
+	poolConfig := newDBPoolConfig()
+	poolConfig.apply(conn)
+	log.Printf("db pool: max_open_conns=%d max_idle_conns=%d conn_max_lifetime=%s conn_max_idle_time=%s",
+		poolConfig.MaxOpenConns, poolConfig.MaxIdleConns, poolConfig.ConnMaxLifetime, poolConfig.ConnMaxIdleTime)
 	dbConn = conn
+	replica, err := newReplicaDB()
+	if err != nil {
+		e.Logger.Errorf("failed to connect replica db: %v", err)
+		os.Exit(1)
+	}
+	if replica != nil {
+		poolConfig.apply(replica)
+		dbReplica = replica
+		log.Printf("routing read-only transactions to replica")
+	}
 
-	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
-	if !ok {
-		e.Logger.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey)
+	if err := auditDBCharsets(context.Background()); err != nil {
+		e.Logger.Errorf("db charset mismatch: %v", err)
 		os.Exit(1)
 	}
-	powerDNSSubdomainAddress = subdomainAddr
+	if err := loadFallbackImage(); err != nil {
+		e.Logger.Errorf("failed to load fallback image: %+v", err)
+		os.Exit(1)
+	}
+	if err := seedIDGenerators(context.Background()); err != nil {
+		e.Logger.Errorf("failed to seed id generators: %v", err)
+		os.Exit(1)
+	}
+	if err := loadCounters(context.Background()); err != nil {
+		e.Logger.Errorf("failed to load counters: %v", err)
+		os.Exit(1)
+	}
+	if n, err := restoreCacheSnapshot(); err != nil {
+		// 読めなくてもキャッシュが空になるだけなので続ける
+		log.Printf("failed to restore cache snapshot: %v", err)
+	} else if n > 0 {
+		log.Printf("restored %d cache entries from %s", n, cacheSnapshotPath)
+	}
+
+	dnsConfig, err := newDNSConfig()
+	if err != nil {
+		e.Logger.Errorf("failed to set up dns backend: %v", err)
+		os.Exit(1)
+	}
+	registrar, err := newDNSRegistrar(dnsConfig)
+	if err != nil {
+		e.Logger.Errorf("failed to set up dns backend: %v", err)
+		os.Exit(1)
+	}
+	dnsRegistrar = registrar
+	dnsZone = dnsConfig.Zone
+	server, builtin := registrar.(*dns.Server)
+	if builtin || dnsWildcard {
+		// 組み込みのDNSサーバは登録済みのユーザをメモリ上にしか持たず、
+		// ワイルドカードレコードは初期化で作り直されるゾーンに含まれないので、起動時と初期化後に登録する
+		dnsReseed = true
+		if err := reseedDNSRecords(context.Background()); err != nil {
+			e.Logger.Errorf("failed to load dns records: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// ワーカーはdnsRegistrarを使うので、設定し終えてから始める
+	// 初期化時に作り直すもの
+	registerInitializeHooks()
+	// 投稿・入退室などのイベントの処理
+	subscribeEvents()
+	eventBus.Start(eventBusWorkers)
+	// 他のサーバでの初期化の反映
+	workers.start(func(ctx context.Context) { runInitializeWatcher(ctx, e.Logger) })
+	// メモリ上にキャッシュしたセッションの掃除
+	workers.start(sessionStore.sweepSessions)
+	// ハートビートの途絶えた視聴者の掃除
+	workers.start(func(ctx context.Context) { sweepStaleViewers(ctx, e.Logger) })
+	// トレンド配信の集計
+	workers.start(func(ctx context.Context) { runTrendingAggregator(ctx, e.Logger) })
+	// 退会したユーザの後片付け
+	workers.start(func(ctx context.Context) { runUserCleanupWorker(ctx, e.Logger) })
+	// リアルタイム配信のサーバ間の中継
+	if realtimeRelayEnabled {
+		workers.start(func(ctx context.Context) { runRealtimeRelay(ctx, e.Logger) })
+	}
+	// リアルタイム配信の死活確認で残った購読の片付け
+	workers.start(runHubReaper)
+	// 配信・配信者ごとの件数の書き出し
+	workers.start(func(ctx context.Context) { runCounterSync(ctx, e.Logger) })
+	// サブドメインのDNSレコードの登録
+	if dnsRegistrationEnabled {
+		workers.start(func(ctx context.Context) { runDNSRecordWorker(ctx, e.Logger) })
+	}
+
+	// ワイルドカードモードではDNSでどのサブドメインも引けるので、ユーザのいないサブドメインはHTTPで404にする
+	// それ以外ではDNSがNXDOMAINを返すので、リクエストごとにユーザを引かない
+	if dnsWildcard {
+		zone, err := readZoneFile(dnsConfig)
+		if err != nil {
+			e.Logger.Errorf("failed to read zone file: %v", err)
+			os.Exit(1)
+		}
+		zoneNames, err := dns.ZoneNames(bytes.NewReader(zone), dnsConfig.Zone)
+		if err != nil {
+			e.Logger.Errorf("failed to read zone file: %v", err)
+			os.Exit(1)
+		}
+		e.Use(newSubdomainMiddleware(dnsConfig.Zone, zoneNames))
+	}
+	if builtin {
+		listenAddr := ":53"
+		if v, ok := os.LookupEnv(dnsListenAddrEnvKey); ok {
+			listenAddr = v
+		}
+		if _, ok := os.LookupEnv(dnsCheckAddrEnvKey); !ok {
+			// 初期化時の確認は自分自身に問い合わせる
+			if host, port, err := net.SplitHostPort(listenAddr); err == nil && (host == "" || host == "0.0.0.0") {
+				dnsCheckAddr = net.JoinHostPort("127.0.0.1", port)
+			} else {
+				dnsCheckAddr = listenAddr
+			}
+		}
+		go func() {
+			if err := server.ListenAndServe(listenAddr); err != nil {
+				e.Logger.Errorf("failed to start DNS server: %v", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	build := currentBuildInfo()
+	log.Printf("build: revision=%s modified=%t build_time=%s go=%s features=%v", build.Revision, build.Modified, build.BuildTime, build.GoVersion, build.Features)
 
 	// HTTPサーバ起動
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
-	if err := e.Start(listenAddr); err != nil {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
 		e.Logger.Errorf("failed to start HTTP server: %v", err)
 		os.Exit(1)
 	}
+	e.Listener = listener
+	// 起動できたので、読み戻したスナップショットはもう要らない
+	if err := discardCacheSnapshot(); err != nil {
+		log.Printf("failed to discard cache snapshot: %v", err)
+	}
+	go func() {
+		if err := e.Start(listenAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Errorf("failed to start HTTP server: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	// 終了の合図を受けたら、処理中のリクエスト・ワーカーを待ってから書き出して閉じる
+	<-ctx.Done()
+	// 2回目のシグナルでは、終了処理を待たずに終了する
+	stop()
+	log.Printf("shutting down (timeout %s)", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		shutdown(shutdownCtx, e)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		log.Printf("shutdown timed out after %s", shutdownTimeout)
+		os.Exit(1)
+	}
+}
+
+// newDNSConfig は、環境変数からdns.Configを作る
+func newDNSConfig() (dns.Config, error) {
+	config := dns.DefaultConfig()
+	// カンマ区切りで複数指定できる
+	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
+	if !ok {
+		return config, fmt.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey)
+	}
+	addresses, err := dns.ParseAddresses(subdomainAddr)
+	if err != nil {
+		return config, err
+	}
+	config.Addresses = addresses
+	if v, ok := os.LookupEnv(dnsZoneEnvKey); ok {
+		config.Zone = v
+	}
+	if v, ok := os.LookupEnv(dnsRecordTTLEnvKey); ok {
+		ttl, err := strconv.Atoi(v)
+		if err != nil || ttl < 0 {
+			return config, fmt.Errorf("environment variable '%s' must be non-negative integer", dnsRecordTTLEnvKey)
+		}
+		config.RecordTTL = ttl
+	}
+	if v, ok := os.LookupEnv(dnsSOAEnvKey); ok {
+		soa, err := dns.ParseSOA(v)
+		if err != nil {
+			return config, err
+		}
+		config.SOA = soa
+	}
+	if v, ok := os.LookupEnv(dnsDropThresholdEnvKey); ok {
+		threshold, err := strconv.Atoi(v)
+		if err != nil {
+			return config, fmt.Errorf("environment variable '%s' must be integer", dnsDropThresholdEnvKey)
+		}
+		config.DropThreshold = threshold
+	}
+	return config, nil
+}
+
+// newDNSRegistrar は、環境変数で指定されたバックエンドのdns.Registrarを返す
+func newDNSRegistrar(config dns.Config) (dns.Registrar, error) {
+	switch backend := os.Getenv(dnsBackendEnvKey); backend {
+	case "", "pdnsutil", "pdns":
+		return dns.NewPdnsutil(config), nil
+	case "none":
+		return dns.NewNop(config), nil
+	case "mysql":
+		dsn, ok := os.LookupEnv(powerDNSMySQLDSNEnvKey)
+		if !ok {
+			return nil, fmt.Errorf("environ %s must be provided for dns backend %s", powerDNSMySQLDSNEnvKey, backend)
+		}
+		db, err := sqlx.Open("mysql", dsn)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Ping(); err != nil {
+			return nil, err
+		}
+		return dns.NewMySQL(db, config), nil
+	case "api":
+		apiURL, ok := os.LookupEnv(powerDNSAPIURLEnvKey)
+		if !ok {
+			return nil, fmt.Errorf("environ %s must be provided for dns backend %s", powerDNSAPIURLEnvKey, backend)
+		}
+		return dns.NewHTTPAPI(apiURL, os.Getenv(powerDNSAPIKeyEnvKey), config), nil
+	case "builtin":
+		zone, err := readZoneFile(config)
+		if err != nil {
+			return nil, err
+		}
+		return dns.NewServer(config, bytes.NewReader(zone))
+	default:
+		return nil, fmt.Errorf("unknown dns backend: %s", backend)
+	}
+}
+
+// readZoneFile は、PowerDNSに読み込ませるものと同じゾーンファイルを読む
+// init_zone.shと同じく、アドレスのプレースホルダを埋める
+func readZoneFile(config dns.Config) ([]byte, error) {
+	zoneFile := "../pdns/u.isucon.dev.zone"
+	if v, ok := os.LookupEnv(dnsZoneFileEnvKey); ok {
+		zoneFile = v
+	}
+	zone, err := os.ReadFile(zoneFile)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.ReplaceAll(zone, []byte("<ISUCON_SUBDOMAIN_ADDRESS>"), []byte(config.Addresses[0])), nil
+}
+
+// initializeDNS は、ゾーンが作り直された後にレコードを登録し直し、DNSサーバを確かめる
+func initializeDNS(ctx context.Context) error {
+	dnsRegistrar.Reset()
+	if dnsReseed {
+		if err := reseedDNSRecords(ctx); err != nil {
+			return fmt.Errorf("failed to reseed dns records: %w", err)
+		}
+	}
+	// ベンチマークの途中で名前が引けなくなるより、ここで失敗させる
+	if err := checkDNS(ctx); err != nil {
+		return fmt.Errorf("dns backend is not ready: %w", err)
+	}
+	return nil
+}
+
+// checkDNS は、DNSサーバがゾーンを応答していることを確かめる
+// トップページのサブドメイン(pipe)が引けない場合は登録し直す
+func checkDNS(ctx context.Context) error {
+	if dnsCheckAddr == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	if err := dns.CheckZone(ctx, dnsCheckAddr, dnsZone); err != nil {
+		return err
+	}
+	ok, err := dns.HasARecord(ctx, dnsCheckAddr, dnsZone, "pipe")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Printf("A record of pipe.%s is missing, registering it", dnsZone)
+		if err := dnsRegistrar.AddARecords(ctx, []string{"pipe"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reseedDNSRecords は、退会していない全ユーザのAレコードを登録し直す
+// init.shで読み込むゾーンファイルは初期ユーザのレコードを1つのアドレスでしか持たないので、
+// 複数のアドレスを指すようにしたい場合などに使う
+// ワイルドカードモードの場合は、ワイルドカードレコードだけを登録する
+func reseedDNSRecords(ctx context.Context) error {
+	if dnsWildcard {
+		return dnsRegistrar.AddARecords(ctx, []string{dns.Wildcard})
+	}
+	var names []string
+	if err := dbConn.SelectContext(ctx, &names, "SELECT name FROM users WHERE deleted_at IS NULL ORDER BY id"); err != nil {
+		return err
+	}
+	return dnsRegistrar.AddARecords(ctx, names)
+}
+
+// isDuplicateEntryError は、UNIQUE制約違反(ER_DUP_ENTRY)かどうかを判定する
+func isDuplicateEntryError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// isTableNotFoundError は、テーブルがない(ER_NO_SUCH_TABLE)かどうかを判定する
+func isTableNotFoundError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1146
 }
 
 type ErrorResponse struct {
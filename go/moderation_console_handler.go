@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/hub"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+// モデレーションコンソール
+// 配信のモデレーター (配信者と、モデレーター権限のあるコラボレーター) 向けに、新しい報告とスパムの警告をWebSocketで送る
+// 報告一覧APIをポーリングしなくても、配信中にすぐ対応できるようにする
+// スパムの警告は、1つのライブコメントへの報告がspamReportThreshold件に達したときに1回だけ送る
+// serverSentEventKeepAliveの間隔で "ping" を送る。届いたメッセージの中身は読み捨てる
+// pong=trueで繋いだクライアントは何か (例: {"type":"pong"}) を送り返すこと。realtimePongWaitの間何も届かなければ切る
+// それ以外のクライアントには応答を求めず、書き込めたことで生きているとみなす (書けなければrealtimeWriteWaitで切れる)
+// セッションのCookieで認証するので、他のサイトのページから繋がれないよう、OriginのホストがHostと同じ場合だけ受け付ける
+
+const (
+	moderationConsoleBufferSize = 64
+	spamReportThreshold         = 3
+
+	moderationMessageReport    = "report"
+	moderationMessageSpamAlert = "spam_alert"
+	moderationMessagePing      = "ping"
+)
+
+// SpamAlert は、報告の多いライブコメントの警告
+type SpamAlert struct {
+	LivestreamID  int64 `json:"livestream_id"`
+	LivecommentID int64 `json:"livecomment_id"`
+	// ライブコメントを投稿したユーザ
+	UserID      int64 `json:"user_id"`
+	ReportCount int64 `json:"report_count"`
+}
+
+// ModerationConsoleMessage は、WebSocketで送るメッセージ。Typeに応じてReport・SpamAlertのどちらかが入る
+type ModerationConsoleMessage struct {
+	Type      string             `json:"type"`
+	Report    *LivecommentReport `json:"report,omitempty"`
+	SpamAlert *SpamAlert         `json:"spam_alert,omitempty"`
+}
+
+// 配信ID -> 購読
+// 取りこぼした場合は、再接続して報告一覧APIで取り直させる
+var moderationStreams = hub.New[int64, ModerationConsoleMessage](hub.Options{
+	Name:       "moderation",
+	BufferSize: moderationConsoleBufferSize,
+})
+
+var moderationRelay = newRealtimeTopic("moderation", moderationStreams, encodeJSON[ModerationConsoleMessage], decodeJSON[ModerationConsoleMessage])
+
+// streamReport は、コンソールの購読がなければ何もしない
+func streamReport(ctx context.Context, event ReportCreated) error {
+	model := event.Model
+	if moderationRelay.Subscribers(model.LivestreamID) == 0 {
+		return nil
+	}
+	report, err := fillLivecommentReportResponse(ctx, dbConn, model)
+	if err != nil {
+		return err
+	}
+	moderationRelay.Publish(ctx, model.LivestreamID, ModerationConsoleMessage{Type: moderationMessageReport, Report: &report})
+
+	// この報告までの件数を数えるので、しきい値に達した報告でだけ警告する
+	var reportCount int64
+	if err := dbConn.GetContext(ctx, &reportCount, "SELECT COUNT(*) FROM livecomment_reports WHERE livestream_id = ? AND livecomment_id = ? AND id <= ?", model.LivestreamID, model.LivecommentID, model.ID); err != nil {
+		return err
+	}
+	if reportCount != spamReportThreshold {
+		return nil
+	}
+	moderationRelay.Publish(ctx, model.LivestreamID, ModerationConsoleMessage{
+		Type: moderationMessageSpamAlert,
+		SpamAlert: &SpamAlert{
+			LivestreamID:  model.LivestreamID,
+			LivecommentID: model.LivecommentID,
+			UserID:        report.Livecomment.User.ID,
+			ReportCount:   reportCount,
+		},
+	})
+	return nil
+}
+
+// モデレーションコンソールAPI
+// GET /api/livestream/:livestream_id/moderation/ws?pong=
+// WebSocketに切り替え、ModerationConsoleMessageをJSONで送る
+// pong=trueの場合は、pingに応答しないクライアントをrealtimePongWaitで切る
+func moderationConsoleHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	requirePong := false
+	if v := c.QueryParam("pong"); v != "" {
+		requirePong, err = strconv.ParseBool(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "pong query parameter must be boolean")
+		}
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	// 切り替えた後はステータスコードを返せないので、先に確かめる
+	if err := verifyLivestreamModerator(ctx, dbConn, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	websocket.Server{Handshake: checkSameOrigin, Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		sub := moderationStreams.Subscribe(int64(livestreamID))
+		defer sub.Close()
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			var discard []byte
+			for {
+				if requirePong {
+					if err := ws.SetReadDeadline(time.Now().Add(realtimePongWait)); err != nil {
+						return
+					}
+				}
+				if err := websocket.Message.Receive(ws, &discard); err != nil {
+					return
+				}
+				sub.Touch()
+			}
+		}()
+
+		send := func(message ModerationConsoleMessage) error {
+			if err := ws.SetWriteDeadline(time.Now().Add(realtimeWriteWait)); err != nil {
+				return err
+			}
+			if err := websocket.JSON.Send(ws, message); err != nil {
+				return err
+			}
+			if !requirePong {
+				sub.Touch()
+			}
+			return nil
+		}
+
+		ping := time.NewTicker(serverSentEventKeepAlive)
+		defer ping.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-closed:
+				return
+			case <-ping.C:
+				if err := send(ModerationConsoleMessage{Type: moderationMessagePing}); err != nil {
+					return
+				}
+			case message, ok := <-sub.Events():
+				if !ok {
+					// 受信が追いつかず切られた・配信が削除された・死活確認で閉じられた・サーバが終了する
+					return
+				}
+				if err := send(message); err != nil {
+					return
+				}
+			}
+		}
+	}}.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// checkSameOrigin は、OriginヘッダがないかホストがHostと違う場合に、WebSocketへの切り替えを断る (403)
+func checkSameOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return errors.New("null origin")
+	}
+	if !strings.EqualFold(origin.Host, req.Host) {
+		return fmt.Errorf("origin %s does not match host %s", origin.Host, req.Host)
+	}
+	config.Origin = origin
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// モデレーション操作の種類
+const (
+	moderationActionNGWordAdded         = "ng_word_added"
+	moderationActionLivecommentsDeleted = "livecomments_deleted"
+	moderationActionShadowBanAdded      = "shadow_ban_added"
+	moderationActionShadowBanRemoved    = "shadow_ban_removed"
+)
+
+type ModerationLogModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	UserID       int64  `db:"user_id"`
+	Action       string `db:"action"`
+	Detail       string `db:"detail"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type ModerationLog struct {
+	ID           int64  `json:"id"`
+	LivestreamID int64  `json:"livestream_id"`
+	UserID       int64  `json:"user_id"`
+	Action       string `json:"action"`
+	Detail       string `json:"detail"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// insertModerationLog は、モデレーション操作を記録する
+// 操作と同じトランザクションで呼び出すこと
+func insertModerationLog(ctx context.Context, tx *sqlx.Tx, livestreamID int64, userID int64, action string, detail string) error {
+	if _, err := tx.ExecContext(ctx, "INSERT INTO moderation_logs (livestream_id, user_id, action, detail, created_at) VALUES (?, ?, ?, ?, ?)", livestreamID, userID, action, detail, time.Now().Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// (配信者向け)モデレーションログ取得API
+// GET /api/livestream/:livestream_id/moderation/logs
+func getModerationLogsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if err := verifyLivestreamModerator(ctx, dbConn, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	query := "SELECT * FROM moderation_logs WHERE livestream_id = ? ORDER BY created_at DESC, id DESC"
+	if c.QueryParam("limit") != "" {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+		}
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	var logModels []ModerationLogModel
+	if err := dbConn.SelectContext(ctx, &logModels, query, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get moderation logs: "+err.Error())
+	}
+
+	logs := make([]ModerationLog, len(logModels))
+	for i := range logModels {
+		logs[i] = ModerationLog{
+			ID:           logModels[i].ID,
+			LivestreamID: logModels[i].LivestreamID,
+			UserID:       logModels[i].UserID,
+			Action:       logModels[i].Action,
+			Detail:       logModels[i].Detail,
+			CreatedAt:    logModels[i].CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, logs)
+}
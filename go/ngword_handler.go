@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/cache"
+)
+
+// 配信ごとのNGワードの判定器
+// (livestream_id, バージョン) をキーにキャッシュし、NGワードの追加や配信の削除でバージョンを上げる
+// 古いバージョンの判定器は参照されなくなるだけなので、読み込み中に追加されても古い判定器を使い続けることはない
+// 他のアプリサーバでの追加はngWordMatcherTTLが過ぎるまで反映されない
+const (
+	ngWordMatcherTTL        = 1 * time.Second
+	ngWordMatcherMaxEntries = 10000
+)
+
+type ngWordMatcherKey struct {
+	livestreamID int64
+	version      uint64
+}
+
+// ngWordMatcher は、NGワードのいずれかを含むかを判定する
+// 他のNGワードを含むNGワードは判定に影響しないので、組み立て時に除いておく
+type ngWordMatcher struct {
+	words []string
+}
+
+func newNGWordMatcher(words []string) *ngWordMatcher {
+	// 短い順に見て、すでに残したNGワードを含むものは捨てる
+	sorted := append([]string(nil), words...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) < len(sorted[j]) })
+	m := &ngWordMatcher{}
+	for _, word := range sorted {
+		if !m.match(word) {
+			m.words = append(m.words, word)
+		}
+	}
+	return m
+}
+
+func (m *ngWordMatcher) match(comment string) bool {
+	for _, word := range m.words {
+		if strings.Contains(comment, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// NGWordMetrics は、NGワードの判定器のキャッシュの利用状況
+type NGWordMetrics struct {
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	Versions int    `json:"versions"`
+	Matchers int    `json:"matchers"`
+}
+
+type ngWordRegistry struct {
+	mu sync.Mutex
+	// バージョンを上げた配信だけ持ち、それ以外はbaseを使う
+	versions map[int64]uint64
+	base     uint64
+	seq      uint64
+
+	matchers *cache.Cache[ngWordMatcherKey, *ngWordMatcher]
+}
+
+var ngWords = &ngWordRegistry{
+	versions: map[int64]uint64{},
+	matchers: cache.New[ngWordMatcherKey, *ngWordMatcher](cache.Options[*ngWordMatcher]{
+		Name:       "ng_word_matchers",
+		TTL:        ngWordMatcherTTL,
+		MaxEntries: ngWordMatcherMaxEntries,
+	}),
+}
+
+func (r *ngWordRegistry) key(livestreamID int64) ngWordMatcherKey {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	version, ok := r.versions[livestreamID]
+	if !ok {
+		version = r.base
+	}
+	return ngWordMatcherKey{livestreamID: livestreamID, version: version}
+}
+
+// matcher は、配信の現在のバージョンの判定器を返す
+// なければDBから読み込んで組み立てる
+func (r *ngWordRegistry) matcher(ctx context.Context, livestreamID int64) (*ngWordMatcher, error) {
+	return r.matchers.GetOrLoad(ctx, r.key(livestreamID), func(ctx context.Context, key ngWordMatcherKey) (*ngWordMatcher, error) {
+		var words []string
+		if err := dbConn.SelectContext(ctx, &words, "SELECT word FROM ng_words WHERE livestream_id = ?", key.livestreamID); err != nil {
+			return nil, err
+		}
+		return newNGWordMatcher(words), nil
+	})
+}
+
+// bump は、配信のバージョンを上げて次回参照時に組み立て直させる
+// NGワードを追加したトランザクションのコミット後に呼ぶ
+func (r *ngWordRegistry) bump(livestreamID int64) {
+	r.mu.Lock()
+	old, ok := r.versions[livestreamID]
+	if !ok {
+		old = r.base
+	}
+	r.seq++
+	r.versions[livestreamID] = r.seq
+	r.mu.Unlock()
+
+	r.matchers.Delete(ngWordMatcherKey{livestreamID: livestreamID, version: old})
+}
+
+// reset は、すべての配信のバージョンを上げる
+// 初期化前に始まった読み込みが終わっても、そのバージョンは参照されない
+func (r *ngWordRegistry) reset() {
+	r.mu.Lock()
+	r.seq++
+	r.base = r.seq
+	r.versions = map[int64]uint64{}
+	r.mu.Unlock()
+
+	r.matchers.Reset()
+}
+
+func (r *ngWordRegistry) metrics() NGWordMetrics {
+	r.mu.Lock()
+	versions := len(r.versions)
+	r.mu.Unlock()
+
+	stats := r.matchers.Stats()
+	return NGWordMetrics{
+		Hits:     stats.Hits,
+		Misses:   stats.Misses,
+		Versions: versions,
+		Matchers: stats.Entries,
+	}
+}
+
+// NGワード判定器メトリクス取得API
+// GET /debug/ngwords/metrics
+// 判定器のキャッシュのヒット数・ミス数などを返す
+func getNGWordMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(ngWords.metrics())
+}
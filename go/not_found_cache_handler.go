@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/cache"
+)
+
+// 存在しないユーザ名・配信IDへの参照を、短い間だけ覚えておく
+// 統計やユーザ詳細などで同じ存在しないものを何度も引かれても、DBに問い合わせずに404・400を返す
+// 登録・予約時はコミット後に取り消すが、他のアプリサーバでの登録はnotFoundCacheTTLが過ぎるまで反映されない
+// 退会済みのユーザはAPIによって扱いが違うので、usersに行がない場合だけ覚える
+const (
+	notFoundCacheTTL        = 2 * time.Second
+	notFoundCacheMaxEntries = 100000
+)
+
+var (
+	missingUserNames = cache.New[string, struct{}](cache.Options[struct{}]{
+		Name:       "missing_user_names",
+		TTL:        notFoundCacheTTL,
+		MaxEntries: notFoundCacheMaxEntries,
+	})
+	missingLivestreams = cache.New[int64, struct{}](cache.Options[struct{}]{
+		Name:       "missing_livestreams",
+		TTL:        notFoundCacheTTL,
+		MaxEntries: notFoundCacheMaxEntries,
+	})
+)
+
+// usersはutf8mb4_binなので、ユーザ名は大文字小文字を区別してそのまま持つ
+func isMissingUserName(name string) bool {
+	_, ok := missingUserNames.Get(name)
+	return ok
+}
+
+func rememberMissingUserName(name string) {
+	missingUserNames.Set(name, struct{}{})
+}
+
+func forgetMissingUserName(name string) {
+	missingUserNames.Delete(name)
+}
+
+func isMissingLivestream(livestreamID int64) bool {
+	_, ok := missingLivestreams.Get(livestreamID)
+	return ok
+}
+
+func rememberMissingLivestream(livestreamID int64) {
+	missingLivestreams.Set(livestreamID, struct{}{})
+}
+
+func forgetMissingLivestream(livestreamID int64) {
+	missingLivestreams.Delete(livestreamID)
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信者への通知
+// ライブコメント・投げ銭・リアクションの投稿のトランザクションで、配信者宛ての通知を積む
+// 件数やランキングと違って元の行から作り直せないので、投稿と一緒にコミットし、落ちても失われないようにする
+// 配信者本人の投稿とシャドウバンされたユーザの投稿は通知しない
+// 受け取り設定の行がないユーザはすべての通知を受け取る
+
+const (
+	notificationTypeLivecomment = "livecomment"
+	notificationTypeTip         = "tip"
+	notificationTypeReaction    = "reaction"
+
+	defaultNotificationsLimit = 20
+	maxNotificationsLimit     = 100
+)
+
+type NotificationModel struct {
+	ID            int64         `db:"id"`
+	UserID        int64         `db:"user_id"`
+	Type          string        `db:"type"`
+	ActorUserID   int64         `db:"actor_user_id"`
+	LivestreamID  int64         `db:"livestream_id"`
+	LivecommentID sql.NullInt64 `db:"livecomment_id"`
+	ReactionID    sql.NullInt64 `db:"reaction_id"`
+	Tip           int64         `db:"tip"`
+	CreatedAt     int64         `db:"created_at"`
+	ReadAt        sql.NullInt64 `db:"read_at"`
+}
+
+type Notification struct {
+	ID            int64  `json:"id"`
+	Type          string `json:"type"`
+	Actor         User   `json:"actor"`
+	LivestreamID  int64  `json:"livestream_id"`
+	LivecommentID *int64 `json:"livecomment_id,omitempty"`
+	ReactionID    *int64 `json:"reaction_id,omitempty"`
+	Tip           int64  `json:"tip,omitempty"`
+	CreatedAt     int64  `json:"created_at"`
+	Read          bool   `json:"read"`
+}
+
+// next_cursorは最終ページではnull
+type NotificationsPage struct {
+	Notifications []Notification `json:"notifications"`
+	NextCursor    *int64         `json:"next_cursor"`
+	UnreadCount   int64          `json:"unread_count"`
+}
+
+// idsを指定した場合はその通知を、until_idを指定した場合はそれ以前のすべての通知を更新する
+type PatchNotificationsRequest struct {
+	IDs     []int64 `json:"ids"`
+	UntilID *int64  `json:"until_id"`
+	Read    bool    `json:"read"`
+}
+
+type PatchNotificationsResponse struct {
+	UnreadCount int64 `json:"unread_count"`
+}
+
+type NotificationPreferencesModel struct {
+	UserID      int64 `db:"user_id"`
+	Livecomment bool  `db:"livecomment"`
+	Tip         bool  `db:"tip"`
+	Reaction    bool  `db:"reaction"`
+	UpdatedAt   int64 `db:"updated_at"`
+}
+
+type NotificationPreferences struct {
+	Livecomment bool `json:"livecomment"`
+	Tip         bool `json:"tip"`
+	Reaction    bool `json:"reaction"`
+}
+
+// nilのフィールドは更新しない
+type PatchNotificationPreferencesRequest struct {
+	Livecomment *bool `json:"livecomment"`
+	Tip         *bool `json:"tip"`
+	Reaction    *bool `json:"reaction"`
+}
+
+// user_id -> 受け取り設定
+// 投稿のたびに配信者の設定を引くので、メモリに持っておく
+type notificationPreferencesCache struct {
+	mu          sync.RWMutex
+	preferences map[int64]NotificationPreferencesModel
+}
+
+var notificationPreferences = &notificationPreferencesCache{preferences: map[int64]NotificationPreferencesModel{}}
+
+func defaultNotificationPreferences(userID int64) NotificationPreferencesModel {
+	return NotificationPreferencesModel{UserID: userID, Livecomment: true, Tip: true, Reaction: true}
+}
+
+func (c *notificationPreferencesCache) get(ctx context.Context, userID int64) (NotificationPreferencesModel, error) {
+	c.mu.RLock()
+	preferences, ok := c.preferences[userID]
+	c.mu.RUnlock()
+	if ok {
+		return preferences, nil
+	}
+
+	if err := dbConn.GetContext(ctx, &preferences, "SELECT * FROM notification_preferences WHERE user_id = ?", userID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return NotificationPreferencesModel{}, err
+		}
+		preferences = defaultNotificationPreferences(userID)
+	}
+
+	c.mu.Lock()
+	c.preferences[userID] = preferences
+	c.mu.Unlock()
+
+	return preferences, nil
+}
+
+// invalidate は、次回参照時にDBから読み直させる
+func (c *notificationPreferencesCache) invalidate(userID int64) {
+	c.mu.Lock()
+	delete(c.preferences, userID)
+	c.mu.Unlock()
+}
+
+func (c *notificationPreferencesCache) reset() {
+	c.mu.Lock()
+	c.preferences = map[int64]NotificationPreferencesModel{}
+	c.mu.Unlock()
+}
+
+func (p NotificationPreferencesModel) accepts(notificationType string) bool {
+	switch notificationType {
+	case notificationTypeLivecomment:
+		return p.Livecomment
+	case notificationTypeTip:
+		return p.Tip
+	case notificationTypeReaction:
+		return p.Reaction
+	default:
+		return false
+	}
+}
+
+// notifyLivestreamOwner は、配信者宛ての通知を積む
+// notificationModelのUserIDは配信者のIDで上書きする
+func notifyLivestreamOwner(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, notificationModel NotificationModel) error {
+	if notificationModel.ActorUserID == livestreamModel.UserID {
+		return nil
+	}
+	banned, err := shadowBans.get(ctx, livestreamModel.ID)
+	if err != nil {
+		return err
+	}
+	if _, ok := banned[notificationModel.ActorUserID]; ok {
+		return nil
+	}
+	preferences, err := notificationPreferences.get(ctx, livestreamModel.UserID)
+	if err != nil {
+		return err
+	}
+	if !preferences.accepts(notificationModel.Type) {
+		return nil
+	}
+
+	notificationModel.UserID = livestreamModel.UserID
+	notificationModel.LivestreamID = livestreamModel.ID
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO notifications (user_id, type, actor_user_id, livestream_id, livecomment_id, reaction_id, tip, created_at) VALUES (:user_id, :type, :actor_user_id, :livestream_id, :livecomment_id, :reaction_id, :tip, :created_at)", notificationModel); err != nil {
+		return err
+	}
+	return nil
+}
+
+func notifyReaction(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, reactionModel ReactionModel) error {
+	return notifyLivestreamOwner(ctx, tx, livestreamModel, NotificationModel{
+		Type:        notificationTypeReaction,
+		ActorUserID: reactionModel.UserID,
+		ReactionID:  sql.NullInt64{Int64: reactionModel.ID, Valid: true},
+		CreatedAt:   reactionModel.CreatedAt,
+	})
+}
+
+func notifyLivecomment(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, livecommentModel LivecommentModel) error {
+	notificationType := notificationTypeLivecomment
+	if livecommentModel.Tip > 0 {
+		notificationType = notificationTypeTip
+	}
+	return notifyLivestreamOwner(ctx, tx, livestreamModel, NotificationModel{
+		Type:          notificationType,
+		ActorUserID:   livecommentModel.UserID,
+		LivecommentID: sql.NullInt64{Int64: livecommentModel.ID, Valid: true},
+		Tip:           livecommentModel.Tip,
+		CreatedAt:     livecommentModel.CreatedAt,
+	})
+}
+
+// 通知一覧API
+// GET /api/user/me/notifications?cursor=&limit=&unread=
+// cursorには前ページ最後の通知IDを指定する。unread=trueの場合は未読のみ返す
+func getNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	query := "SELECT * FROM notifications WHERE user_id = ?"
+	args := []interface{}{userID}
+	if c.QueryParam("unread") == "true" {
+		query += " AND read_at IS NULL"
+	}
+	if c.QueryParam("cursor") != "" {
+		cursor, err := strconv.ParseInt(c.QueryParam("cursor"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "cursor query parameter must be integer")
+		}
+		query += " AND id < ?"
+		args = append(args, cursor)
+	}
+	limit := defaultNotificationsLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		if limit > maxNotificationsLimit {
+			limit = maxNotificationsLimit
+		}
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", limit)
+
+	var notificationModels []NotificationModel
+	if err := dbConn.SelectContext(ctx, &notificationModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notifications: "+err.Error())
+	}
+
+	actorIDs := make([]int64, 0, len(notificationModels))
+	for _, nm := range notificationModels {
+		actorIDs = append(actorIDs, nm.ActorUserID)
+	}
+	actors, err := getUsersByIDs(ctx, dbConn, actorIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+
+	unreadCount, err := countUnreadNotifications(ctx, dbConn, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count unread notifications: "+err.Error())
+	}
+
+	notifications := make([]Notification, len(notificationModels))
+	for i, nm := range notificationModels {
+		notifications[i] = Notification{
+			ID:            nm.ID,
+			Type:          nm.Type,
+			Actor:         actors[nm.ActorUserID],
+			LivestreamID:  nm.LivestreamID,
+			LivecommentID: nullInt64Ptr(nm.LivecommentID),
+			ReactionID:    nullInt64Ptr(nm.ReactionID),
+			Tip:           nm.Tip,
+			CreatedAt:     nm.CreatedAt,
+			Read:          nm.ReadAt.Valid,
+		}
+	}
+
+	resp := NotificationsPage{Notifications: notifications, UnreadCount: unreadCount}
+	if len(notifications) == limit {
+		nextCursor := notifications[len(notifications)-1].ID
+		resp.NextCursor = &nextCursor
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// 通知既読API
+// PATCH /api/user/me/notifications
+func patchNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PatchNotificationsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if (len(req.IDs) == 0) == (req.UntilID == nil) {
+		return echo.NewHTTPError(http.StatusBadRequest, "either ids or until_id must be specified")
+	}
+
+	// 既読日時は最初に既読にしたときのものを残す
+	query := "UPDATE notifications SET read_at = NULL WHERE user_id = ?"
+	args := []interface{}{userID}
+	if req.Read {
+		query = "UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL"
+		args = []interface{}{time.Now().Unix(), userID}
+	}
+	if len(req.IDs) > 0 {
+		query += " AND id IN (?)"
+		args = append(args, req.IDs)
+	} else {
+		query += " AND id <= ?"
+		args = append(args, *req.UntilID)
+	}
+	query, args, err := sqlx.In(query, args...)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update notifications: "+err.Error())
+	}
+
+	unreadCount, err := countUnreadNotifications(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count unread notifications: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, PatchNotificationsResponse{UnreadCount: unreadCount})
+}
+
+func countUnreadNotifications(ctx context.Context, db dbQueryer, userID int64) (int64, error) {
+	var count int64
+	if err := db.GetContext(ctx, &count, "SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// 通知設定取得API
+// GET /api/user/me/notification_preferences
+func getNotificationPreferencesHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	preferencesModel, err := notificationPreferences.get(c.Request().Context(), userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notification preferences: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, fillNotificationPreferencesResponse(preferencesModel))
+}
+
+// 通知設定更新API
+// PATCH /api/user/me/notification_preferences
+func patchNotificationPreferencesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PatchNotificationPreferencesRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	preferencesModel := defaultNotificationPreferences(userID)
+	if err := tx.GetContext(ctx, &preferencesModel, "SELECT * FROM notification_preferences WHERE user_id = ? FOR UPDATE", userID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notification preferences: "+err.Error())
+	}
+	if req.Livecomment != nil {
+		preferencesModel.Livecomment = *req.Livecomment
+	}
+	if req.Tip != nil {
+		preferencesModel.Tip = *req.Tip
+	}
+	if req.Reaction != nil {
+		preferencesModel.Reaction = *req.Reaction
+	}
+	preferencesModel.UpdatedAt = time.Now().Unix()
+
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO notification_preferences (user_id, livecomment, tip, reaction, updated_at) VALUES (:user_id, :livecomment, :tip, :reaction, :updated_at) ON DUPLICATE KEY UPDATE livecomment = VALUES(livecomment), tip = VALUES(tip), reaction = VALUES(reaction), updated_at = VALUES(updated_at)", preferencesModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update notification preferences: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	notificationPreferences.invalidate(userID)
+
+	return c.JSON(http.StatusOK, fillNotificationPreferencesResponse(preferencesModel))
+}
+
+func fillNotificationPreferencesResponse(preferencesModel NotificationPreferencesModel) NotificationPreferences {
+	return NotificationPreferences{
+		Livecomment: preferencesModel.Livecomment,
+		Tip:         preferencesModel.Tip,
+		Reaction:    preferencesModel.Reaction,
+	}
+}
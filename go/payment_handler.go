@@ -1,8 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -13,22 +18,110 @@ type PaymentResult struct {
 func GetPaymentResult(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
+	db := readDB()
 
 	var totalTip int64
-	if err := tx.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments"); err != nil {
+	if err := db.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments"); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
 	return c.JSON(http.StatusOK, &PaymentResult{
 		TotalTip: totalTip,
 	})
 }
+
+// 配信者の投げ銭集計
+// 日ごとの集計はUTCの日付で区切る
+const payoutDaySeconds = 24 * 60 * 60
+
+type PayoutSummary struct {
+	TotalTip    int64              `json:"total_tip"`
+	TipCount    int64              `json:"tip_count"`
+	Livestreams []LivestreamPayout `json:"livestreams"`
+	Daily       []DailyPayout      `json:"daily"`
+}
+
+type LivestreamPayout struct {
+	LivestreamID int64  `json:"livestream_id" db:"livestream_id"`
+	Title        string `json:"title" db:"title"`
+	TotalTip     int64  `json:"total_tip" db:"total_tip"`
+	TipCount     int64  `json:"tip_count" db:"tip_count"`
+}
+
+type DailyPayout struct {
+	Date     string `json:"date" db:"-"`
+	Day      int64  `json:"-" db:"day"`
+	TotalTip int64  `json:"total_tip" db:"total_tip"`
+	TipCount int64  `json:"tip_count" db:"tip_count"`
+}
+
+// 投げ銭集計API
+// GET /api/user/me/payout?from=&until=
+// 自分の配信で受け取った投げ銭を配信ごと・日ごとに集計する
+// 統計と同じく、シャドウバンされたユーザからの投げ銭は含めない
+func getMyPayoutHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var from, until int64 = 0, math.MaxInt64
+	if c.QueryParam("from") != "" {
+		v, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+		}
+		from = v
+	}
+	if c.QueryParam("until") != "" {
+		v, err := strconv.ParseInt(c.QueryParam("until"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "until query parameter must be integer")
+		}
+		until = v
+	}
+	if until <= from {
+		return echo.NewHTTPError(http.StatusBadRequest, "until must be after from")
+	}
+
+	// livestreams_user_idで配信を絞り、livecomments_livestream_id_created_at_tipだけで集計する
+	const tipsQuery = `
+		FROM livestreams l
+		INNER JOIN livecomments lc ON lc.livestream_id = l.id
+		WHERE l.user_id = ? AND lc.created_at >= ? AND lc.created_at < ? AND lc.tip > 0
+		AND NOT EXISTS (SELECT 1 FROM shadow_bans sb WHERE sb.livestream_id = lc.livestream_id AND sb.user_id = lc.user_id)
+`
+
+	livestreams := []LivestreamPayout{}
+	query := "SELECT l.id AS livestream_id, l.title, SUM(lc.tip) AS total_tip, COUNT(*) AS tip_count" + tipsQuery + " GROUP BY l.id ORDER BY l.id"
+	if err := dbConn.SelectContext(ctx, &livestreams, query, userID, from, until); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get payouts by livestream: "+err.Error())
+	}
+
+	daily := []DailyPayout{}
+	query = fmt.Sprintf("SELECT lc.created_at DIV %d AS day, SUM(lc.tip) AS total_tip, COUNT(*) AS tip_count", payoutDaySeconds) + tipsQuery + " GROUP BY day ORDER BY day"
+	if err := dbConn.SelectContext(ctx, &daily, query, userID, from, until); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get payouts by day: "+err.Error())
+	}
+
+	summary := PayoutSummary{
+		Livestreams: livestreams,
+		Daily:       daily,
+	}
+	for i := range daily {
+		daily[i].Date = time.Unix(daily[i].Day*payoutDaySeconds, 0).UTC().Format(time.DateOnly)
+	}
+	for _, lp := range livestreams {
+		summary.TotalTip += lp.TotalTip
+		summary.TipCount += lp.TipCount
+	}
+
+	return c.JSON(http.StatusOK, summary)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/hub"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信の視聴者数のプレゼンス
+// 入退室・ハートビート切れのイベントで、増減とその時点の視聴者数をpresenceStreamsで配信ごとに流す
+// 視聴者数はcountViewersで数え、統計APIも同じものを使う (internal/counterのメモリ上の値。数え直し中だけMySQL)
+// 同時に入退室があると通知の順序と視聴者数の順序が前後しうるので、クライアントは増減を足し込まずにviewers_countで置き換えること
+
+const (
+	presenceStreamBufferSize = 64
+	// 視聴者数は次の通知で置き換わるので、落としてもしばらくは切らない
+	presenceStreamDropLimit = 256
+)
+
+// ViewerPresence は、視聴者数の通知
+type ViewerPresence struct {
+	LivestreamID int64 `json:"livestream_id"`
+	// 入退室による増減。接続直後の通知では0
+	Delta        int64 `json:"delta"`
+	ViewersCount int64 `json:"viewers_count"`
+}
+
+// 配信ID -> 購読
+var presenceStreams = hub.New[int64, ViewerPresence](hub.Options{
+	Name:       "presence",
+	BufferSize: presenceStreamBufferSize,
+	DropLimit:  presenceStreamDropLimit,
+})
+
+var presenceRelay = newRealtimeTopic("presence", presenceStreams, encodeJSON[ViewerPresence], decodeJSON[ViewerPresence])
+
+// countViewers は、配信ごとの視聴者数を返す
+func countViewers(ctx context.Context, db dbQueryer, livestreamIDs []int64) (map[int64]int64, error) {
+	if counts, ok := livestreamViewerCounter.GetMany(livestreamIDs); ok {
+		return counts, nil
+	}
+	return livestreamRepo.CountViewersByIDs(ctx, db, livestreamIDs)
+}
+
+// publishViewerPresence は、購読がなければ何もしない (数え直し中にMySQLで数えないようにする)
+// サーバ間で中継する場合は、他のサーバの購読が分からないので常に数える
+func publishViewerPresence(ctx context.Context, livestreamID int64, delta int64) error {
+	if presenceRelay.Subscribers(livestreamID) == 0 {
+		return nil
+	}
+	counts, err := countViewers(ctx, dbConn, []int64{livestreamID})
+	if err != nil {
+		return err
+	}
+	presenceRelay.Publish(ctx, livestreamID, ViewerPresence{
+		LivestreamID: livestreamID,
+		Delta:        delta,
+		ViewersCount: counts[livestreamID],
+	})
+	return nil
+}
+
+func streamViewerEntered(ctx context.Context, event ViewerEntered) error {
+	return publishViewerPresence(ctx, event.LivestreamID, 1)
+}
+
+func streamViewerLeft(ctx context.Context, event ViewerLeft) error {
+	return publishViewerPresence(ctx, event.LivestreamID, -1)
+}
+
+// 視聴者数ストリーミングAPI
+// GET /api/livestream/:livestream_id/presence
+// 接続直後にその時点の視聴者数を、以降は入退室のたびに "viewers" イベントをServer-Sent Eventsで送る
+func streamViewerPresenceHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	if _, err := livestreamRepo.FindByID(ctx, dbConn, int64(livestreamID)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	// 取りこぼさないよう、数える前に購読する
+	sub := presenceStreams.Subscribe(int64(livestreamID))
+	defer sub.Close()
+
+	counts, err := countViewers(ctx, dbConn, []int64{int64(livestreamID)})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	// nginxにバッファさせない
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	defer clearWriteDeadline(res)
+
+	// ここから先はステータスコードを返せないので、書き込めなくなったら打ち切る
+	initial := ViewerPresence{LivestreamID: int64(livestreamID), ViewersCount: counts[int64(livestreamID)]}
+	if err := sendServerSentEvents(res, sub.Touch, func(w io.Writer) error { return writeViewerPresence(w, initial) }); err != nil {
+		return nil
+	}
+
+	keepAlive := time.NewTicker(serverSentEventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-keepAlive.C:
+			err = sendServerSentEvents(res, sub.Touch, writeServerSentEventKeepAlive)
+		case event, ok := <-sub.Events():
+			if !ok {
+				// 受信が追いつかず切られた・配信が削除された・死活確認で閉じられた・サーバが終了する
+				return nil
+			}
+			err = sendServerSentEvents(res, sub.Touch, func(w io.Writer) error { return writeViewerPresence(w, event) })
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func writeViewerPresence(w io.Writer, presence ViewerPresence) error {
+	data, err := json.Marshal(presence)
+	if err != nil {
+		return err
+	}
+	return writeServerSentEvent(w, "viewers", 0, data)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// サンプリングしたクエリログ
+// 全クエリをログに出すと重いので、queryLogSampleRate件に1件だけ実行時間と更新行数をslogで標準エラー (journald) に出す
+// 遅い順ではなく回数の多いクエリを見つけるためのもので、スロークエリログと同じくドライバを包んで測る
+// 引数の値は残さない。参照の行数は数えない (結果の読み出しを包むとドライバの任意インタフェースが見えなくなるため)
+
+var (
+	// 0の場合は出さない
+	queryLogSampleRate int64
+	queryLogCount      atomic.Int64
+	queryLogger        = slog.New(slog.NewTextHandler(os.Stderr, nil))
+)
+
+// recordQuery は、ドライバでクエリを実行した後に呼ぶ。resultは参照の場合nil
+func recordQuery(query string, args []driver.NamedValue, start time.Time, result driver.Result, err error) {
+	if slowQueryThreshold > 0 {
+		recordSlowQuery(query, args, start, err)
+	}
+	if queryLogSampleRate > 0 && queryLogCount.Add(1)%queryLogSampleRate == 0 {
+		logSampledQuery(query, args, start, result, err)
+	}
+}
+
+func logSampledQuery(query string, args []driver.NamedValue, start time.Time, result driver.Result, err error) {
+	attrs := []slog.Attr{
+		slog.String("query", query),
+		slog.Int("num_args", len(args)),
+		slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+		slog.String("caller", slowQueryCaller()),
+	}
+	if result != nil {
+		if n, err := result.RowsAffected(); err == nil {
+			attrs = append(attrs, slog.Int64("rows_affected", n))
+		}
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	queryLogger.LogAttrs(context.Background(), slog.LevelInfo, "query", attrs...)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// リクエストごとのDBクエリの期限
+// リクエストのcontextに期限を付け、ハンドラ内のDB呼び出しはすべてそのcontextを使う
+// ベンチマーカーがタイムアウトして再送したあとも、遅いクエリが残って詰まり続けないようにする
+// 期限を過ぎるとドライバがクエリを中断して接続を閉じ、ハンドラは503を返す
+// 経路ごとの期限は "メソッド 経路" (例: "GET /api/livestream/search") で指定し、0は期限なし
+
+var (
+	queryTimeout = 5 * time.Second
+	// 初期化とエクスポートは時間がかかってよい。ストリーミング・ロングポーリングは待っている間も続く
+	routeQueryTimeouts = map[string]time.Duration{
+		"POST /api/initialize": 0,
+		"GET /api/livestream/:livestream_id/livecomment/export": 0,
+		"GET /api/livestream/:livestream_id/livecomment/stream": 0,
+		"GET /api/livestream/:livestream_id/updates":            0,
+		"GET /api/livestream/:livestream_id/presence":           0,
+		"GET /api/livestream/:livestream_id/moderation/ws":      0,
+	}
+)
+
+// parseRouteQueryTimeouts は、"GET /api/livestream/search=2s,POST /api/livestream/:livestream_id/livecomment=500ms" の形式を読む
+func parseRouteQueryTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, v, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("missing timeout in %q", entry)
+		}
+		method, path, ok := strings.Cut(strings.TrimSpace(route), " ")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("route must be \"METHOD PATH\": %q", route)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid timeout in %q", entry)
+		}
+		timeouts[strings.ToUpper(method)+" "+strings.TrimSpace(path)] = timeout
+	}
+	return timeouts, nil
+}
+
+func routeQueryTimeout(method, path string) time.Duration {
+	if timeout, ok := routeQueryTimeouts[method+" "+path]; ok {
+		return timeout
+	}
+	return queryTimeout
+}
+
+// queryTimeoutMiddleware は、ルーティング後の経路に応じてリクエストのcontextに期限を付ける
+func queryTimeoutMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		timeout := routeQueryTimeout(c.Request().Method, c.Path())
+		if timeout <= 0 {
+			return next(c)
+		}
+		ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+		defer cancel()
+		c.SetRequest(c.Request().WithContext(ctx))
+
+		err := next(c)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && !c.Response().Committed {
+			c.Logger().Errorf("query timeout (%s) exceeded: %s %s: %v", timeout, c.Request().Method, c.Path(), err)
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "query timeout exceeded")
+		}
+		return err
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/redis"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/sync/singleflight"
+)
+
+// 統計APIの順位と、配信ごとのリアクション数をRedisに持つ
+// Redisが設定されていないか繋がらない場合は、これまでどおりMySQLで数える
+//
+// 順位はソート済み集合で持ち、スコアはリアクション数とチップの合計 (シャドウバンされたユーザのチップは除く)
+//   - ユーザ: メンバーはユーザ名。同点の場合は名前の辞書順で後ろの方が上位で、MySQLで数える場合と同じ
+//   - 配信: メンバーは0埋めした配信ID。同点の場合はIDの大きい方が上位
+//
+// リアクション・チップの投稿、ユーザ登録、配信予約では加算するだけで済ませ、
+// それ以外でスコアが変わる場合 (NGワードでの削除、シャドウバン、配信の取り消し、退会) はキーごと消し、
+// 次に参照されたときにMySQLから作り直す
+// Redisへの書き込みに失敗した場合も、古いスコアが残らないよう次の機会にキーごと消す
+//
+// 作り直しの間に届いた加算は、作り直しごとの保留ハッシュに記録しておき、
+// MySQLのスナップショットに含まれていなかった行の分だけ一時キーに足してから置き換える (redis.Rebuild)
+// キーを消すときは作り直しの登録集合も消すので、実行中の作り直しの結果は使われない
+const (
+	redisKeyPrefix              = "isupipe:"
+	userRankingKey              = redisKeyPrefix + "ranking:users"
+	livestreamRankingKey        = redisKeyPrefix + "ranking:livestreams"
+	livestreamReactionCountsKey = redisKeyPrefix + "counts:livestream_reactions"
+	rankingRebuildsKey          = redisKeyPrefix + "ranking:rebuilds"
+	// 作り直しがこれより長くかかった場合は、保留ハッシュが消えて作り直しは取り消される
+	rankingRebuildTTL = time.Minute
+	// 作り直しの間に加算が届き続けた場合に、置き換えを試す回数
+	rankingCommitAttempts = 5
+)
+
+var rankingKeys = []string{userRankingKey, livestreamRankingKey, livestreamReactionCountsKey}
+
+var (
+	redisClient *redis.Client
+	// trueの場合、Redisの順位・リアクション数が古い可能性がある
+	rankingsDirty atomic.Bool
+	rankingsBuild singleflight.Group
+)
+
+func livestreamRankingMember(livestreamID int64) string {
+	return fmt.Sprintf("%020d", livestreamID)
+}
+
+// resetRedis は、初期化時にRedisの内容を捨てる
+func resetRedis(ctx context.Context) {
+	if err := redisClient.DeletePrefix(ctx, redisKeyPrefix); err != nil {
+		rankingsDirty.Store(true)
+	}
+}
+
+// cleanRankings は、古い可能性があればキーを消し、消せた場合にtrueを返す
+func cleanRankings(ctx context.Context) bool {
+	if !rankingsDirty.Load() {
+		return true
+	}
+	if err := redisClient.Del(ctx, userRankingKey, livestreamRankingKey, livestreamReactionCountsKey, rankingRebuildsKey); err != nil {
+		return false
+	}
+	rankingsDirty.Store(false)
+	return true
+}
+
+// updateRankings は、Redisの順位・リアクション数を書き換える
+// 失敗した場合は古くなったものとして、次の機会に消す
+func updateRankings(ctx context.Context, f func() error) {
+	if !redisClient.Available() || !cleanRankings(ctx) {
+		return
+	}
+	if err := f(); err != nil {
+		rankingsDirty.Store(true)
+	}
+}
+
+// invalidateRankings は、スコアが加算以外で変わったトランザクションのコミット後に呼ぶ
+func invalidateRankings(ctx context.Context) {
+	if redisClient == nil {
+		return
+	}
+	rankingsDirty.Store(true)
+	cleanRankings(ctx)
+}
+
+// rankingEntry は、加算1回分の内容。作り直し中の保留ハッシュにJSONで記録する
+type rankingEntry struct {
+	OwnerName    string `json:"owner_name,omitempty"`
+	LivestreamID int64  `json:"livestream_id,omitempty"`
+	Reactions    int64  `json:"reactions,omitempty"`
+	Tip          int64  `json:"tip,omitempty"`
+}
+
+func (e rankingEntry) incrs() []redis.Incr {
+	var incrs []redis.Incr
+	if e.OwnerName != "" {
+		incrs = append(incrs, redis.Incr{Key: userRankingKey, Member: e.OwnerName, Delta: e.Reactions + e.Tip})
+	}
+	if e.LivestreamID != 0 {
+		incrs = append(incrs, redis.Incr{Key: livestreamRankingKey, Member: livestreamRankingMember(e.LivestreamID), Delta: e.Reactions + e.Tip})
+		if e.Reactions != 0 {
+			incrs = append(incrs, redis.Incr{Key: livestreamReactionCountsKey, Member: strconv.FormatInt(e.LivestreamID, 10), Delta: e.Reactions, Hash: true})
+		}
+	}
+	return incrs
+}
+
+// recordRanking は、entryIDの行のコミット後に、entryの分を加算する
+// entryIDは "<テーブル名>:<主キー>" で、作り直しのときにスナップショットに含まれていたかを調べるのに使う
+func recordRanking(ctx context.Context, entryID string, entry rankingEntry) {
+	updateRankings(ctx, func() error {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return redisClient.IncrRecording(ctx, rankingRebuildsKey, entryID, string(b), rankingRebuildTTL, entry.incrs())
+	})
+}
+
+func scoreReaction(ctx context.Context, event ReactionCreated) error {
+	recordRanking(ctx, "reactions:"+strconv.FormatInt(event.Model.ID, 10), rankingEntry{
+		OwnerName:    event.Reaction.Livestream.Owner.Name,
+		LivestreamID: event.Livestream.ID,
+		Reactions:    1,
+	})
+	return nil
+}
+
+// scoreLivecomment は、シャドウバンされたユーザのチップをスコアに含めない
+func scoreLivecomment(ctx context.Context, event LivecommentCreated) error {
+	if event.Model.Tip == 0 {
+		return nil
+	}
+	banned, err := shadowBans.get(ctx, event.Livestream.ID)
+	if err != nil {
+		invalidateRankings(ctx)
+		return err
+	}
+	if _, ok := banned[event.Model.UserID]; !ok {
+		recordRanking(ctx, "livecomments:"+strconv.FormatInt(event.Model.ID, 10), rankingEntry{
+			OwnerName:    event.Livecomment.Livestream.Owner.Name,
+			LivestreamID: event.Livestream.ID,
+			Tip:          event.Model.Tip,
+		})
+	}
+	return nil
+}
+
+// addUserToRanking は、ユーザ登録のコミット後に呼ぶ
+func addUserToRanking(ctx context.Context, name string) {
+	recordRanking(ctx, "users:"+name, rankingEntry{OwnerName: name})
+}
+
+// addLivestreamToRanking は、配信予約のコミット後に呼ぶ
+func addLivestreamToRanking(ctx context.Context, livestreamID int64) {
+	recordRanking(ctx, "livestreams:"+strconv.FormatInt(livestreamID, 10), rankingEntry{LivestreamID: livestreamID})
+}
+
+// redisRank は、Redisの順位 (1始まり) を返す。キーがなければ作り直す
+// Redisが使えないか、メンバーが見つからない場合はfalseを返すので、MySQLで数えること
+func redisRank(ctx context.Context, key string, member string) (int64, bool) {
+	if !redisClient.Available() || !cleanRankings(ctx) {
+		return 0, false
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		rank, keyExists, found, err := redisClient.ZRevRank(ctx, key, member)
+		if err != nil {
+			return 0, false
+		}
+		if found {
+			return rank + 1, true
+		}
+		if keyExists || attempt > 0 {
+			return 0, false
+		}
+		if err := rebuildRankings(ctx); err != nil {
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// redisLivestreamReactionCounts は、配信ごとのリアクション数をRedisから返す
+// Redisが使えない場合はfalseを返す
+func redisLivestreamReactionCounts(ctx context.Context, livestreamIDs []int64) (map[int64]int64, bool) {
+	if !redisClient.Available() || !cleanRankings(ctx) {
+		return nil, false
+	}
+	fields := make([]string, len(livestreamIDs))
+	for i, livestreamID := range livestreamIDs {
+		fields[i] = strconv.FormatInt(livestreamID, 10)
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		values, keyExists, err := redisClient.HGetInts(ctx, livestreamReactionCountsKey, fields)
+		if err != nil {
+			return nil, false
+		}
+		if keyExists {
+			counts := make(map[int64]int64, len(livestreamIDs))
+			for i, livestreamID := range livestreamIDs {
+				counts[livestreamID] = values[fields[i]]
+			}
+			return counts, true
+		}
+		if attempt > 0 {
+			break
+		}
+		if err := rebuildRankings(ctx); err != nil {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// rebuildRankings は、順位とリアクション数をMySQLで数えてRedisに置き直す
+// 同時に呼ばれた場合は1回だけ数える。最初の呼び出し元がキャンセルしても、待っている他の呼び出し元のために続ける
+func rebuildRankings(ctx context.Context) error {
+	_, err, _ := rankingsBuild.Do("rankings", func() (interface{}, error) {
+		return nil, buildRankings(context.WithoutCancel(ctx))
+	})
+	return err
+}
+
+func buildRankings(ctx context.Context) (err error) {
+	rebuild, err := redisClient.BeginRebuild(ctx, rankingRebuildsKey, rankingKeys, rankingRebuildTTL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			rebuild.Abort(ctx)
+		}
+	}()
+
+	// 保留ハッシュを登録してから、1つのスナップショットで数える
+	// 登録後にコミットされた行は、スナップショットに含まれていなくても保留ハッシュに記録される
+	conn, err := dbConn.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tx, err := conn.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var users []struct {
+		ID   int64  `db:"id"`
+		Name string `db:"name"`
+	}
+	if err := tx.SelectContext(ctx, &users, "SELECT id, name FROM users WHERE deleted_at IS NULL"); err != nil {
+		return err
+	}
+	var livestreamIDs []int64
+	if err := tx.SelectContext(ctx, &livestreamIDs, "SELECT id FROM livestreams"); err != nil {
+		return err
+	}
+
+	type scoreRow struct {
+		ID    int64 `db:"id"`
+		Score int64 `db:"score"`
+	}
+	var userReactions, userTips, livestreamReactions, livestreamTips []scoreRow
+	for _, q := range []struct {
+		dest  *[]scoreRow
+		query string
+	}{
+		{&userReactions, "SELECT l.user_id AS id, COUNT(r.id) AS score FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id GROUP BY l.user_id"},
+		{&userTips, "SELECT ls.user_id AS id, IFNULL(SUM(lc.tip), 0) AS score FROM livestreams ls INNER JOIN livecomments lc ON lc.livestream_id = ls.id WHERE NOT EXISTS (SELECT 1 FROM shadow_bans sb WHERE sb.livestream_id = lc.livestream_id AND sb.user_id = lc.user_id) GROUP BY ls.user_id"},
+		{&livestreamReactions, "SELECT livestream_id AS id, COUNT(*) AS score FROM reactions GROUP BY livestream_id"},
+		{&livestreamTips, "SELECT lc.livestream_id AS id, IFNULL(SUM(lc.tip), 0) AS score FROM livecomments lc WHERE NOT EXISTS (SELECT 1 FROM shadow_bans sb WHERE sb.livestream_id = lc.livestream_id AND sb.user_id = lc.user_id) GROUP BY lc.livestream_id"},
+	} {
+		if err := tx.SelectContext(ctx, q.dest, q.query); err != nil {
+			return err
+		}
+	}
+
+	userScores := make(map[int64]int64, len(users))
+	for _, rows := range [][]scoreRow{userReactions, userTips} {
+		for _, row := range rows {
+			userScores[row.ID] += row.Score
+		}
+	}
+	userRanking := make(map[string]int64, len(users))
+	for _, user := range users {
+		userRanking[user.Name] = userScores[user.ID]
+	}
+
+	livestreamScores := make(map[int64]int64, len(livestreamIDs))
+	for _, rows := range [][]scoreRow{livestreamReactions, livestreamTips} {
+		for _, row := range rows {
+			livestreamScores[row.ID] += row.Score
+		}
+	}
+	livestreamRanking := make(map[string]int64, len(livestreamIDs))
+	for _, livestreamID := range livestreamIDs {
+		livestreamRanking[livestreamRankingMember(livestreamID)] = livestreamScores[livestreamID]
+	}
+	reactionCounts := make(map[string]int64, len(livestreamReactions))
+	for _, row := range livestreamReactions {
+		reactionCounts[strconv.FormatInt(row.ID, 10)] = row.Score
+	}
+
+	if err := rebuild.WriteZSet(ctx, userRankingKey, userRanking); err != nil {
+		return err
+	}
+	if err := rebuild.WriteZSet(ctx, livestreamRankingKey, livestreamRanking); err != nil {
+		return err
+	}
+	if err := rebuild.WriteHash(ctx, livestreamReactionCountsKey, reactionCounts); err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < rankingCommitAttempts; attempt++ {
+		if err := replayRankingEntries(ctx, tx, rebuild); err != nil {
+			return err
+		}
+		done, err := rebuild.Commit(ctx)
+		if err != nil || done {
+			return err
+		}
+	}
+	return fmt.Errorf("rankings kept changing during rebuild")
+}
+
+// replayRankingEntries は、保留ハッシュに記録された加算のうち、スナップショットに含まれていない行の分を一時キーに足す
+func replayRankingEntries(ctx context.Context, tx *sqlx.Tx, rebuild *redis.Rebuild) error {
+	entries, err := rebuild.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	ids := make(map[string][]int64)
+	for entryID := range entries {
+		table, id, ok := strings.Cut(entryID, ":")
+		if !ok {
+			continue
+		}
+		if table == "reactions" || table == "livecomments" {
+			n, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				return err
+			}
+			ids[table] = append(ids[table], n)
+		}
+	}
+	counted := make(map[string]struct{})
+	for table, tableIDs := range ids {
+		query, args, err := sqlx.In("SELECT id FROM "+table+" WHERE id IN (?)", tableIDs)
+		if err != nil {
+			return err
+		}
+		var found []int64
+		if err := tx.SelectContext(ctx, &found, query, args...); err != nil {
+			return err
+		}
+		for _, id := range found {
+			counted[table+":"+strconv.FormatInt(id, 10)] = struct{}{}
+		}
+	}
+
+	for entryID, raw := range entries {
+		// ユーザ・配信の追加は加算が0なので、スナップショットに含まれていても足してよい
+		if _, ok := counted[entryID]; ok {
+			continue
+		}
+		var entry rankingEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			return err
+		}
+		for _, incr := range entry.incrs() {
+			if incr.Hash {
+				err = rebuild.HIncrBy(ctx, incr.Key, incr.Member, incr.Delta)
+			} else {
+				err = rebuild.ZIncrBy(ctx, incr.Key, incr.Member, incr.Delta)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
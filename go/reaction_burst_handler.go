@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// リアクションのまとめ送り
+// 人気の配信ではリアクションが集中するので、1件ずつではなく、配信・絵文字ごとにreactionBurstWindowの間の件数をまとめてreactionStreamsに送る
+// まとめるのはリアルタイム配信だけで、リアクションの保存・取得APIには影響しない
+// 受け取る側 (ロングポーリング) は、届くまでに最大でreactionBurstWindowだけ遅れる
+
+// 0の場合はまとめずに1件ずつ送る
+var reactionBurstWindow = 200 * time.Millisecond
+
+// ReactionBurst は、reactionBurstWindowの間に投稿された同じ絵文字のリアクションの件数
+type ReactionBurst struct {
+	LivestreamID int64  `json:"livestream_id"`
+	EmojiName    string `json:"emoji_name"`
+	Count        int64  `json:"count"`
+	// まとめたリアクションのうち最大のID (IDの順はサーバをまたぐと投稿の順とずれるので、目安にだけ使う)
+	LastReactionID int64 `json:"last_reaction_id"`
+}
+
+type reactionBurstAggregator struct {
+	mu sync.Mutex
+	// 配信ID -> 絵文字 -> まだ送っていない件数
+	pending map[int64]map[string]*ReactionBurst
+	// 初期化のたびに増やし、それより前に始まった窓の分は送らない
+	generation uint64
+}
+
+var reactionBursts = &reactionBurstAggregator{pending: map[int64]map[string]*ReactionBurst{}}
+
+func streamReaction(ctx context.Context, event ReactionCreated) error {
+	reactionBursts.add(event.Livestream.ID, event.Reaction)
+	return nil
+}
+
+// add は、配信で窓が始まっていなければ始め、窓の終わりにまとめて送る
+func (a *reactionBurstAggregator) add(livestreamID int64, reaction Reaction) {
+	if reactionBurstWindow <= 0 {
+		reactionRelay.Publish(context.Background(), livestreamID, ReactionBurst{
+			LivestreamID:   livestreamID,
+			EmojiName:      reaction.EmojiName,
+			Count:          1,
+			LastReactionID: reaction.ID,
+		})
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	bursts := a.pending[livestreamID]
+	if bursts == nil {
+		bursts = map[string]*ReactionBurst{}
+		a.pending[livestreamID] = bursts
+		generation := a.generation
+		time.AfterFunc(reactionBurstWindow, func() { a.flush(livestreamID, generation) })
+	}
+	burst := bursts[reaction.EmojiName]
+	if burst == nil {
+		burst = &ReactionBurst{LivestreamID: livestreamID, EmojiName: reaction.EmojiName}
+		bursts[reaction.EmojiName] = burst
+	}
+	burst.Count++
+	burst.LastReactionID = max(burst.LastReactionID, reaction.ID)
+}
+
+func (a *reactionBurstAggregator) flush(livestreamID int64, generation uint64) {
+	a.mu.Lock()
+	if generation != a.generation {
+		a.mu.Unlock()
+		return
+	}
+	bursts := a.pending[livestreamID]
+	delete(a.pending, livestreamID)
+	a.mu.Unlock()
+
+	emojiNames := make([]string, 0, len(bursts))
+	for emojiName := range bursts {
+		emojiNames = append(emojiNames, emojiName)
+	}
+	sort.Strings(emojiNames)
+	for _, emojiName := range emojiNames {
+		reactionRelay.Publish(context.Background(), livestreamID, *bursts[emojiName])
+	}
+}
+
+// reset は、まだ送っていない件数を捨てる。初期化時に呼ぶ
+func (a *reactionBurstAggregator) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.generation++
+	clear(a.pending)
+}
@@ -2,28 +2,21 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
-	"github.com/jmoiron/sqlx"
+	"github.com/isucon/isucon13/webapp/go/internal/counter"
+	"github.com/isucon/isucon13/webapp/go/internal/repository"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
-type ReactionModel struct {
-	ID           int64  `db:"id"`
-	EmojiName    string `db:"emoji_name"`
-	UserID       int64  `db:"user_id"`
-	LivestreamID int64  `db:"livestream_id"`
-	CreatedAt    int64  `db:"created_at"`
-}
+type ReactionModel = repository.ReactionModel
 
 type Reaction struct {
 	ID         int64      `json:"id"`
@@ -50,27 +43,22 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
 	type livestreamWithDetails struct {
 		LivestreamID               int64  `db:"livestream_id"`
 		LivestreamOwnerID          int64  `db:"livestream_owner_id"`
 		LivestreamOwnerName        string `db:"livestream_owner_name"`
 		LivestreamOwnerDisplayName string `db:"livestream_owner_display_name"`
 		LivestreamOwnerDescription string `db:"livestream_owner_description"`
-		LivestreamOwnerThemeID     int64  `db:"livestream_owner_theme_id"`
-		LivestreamOwnerDarkMode    bool   `db:"livestream_owner_dark_mode"`
-		LivestreamOwnerIconImage   []byte `db:"livestream_owner_icon_image"`
+		LivestreamOwnerFollowers   int64  `db:"livestream_owner_follower_count"`
 		LivestreamTitle            string `db:"livestream_title"`
 		LivestreamDescription      string `db:"livestream_description"`
 		LivestreamPlaylistURL      string `db:"livestream_playlist_url"`
 		LivestreamThumbnailURL     string `db:"livestream_thumbnail_url"`
 		LivestreamStartAt          int64  `db:"livestream_start_at"`
 		LivestreamEndAt            int64  `db:"livestream_end_at"`
+		LivestreamStatus           string `db:"livestream_status"`
+		LivestreamLanguage         string `db:"livestream_language"`
+		LivestreamCategory         string `db:"livestream_category"`
 	}
 	livestream := livestreamWithDetails{}
 	query := `
@@ -82,25 +70,22 @@ func getReactionsHandler(c echo.Context) error {
         ls.thumbnail_url AS livestream_thumbnail_url,
         ls.start_at AS livestream_start_at,
         ls.end_at AS livestream_end_at,
+        ls.status AS livestream_status,
+        ls.language AS livestream_language,
+        ls.category AS livestream_category,
 		o.id AS livestream_owner_id,
         o.name AS livestream_owner_name,
         o.display_name AS livestream_owner_display_name,
         o.description AS livestream_owner_description,
-        ot.id AS livestream_owner_theme_id,
-        ot.dark_mode AS livestream_owner_dark_mode,
-        oi.image AS livestream_owner_icon_image
+        o.follower_count AS livestream_owner_follower_count
     FROM
         livestreams ls
     INNER JOIN
 		users o ON ls.user_id = o.id
-	LEFT JOIN
-		themes ot ON o.id = ot.user_id
-	LEFT JOIN
-		icons oi ON o.id = oi.user_id
     WHERE 
         ls.id = ?
 `
-	err = tx.GetContext(ctx, &livestream, query, livestreamID)
+	err = dbConn.GetContext(ctx, &livestream, query, livestreamID)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
@@ -113,9 +98,7 @@ func getReactionsHandler(c echo.Context) error {
 		UserName        string `db:"user_name"`
 		UserDisplayName string `db:"user_display_name"`
 		UserDescription string `db:"user_description"`
-		UserThemeID     int64  `db:"user_theme_id"`
-		UserDarkMode    bool   `db:"user_dark_mode"`
-		UserIconImage   []byte `db:"user_icon_image"`
+		UserFollowers   int64  `db:"user_follower_count"`
 	}
 
 	reactions := []ReactionWithDetails{}
@@ -128,17 +111,11 @@ func getReactionsHandler(c echo.Context) error {
         u.name AS user_name,
         u.display_name AS user_display_name,
         u.description AS user_description,
-        ut.id AS user_theme_id,
-        ut.dark_mode AS user_dark_mode,
-        ui.image AS user_icon_image
+        u.follower_count AS user_follower_count
     FROM 
         reactions r
     INNER JOIN 
         users u ON r.user_id = u.id
-	LEFT JOIN
-		themes ut ON u.id = ut.user_id
-	LEFT JOIN
-		icons ui ON u.id = ui.user_id
     WHERE 
         r.livestream_id = ?
     ORDER BY 
@@ -152,7 +129,7 @@ func getReactionsHandler(c echo.Context) error {
 		query += fmt.Sprintf(" LIMIT %d", limit)
 	}
 
-	err = tx.SelectContext(ctx, &reactions, query, livestreamID)
+	err = dbConn.SelectContext(ctx, &reactions, query, livestreamID)
 	if errors.Is(err, sql.ErrNoRows) {
 		return c.JSON(http.StatusOK, []*ReactionWithDetails{})
 	}
@@ -160,41 +137,29 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
 	}
 
-	var tags []Tag
-	query = "SELECT tags.* FROM tags JOIN livestream_tags ON tags.id = livestream_tags.tag_id WHERE livestream_tags.livestream_id = ?"
-	err = tx.SelectContext(ctx, &tags, query, livestreamID)
-	if !errors.Is(err, sql.ErrNoRows) && err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	tags, collaborators, err := getLivestreamTagsAndCollaborators(ctx, dbConn, int64(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags and collaborators: "+err.Error())
 	}
 
 	reactionsResponse := make([]Reaction, len(reactions))
-	image, err := os.ReadFile(fallbackImage)
+	userIDs := make([]int64, 0, len(reactions)+1)
+	userIDs = append(userIDs, livestream.LivestreamOwnerID)
+	for i := range reactions {
+		userIDs = append(userIDs, reactions[i].UserID)
+	}
+	themeMap, err := getUserThemes(ctx, userIDs)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed read fallback image: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user themes: "+err.Error())
 	}
-	fallbackImageHash := fmt.Sprintf("%x", sha256.Sum256(image))
-
-	livestreamOwnerIconHash := fallbackImageHash
-	if livestream.LivestreamOwnerIconImage != nil {
-		livestreamOwnerIconHash = fmt.Sprintf("%x", sha256.Sum256(livestream.LivestreamOwnerIconImage))
+	iconHashes, err := getIconHashes(ctx, userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load icon hashes: "+err.Error())
 	}
+	livestreamOwnerIconHash := iconHashes[livestream.LivestreamOwnerID]
 
-	userIconHashCache := make(map[int64]string)
 	for i := range reactions {
-		var userIconHash string
-		if c, ok := userIconHashCache[reactions[i].UserID]; ok {
-			userIconHash = c
-		} else {
-			userIconHash = fallbackImageHash
-			if reactions[i].UserIconImage != nil {
-				userIconHash = fmt.Sprintf("%x", sha256.Sum256(reactions[i].UserIconImage))
-			}
-			userIconHashCache[reactions[i].UserID] = userIconHash
-		}
+		userIconHash := iconHashes[reactions[i].UserID]
 
 		reactionsResponse[i] = Reaction{
 			ID:        reactions[i].ID,
@@ -206,10 +171,11 @@ func getReactionsHandler(c echo.Context) error {
 				DisplayName: reactions[i].UserDisplayName,
 				Description: reactions[i].UserDescription,
 				Theme: Theme{
-					ID:       reactions[i].UserThemeID,
-					DarkMode: reactions[i].UserDarkMode,
+					ID:       themeMap[reactions[i].UserID].ID,
+					DarkMode: themeMap[reactions[i].UserID].DarkMode,
 				},
-				IconHash: userIconHash,
+				IconHash:      userIconHash,
+				FollowerCount: reactions[i].UserFollowers,
 			},
 			Livestream: Livestream{
 				ID: livestream.LivestreamID,
@@ -219,18 +185,23 @@ func getReactionsHandler(c echo.Context) error {
 					DisplayName: livestream.LivestreamOwnerDisplayName,
 					Description: livestream.LivestreamOwnerDescription,
 					Theme: Theme{
-						ID:       livestream.LivestreamOwnerThemeID,
-						DarkMode: livestream.LivestreamOwnerDarkMode,
+						ID:       themeMap[livestream.LivestreamOwnerID].ID,
+						DarkMode: themeMap[livestream.LivestreamOwnerID].DarkMode,
 					},
-					IconHash: livestreamOwnerIconHash,
+					IconHash:      livestreamOwnerIconHash,
+					FollowerCount: livestream.LivestreamOwnerFollowers,
 				},
-				Title:        livestream.LivestreamTitle,
-				Description:  livestream.LivestreamDescription,
-				PlaylistUrl:  livestream.LivestreamPlaylistURL,
-				ThumbnailUrl: livestream.LivestreamThumbnailURL,
-				StartAt:      livestream.LivestreamStartAt,
-				EndAt:        livestream.LivestreamEndAt,
-				Tags:         tags,
+				Collaborators: collaborators,
+				Title:         livestream.LivestreamTitle,
+				Description:   livestream.LivestreamDescription,
+				PlaylistUrl:   livestream.LivestreamPlaylistURL,
+				ThumbnailUrl:  livestream.LivestreamThumbnailURL,
+				StartAt:       livestream.LivestreamStartAt,
+				EndAt:         livestream.LivestreamEndAt,
+				Status:        livestream.LivestreamStatus,
+				Language:      livestream.LivestreamLanguage,
+				Category:      livestream.LivestreamCategory,
+				Tags:          tags,
 			},
 		}
 	}
@@ -266,51 +237,69 @@ func postReactionHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	stmts := statementsFor(dbConn)
+
+	livestreamModel, err := livestreamRepo.FindByID(ctx, stmts.bind(tx), int64(livestreamID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if err := verifyLivestreamAcceptsPost(livestreamModel); err != nil {
+		return err
+	}
+	if err := verifyReactionAllowed(ctx, livestreamModel.ID); err != nil {
+		return err
+	}
+
+	reactionID, err := reactionIDs.next(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate reaction id: "+err.Error())
+	}
 	reactionModel := ReactionModel{
+		ID:           reactionID,
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
 		EmojiName:    req.EmojiName,
 		CreatedAt:    time.Now().Unix(),
 	}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
-	if err != nil {
+	if err := reactionRepo.Insert(ctx, stmts.bind(tx), reactionModel); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
 	}
+	if err := notifyReaction(ctx, tx, livestreamModel, reactionModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert notification: "+err.Error())
+	}
 
-	reactionID, err := result.LastInsertId()
+	counterEpoch, err := counter.Commit(tx.Commit)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
-	reactionModel.ID = reactionID
 
-	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
+	// ロックを持ったまま組み立てないよう、コミット後にキャッシュとプライマリから組み立てる
+	reaction, err := fillReactionResponse(ctx, dbConn, reactionModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
 	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
+	// 件数・スコア・リアルタイム配信はイベントの購読者が行う
+	reactionCreated.Publish(livestreamModel.ID, ReactionCreated{
+		Livestream:   livestreamModel,
+		Model:        reactionModel,
+		Reaction:     reaction,
+		CounterEpoch: counterEpoch,
+	})
 
 	return c.JSON(http.StatusCreated, reaction)
 }
 
-func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
-	userModel := UserModel{}
-	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", reactionModel.UserID); err != nil {
-		return Reaction{}, err
-	}
-	user, err := fillUserResponse(ctx, tx, userModel)
+func fillReactionResponse(ctx context.Context, db dbQueryer, reactionModel ReactionModel) (Reaction, error) {
+	user, err := getUserByID(ctx, db, reactionModel.UserID)
 	if err != nil {
 		return Reaction{}, err
 	}
 
-	livestreamModel := LivestreamModel{}
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", reactionModel.LivestreamID); err != nil {
-		return Reaction{}, err
-	}
-	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	livestream, err := getLivestreamByID(ctx, db, reactionModel.LivestreamID)
 	if err != nil {
 		return Reaction{}, err
 	}
@@ -325,3 +314,56 @@ func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel Reacti
 
 	return reaction, nil
 }
+
+// fillReactionResponses は、ユーザと配信をまとめて読み、reactionModelsと同じ順で返す
+func fillReactionResponses(ctx context.Context, db dbQueryer, reactionModels []ReactionModel) ([]Reaction, error) {
+	reactions := make([]Reaction, len(reactionModels))
+	if len(reactionModels) == 0 {
+		return reactions, nil
+	}
+
+	userIDSet := make(map[int64]struct{})
+	livestreamIDSet := make(map[int64]struct{})
+	for _, rm := range reactionModels {
+		userIDSet[rm.UserID] = struct{}{}
+		livestreamIDSet[rm.LivestreamID] = struct{}{}
+	}
+	userIDs := make([]int64, 0, len(userIDSet))
+	for id := range userIDSet {
+		userIDs = append(userIDs, id)
+	}
+	livestreamIDs := make([]int64, 0, len(livestreamIDSet))
+	for id := range livestreamIDSet {
+		livestreamIDs = append(livestreamIDs, id)
+	}
+
+	userMap, err := getUsersByIDs(ctx, db, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	livestreamMap, err := getLivestreamsByIDs(ctx, db, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rm := range reactionModels {
+		user, ok := userMap[rm.UserID]
+		if !ok {
+			return nil, fmt.Errorf("user %d not found", rm.UserID)
+		}
+		livestream, ok := livestreamMap[rm.LivestreamID]
+		if !ok {
+			return nil, fmt.Errorf("livestream %d not found", rm.LivestreamID)
+		}
+		reactions[i] = Reaction{
+			ID:         rm.ID,
+			EmojiName:  rm.EmojiName,
+			User:       user,
+			Livestream: livestream,
+			CreatedAt:  rm.CreatedAt,
+		}
+	}
+
+	return reactions, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/hub"
+	"github.com/labstack/echo/v4"
+)
+
+// リアルタイム配信の接続の死活確認
+// Server-Sent Eventsは、送るものがなくてもserverSentEventKeepAliveの間隔でコメント行を送り、書き込みにrealtimeWriteWaitの期限を付ける
+// 書き込めたら購読をTouchする。受信しないクライアントには書き込みが止まるので、期限切れで切る
+// WebSocketは、serverSentEventKeepAliveの間隔で "ping" を送り、書き込めたか、クライアントから何か届いたら購読をTouchする
+// 応答することを選んだ (pong=true) クライアントだけ、realtimePongWaitの間何も届かなければ切る
+// それでも残った購読 (受信側のgoroutineが止まったままのものなど) は、runHubReaperがrealtimeIdleTimeoutで閉じる
+
+const (
+	// プロキシに切られないよう、送るものがなくてもこの間隔で送る
+	serverSentEventKeepAlive = 15 * time.Second
+	realtimeWriteWait        = 10 * time.Second
+	realtimePongWait         = 2*serverSentEventKeepAlive + realtimeWriteWait
+	// ロングポーリングの購読 (最大maxLivestreamUpdatesTimeout) も閉じないよう、それより長くする
+	realtimeIdleTimeout  = 60 * time.Second
+	realtimeReapInterval = 15 * time.Second
+)
+
+// sendServerSentEvents は、writeで書いた分を期限付きでフラッシュし、書き込めたらtouchを呼ぶ
+func sendServerSentEvents(res *echo.Response, touch func(), write func(w io.Writer) error) error {
+	rc := http.NewResponseController(res)
+	if err := rc.SetWriteDeadline(time.Now().Add(realtimeWriteWait)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if err := write(res); err != nil {
+		return err
+	}
+	if err := rc.Flush(); err != nil {
+		return err
+	}
+	touch()
+	return nil
+}
+
+// clearWriteDeadline は、Server-Sent Eventsのハンドラの終わりに呼び、同じ接続の次のリクエストに期限を残さない
+func clearWriteDeadline(res *echo.Response) {
+	_ = http.NewResponseController(res).SetWriteDeadline(time.Time{})
+}
+
+func writeServerSentEventKeepAlive(w io.Writer) error {
+	_, err := io.WriteString(w, ": keep-alive\n\n")
+	return err
+}
+
+// runHubReaper は、しばらく生きていることを確かめられていない購読を閉じる
+func runHubReaper(ctx context.Context) {
+	ticker := time.NewTicker(realtimeReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n := hub.ReapAll(realtimeIdleTimeout); n > 0 {
+				log.Printf("reaped %d idle realtime subscriptions", n)
+			}
+		}
+	}
+}
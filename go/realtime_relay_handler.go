@@ -0,0 +1,249 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/hub"
+	"github.com/isucon/isucon13/webapp/go/internal/redis"
+	"github.com/labstack/echo/v4"
+)
+
+// リアルタイム配信のサーバ間の中継
+// ISUCON13_REALTIME_RELAY=redisの場合、livecommentStreams・reactionStreams・presenceStreams・moderationStreamsへの送信をRedis Streamsに書き、
+// 各サーバのrunRealtimeRelayが読んで自分のHubに送る
+// 自分のHubには書く前に直接送り、読んだときは自分が書いたものを飛ばす (Redisを待たず、書けなくても順序が変わらない)
+// どのサーバで投稿・入退室があっても、どのサーバに繋いだ購読者にも届き、どのサーバのHubにも再送用のイベントが貯まる
+// Redisに書けない場合は他のサーバには届かない。読めない間に書かれたものは、読めるようになってから送る (realtimeRelayMaxLen件まで)
+// 初期化では、リセットを書いてから自分がそこまで読むのを待つ。リセットより前に書かれたものは読んだ時点で送り、リセットで消す
+// 無効な場合は、これまでどおり自分のHubに直接送る
+
+const (
+	realtimeRelayStream        = redisKeyPrefix + "realtime"
+	realtimeRelayMaxLen        = 10000
+	realtimeRelayReadCount     = 256
+	realtimeRelayBlock         = time.Second
+	realtimeRelayRetryInterval = time.Second
+	// 初期化で、自分が書いたリセットまで読むのを待つ時間
+	realtimeRelayResetWait = 5 * time.Second
+	// 初期化で全サーバのHubを空にする
+	realtimeRelayResetTopic = "reset"
+)
+
+// ISUCON13_REALTIME_RELAY=redisかつRedisが設定されている場合にtrue
+var realtimeRelayEnabled bool
+
+// このサーバが書いたものを見分ける
+var realtimeRelayOrigin = fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+
+// トピック名 -> 受け取ったものを自分のHubに送る関数
+var realtimeRelayReceivers = map[string]func(key int64, data []byte) error{}
+
+// runRealtimeRelayがどこまで読んだか
+// 初期化で、自分が書いたリセットより前のものを読み終えたか確かめる
+var realtimeRelayPosition = &streamPosition{advanced: make(chan struct{})}
+
+type streamPosition struct {
+	mu sync.Mutex
+	id string
+	// idが進むたびに閉じて作り直す
+	advanced chan struct{}
+}
+
+func (p *streamPosition) set(id string) {
+	p.mu.Lock()
+	p.id = id
+	close(p.advanced)
+	p.advanced = make(chan struct{})
+	p.mu.Unlock()
+}
+
+// wait は、id以降まで読むのを待つ
+func (p *streamPosition) wait(ctx context.Context, id string) error {
+	for {
+		p.mu.Lock()
+		reached := p.id != "" && compareStreamIDs(p.id, id) >= 0
+		advanced := p.advanced
+		p.mu.Unlock()
+		if reached {
+			return nil
+		}
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// compareStreamIDs は、Redis StreamsのID (<ミリ秒>-<連番>) を比べる
+func compareStreamIDs(a, b string) int {
+	aMillis, aSeq := parseStreamID(a)
+	bMillis, bSeq := parseStreamID(b)
+	if aMillis != bMillis {
+		return cmp.Compare(aMillis, bMillis)
+	}
+	return cmp.Compare(aSeq, bSeq)
+}
+
+func parseStreamID(id string) (uint64, uint64) {
+	millis, seq, _ := strings.Cut(id, "-")
+	m, _ := strconv.ParseUint(millis, 10, 64)
+	s, _ := strconv.ParseUint(seq, 10, 64)
+	return m, s
+}
+
+// realtimeTopic は、Hubへの送信を中継する
+type realtimeTopic[E any] struct {
+	name   string
+	hub    *hub.Hub[int64, E]
+	encode func(E) ([]byte, error)
+}
+
+// newRealtimeTopic は、パッケージの変数の初期化で呼ぶ。nameはサーバ間で同じにすること
+func newRealtimeTopic[E any](name string, h *hub.Hub[int64, E], encode func(E) ([]byte, error), decode func([]byte) (E, error)) *realtimeTopic[E] {
+	realtimeRelayReceivers[name] = func(key int64, data []byte) error {
+		event, err := decode(data)
+		if err != nil {
+			return err
+		}
+		h.Publish(key, event)
+		return nil
+	}
+	return &realtimeTopic[E]{name: name, hub: h, encode: encode}
+}
+
+// Publish は、自分のHubに送り、中継が有効なら他のサーバのHubにも送る
+func (t *realtimeTopic[E]) Publish(ctx context.Context, key int64, event E) {
+	t.hub.Publish(key, event)
+	if !realtimeRelayEnabled {
+		return
+	}
+	data, err := t.encode(event)
+	if err == nil {
+		_, err = redisClient.XAdd(ctx, realtimeRelayStream, realtimeRelayMaxLen, map[string]string{
+			"topic":  t.name,
+			"key":    strconv.FormatInt(key, 10),
+			"origin": realtimeRelayOrigin,
+			"data":   string(data),
+		})
+	}
+	if err != nil {
+		log.Printf("failed to relay %s: %v", t.name, err)
+	}
+}
+
+// Subscribers は、中継が有効なら他のサーバに購読があるかは分からないので、常に1以上を返す
+func (t *realtimeTopic[E]) Subscribers(key int64) int {
+	if realtimeRelayEnabled {
+		return max(t.hub.Subscribers(key), 1)
+	}
+	return t.hub.Subscribers(key)
+}
+
+func encodeJSON[E any](event E) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+func decodeJSON[E any](data []byte) (E, error) {
+	var event E
+	err := json.Unmarshal(data, &event)
+	return event, err
+}
+
+// closeRealtimeHubs は、このサーバのHubの購読と貯めてあるイベントをすべて消す
+func closeRealtimeHubs() {
+	livecommentStreams.CloseAll()
+	reactionStreams.CloseAll()
+	presenceStreams.CloseAll()
+	moderationStreams.CloseAll()
+}
+
+// resetRealtime は、初期化時に全サーバのHubを空にする
+// 中継が有効な場合は、リセットより前に書かれたものを読み終えてリセットで空にするまで待つ
+// (先に空にすると、読み残していた初期化前のイベントがその後に届く)
+func resetRealtime(ctx context.Context) {
+	reactionBursts.reset()
+	closeRealtimeHubs()
+	if !realtimeRelayEnabled {
+		return
+	}
+	id, err := redisClient.XAdd(ctx, realtimeRelayStream, realtimeRelayMaxLen, map[string]string{
+		"topic":  realtimeRelayResetTopic,
+		"origin": realtimeRelayOrigin,
+	})
+	if err != nil {
+		log.Printf("failed to relay realtime reset: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, realtimeRelayResetWait)
+	defer cancel()
+	if err := realtimeRelayPosition.wait(ctx, id); err != nil {
+		log.Printf("failed to wait for realtime reset %s: %v", id, err)
+	}
+}
+
+// runRealtimeRelay は、中継されたものを自分のHubに送る。起動時より前に書かれたものは送らない
+func runRealtimeRelay(ctx context.Context, logger echo.Logger) {
+	after := ""
+	for ctx.Err() == nil {
+		var messages []redis.StreamMessage
+		var err error
+		if after == "" {
+			var last string
+			if last, err = redisClient.XLastID(ctx, realtimeRelayStream); err == nil {
+				after = last
+			}
+		} else {
+			messages, err = redisClient.XRead(ctx, realtimeRelayStream, after, realtimeRelayReadCount, realtimeRelayBlock)
+		}
+		if err != nil {
+			// Redisが落ちている間は、クライアントが問い合わせずにすぐ返すので待つ
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(realtimeRelayRetryInterval):
+			}
+			continue
+		}
+		for _, m := range messages {
+			after = m.ID
+			if err := receiveRealtime(m.Values); err != nil {
+				logger.Errorf("failed to receive relayed realtime event %s: %v", m.ID, err)
+			}
+		}
+		if after != "" {
+			realtimeRelayPosition.set(after)
+		}
+	}
+}
+
+func receiveRealtime(values map[string]string) error {
+	topic := values["topic"]
+	if topic == realtimeRelayResetTopic {
+		// 自分のリセットでも、それまでに読んだ初期化前のイベントを消すため空にする
+		closeRealtimeHubs()
+		return nil
+	}
+	if values["origin"] == realtimeRelayOrigin {
+		// 書く前に自分のHubに送っている
+		return nil
+	}
+	receive, ok := realtimeRelayReceivers[topic]
+	if !ok {
+		return fmt.Errorf("unknown topic %q", topic)
+	}
+	key, err := strconv.ParseInt(values["key"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid key %q", values["key"])
+	}
+	return receive(key, []byte(values["data"]))
+}
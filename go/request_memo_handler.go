@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// リクエスト内のメモ
+// 1つのレスポンスに同じユーザや配信が何度も出てくる場合 (リアクション一覧の配信など) に、組み立てを1回で済ませる
+// 組み立て後に更新すると古い値を返してしまうので、参照系のGETリクエストでだけ使う
+// タグはtagsByIDから引くので、ここでは覚えない
+
+type requestMemoKey struct{}
+
+type requestMemo struct {
+	mu          sync.Mutex
+	users       map[int64]User
+	livestreams map[int64]Livestream
+}
+
+// requestMemoMiddleware は、GETリクエストにメモを付ける
+// ヘルパーに渡すリクエストのcontext.Contextから引けるようにする
+func requestMemoMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Request().Method != http.MethodGet {
+			return next(c)
+		}
+		memo := &requestMemo{
+			users:       map[int64]User{},
+			livestreams: map[int64]Livestream{},
+		}
+		c.SetRequest(c.Request().WithContext(context.WithValue(c.Request().Context(), requestMemoKey{}, memo)))
+		return next(c)
+	}
+}
+
+// requestMemoFrom は、メモのないリクエストではnilを返す
+// nilのメモは何も覚えず、何も返さない
+func requestMemoFrom(ctx context.Context) *requestMemo {
+	memo, _ := ctx.Value(requestMemoKey{}).(*requestMemo)
+	return memo
+}
+
+// lookupUsers は、覚えているユーザと、覚えていないIDを返す
+func (m *requestMemo) lookupUsers(userIDs []int64) (map[int64]User, []int64) {
+	if m == nil {
+		return map[int64]User{}, userIDs
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return lookupMemo(m.users, userIDs)
+}
+
+func (m *requestMemo) storeUsers(users []User) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	for _, u := range users {
+		m.users[u.ID] = u
+	}
+	m.mu.Unlock()
+}
+
+// lookupLivestreams は、覚えている配信と、覚えていないIDを返す
+func (m *requestMemo) lookupLivestreams(livestreamIDs []int64) (map[int64]Livestream, []int64) {
+	if m == nil {
+		return map[int64]Livestream{}, livestreamIDs
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return lookupMemo(m.livestreams, livestreamIDs)
+}
+
+func (m *requestMemo) storeLivestreams(livestreams []Livestream) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	for _, l := range livestreams {
+		m.livestreams[l.ID] = l
+	}
+	m.mu.Unlock()
+}
+
+func lookupMemo[V any](memo map[int64]V, ids []int64) (map[int64]V, []int64) {
+	found := make(map[int64]V, len(ids))
+	var missing []int64
+	for _, id := range ids {
+		if v, ok := memo[id]; ok {
+			found[id] = v
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return found, missing
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 予約枠の残数をメモリ上に保持する
+// 予約・予約取り消しはcommitWithDeltaでコミットし、コミットした後に短いロックで差分を反映する
+// 読み込みはロックを持たずにDBから読み、読み込み中にコミットがあった場合は結果を捨てて読み直す
+// 何度読み直しても落ち着かない場合は、覚えずにDBから直接返す
+const reservationSlotLoadAttempts = 3
+
+type ReservationSlotAvailability struct {
+	StartAt int64 `json:"start_at" db:"start_at"`
+	EndAt   int64 `json:"end_at" db:"end_at"`
+	Slot    int64 `json:"slot" db:"slot"`
+}
+
+type reservationSlotCache struct {
+	mu     sync.RWMutex
+	loaded bool
+	// start_at昇順
+	slots []ReservationSlotModel
+	// コミット中の件数と、コミットを始めた累計
+	committing int
+	commits    uint64
+}
+
+var reservationSlots = &reservationSlotCache{}
+
+// load は、読み込めた場合にtrueを返す
+// 読み込み中にコミットが続いて読み込めなかった場合はfalseを返すので、DBから直接読むこと
+func (c *reservationSlotCache) load(ctx context.Context) (bool, error) {
+	for attempt := 0; attempt < reservationSlotLoadAttempts; attempt++ {
+		c.mu.RLock()
+		loaded, committing, commits := c.loaded, c.committing, c.commits
+		c.mu.RUnlock()
+		if loaded {
+			return true, nil
+		}
+		if committing > 0 {
+			// コミット中のものが読み込みに含まれるか分からない
+			continue
+		}
+
+		var slots []ReservationSlotModel
+		if err := dbConn.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots ORDER BY start_at"); err != nil {
+			return false, err
+		}
+
+		c.mu.Lock()
+		if !c.loaded && c.committing == 0 && c.commits == commits {
+			c.slots = slots
+			c.loaded = true
+		}
+		loaded = c.loaded
+		c.mu.Unlock()
+		if loaded {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// between は、[from, until)に収まる枠を返す
+func (c *reservationSlotCache) between(from, until int64) []ReservationSlotAvailability {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	start := sort.Search(len(c.slots), func(i int) bool { return c.slots[i].StartAt >= from })
+	availabilities := []ReservationSlotAvailability{}
+	for i := start; i < len(c.slots) && c.slots[i].EndAt <= until; i++ {
+		availabilities = append(availabilities, ReservationSlotAvailability{
+			StartAt: c.slots[i].StartAt,
+			EndAt:   c.slots[i].EndAt,
+			Slot:    c.slots[i].Slot,
+		})
+	}
+	return availabilities
+}
+
+// commitWithDelta は、予約枠を更新したトランザクションをコミットし、
+// [startAt, endAt)に収まる枠の残数にdeltaを加算する
+// 範囲は予約枠のUPDATEと同じ条件にすること
+func (c *reservationSlotCache) commitWithDelta(tx *sqlx.Tx, startAt, endAt, delta int64) error {
+	c.mu.Lock()
+	c.committing++
+	c.commits++
+	c.mu.Unlock()
+
+	err := tx.Commit()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.committing--
+	if err != nil || !c.loaded {
+		return err
+	}
+	start := sort.Search(len(c.slots), func(i int) bool { return c.slots[i].StartAt >= startAt })
+	for i := start; i < len(c.slots) && c.slots[i].EndAt <= endAt; i++ {
+		c.slots[i].Slot += delta
+	}
+	return nil
+}
+
+func (c *reservationSlotCache) reset() {
+	c.mu.Lock()
+	c.loaded = false
+	c.slots = nil
+	c.mu.Unlock()
+}
+
+// 予約枠の空き状況API
+// GET /api/reservation_slots/availability?from=&until=
+func getReservationSlotAvailabilityHandler(c echo.Context) error {
+	from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+	}
+	until, err := strconv.ParseInt(c.QueryParam("until"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "until query parameter must be integer")
+	}
+	if until <= from {
+		return echo.NewHTTPError(http.StatusBadRequest, "until must be after from")
+	}
+
+	ctx := c.Request().Context()
+	loaded, err := reservationSlots.load(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load reservation_slots: "+err.Error())
+	}
+	if loaded {
+		return c.JSON(http.StatusOK, reservationSlots.between(from, until))
+	}
+
+	availabilities := []ReservationSlotAvailability{}
+	if err := dbConn.SelectContext(ctx, &availabilities, "SELECT start_at, end_at, slot FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at", from, until); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, availabilities)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/cache"
+	"github.com/labstack/echo/v4"
+)
+
+// ログイン不要な一覧系API (トップページ) のレスポンスのキャッシュ
+// パスとクエリパラメータごとに、200のレスポンスをresponseCacheTTLの間そのまま返す
+// 期限切れからresponseCacheStaleTTLの間は古いレスポンスを返しつつ、裏で1回だけ作り直す
+// キャッシュがない場合に同時に来たリクエストは、1回だけハンドラを呼んで結果を共有する
+// ユーザやセッションによってレスポンスが変わるAPIには使わないこと
+// 配信の予約・取り消しなど一覧の内容が変わる書き込みでは、コミット後にpurgeResponseCacheを呼ぶ
+const responseCacheStaleTTL = 2 * time.Second
+
+var (
+	// ISUCON13_RESPONSE_CACHE_TTLで変更する (例: 500ms)。0の場合はキャッシュしない
+	responseCacheTTL = 500 * time.Millisecond
+	responseCache    *cache.Cache[string, cachedResponse]
+	// 裏で作り直している最中のキー
+	responseCacheRefreshing sync.Map
+	// purgeResponseCacheのたびに進める。作り直しの途中で消された場合に、古い結果を覚えないようにする
+	responseCachePurgeMu         sync.Mutex
+	responseCachePurgeGeneration uint64
+)
+
+type cachedResponse struct {
+	status      int
+	contentType string
+	body        []byte
+	createdAt   time.Time
+}
+
+// uncacheableResponse は、200以外のレスポンスをキャッシュせずに呼び出し元へ返すためのエラー
+type uncacheableResponse struct {
+	response cachedResponse
+}
+
+func (uncacheableResponse) Error() string {
+	return "uncacheable response"
+}
+
+// responseRecorder は、ハンドラの書き込みをメモリに溜める
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func newResponseCache() *cache.Cache[string, cachedResponse] {
+	return cache.New[string, cachedResponse](cache.Options[cachedResponse]{
+		Name:       "responses",
+		TTL:        responseCacheTTL + responseCacheStaleTTL,
+		MaxEntries: 1000,
+	})
+}
+
+// responseCacheMiddleware は、パスパラメータのないGETのルートに付ける
+func responseCacheMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if responseCache == nil || c.Request().Method != http.MethodGet {
+			return next(c)
+		}
+		// Encodeはキーの順に並べるので、パラメータの順序が違っても同じキーになる
+		key := c.Request().URL.Path + "?" + c.QueryParams().Encode()
+
+		if cached, ok := responseCache.Get(key); ok {
+			if time.Since(cached.createdAt) > responseCacheTTL {
+				refreshResponseCache(c, next, key)
+			}
+			return writeCachedResponse(c, cached)
+		}
+
+		cached, err := responseCache.GetOrLoad(c.Request().Context(), key, func(ctx context.Context, key string) (cachedResponse, error) {
+			// 結果を待つ他のリクエストがいるので、最初のリクエストが切断されても作り終える
+			return renderResponse(c.Echo(), c.Request().Clone(ctx), next)
+		})
+		var uncacheable uncacheableResponse
+		if errors.As(err, &uncacheable) {
+			return writeCachedResponse(c, uncacheable.response)
+		}
+		if err != nil {
+			return err
+		}
+		return writeCachedResponse(c, cached)
+	}
+}
+
+// refreshResponseCache は、リクエストとは別にハンドラを呼んでキャッシュを作り直す
+// 同じキーの作り直しが進行中の場合は何もしない
+func refreshResponseCache(c echo.Context, next echo.HandlerFunc, key string) {
+	if _, loaded := responseCacheRefreshing.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+	e := c.Echo()
+	// レスポンスを返し終えたリクエストのキャンセルを伝えない
+	req := c.Request().Clone(context.WithoutCancel(c.Request().Context()))
+	responseCachePurgeMu.Lock()
+	generation := responseCachePurgeGeneration
+	responseCachePurgeMu.Unlock()
+	go func() {
+		defer responseCacheRefreshing.Delete(key)
+		resp, err := renderResponse(e, req, next)
+		if err != nil {
+			// 古いものは期限が来れば消えるので、次のリクエストでやり直す
+			return
+		}
+		responseCachePurgeMu.Lock()
+		defer responseCachePurgeMu.Unlock()
+		if generation != responseCachePurgeGeneration {
+			return
+		}
+		responseCache.Set(key, resp)
+	}()
+}
+
+// purgeResponseCache は、キャッシュしたレスポンスをすべて捨てる
+// 読み込み中の結果もcache.Cache.Resetで捨てられるので、書き込みの直後に古い一覧を返さない
+func purgeResponseCache() {
+	if responseCache == nil {
+		return
+	}
+	responseCachePurgeMu.Lock()
+	defer responseCachePurgeMu.Unlock()
+	responseCachePurgeGeneration++
+	responseCache.Reset()
+}
+
+// renderResponse は、ハンドラのレスポンスをメモリ上に作る
+// ハンドラのエラーと200以外のレスポンスはエラーとして返す
+func renderResponse(e *echo.Echo, req *http.Request, next echo.HandlerFunc) (cachedResponse, error) {
+	rec := &responseRecorder{header: http.Header{}}
+	rc := e.NewContext(req, rec)
+	createdAt := time.Now()
+	if err := next(rc); err != nil {
+		return cachedResponse{}, err
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	resp := cachedResponse{
+		status:      rec.status,
+		contentType: rec.header.Get(echo.HeaderContentType),
+		body:        rec.body.Bytes(),
+		createdAt:   createdAt,
+	}
+	if resp.status != http.StatusOK {
+		return cachedResponse{}, uncacheableResponse{response: resp}
+	}
+	return resp, nil
+}
+
+func writeCachedResponse(c echo.Context, resp cachedResponse) error {
+	return c.Blob(resp.status, resp.contentType, resp.body)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// 初期化後に必ず張られているはずのインデックス
+// インデックスは10_schema.sqlで宣言し、ここでは張られているかを確かめるだけにする
+// init.shのスキーマが古いサーバや、手でスキーマを作り直した環境で、インデックスなしでベンチマークが走らないようにする
+// 先頭の列が一致するインデックスがあれば、張られているとみなす
+type requiredIndex struct {
+	table   string
+	name    string
+	columns []string
+}
+
+var requiredIndexes = []requiredIndex{
+	{table: "reactions", name: "reactions_livestream_id_created_at", columns: []string{"livestream_id", "created_at"}},
+	{table: "livecomments", name: "livecomments_livestream_id_created_at", columns: []string{"livestream_id", "created_at"}},
+	{table: "livestream_tags", name: "livestream_tags_tag_id", columns: []string{"tag_id"}},
+	{table: "icons", name: "icons_user_id", columns: []string{"user_id"}},
+	{table: "themes", name: "themes_user_id", columns: []string{"user_id"}},
+	{table: "ng_words", name: "ng_words_livestream_id", columns: []string{"livestream_id"}},
+	{table: "livecomment_reports", name: "livecomment_reports_livestream_id", columns: []string{"livestream_id"}},
+}
+
+// missingIndexes は、requiredIndexesのうち足りないものを返す
+func missingIndexes(ctx context.Context) ([]requiredIndex, error) {
+	var missing []requiredIndex
+	for _, index := range requiredIndexes {
+		exists, err := hasIndexWithPrefix(ctx, index.table, index.columns)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, index)
+		}
+	}
+	return missing, nil
+}
+
+// hasIndexWithPrefix は、columnsを先頭に持つインデックス (主キー・ユニークキーを含む) があるかを返す
+// 全文検索インデックスは除く
+func hasIndexWithPrefix(ctx context.Context, table string, columns []string) (bool, error) {
+	var rows []struct {
+		IndexName  string `db:"INDEX_NAME"`
+		ColumnName string `db:"COLUMN_NAME"`
+	}
+	query := "SELECT INDEX_NAME, COLUMN_NAME FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_TYPE <> 'FULLTEXT' ORDER BY INDEX_NAME, SEQ_IN_INDEX"
+	if err := dbConn.SelectContext(ctx, &rows, query, table); err != nil {
+		return false, err
+	}
+
+	indexColumns := map[string][]string{}
+	for _, row := range rows {
+		indexColumns[row.IndexName] = append(indexColumns[row.IndexName], row.ColumnName)
+	}
+	for _, cols := range indexColumns {
+		if len(cols) < len(columns) {
+			continue
+		}
+		matched := true
+		for i, column := range columns {
+			if !strings.EqualFold(cols[i], column) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ログイン中の端末(セッション)の一覧・破棄
+// セッションIDはクッキーを偽造できなくても秘密にしておきたいので、APIではsha256の先頭を使う
+// JWT認証モードではサーバ側にセッションがないので使えない
+
+type UserSessionModel struct {
+	ID        string `db:"id"`
+	UserAgent string `db:"user_agent"`
+	CreatedAt int64  `db:"created_at"`
+	ExpiresAt int64  `db:"expires_at"`
+}
+
+type UserSession struct {
+	ID        string `json:"id"`
+	UserAgent string `json:"user_agent"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+	// このリクエストのセッションか
+	Current bool `json:"current"`
+}
+
+// publicSessionID は、セッションIDからAPIで使うIDを求める
+func publicSessionID(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// セッション一覧API
+// GET /api/user/me/sessions
+func getMySessionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if jwtAuthEnabled {
+		return echo.NewHTTPError(http.StatusNotImplemented, "session management is not available in jwt auth mode")
+	}
+
+	var sessionModels []UserSessionModel
+	if err := dbConn.SelectContext(ctx, &sessionModels, "SELECT id, user_agent, created_at, expires_at FROM sessions WHERE user_id = ? AND expires_at >= ? ORDER BY created_at DESC", userID, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get sessions: "+err.Error())
+	}
+
+	sessions := make([]UserSession, len(sessionModels))
+	for i, sm := range sessionModels {
+		sessions[i] = UserSession{
+			ID:        publicSessionID(sm.ID),
+			UserAgent: sm.UserAgent,
+			CreatedAt: sm.CreatedAt,
+			ExpiresAt: sm.ExpiresAt,
+			Current:   sm.ID == sess.ID,
+		}
+	}
+
+	return c.JSON(http.StatusOK, sessions)
+}
+
+// セッション破棄API
+// DELETE /api/user/me/sessions/:session_id
+// 他の端末をログアウトさせる。このリクエストのセッションを指定した場合はログアウトする
+func deleteMySessionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if jwtAuthEnabled {
+		return echo.NewHTTPError(http.StatusNotImplemented, "session management is not available in jwt auth mode")
+	}
+
+	// 1ユーザのセッションは多くないので、全件からAPI上のIDで探す
+	var sessionIDs []string
+	if err := dbConn.SelectContext(ctx, &sessionIDs, "SELECT id FROM sessions WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get sessions: "+err.Error())
+	}
+	target := ""
+	for _, sessionID := range sessionIDs {
+		if publicSessionID(sessionID) == c.Param("session_id") {
+			target = sessionID
+			break
+		}
+	}
+	if target == "" {
+		return echo.NewHTTPError(http.StatusNotFound, "not found session that has the given id")
+	}
+
+	if target == sess.ID {
+		sess.Options.MaxAge = -1
+		if err := sess.Save(c.Request(), c.Response()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	if err := sessionStore.revoke(ctx, target); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete session: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
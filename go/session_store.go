@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// セッションの中身はサーバ側に持ち、クッキーには署名したセッションIDだけを載せる
+// 複数台のアプリサーバで共有できるようsessionsテーブルに永続化し、
+// 各サーバはメモリ上にsessionLocalTTLの間だけキャッシュし、過ぎたらDBから読み直す
+// ログアウト・破棄は必ずsessionsテーブルの行を消すので、他のサーバでのログアウト・破棄は読み直したときに反映される
+// メモリ上のキャッシュは、sweepSessionsが読み直す時期を過ぎたものを定期的に捨てる
+// Redisが設定されている場合は、他のサーバで作られたセッションをDBより先にRedisから引く
+// Redisの削除に失敗したセッションが残り続けないよう、RedisにはsessionRedisTTLまでしか置かない
+// ログアウト・破棄では先にRedisから消し、消せなければ失敗させる (Redisに残ったセッションを他のサーバが読まないように)
+
+type sessionRecord struct {
+	values    map[interface{}]interface{}
+	expiresAt int64
+	// メモリ上のキャッシュを使ってよい期限
+	staleAt time.Time
+}
+
+type serverSessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	mu sync.RWMutex
+	// session_id -> セッション
+	records map[string]sessionRecord
+}
+
+var sessionIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// sessions.user_agentの長さ
+const maxSessionUserAgentLength = 512
+
+const (
+	sessionRedisTTL      = 10 * time.Minute
+	sessionLocalTTL      = 2 * time.Second
+	sessionSweepInterval = 30 * time.Second
+)
+
+func sessionRedisKey(sessionID string) string {
+	return redisKeyPrefix + "session:" + sessionID
+}
+
+// userSessionsRedisKey は、ユーザのセッションIDの集合のキー
+func userSessionsRedisKey(userID int64) string {
+	return redisKeyPrefix + "user_sessions:" + strconv.FormatInt(userID, 10)
+}
+
+func newServerSessionStore(keyPairs ...[]byte) *serverSessionStore {
+	return &serverSessionStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		records: map[string]sessionRecord{},
+	}
+}
+
+// Get は、リクエスト内でキャッシュされたセッションを返す
+func (s *serverSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New は、クッキーのセッションIDに対応するセッションを読み込む
+// 見つからない・期限切れの場合は、クッキーがない場合と同じく空のセッションを返す
+func (s *serverSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var sessionID string
+	if err := securecookie.DecodeMulti(name, c.Value, &sessionID, s.Codecs...); err != nil {
+		return session, err
+	}
+	values, ok, err := s.load(r.Context(), name, sessionID)
+	if err != nil {
+		return session, err
+	}
+	if ok {
+		session.ID = sessionID
+		session.Values = values
+		session.IsNew = false
+	}
+	return session, nil
+}
+
+// Save は、セッションを保存してセッションIDをクッキーに書き込む
+// MaxAgeが0以下の場合はセッションを破棄する
+func (s *serverSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	ctx := r.Context()
+
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if err := s.revoke(ctx, session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = sessionIDEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	}
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(session.Options.MaxAge) * time.Second).Unix()
+	// ユーザ単位でセッションを一覧・破棄できるよう、ログイン中のユーザIDも持っておく
+	// User-Agentと作成日時は作成時のものを残す
+	userID, _ := session.Values[defaultUserIDKey].(int64)
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxSessionUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxSessionUserAgentLength], "")
+	}
+	if _, err := dbConn.ExecContext(ctx, "INSERT INTO sessions (id, data, expires_at, user_id, user_agent, created_at) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data), expires_at = VALUES(expires_at), user_id = VALUES(user_id)", session.ID, data, expiresAt, userID, userAgent, now.Unix()); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.records[session.ID] = sessionRecord{values: copySessionValues(session.Values), expiresAt: expiresAt, staleAt: now.Add(sessionLocalTTL)}
+	s.mu.Unlock()
+	s.storeRedis(ctx, session.ID, userID, data, expiresAt)
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// load は、メモリになければRedis・DBから、読み直す時期になっていればDBからセッションを読み込む
+// 他のサーバで作られたセッションもここで読み込まれる
+func (s *serverSessionStore) load(ctx context.Context, name string, sessionID string) (map[interface{}]interface{}, bool, error) {
+	loadedAt := time.Now()
+	now := loadedAt.Unix()
+
+	s.mu.RLock()
+	record, ok := s.records[sessionID]
+	s.mu.RUnlock()
+	if ok && loadedAt.Before(record.staleAt) {
+		if record.expiresAt < now {
+			return nil, false, nil
+		}
+		return copySessionValues(record.values), true, nil
+	}
+
+	var row struct {
+		Data      string `db:"data"`
+		ExpiresAt int64  `db:"expires_at"`
+	}
+	// 読み直しでは、他のサーバで破棄されていないかをsessionsテーブルで確かめる
+	data, expiresAt, inRedis := "", int64(0), false
+	if !ok {
+		data, expiresAt, inRedis = s.loadRedis(ctx, sessionID)
+	}
+	if inRedis && expiresAt >= now {
+		row.Data = data
+		row.ExpiresAt = expiresAt
+	} else if err := dbConn.GetContext(ctx, &row, "SELECT data, expires_at FROM sessions WHERE id = ? AND expires_at >= ?", sessionID, now); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// 期限切れか、他のサーバでログアウト・破棄された
+			s.mu.Lock()
+			delete(s.records, sessionID)
+			s.mu.Unlock()
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	values := map[interface{}]interface{}{}
+	if err := securecookie.DecodeMulti(name, row.Data, &values, s.Codecs...); err != nil {
+		return nil, false, err
+	}
+	if !inRedis && !ok {
+		userID, _ := values[defaultUserIDKey].(int64)
+		s.storeRedis(ctx, sessionID, userID, row.Data, row.ExpiresAt)
+	}
+
+	s.mu.Lock()
+	s.records[sessionID] = sessionRecord{values: values, expiresAt: row.ExpiresAt, staleAt: loadedAt.Add(sessionLocalTTL)}
+	s.mu.Unlock()
+
+	return copySessionValues(values), true, nil
+}
+
+// sweepSessions は、読み直す時期を過ぎたセッションをメモリ上のキャッシュから定期的に捨てる
+// 捨てたセッションは、次に使われたときにRedis・DBから読み直す
+func (s *serverSessionStore) sweepSessions(ctx context.Context) {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for sessionID, record := range s.records {
+				if now.After(record.staleAt) {
+					delete(s.records, sessionID)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// forgetUser は、ユーザのセッションをsessionsテーブルから消したトランザクションのコミット後に呼ぶ
+func (s *serverSessionStore) forgetUser(ctx context.Context, userID int64) {
+	s.mu.Lock()
+	for sessionID, record := range s.records {
+		if id, _ := record.values[defaultUserIDKey].(int64); id == userID {
+			delete(s.records, sessionID)
+		}
+	}
+	s.mu.Unlock()
+
+	sessionIDs, err := redisClient.SMembers(ctx, userSessionsRedisKey(userID))
+	if err != nil {
+		return
+	}
+	keys := []string{userSessionsRedisKey(userID)}
+	for _, sessionID := range sessionIDs {
+		keys = append(keys, sessionRedisKey(sessionID))
+	}
+	redisClient.Del(ctx, keys...)
+}
+
+// revoke は、セッションを破棄する
+// Redisが設定されていて消せない場合は、sessionsテーブルの行を残したまま失敗する (やり直せば消える)
+func (s *serverSessionStore) revoke(ctx context.Context, sessionID string) error {
+	if err := redisClient.Del(ctx, sessionRedisKey(sessionID)); err != nil && redisClient != nil {
+		return fmt.Errorf("failed to delete session from redis: %w", err)
+	}
+	if _, err := dbConn.ExecContext(ctx, "DELETE FROM sessions WHERE id = ?", sessionID); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.records, sessionID)
+	s.mu.Unlock()
+	return nil
+}
+
+// storeRedis は、DBに保存したセッションをRedisにも置く
+// 失敗しても他のサーバはDBから読めるので、エラーは返さない
+func (s *serverSessionStore) storeRedis(ctx context.Context, sessionID string, userID int64, data string, expiresAt int64) {
+	ttl := time.Until(time.Unix(expiresAt, 0))
+	if ttl <= 0 {
+		return
+	}
+	ttl = min(ttl, sessionRedisTTL)
+	if err := redisClient.Set(ctx, sessionRedisKey(sessionID), []byte(strconv.FormatInt(expiresAt, 10)+"\n"+data), ttl); err != nil {
+		return
+	}
+	if userID != 0 {
+		redisClient.SAdd(ctx, userSessionsRedisKey(userID), sessionID, sessionRedisTTL)
+	}
+}
+
+// loadRedis は、Redisからセッションを読む。ないか、Redisが使えない場合はfalseを返す
+func (s *serverSessionStore) loadRedis(ctx context.Context, sessionID string) (string, int64, bool) {
+	value, ok, err := redisClient.Get(ctx, sessionRedisKey(sessionID))
+	if err != nil || !ok {
+		return "", 0, false
+	}
+	expiresAt, data, ok := strings.Cut(string(value), "\n")
+	if !ok {
+		return "", 0, false
+	}
+	at, err := strconv.ParseInt(expiresAt, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return data, at, true
+}
+
+// reset は、初期化でsessionsテーブルが作り直されるのに合わせてキャッシュを捨てる
+func (s *serverSessionStore) reset() {
+	s.mu.Lock()
+	s.records = map[string]sessionRecord{}
+	s.mu.Unlock()
+}
+
+// リクエストごとにsession.Valuesを書き換えても、キャッシュに影響しないようにする
+func copySessionValues(values map[interface{}]interface{}) map[interface{}]interface{} {
+	copied := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		copied[k] = v
+	}
+	return copied
+}
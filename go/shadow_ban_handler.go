@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/counter"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// シャドウバンされたユーザのライブコメントは保存されるが、本人以外の一覧や統計からは除外される
+
+const shadowBannedUserIDsContextKey = "shadow_banned_user_ids"
+
+type ShadowBanModel struct {
+	ID           int64 `db:"id"`
+	LivestreamID int64 `db:"livestream_id"`
+	UserID       int64 `db:"user_id"`
+	CreatedAt    int64 `db:"created_at"`
+}
+
+type PostShadowBanRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+type ShadowBan struct {
+	ID           int64 `json:"id"`
+	LivestreamID int64 `json:"livestream_id"`
+	User         User  `json:"user"`
+	CreatedAt    int64 `json:"created_at"`
+}
+
+// livestream_id -> シャドウバンされたuser_idの集合
+// 読み込み中にinvalidateされた場合に古い集合を覚えないよう、配信ごとの版を比べてから覚える
+type shadowBanCache struct {
+	mu       sync.RWMutex
+	sets     map[int64]map[int64]struct{}
+	versions map[int64]uint64
+	// resetのたびに進める
+	generation uint64
+}
+
+var shadowBans = &shadowBanCache{sets: map[int64]map[int64]struct{}{}, versions: map[int64]uint64{}}
+
+func (c *shadowBanCache) get(ctx context.Context, livestreamID int64) (map[int64]struct{}, error) {
+	c.mu.RLock()
+	set, ok := c.sets[livestreamID]
+	version, generation := c.versions[livestreamID], c.generation
+	c.mu.RUnlock()
+	if ok {
+		return set, nil
+	}
+
+	var userIDs []int64
+	if err := dbConn.SelectContext(ctx, &userIDs, "SELECT user_id FROM shadow_bans WHERE livestream_id = ?", livestreamID); err != nil {
+		return nil, err
+	}
+	set = make(map[int64]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		set[userID] = struct{}{}
+	}
+
+	c.mu.Lock()
+	if c.versions[livestreamID] == version && c.generation == generation {
+		c.sets[livestreamID] = set
+	}
+	c.mu.Unlock()
+
+	return set, nil
+}
+
+// invalidate は、次回参照時にDBから読み直させる
+// 集合自体は読み取り側と共有しているので、書き換えずに捨てる
+func (c *shadowBanCache) invalidate(livestreamID int64) {
+	c.mu.Lock()
+	delete(c.sets, livestreamID)
+	c.versions[livestreamID]++
+	c.mu.Unlock()
+}
+
+func (c *shadowBanCache) reset() {
+	c.mu.Lock()
+	c.sets = map[int64]map[int64]struct{}{}
+	c.versions = map[int64]uint64{}
+	c.generation++
+	c.mu.Unlock()
+}
+
+// shadowBanMiddleware は、パスの配信についてシャドウバン中のユーザ集合をcontextに載せる
+// ログインしていないリクエストでDBを読まないよう、先にセッションを検証する
+func shadowBanMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := verifyUserSession(c); err != nil {
+			// echo.NewHTTPErrorが返っているのでそのまま出力
+			return err
+		}
+
+		livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		}
+
+		set, err := shadowBans.get(c.Request().Context(), int64(livestreamID))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get shadow bans: "+err.Error())
+		}
+		c.Set(shadowBannedUserIDsContextKey, set)
+
+		return next(c)
+	}
+}
+
+// hiddenUserIDs は、閲覧者(viewerID)から見て除外すべきユーザIDを返す
+// シャドウバンされた本人には自分のコメントが見えるようにする
+func hiddenUserIDs(c echo.Context, viewerID int64) []int64 {
+	set, _ := c.Get(shadowBannedUserIDsContextKey).(map[int64]struct{})
+	userIDs := make([]int64, 0, len(set))
+	for userID := range set {
+		if userID != viewerID {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs
+}
+
+// シャドウバン一覧取得API (配信者向け)
+// GET /api/livestream/:livestream_id/ban
+func getShadowBansHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if err := verifyLivestreamModerator(ctx, dbConn, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	var banModels []ShadowBanModel
+	if err := dbConn.SelectContext(ctx, &banModels, "SELECT * FROM shadow_bans WHERE livestream_id = ? ORDER BY created_at DESC", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get shadow bans: "+err.Error())
+	}
+
+	bans := make([]ShadowBan, len(banModels))
+	for i := range banModels {
+		ban, err := fillShadowBanResponse(ctx, dbConn, banModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill shadow ban: "+err.Error())
+		}
+		bans[i] = ban
+	}
+
+	return c.JSON(http.StatusOK, bans)
+}
+
+// シャドウバン登録API (配信者向け)
+// POST /api/livestream/:livestream_id/ban
+func postShadowBanHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostShadowBanRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamModerator(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+	if req.UserID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't shadow-ban yourself")
+	}
+	var ownerID int64
+	if err := tx.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if req.UserID == ownerID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't shadow-ban the owner")
+	}
+
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", req.UserID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+
+	banModel := ShadowBanModel{
+		LivestreamID: int64(livestreamID),
+		UserID:       req.UserID,
+		CreatedAt:    time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO shadow_bans (livestream_id, user_id, created_at) VALUES (:livestream_id, :user_id, :created_at)", banModel)
+	if isDuplicateEntryError(err) {
+		return echo.NewHTTPError(http.StatusConflict, "the user is already shadow-banned")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert shadow ban: "+err.Error())
+	}
+	banID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted shadow ban id: "+err.Error())
+	}
+	banModel.ID = banID
+	if err := insertModerationLog(ctx, tx, int64(livestreamID), userID, moderationActionShadowBanAdded, fmt.Sprintf("user_id=%d", req.UserID)); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert moderation log: "+err.Error())
+	}
+
+	ban, err := fillShadowBanResponse(ctx, tx, banModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill shadow ban: "+err.Error())
+	}
+
+	// シャドウバンされたユーザのライブコメントは、配信者のライブコメント数に数えない
+	var deltas counterDeltas
+	if err := deltas.addCounts(ctx, tx, userLivecommentCounter, -1, "SELECT ? AS id, COUNT(*) AS count FROM livecomments WHERE livestream_id = ? AND user_id = ?", ownerID, livestreamID, req.UserID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livecomments: "+err.Error())
+	}
+
+	counterEpoch, err := counter.Commit(tx.Commit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	shadowBans.invalidate(int64(livestreamID))
+	deltas.apply(counterEpoch)
+	invalidateRankings(ctx)
+
+	return c.JSON(http.StatusCreated, ban)
+}
+
+// シャドウバン解除API (配信者向け)
+// DELETE /api/livestream/:livestream_id/ban/:user_id
+func deleteShadowBanHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	bannedUserID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "user_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamModerator(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	rs, err := tx.ExecContext(ctx, "DELETE FROM shadow_bans WHERE livestream_id = ? AND user_id = ?", livestreamID, bannedUserID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete shadow ban: "+err.Error())
+	}
+	affected, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+	if affected == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "the user is not shadow-banned")
+	}
+	if err := insertModerationLog(ctx, tx, int64(livestreamID), userID, moderationActionShadowBanRemoved, fmt.Sprintf("user_id=%d", bannedUserID)); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert moderation log: "+err.Error())
+	}
+
+	// 解除したユーザのライブコメントを、配信者のライブコメント数に戻す
+	var deltas counterDeltas
+	if err := deltas.addCounts(ctx, tx, userLivecommentCounter, 1, "SELECT l.user_id AS id, COUNT(*) AS count FROM livecomments lc INNER JOIN livestreams l ON l.id = lc.livestream_id WHERE lc.livestream_id = ? AND lc.user_id = ? GROUP BY l.user_id", livestreamID, bannedUserID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livecomments: "+err.Error())
+	}
+
+	counterEpoch, err := counter.Commit(tx.Commit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	shadowBans.invalidate(int64(livestreamID))
+	deltas.apply(counterEpoch)
+	invalidateRankings(ctx)
+
+	return c.NoContent(http.StatusOK)
+}
+
+func fillShadowBanResponse(ctx context.Context, db dbQueryer, banModel ShadowBanModel) (ShadowBan, error) {
+	user, err := getUserByID(ctx, db, banModel.UserID)
+	if err != nil {
+		return ShadowBan{}, err
+	}
+
+	return ShadowBan{
+		ID:           banModel.ID,
+		LivestreamID: banModel.LivestreamID,
+		User:         user,
+		CreatedAt:    banModel.CreatedAt,
+	}, nil
+}
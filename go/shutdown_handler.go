@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/counter"
+	"github.com/labstack/echo/v4"
+)
+
+// 終了処理
+// SIGINT・SIGTERMを受けたら、次の順に片付けて終了する
+//  1. 新しい接続の受け付けをやめ、処理中のリクエストを待つ
+//  2. 後片付けジョブなどのワーカーを止め、終わるのを待つ
+//     (途中で止めたジョブはDBに積まれたまま残るので、次の起動でやり直す)
+//     その後、キューに残った投稿などのイベントを処理し終えるのを待つ
+//  3. メモリ上の件数をMySQLに書き出し、キャッシュのスナップショットを保存する
+//  4. Redis・DBの接続を閉じる
+// 全体でshutdownTimeoutを過ぎた場合は、残りを諦めて終了する
+// 終了処理中にもう一度シグナルを受けた場合は、すぐに終了する
+
+var shutdownTimeout = 10 * time.Second
+
+// backgroundWorkers は、終了時に止めて待つgoroutine
+type backgroundWorkers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var workers = newBackgroundWorkers()
+
+func newBackgroundWorkers() *backgroundWorkers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backgroundWorkers{ctx: ctx, cancel: cancel}
+}
+
+// start は、runを別のgoroutineで動かす。runはctxが終わったら戻ること
+func (w *backgroundWorkers) start(run func(ctx context.Context)) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		run(w.ctx)
+	}()
+}
+
+// stop は、ワーカーを止め、すべて戻るかctxが終わるまで待つ
+func (w *backgroundWorkers) stop(ctx context.Context) error {
+	w.cancel()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown は、終了処理を行う。失敗した段階があっても、残りの段階は続ける
+func shutdown(ctx context.Context, e *echo.Echo) {
+	if err := e.Shutdown(ctx); err != nil {
+		log.Printf("failed to shut down HTTP server: %v", err)
+	}
+	if err := workers.stop(ctx); err != nil {
+		log.Printf("failed to stop background workers: %v", err)
+	}
+	if err := eventBus.Close(ctx); err != nil {
+		log.Printf("failed to drain events: %v", err)
+	}
+	if err := counter.SyncAll(ctx, dbConn, false); err != nil {
+		log.Printf("failed to flush counters: %v", err)
+	}
+	if err := saveCacheSnapshot(); err != nil {
+		log.Printf("failed to save cache snapshot: %v", err)
+	}
+	if err := redisClient.Close(); err != nil {
+		log.Printf("failed to close redis: %v", err)
+	}
+	if dbReplica != nil {
+		if err := dbReplica.Close(); err != nil {
+			log.Printf("failed to close replica db: %v", err)
+		}
+	}
+	if err := dbConn.Close(); err != nil {
+		log.Printf("failed to close db: %v", err)
+	}
+}
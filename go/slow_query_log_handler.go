@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// アプリ側のスロークエリログ
+// mysqldを再起動できないベンチマーク中でも遅いクエリを調べられるよう、ドライバの接続を包んで実行時間を測る
+// slowQueryThresholdを超えたクエリを、引数のダイジェストと呼び出し元とともに直近slowQueryLogSize件だけ覚える
+// 引数はパスワードなどを含みうるので、値そのものは残さない
+// 参照の時間は結果の最初の行を受け取るまでで、行の読み出しは含まない
+
+const slowQueryLogSize = 1000
+
+var (
+	// 0の場合は記録しない
+	slowQueryThreshold = 100 * time.Millisecond
+	slowQueries        = &slowQueryLog{}
+)
+
+// SlowQuery は、しきい値を超えたクエリ1件
+type SlowQuery struct {
+	Query      string  `json:"query"`
+	ArgsDigest string  `json:"args_digest"`
+	NumArgs    int     `json:"num_args"`
+	DurationMS float64 `json:"duration_ms"`
+	Caller     string  `json:"caller"`
+	Error      string  `json:"error,omitempty"`
+	StartedAt  int64   `json:"started_at"`
+}
+
+// slowQueryLog は、直近のスロークエリを覚えるリングバッファ
+type slowQueryLog struct {
+	mu      sync.Mutex
+	entries [slowQueryLogSize]SlowQuery
+	next    int
+	count   int
+}
+
+func (l *slowQueryLog) add(entry SlowQuery) {
+	l.mu.Lock()
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % slowQueryLogSize
+	if l.count < slowQueryLogSize {
+		l.count++
+	}
+	l.mu.Unlock()
+}
+
+// list は、新しい順に返す
+func (l *slowQueryLog) list() []SlowQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]SlowQuery, 0, l.count)
+	for i := 1; i <= l.count; i++ {
+		entries = append(entries, l.entries[(l.next-i+slowQueryLogSize)%slowQueryLogSize])
+	}
+	return entries
+}
+
+func recordSlowQuery(query string, args []driver.NamedValue, start time.Time, err error) {
+	elapsed := time.Since(start)
+	if elapsed < slowQueryThreshold {
+		return
+	}
+	entry := SlowQuery{
+		Query:      query,
+		ArgsDigest: digestQueryArgs(args),
+		NumArgs:    len(args),
+		DurationMS: float64(elapsed.Microseconds()) / 1000,
+		Caller:     slowQueryCaller(),
+		StartedAt:  start.Unix(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	slowQueries.add(entry)
+}
+
+// digestQueryArgs は、同じ引数で繰り返し遅くなっているかを見分けるためのハッシュを返す
+func digestQueryArgs(args []driver.NamedValue) string {
+	h := fnv.New64a()
+	for _, arg := range args {
+		fmt.Fprintf(h, "%d:%T:%v;", arg.Ordinal, arg.Value, arg.Value)
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// 呼び出し元から除く記録用の関数
+var queryRecorders = map[string]bool{
+	"main.recordQuery":     true,
+	"main.recordSlowQuery": true,
+	"main.logSampledQuery": true,
+}
+
+// slowQueryCaller は、database/sql・sqlx・記録用の関数を除いた最初の呼び出し元を返す
+func slowQueryCaller() string {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if strings.HasPrefix(frame.Function, "main.") && !strings.HasPrefix(frame.Function, "main.(*slowQuery") && !queryRecorders[frame.Function] {
+			return fmt.Sprintf("%s (%s:%d)", strings.TrimPrefix(frame.Function, "main."), frame.File, frame.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+// openDB は、confでDBに接続する
+// slowQueryThresholdかqueryLogSampleRateが0でなければ、クエリを記録するドライバで包む
+func openDB(conf *mysql.Config) (*sqlx.DB, error) {
+	connector, err := mysql.NewConnector(conf)
+	if err != nil {
+		return nil, err
+	}
+	if slowQueryThreshold > 0 || queryLogSampleRate > 0 {
+		connector = &slowQueryConnector{Connector: connector}
+	}
+	return sqlx.NewDb(sql.OpenDB(connector), "mysql"), nil
+}
+
+// mysqlDriverConn は、go-sql-driver/mysqlの接続が実装しているインタフェース
+type mysqlDriverConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+	driver.NamedValueChecker
+	driver.SessionResetter
+	driver.Validator
+}
+
+// mysqlDriverStmt は、go-sql-driver/mysqlのステートメントが実装しているインタフェース
+type mysqlDriverStmt interface {
+	driver.Stmt
+	driver.StmtExecContext
+	driver.StmtQueryContext
+	driver.NamedValueChecker
+}
+
+type slowQueryConnector struct {
+	driver.Connector
+}
+
+func (c *slowQueryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mc, ok := conn.(mysqlDriverConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected mysql connection type %T", conn)
+	}
+	return &slowQueryConn{mysqlDriverConn: mc}, nil
+}
+
+type slowQueryConn struct {
+	mysqlDriverConn
+}
+
+func (c *slowQueryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	result, err := c.mysqlDriverConn.ExecContext(ctx, query, args)
+	// interpolateParamsが無効な場合などはErrSkipでPrepareし直されるので、そちらで測る
+	if err != driver.ErrSkip {
+		recordQuery(query, args, start, result, err)
+	}
+	return result, err
+}
+
+func (c *slowQueryConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.mysqlDriverConn.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		recordQuery(query, args, start, nil, err)
+	}
+	return rows, err
+}
+
+func (c *slowQueryConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.mysqlDriverConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	ms, ok := stmt.(mysqlDriverStmt)
+	if !ok {
+		return stmt, nil
+	}
+	return &slowQueryStmt{mysqlDriverStmt: ms, query: query}, nil
+}
+
+type slowQueryStmt struct {
+	mysqlDriverStmt
+	query string
+}
+
+func (s *slowQueryStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	result, err := s.mysqlDriverStmt.ExecContext(ctx, args)
+	recordQuery(s.query, args, start, result, err)
+	return result, err
+}
+
+func (s *slowQueryStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.mysqlDriverStmt.QueryContext(ctx, args)
+	recordQuery(s.query, args, start, nil, err)
+	return rows, err
+}
+
+// スロークエリ取得API
+// GET /api/admin/slowlog
+// slowQueryThresholdを超えたクエリを新しい順に返す。初期化しても消さない
+// 引数のダイジェストから短いパスワードなどを総当たりで割り出せるので、内部向けのポートでのみ受け付ける
+func getSlowQueryLogHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(slowQueries.list())
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"net/http"
@@ -18,6 +19,13 @@ type LivestreamStatistics struct {
 	MaxTip         int64 `json:"max_tip"`
 }
 
+// 配信一覧に添える簡易統計
+type LivestreamMiniStatistics struct {
+	ViewersCount   int64 `json:"viewers_count"`
+	TotalReactions int64 `json:"total_reactions"`
+	TotalReports   int64 `json:"total_reports"`
+}
+
 type LivestreamRankingEntry struct {
 	LivestreamID int64
 	Score        int64
@@ -41,6 +49,7 @@ type UserStatistics struct {
 	TotalLivecomments int64  `json:"total_livecomments"`
 	TotalTip          int64  `json:"total_tip"`
 	FavoriteEmoji     string `json:"favorite_emoji"`
+	FollowerCount     int64  `json:"follower_count"`
 }
 
 type UserRankingEntry struct {
@@ -70,16 +79,20 @@ func getUserStatisticsHandler(c echo.Context) error {
 	username := c.Param("username")
 	// ユーザごとに、紐づく配信について、累計リアクション数、累計ライブコメント数、累計売上金額を算出
 	// また、現在の合計視聴者数もだす
-
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	if isMissingUserName(username) {
+		return echo.NewHTTPError(http.StatusBadRequest, "not found user that has the given username")
 	}
-	defer tx.Rollback()
 
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+	db := readDB()
+
+	user, err := userRepo.FindByName(ctx, db, username)
+	if errors.Is(err, sql.ErrNoRows) && isReplica(db) {
+		// レプリカにまだ届いていない可能性がある
+		user, err = userRepo.FindByName(ctx, dbConn, username)
+	}
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
+			rememberMissingUserName(username)
 			return echo.NewHTTPError(http.StatusBadRequest, "not found user that has the given username")
 		} else {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
@@ -87,11 +100,197 @@ func getUserStatisticsHandler(c echo.Context) error {
 	}
 	var userTotalReactions int64
 	var userTotalTip int64
+	rank, ok := redisRank(ctx, userRankingKey, username)
+	if ok {
+		if count, ok := userReactionCounter.Get(user.ID); ok {
+			userTotalReactions = count
+		} else if err := db.GetContext(ctx, &userTotalReactions, "SELECT COUNT(r.id) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id WHERE l.user_id = ?", user.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+		}
+		if err := db.GetContext(ctx, &userTotalTip, "SELECT IFNULL(SUM(lc.tip), 0) FROM livestreams ls INNER JOIN livecomments lc ON lc.livestream_id = ls.id WHERE ls.user_id = ? AND NOT EXISTS (SELECT 1 FROM shadow_bans sb WHERE sb.livestream_id = lc.livestream_id AND sb.user_id = lc.user_id)", user.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
+		}
+	} else {
+		var err error
+		rank, userTotalReactions, userTotalTip, err = computeUserRank(ctx, db, user, username)
+		if err != nil {
+			return err
+		}
+	}
+
+	// ライブコメント数、合計視聴者数
+	totalLivecomments, ok := userLivecommentCounter.Get(user.ID)
+	if !ok {
+		if err := db.GetContext(ctx, &totalLivecomments, "SELECT COUNT(lc.id) FROM livecomments lc INNER JOIN livestreams ls ON lc.livestream_id = ls.id WHERE ls.user_id = ? AND NOT EXISTS (SELECT 1 FROM shadow_bans sb WHERE sb.livestream_id = lc.livestream_id AND sb.user_id = lc.user_id)", user.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments count: "+err.Error())
+		}
+	}
+	viewersCount, ok := userViewerCounter.Get(user.ID)
+	if !ok {
+		if err := db.GetContext(ctx, &viewersCount, "SELECT COUNT(lvh.id) FROM livestream_viewers_history lvh INNER JOIN livestreams ls ON lvh.livestream_id = ls.id WHERE ls.user_id = ?", user.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get viewers count: "+err.Error())
+		}
+	}
+
+	// お気に入り絵文字
+	var favoriteEmoji string
+	query := `
+	SELECT r.emoji_name
+	FROM users u
+	INNER JOIN livestreams l ON l.user_id = u.id
+	INNER JOIN reactions r ON r.livestream_id = l.id
+	WHERE u.name = ?
+	GROUP BY emoji_name
+	ORDER BY COUNT(*) DESC, emoji_name DESC
+	LIMIT 1
+	`
+
+	if err := db.GetContext(ctx, &favoriteEmoji, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
+	}
+
+	stats := UserStatistics{
+		Rank:              rank,
+		ViewersCount:      viewersCount,
+		TotalReactions:    userTotalReactions,
+		TotalLivecomments: totalLivecomments,
+		TotalTip:          userTotalTip,
+		FavoriteEmoji:     favoriteEmoji,
+		FollowerCount:     user.FollowerCount,
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+func getLivestreamStatisticsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livestreamID := int64(id)
+	if isMissingLivestream(livestreamID) {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot get stats of not found livestream")
+	}
+
+	db := readDB()
+
+	_, err = livestreamRepo.FindByID(ctx, db, livestreamID)
+	if errors.Is(err, sql.ErrNoRows) && isReplica(db) {
+		// レプリカにまだ届いていない可能性がある
+		_, err = livestreamRepo.FindByID(ctx, dbConn, livestreamID)
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			rememberMissingLivestream(livestreamID)
+			return echo.NewHTTPError(http.StatusBadRequest, "cannot get stats of not found livestream")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+	var totalReactions int64
+	rank, ok := redisRank(ctx, livestreamRankingKey, livestreamRankingMember(livestreamID))
+	if ok {
+		if count, ok := livestreamReactionCounter.Get(livestreamID); ok {
+			totalReactions = count
+		} else if counts, ok := redisLivestreamReactionCounts(ctx, []int64{livestreamID}); ok {
+			totalReactions = counts[livestreamID]
+		} else if totalReactions, err = reactionRepo.CountByLivestreamID(ctx, db, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+		}
+	} else {
+		rank, totalReactions, err = computeLivestreamRank(ctx, db, livestreamID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 視聴者数算出
+	viewersCounts, err := countViewers(ctx, db, []int64{livestreamID})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
+	}
+
+	// 最大チップ額
+	var maxTip int64
+	if err := db.GetContext(ctx, &maxTip, `SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ? AND NOT EXISTS (SELECT 1 FROM shadow_bans sb WHERE sb.livestream_id = l2.livestream_id AND sb.user_id = l2.user_id)`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find maximum tip livecomment: "+err.Error())
+	}
+
+	// スパム報告数
+	reportsCounts, err := countReports(ctx, db, []int64{livestreamID})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total spam reports: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, LivestreamStatistics{
+		Rank:           rank,
+		ViewersCount:   viewersCounts[livestreamID],
+		MaxTip:         maxTip,
+		TotalReactions: totalReactions,
+		TotalReports:   reportsCounts[livestreamID],
+	})
+}
+
+// getLivestreamsMiniStatistics は、複数配信の簡易統計を指標ごとに1クエリでまとめて取得する
+// 結果のmapには全てのlivestreamIDが含まれる
+func getLivestreamsMiniStatistics(ctx context.Context, db dbQueryer, livestreamIDs []int64) (map[int64]LivestreamMiniStatistics, error) {
+	stats := make(map[int64]LivestreamMiniStatistics, len(livestreamIDs))
+	if len(livestreamIDs) == 0 {
+		return stats, nil
+	}
+
+	viewers, err := countViewers(ctx, db, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	reports, err := countReports(ctx, db, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	reactions, ok := livestreamReactionCounter.GetMany(livestreamIDs)
+	if !ok {
+		reactions, ok = redisLivestreamReactionCounts(ctx, livestreamIDs)
+	}
+	if !ok {
+		reactions, err = reactionRepo.CountByLivestreamIDs(ctx, db, livestreamIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, livestreamID := range livestreamIDs {
+		stats[livestreamID] = LivestreamMiniStatistics{
+			ViewersCount:   viewers[livestreamID],
+			TotalReactions: reactions[livestreamID],
+			TotalReports:   reports[livestreamID],
+		}
+	}
+	return stats, nil
+}
+
+// countReports は、配信ごとのスパム報告数を返す。メモリ上の件数が使えない場合だけMySQLで数える
+func countReports(ctx context.Context, db dbQueryer, livestreamIDs []int64) (map[int64]int64, error) {
+	if counts, ok := livestreamReportCounter.GetMany(livestreamIDs); ok {
+		return counts, nil
+	}
+	return livestreamRepo.CountReportsByIDs(ctx, db, livestreamIDs)
+}
+
+// computeUserRank は、全ユーザのスコアをMySQLで数えて、ユーザの順位と累計リアクション数・累計チップを返す
+// 返すエラーはecho.HTTPError
+func computeUserRank(ctx context.Context, db dbQueryer, user UserModel, username string) (int64, int64, int64, error) {
+	var userTotalReactions int64
+	var userTotalTip int64
 
 	// ランク算出
 	var users []*UserModel
-	if err := tx.SelectContext(ctx, &users, "SELECT * FROM users"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	if err := db.SelectContext(ctx, &users, "SELECT * FROM users WHERE deleted_at IS NULL"); err != nil {
+		return 0, 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
 	}
 
 	userScore := map[int64]int64{}
@@ -111,8 +310,8 @@ func getUserStatisticsHandler(c echo.Context) error {
 		GROUP BY u.id
 `
 	reactionCounts := []ReactionCount{}
-	if err := tx.SelectContext(ctx, &reactionCounts, query); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	if err := db.SelectContext(ctx, &reactionCounts, query); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
 	}
 	for _, rc := range reactionCounts {
 		userScore[rc.UserID] = rc.ReactionCount
@@ -133,11 +332,12 @@ func getUserStatisticsHandler(c echo.Context) error {
 		    users u
 		INNER JOIN livestreams ls ON ls.user_id = u.id
 		INNER JOIN livecomments lc ON lc.livestream_id = ls.id
+		WHERE NOT EXISTS (SELECT 1 FROM shadow_bans sb WHERE sb.livestream_id = lc.livestream_id AND sb.user_id = lc.user_id)
 		GROUP BY u.id
 `
 	totalTips := []TotalTip{}
-	if err := tx.SelectContext(ctx, &totalTips, query); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
+	if err := db.SelectContext(ctx, &totalTips, query); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
 	}
 	for _, tt := range totalTips {
 		userScore[tt.UserID] += tt.TotalTip
@@ -165,76 +365,17 @@ func getUserStatisticsHandler(c echo.Context) error {
 		rank++
 	}
 
-	// ライブコメント数、合計視聴者数
-	var totalLivecomments int64
-	var viewersCount int64
-	if err := tx.GetContext(ctx, &totalLivecomments, "SELECT COUNT(lc.id) FROM livecomments lc INNER JOIN livestreams ls ON lc.livestream_id = ls.id WHERE ls.user_id = ?", user.ID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments count: "+err.Error())
-	}
-	if err := tx.GetContext(ctx, &viewersCount, "SELECT COUNT(lvh.id) FROM livestream_viewers_history lvh INNER JOIN livestreams ls ON lvh.livestream_id = ls.id WHERE ls.user_id = ?", user.ID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get viewers count: "+err.Error())
-	}
-
-	// お気に入り絵文字
-	var favoriteEmoji string
-	query = `
-	SELECT r.emoji_name
-	FROM users u
-	INNER JOIN livestreams l ON l.user_id = u.id
-	INNER JOIN reactions r ON r.livestream_id = l.id
-	WHERE u.name = ?
-	GROUP BY emoji_name
-	ORDER BY COUNT(*) DESC, emoji_name DESC
-	LIMIT 1
-	`
-
-	if err := tx.GetContext(ctx, &favoriteEmoji, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
-	}
-
-	stats := UserStatistics{
-		Rank:              rank,
-		ViewersCount:      viewersCount,
-		TotalReactions:    userTotalReactions,
-		TotalLivecomments: totalLivecomments,
-		TotalTip:          userTotalTip,
-		FavoriteEmoji:     favoriteEmoji,
-	}
-	return c.JSON(http.StatusOK, stats)
+	return rank, userTotalReactions, userTotalTip, nil
 }
 
-func getLivestreamStatisticsHandler(c echo.Context) error {
-	ctx := c.Request().Context()
-
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
-	id, err := strconv.Atoi(c.Param("livestream_id"))
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
-	}
-	livestreamID := int64(id)
-
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	var livestream LivestreamModel
-	if err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusBadRequest, "cannot get stats of not found livestream")
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
-		}
-	}
+// computeLivestreamRank は、全配信のスコアをMySQLで数えて、配信の順位と累計リアクション数を返す
+// 返すエラーはecho.HTTPError
+func computeLivestreamRank(ctx context.Context, db dbQueryer, livestreamID int64) (int64, int64, error) {
 	var totalReactions int64
 
 	var livestreams []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams"); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	if err := db.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams"); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
 	// ランク算出
@@ -253,8 +394,8 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	GROUP BY l.id
 `
 	reactionCounts := []ReactionCount{}
-	if err := tx.SelectContext(ctx, &reactionCounts, query); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	if err := db.SelectContext(ctx, &reactionCounts, query); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
 	}
 	for _, rc := range reactionCounts {
 		livestreamScore[rc.LivestreamID] = rc.ReactionCount
@@ -274,11 +415,12 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	FROM
 	    livestreams l
 	INNER JOIN livecomments l2 ON l.id = l2.livestream_id
+	WHERE NOT EXISTS (SELECT 1 FROM shadow_bans sb WHERE sb.livestream_id = l2.livestream_id AND sb.user_id = l2.user_id)
 	GROUP BY l.id
 `
 	totalTips := []TotalTip{}
-	if err := tx.SelectContext(ctx, &totalTips, query); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
+	if err := db.SelectContext(ctx, &totalTips, query); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
 	}
 	for _, tt := range totalTips {
 		livestreamScore[tt.LivestreamID] += tt.TotalTip
@@ -303,33 +445,5 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 		rank++
 	}
 
-	// 視聴者数算出
-	var viewersCount int64
-	if err := tx.GetContext(ctx, &viewersCount, `SELECT COUNT(h.id) FROM livestreams l INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
-	}
-
-	// 最大チップ額
-	var maxTip int64
-	if err := tx.GetContext(ctx, &maxTip, `SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find maximum tip livecomment: "+err.Error())
-	}
-
-	// スパム報告数
-	var totalReports int64
-	if err := tx.GetContext(ctx, &totalReports, `SELECT COUNT(r.id) FROM livestreams l INNER JOIN livecomment_reports r ON r.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total spam reports: "+err.Error())
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
-	return c.JSON(http.StatusOK, LivestreamStatistics{
-		Rank:           rank,
-		ViewersCount:   viewersCount,
-		MaxTip:         maxTip,
-		TotalReactions: totalReactions,
-		TotalReports:   totalReports,
-	})
+	return rank, totalReactions, nil
 }
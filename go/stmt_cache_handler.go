@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// プリペアドステートメントのキャッシュ
+// 投稿系のように頻繁に実行するクエリは、DBハンドルごと・クエリ文字列ごとに1回だけPrepareして使い回す
+// トランザクション内では、キャッシュしたステートメントをそのトランザクションに結び付けて実行する
+// (結び付けたステートメントはコミット・ロールバック時に閉じられる)
+type statementCache struct {
+	db *sqlx.DB
+
+	mu    sync.Mutex
+	stmts map[string]*sqlx.Stmt
+	named map[string]*sqlx.NamedStmt
+}
+
+// DBハンドル -> *statementCache
+var statementCaches sync.Map
+
+// statementsFor は、dbのステートメントのキャッシュを返す
+func statementsFor(db *sqlx.DB) *statementCache {
+	if sc, ok := statementCaches.Load(db); ok {
+		return sc.(*statementCache)
+	}
+	sc, _ := statementCaches.LoadOrStore(db, &statementCache{
+		db:    db,
+		stmts: map[string]*sqlx.Stmt{},
+		named: map[string]*sqlx.NamedStmt{},
+	})
+	return sc.(*statementCache)
+}
+
+func (sc *statementCache) stmt(ctx context.Context, query string) (*sqlx.Stmt, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if stmt, ok := sc.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := sc.db.PreparexContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	sc.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (sc *statementCache) namedStmt(ctx context.Context, query string) (*sqlx.NamedStmt, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if stmt, ok := sc.named[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := sc.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	sc.named[query] = stmt
+	return stmt, nil
+}
+
+// preparedTx は、statementCacheのステートメントをtxに結び付けて実行する
+// repositoryのメソッドにtxの代わりに渡すと、同じクエリを毎回パースせずに済む
+type preparedTx struct {
+	sc *statementCache
+	tx *sqlx.Tx
+}
+
+// bind は、txをこのキャッシュで実行するハンドルを返す
+// txはこのキャッシュのDBハンドルで始めたものであること
+func (sc *statementCache) bind(tx *sqlx.Tx) preparedTx {
+	return preparedTx{sc: sc, tx: tx}
+}
+
+func (p preparedTx) stmt(ctx context.Context, query string) (*sqlx.Stmt, error) {
+	stmt, err := p.sc.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return p.tx.StmtxContext(ctx, stmt), nil
+}
+
+func (p preparedTx) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	stmt, err := p.stmt(ctx, query)
+	if err != nil {
+		return err
+	}
+	return stmt.GetContext(ctx, dest, args...)
+}
+
+func (p preparedTx) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	stmt, err := p.stmt(ctx, query)
+	if err != nil {
+		return err
+	}
+	return stmt.SelectContext(ctx, dest, args...)
+}
+
+func (p preparedTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := p.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+func (p preparedTx) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	stmt, err := p.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryxContext(ctx, args...)
+}
+
+// QueryRowxContext は、Prepareに失敗した場合はそのままtxで実行してエラーを返させる
+func (p preparedTx) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	stmt, err := p.stmt(ctx, query)
+	if err != nil {
+		return p.tx.QueryRowxContext(ctx, query, args...)
+	}
+	return stmt.QueryRowxContext(ctx, args...)
+}
+
+func (p preparedTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := p.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+func (p preparedTx) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	stmt, err := p.sc.namedStmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return p.tx.NamedStmtContext(ctx, stmt).ExecContext(ctx, arg)
+}
+
+func (p preparedTx) Rebind(query string) string {
+	return p.tx.Rebind(query)
+}
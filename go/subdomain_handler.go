@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ワイルドカードモードでのユーザのサブドメイン (<username>.<zone>) へのアクセス
+// DNSのNXDOMAINの代わりに、ユーザのいないサブドメインへのリクエストを404にする
+
+// newSubdomainMiddleware は、ワイルドカードモードでのみ使う
+// どの名前もDNSで引けるので、ゾーンファイルにある名前 (pipeなど) はユーザでなくても通す
+func newSubdomainMiddleware(zone string, zoneNames []string) echo.MiddlewareFunc {
+	suffix := "." + strings.ToLower(zone)
+	reserved := make(map[string]struct{}, len(zoneNames))
+	for _, name := range zoneNames {
+		reserved[name] = struct{}{}
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			host := c.Request().Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			// ゾーンの部分だけ大文字小文字を区別せずに比べ、ユーザ名の部分は送られたまま引く
+			if len(host) <= len(suffix) || !strings.EqualFold(host[len(host)-len(suffix):], suffix) {
+				return next(c)
+			}
+			name := host[:len(host)-len(suffix)]
+
+			if _, ok := reserved[strings.ToLower(name)]; ok {
+				return next(c)
+			}
+			// ユーザのサブドメインは1段だけ
+			if !strings.Contains(name, ".") {
+				found, err := subdomainUserExists(c.Request().Context(), name)
+				if err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+				}
+				if found {
+					return next(c)
+				}
+			}
+			return echo.NewHTTPError(http.StatusNotFound, "not found user subdomain")
+		}
+	}
+}
+
+// subdomainUserExists は、サブドメインのユーザ名の部分 (label) のユーザがいるかを返す
+// usersはutf8mb4_binなので、まず同じ名前で引く
+// DNSの名前は大文字小文字を区別せず、ブラウザは小文字にして送るので、なければ大文字小文字を無視して引く
+// 大文字小文字だけが違うユーザが複数いる場合は、どのユーザか決められないので見つからないものとする
+// どちらでも見つからない名前は、存在しないユーザ名のキャッシュ (not_found_cache_handler.go) に覚える
+func subdomainUserExists(ctx context.Context, label string) (bool, error) {
+	if isMissingUserName(label) {
+		return false, nil
+	}
+	var deletedAt sql.NullInt64
+	err := dbConn.GetContext(ctx, &deletedAt, "SELECT deleted_at FROM users WHERE name = ?", label)
+	if err == nil {
+		return !deletedAt.Valid, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	var userIDs []int64
+	if err := dbConn.SelectContext(ctx, &userIDs, "SELECT id FROM users WHERE LOWER(name) = LOWER(?) AND deleted_at IS NULL LIMIT 2", label); err != nil {
+		return false, err
+	}
+	if len(userIDs) == 0 {
+		rememberMissingUserName(label)
+	}
+	return len(userIDs) == 1, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// アップロードされたサムネイルはthumbnailDirに保存し、アプリから配信する
+// 画像が差し替えられても同じURLのままなので、ETagで再検証させる
+
+const maxThumbnailSize = 2 * 1024 * 1024
+
+var (
+	thumbnailDir = "../thumbnails"
+	// livestream_id -> サムネイルのsha256
+	thumbnailHashMap sync.Map
+)
+
+func livestreamThumbnailPath(livestreamID int64) string {
+	return filepath.Join(thumbnailDir, strconv.FormatInt(livestreamID, 10))
+}
+
+func livestreamThumbnailURL(livestreamID int64) string {
+	return fmt.Sprintf("/api/livestream/%d/thumbnail", livestreamID)
+}
+
+// saveLivestreamThumbnail は、サムネイルを保存する
+// 配信中の読み出しと競合しないよう、一時ファイルに書いてからrenameする
+func saveLivestreamThumbnail(livestreamID int64, image []byte) error {
+	if err := os.MkdirAll(thumbnailDir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(thumbnailDir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(image); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), livestreamThumbnailPath(livestreamID)); err != nil {
+		return err
+	}
+	thumbnailHashMap.Store(livestreamID, fmt.Sprintf("%x", sha256.Sum256(image)))
+	return nil
+}
+
+func removeLivestreamThumbnail(livestreamID int64) {
+	thumbnailHashMap.Delete(livestreamID)
+	os.Remove(livestreamThumbnailPath(livestreamID))
+}
+
+// resetLivestreamThumbnails は、初期化時に保存済みのサムネイルを全て削除する
+func resetLivestreamThumbnails() error {
+	thumbnailHashMap.Range(func(key, _ any) bool {
+		thumbnailHashMap.Delete(key)
+		return true
+	})
+	if err := os.RemoveAll(thumbnailDir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// 配信サムネイル取得API
+// GET /api/livestream/:livestream_id/thumbnail
+func getLivestreamThumbnailHandler(c echo.Context) error {
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	ifNoneMatch := c.Request().Header.Get("If-None-Match")
+
+	c.Response().Header().Set("Cache-Control", "public, no-cache")
+	if cachedHash, ok := thumbnailHashMap.Load(livestreamID); ok && etagMatches(ifNoneMatch, cachedHash.(string)) {
+		c.Response().Header().Set("ETag", `"`+cachedHash.(string)+`"`)
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	image, err := os.ReadFile(livestreamThumbnailPath(livestreamID))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return echo.NewHTTPError(http.StatusNotFound, "thumbnail not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read thumbnail: "+err.Error())
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256(image))
+	thumbnailHashMap.Store(livestreamID, hash)
+
+	c.Response().Header().Set("ETag", `"`+hash+`"`)
+	if etagMatches(ifNoneMatch, hash) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return c.Blob(http.StatusOK, http.DetectContentType(image), image)
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/isucon/isucon13/webapp/go/internal/cache"
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 )
 
@@ -22,22 +30,153 @@ type TagsResponse struct {
 	Tags []*Tag `json:"tags"`
 }
 
-func getTagHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+type TagSuggestion struct {
+	ID    int64  `db:"id" json:"id"`
+	Name  string `db:"name" json:"name"`
+	Count int64  `db:"count" json:"count"`
+}
+
+type TagSuggestionsResponse struct {
+	Tags []TagSuggestion `json:"tags"`
+}
+
+// タグのマスタ
+// 追加・更新APIはないので、一度読み込んだタグは初期化まで使い続ける
+var tagsByID = cache.New[int64, Tag](cache.Options[Tag]{Name: "tags"})
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+// getTags は、tagIDsのタグをID順に返す。キャッシュにないものはまとめてDBから読み込む
+func getTags(ctx context.Context, tagIDs []int64) ([]Tag, error) {
+	tagMap, err := tagsByID.GetOrLoadMany(ctx, tagIDs, func(ctx context.Context, tagIDs []int64) (map[int64]Tag, error) {
+		var tags []Tag
+		query, args, err := sqlx.In("SELECT id, name FROM tags WHERE id IN (?)", tagIDs)
+		if err != nil {
+			return nil, err
+		}
+		if err := dbConn.SelectContext(ctx, &tags, dbConn.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		tagMap := make(map[int64]Tag, len(tags))
+		for _, tag := range tags {
+			tagMap[tag.ID] = tag
+		}
+		return tagMap, nil
+	})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin new transaction: : "+err.Error()+err.Error())
+		return nil, err
+	}
+	tags := make([]Tag, 0, len(tagMap))
+	for _, tag := range tagMap {
+		tags = append(tags, tag)
 	}
-	defer tx.Rollback()
+	sort.Slice(tags, func(i, j int) bool { return tags[i].ID < tags[j].ID })
+	return tags, nil
+}
 
-	var tagModels []*TagModel
-	if err := tx.SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+const (
+	defaultTagSuggestLimit = 10
+	maxTagSuggestLimit     = 50
+)
+
+// タグ名(小文字化)でソートしたタグ一覧と、配信での使用回数
+// 初回参照時にDBから読み込み、以降は配信予約時に使用回数だけ更新する
+type tagIndex struct {
+	mu      sync.RWMutex
+	loaded  bool
+	entries []tagIndexEntry
+	// tag_id -> entriesの添字
+	positions map[int64]int
+	// resetのたびに進める。reset前に読み始めたloadの結果を捨てるために使う
+	generation uint64
+}
+
+type tagIndexEntry struct {
+	key string
+	tag TagSuggestion
+}
+
+var tagSuggestIndex = &tagIndex{}
+
+func (idx *tagIndex) load(ctx context.Context) error {
+	idx.mu.RLock()
+	loaded, generation := idx.loaded, idx.generation
+	idx.mu.RUnlock()
+	if loaded {
+		return nil
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	var tags []TagSuggestion
+	if err := dbConn.SelectContext(ctx, &tags, "SELECT t.id, t.name, COUNT(lt.id) AS count FROM tags t LEFT JOIN livestream_tags lt ON lt.tag_id = t.id GROUP BY t.id, t.name"); err != nil {
+		return err
+	}
+	entries := make([]tagIndexEntry, len(tags))
+	for i := range tags {
+		entries[i] = tagIndexEntry{key: strings.ToLower(tags[i].Name), tag: tags[i]}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	positions := make(map[int64]int, len(entries))
+	for i := range entries {
+		positions[entries[i].tag.ID] = i
+	}
+
+	idx.mu.Lock()
+	if !idx.loaded && idx.generation == generation {
+		idx.entries = entries
+		idx.positions = positions
+		idx.loaded = true
+	}
+	idx.mu.Unlock()
+	return nil
+}
+
+// suggest は、prefixで始まるタグを使用回数の多い順に返す
+func (idx *tagIndex) suggest(prefix string, limit int) []TagSuggestion {
+	prefix = strings.ToLower(prefix)
+
+	idx.mu.RLock()
+	start := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].key >= prefix })
+	matched := []TagSuggestion{}
+	for i := start; i < len(idx.entries) && strings.HasPrefix(idx.entries[i].key, prefix); i++ {
+		matched = append(matched, idx.entries[i].tag)
+	}
+	idx.mu.RUnlock()
+
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].Count > matched[j].Count })
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return matched
+}
+
+// add は、配信に付けられたタグの使用回数にdeltaを加算する
+// 未読み込みの場合は、読み込み時にDBの値が使われるので何もしない
+func (idx *tagIndex) add(tagIDs []int64, delta int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if !idx.loaded {
+		return
+	}
+	for _, tagID := range tagIDs {
+		if i, ok := idx.positions[tagID]; ok {
+			idx.entries[i].tag.Count += delta
+		}
+	}
+}
+
+func (idx *tagIndex) reset() {
+	idx.mu.Lock()
+	idx.loaded = false
+	idx.entries = nil
+	idx.positions = nil
+	idx.generation++
+	idx.mu.Unlock()
+}
+
+func getTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var tagModels []*TagModel
+	if err := readDB().SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
 	}
 
 	tags := make([]*Tag, len(tagModels))
@@ -52,6 +191,104 @@ func getTagHandler(c echo.Context) error {
 	})
 }
 
+type Category struct {
+	ID   int64  `db:"id" json:"id"`
+	Name string `db:"name" json:"name"`
+}
+
+type CategoriesResponse struct {
+	Categories []Category `json:"categories"`
+}
+
+// 配信カテゴリのマスタ
+// 更新APIはないので、初回参照時に読み込んだものを使い続ける
+type categoryMaster struct {
+	mu         sync.RWMutex
+	categories []Category
+}
+
+var categories = &categoryMaster{}
+
+func (m *categoryMaster) list(ctx context.Context) ([]Category, error) {
+	m.mu.RLock()
+	cached := m.categories
+	m.mu.RUnlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	loaded := []Category{}
+	if err := dbConn.SelectContext(ctx, &loaded, "SELECT * FROM categories ORDER BY id"); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.categories = loaded
+	m.mu.Unlock()
+	return loaded, nil
+}
+
+func (m *categoryMaster) exists(ctx context.Context, name string) (bool, error) {
+	list, err := m.list(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, category := range list {
+		if category.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *categoryMaster) reset() {
+	m.mu.Lock()
+	m.categories = nil
+	m.mu.Unlock()
+}
+
+// 言語タグ (ja, en-US, zh-Hant-TW など)
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// isValidLanguage は、配信言語として受け付けられるかを返す (未指定は可)
+func isValidLanguage(language string) bool {
+	return language == "" || (len(language) <= 16 && languagePattern.MatchString(language))
+}
+
+// 配信カテゴリ一覧API
+// GET /api/category
+func getCategoriesHandler(c echo.Context) error {
+	list, err := categories.list(c.Request().Context())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get categories: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, &CategoriesResponse{Categories: list})
+}
+
+// タグ補完API
+// GET /api/tag/suggest?prefix=&limit=
+func getTagSuggestionsHandler(c echo.Context) error {
+	limit := defaultTagSuggestLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+		if limit > maxTagSuggestLimit {
+			limit = maxTagSuggestLimit
+		}
+	}
+
+	if err := tagSuggestIndex.load(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load tags: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &TagSuggestionsResponse{
+		Tags: tagSuggestIndex.suggest(c.QueryParam("prefix"), limit),
+	})
+}
+
 // 配信者のテーマ取得API
 // GET /api/user/:username/theme
 func getStreamerThemeHandler(c echo.Context) error {
@@ -65,14 +302,8 @@ func getStreamerThemeHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
 	userModel := UserModel{}
-	err = tx.GetContext(ctx, &userModel, "SELECT id FROM users WHERE name = ?", username)
+	err := dbConn.GetContext(ctx, &userModel, "SELECT id FROM users WHERE name = ?", username)
 	if errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
 	}
@@ -80,15 +311,11 @@ func getStreamerThemeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	themeModel := ThemeModel{}
-	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ?", userModel.ID); err != nil {
+	themeModel, err := getUserTheme(ctx, userModel.ID)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user theme: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
 	theme := Theme{
 		ID:       themeModel.ID,
 		DarkMode: themeModel.DarkMode,
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信中のライブ配信を、直近のリアクション・ライブコメント・視聴者数から算出したスコア順に並べる
+// スコアはバックグラウンドで定期的に集計し、APIはメモリ上の結果を返すだけにする
+
+const (
+	trendingAggregateInterval = 5 * time.Second
+	// この期間より古いリアクション・ライブコメントは集計しない
+	trendingWindowSeconds = 30 * 60
+	// 経過時間に対する減衰の時定数 (秒)
+	trendingDecaySeconds = 5 * 60
+	// 集計しておく件数の上限
+	trendingMaxLivestreams = 100
+	defaultTrendingLimit   = 20
+
+	trendingReactionWeight    = 1.0
+	trendingLivecommentWeight = 2.0
+	trendingViewerWeight      = 3.0
+)
+
+type TrendingLivestream struct {
+	Livestream Livestream `json:"livestream"`
+	Score      float64    `json:"score"`
+}
+
+type trendingFeed struct {
+	mu          sync.RWMutex
+	livestreams []TrendingLivestream
+}
+
+var trending = &trendingFeed{livestreams: []TrendingLivestream{}}
+
+func (f *trendingFeed) get(limit int) []TrendingLivestream {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if limit > len(f.livestreams) {
+		limit = len(f.livestreams)
+	}
+	return f.livestreams[:limit]
+}
+
+// set は集計結果を差し替える
+// 読み取り側とスライスを共有するので、渡したスライスは以降書き換えないこと
+func (f *trendingFeed) set(livestreams []TrendingLivestream) {
+	f.mu.Lock()
+	f.livestreams = livestreams
+	f.mu.Unlock()
+}
+
+// update は、集計済みの配信情報を更新後のものに差し替える
+func (f *trendingFeed) update(livestream Livestream) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.livestreams {
+		if f.livestreams[i].Livestream.ID == livestream.ID {
+			// 読み取り側と共有しているので、コピーしてから書き換える
+			livestreams := make([]TrendingLivestream, len(f.livestreams))
+			copy(livestreams, f.livestreams)
+			livestreams[i].Livestream = livestream
+			f.livestreams = livestreams
+			return
+		}
+	}
+}
+
+// updateUser は、集計済みの配信の配信者・コラボレーターの情報を更新後のものに差し替える
+func (f *trendingFeed) updateUser(user User) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var livestreams []TrendingLivestream
+	for i := range f.livestreams {
+		l := f.livestreams[i].Livestream
+		isOwner := l.Owner.ID == user.ID
+		collaboratorIndex := -1
+		for j := range l.Collaborators {
+			if l.Collaborators[j].ID == user.ID {
+				collaboratorIndex = j
+			}
+		}
+		if !isOwner && collaboratorIndex < 0 {
+			continue
+		}
+
+		// 読み取り側と共有しているので、コピーしてから書き換える
+		if livestreams == nil {
+			livestreams = make([]TrendingLivestream, len(f.livestreams))
+			copy(livestreams, f.livestreams)
+		}
+		if isOwner {
+			l.Owner = user
+		}
+		if collaboratorIndex >= 0 {
+			collaborators := make([]User, len(l.Collaborators))
+			copy(collaborators, l.Collaborators)
+			collaborators[collaboratorIndex] = user
+			l.Collaborators = collaborators
+		}
+		livestreams[i].Livestream = l
+	}
+	if livestreams != nil {
+		f.livestreams = livestreams
+	}
+}
+
+// remove は、集計済みの結果から配信を取り除く
+func (f *trendingFeed) remove(livestreamID int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	livestreams := make([]TrendingLivestream, 0, len(f.livestreams))
+	for _, l := range f.livestreams {
+		if l.Livestream.ID != livestreamID {
+			livestreams = append(livestreams, l)
+		}
+	}
+	f.livestreams = livestreams
+}
+
+func (f *trendingFeed) reset() {
+	f.set([]TrendingLivestream{})
+}
+
+// runTrendingAggregator は、トレンドを定期的に集計する
+func runTrendingAggregator(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(trendingAggregateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			livestreams, err := aggregateTrending(ctx, now.Unix())
+			if err != nil {
+				logger.Errorf("failed to aggregate trending livestreams: %v", err)
+				continue
+			}
+			trending.set(livestreams)
+		}
+	}
+}
+
+func aggregateTrending(ctx context.Context, now int64) ([]TrendingLivestream, error) {
+	// 配信中: 明示的に開始されたもの、または未終了で配信時間帯に入っているもの
+	var livestreamModels []LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE status = ? OR (status = ? AND start_at <= ? AND end_at > ?)", livestreamStatusLive, livestreamStatusReserved, now, now); err != nil {
+		return nil, err
+	}
+	if len(livestreamModels) == 0 {
+		return []TrendingLivestream{}, nil
+	}
+
+	livestreamIDs := make([]int64, len(livestreamModels))
+	for i := range livestreamModels {
+		livestreamIDs[i] = livestreamModels[i].ID
+	}
+
+	scores := make(map[int64]float64, len(livestreamModels))
+	decayedQueries := []struct {
+		query  string
+		weight float64
+	}{
+		{"SELECT livestream_id, SUM(EXP((created_at - ?) / ?)) AS score FROM reactions WHERE livestream_id IN (?) AND created_at >= ? GROUP BY livestream_id", trendingReactionWeight},
+		{"SELECT livestream_id, SUM(EXP((created_at - ?) / ?)) AS score FROM livecomments WHERE livestream_id IN (?) AND created_at >= ? GROUP BY livestream_id", trendingLivecommentWeight},
+	}
+	for _, q := range decayedQueries {
+		if err := addTrendingScores(ctx, dbConn, scores, q.weight, q.query, now, trendingDecaySeconds, livestreamIDs, now-trendingWindowSeconds); err != nil {
+			return nil, err
+		}
+	}
+	// 視聴者数は現在の人数をそのまま使う
+	if err := addTrendingScores(ctx, dbConn, scores, trendingViewerWeight, "SELECT livestream_id, COUNT(*) AS score FROM livestream_viewers_history WHERE livestream_id IN (?) GROUP BY livestream_id", livestreamIDs); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(livestreamModels, func(i, j int) bool {
+		si, sj := scores[livestreamModels[i].ID], scores[livestreamModels[j].ID]
+		if si != sj {
+			return si > sj
+		}
+		return livestreamModels[i].ID > livestreamModels[j].ID
+	})
+	if len(livestreamModels) > trendingMaxLivestreams {
+		livestreamModels = livestreamModels[:trendingMaxLivestreams]
+	}
+
+	livestreams, err := fillLivestreamResponses(ctx, dbConn, livestreamModels)
+	if err != nil {
+		return nil, err
+	}
+
+	trendingLivestreams := make([]TrendingLivestream, len(livestreams))
+	for i := range livestreams {
+		trendingLivestreams[i] = TrendingLivestream{
+			Livestream: livestreams[i],
+			Score:      scores[livestreams[i].ID],
+		}
+	}
+	return trendingLivestreams, nil
+}
+
+// addTrendingScores は、(livestream_id, score)を返すクエリの結果に重みを掛けてscoresに加算する
+func addTrendingScores(ctx context.Context, db dbQueryer, scores map[int64]float64, weight float64, query string, args ...any) error {
+	query, args, err := sqlx.In(query, args...)
+	if err != nil {
+		return err
+	}
+	var rows []struct {
+		LivestreamID int64   `db:"livestream_id"`
+		Score        float64 `db:"score"`
+	}
+	if err := db.SelectContext(ctx, &rows, db.Rebind(query), args...); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		scores[row.LivestreamID] += weight * row.Score
+	}
+	return nil
+}
+
+// トレンド配信一覧API
+// GET /api/livestream/trending?limit=
+func getTrendingLivestreamsHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	limit := defaultTrendingLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+	}
+
+	return c.JSON(http.StatusOK, trending.get(limit))
+}
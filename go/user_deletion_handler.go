@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/counter"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 退会
+// 退会APIはユーザを退会済みにしてプロフィール・フォロー・セッションを同じトランザクションで消し、
+// 配信・ライブコメント・リアクションの削除はuser_cleanup_jobsに積んで後片付けジョブで行う
+// DNSレコードの削除は、登録と同じくdns_record_jobsに積む
+// ジョブは退会したサーバに通知するほか、取りこぼしや他のサーバで積まれた分を定期的に拾う
+// ジョブはclaimed_untilを進めて受け持ち、トランザクションや行ロックを持たずに片付ける
+// (片付けの途中でRedisなどに問い合わせる間、ジョブの行を塞がないため)
+// 他のサーバでの退会は、verifyUserSessionとログインでのユーザの存在確認 (userExists) で反映される
+const (
+	userCleanupInterval = 30 * time.Second
+	// 受け持ちの期限。片付けがこれより長くかかると、他のサーバも並行して片付け始める (冪等なので壊れはしない)
+	userCleanupClaimDuration = time.Minute
+)
+
+var userCleanupRequests = make(chan int64, 64)
+
+// 退会API
+// DELETE /api/user/me
+func deleteMeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	if userModel, err = userRepo.FindByIDForUpdate(ctx, tx, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if userModel.DeletedAt.Valid {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given id")
+	}
+
+	now := time.Now().Unix()
+
+	// 名前はサブドメインと対応しているので再利用させないよう残し、それ以外は消す
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET display_name = '', description = '', password = '', follower_count = 0, deleted_at = ? WHERE id = ?", now, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user: "+err.Error())
+	}
+
+	// フォローしていた配信者のfollower_countを戻す
+	if _, err := tx.ExecContext(ctx, "UPDATE users u INNER JOIN follows f ON f.target_user_id = u.id SET u.follower_count = u.follower_count - 1 WHERE f.user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update follower_count: "+err.Error())
+	}
+
+	// コラボレーターとして参加していた配信は、キャッシュからも外す
+	var collaboratedLivestreamIDs []int64
+	if err := tx.SelectContext(ctx, &collaboratedLivestreamIDs, "SELECT livestream_id FROM livestream_collaborators WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborators: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM follows WHERE user_id = ? OR target_user_id = ?", userID, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete follows: "+err.Error())
+	}
+	for _, query := range []string{
+		"DELETE FROM icons WHERE user_id = ?",
+		"DELETE FROM livestream_collaborators WHERE user_id = ?",
+		"DELETE FROM livestream_watch_history WHERE user_id = ?",
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM notifications WHERE user_id = ?",
+		"DELETE FROM notification_preferences WHERE user_id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user: "+err.Error())
+		}
+	}
+
+	if !dnsWildcard {
+		if err := enqueueDNSRecordRemoval(ctx, tx, userID, userModel.Name); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue dns record removal: "+err.Error())
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_cleanup_jobs (user_id, created_at) VALUES (?, ?)", userID, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue user cleanup: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// メモリ上の状態を片付ける
+	knownUsers.Set(userID, false)
+	loginCache.removeUser(userModel.Name)
+	sessionStore.forgetUser(ctx, userID)
+	notificationPreferences.invalidate(userID)
+	iconHashCache.Delete(userID)
+	for _, livestreamID := range collaboratedLivestreamIDs {
+		livestreamDetails.Delete(livestreamID)
+	}
+	invalidateRankings(ctx)
+	iconHashMap.Delete(userModel.Name)
+
+	// セッションは削除済みなので、クッキーだけ消す
+	sess.Options.MaxAge = -1
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+
+	// 通知が溢れた場合は定期的な走査で拾う
+	select {
+	case userCleanupRequests <- userID:
+	default:
+	}
+	if !dnsWildcard {
+		notifyDNSRecord(userID)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// runUserCleanupWorker は、退会したユーザの後片付けを行う
+func runUserCleanupWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(userCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case userID := <-userCleanupRequests:
+			if err := cleanupDeletedUser(ctx, userID); err != nil {
+				logger.Errorf("failed to clean up deleted user %d: %v", userID, err)
+			}
+		case <-ticker.C:
+			var userIDs []int64
+			if err := dbConn.SelectContext(ctx, &userIDs, "SELECT user_id FROM user_cleanup_jobs ORDER BY created_at"); err != nil {
+				logger.Errorf("failed to get user cleanup jobs: %v", err)
+				continue
+			}
+			for _, userID := range userIDs {
+				if err := cleanupDeletedUser(ctx, userID); err != nil {
+					logger.Errorf("failed to clean up deleted user %d: %v", userID, err)
+				}
+			}
+		}
+	}
+}
+
+// cleanupDeletedUser は、退会したユーザの配信・ライブコメント・リアクションを削除する
+// 各段階は冪等なので、途中で失敗した場合はジョブを残して次回やり直す
+func cleanupDeletedUser(ctx context.Context, userID int64) (err error) {
+	// 受け持ちの期限を進められたサーバだけが片付け、他のサーバと同じジョブを並行して処理しない
+	now := time.Now()
+	result, err := dbConn.ExecContext(ctx, "UPDATE user_cleanup_jobs SET claimed_until = ? WHERE user_id = ? AND claimed_until < ?", now.Add(userCleanupClaimDuration).Unix(), userID, now.Unix())
+	if err != nil {
+		return err
+	}
+	if claimed, err := result.RowsAffected(); err != nil {
+		return err
+	} else if claimed == 0 {
+		// 片付け済みか、他のサーバが処理中
+		return nil
+	}
+	defer func() {
+		if err != nil {
+			// 次の走査ですぐにやり直せるよう、受け持ちを外す
+			dbConn.ExecContext(context.WithoutCancel(ctx), "UPDATE user_cleanup_jobs SET claimed_until = 0 WHERE user_id = ?", userID)
+		}
+	}()
+
+	var livestreamIDs []int64
+	if err := dbConn.SelectContext(ctx, &livestreamIDs, "SELECT id FROM livestreams WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, livestreamID := range livestreamIDs {
+		if err := deleteLivestreamOfDeletedUser(ctx, livestreamID); err != nil {
+			return err
+		}
+	}
+
+	if err := deleteLivecommentsAndReactionsOfDeletedUser(ctx, userID); err != nil {
+		return err
+	}
+
+	_, err = dbConn.ExecContext(ctx, "DELETE FROM user_cleanup_jobs WHERE user_id = ?", userID)
+	return err
+}
+
+// deleteLivestreamOfDeletedUser は、配信を予約取り消しと同じ手順で削除する
+// 予約枠を戻す範囲は配信ごとに異なるので、配信ごとにコミットする
+func deleteLivestreamOfDeletedUser(ctx context.Context, livestreamID int64) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	livestreamModel := LivestreamModel{}
+	if livestreamModel, err = livestreamRepo.FindByIDForUpdate(ctx, tx, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	var deltas counterDeltas
+	tagIDs, err := purgeLivestream(ctx, tx, livestreamModel, time.Now().Unix(), &deltas)
+	if err != nil {
+		return err
+	}
+
+	counterEpoch, err := counter.Commit(func() error {
+		if livestreamModel.Status == livestreamStatusReserved {
+			return reservationSlots.commitWithDelta(tx, livestreamModel.StartAt, livestreamModel.EndAt, 1)
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+
+	deltas.apply(counterEpoch)
+	forgetLivestream(livestreamID, tagIDs)
+	return nil
+}
+
+// deleteLivecommentsAndReactionsOfDeletedUser は、他の配信に残っているライブコメント・リアクションを
+// 統計から外すためtombstoneテーブルへ移し、ライブコメントへのスパム報告とともに削除する
+func deleteLivecommentsAndReactionsOfDeletedUser(ctx context.Context, userID int64) error {
+	var deltas counterDeltas
+	counterEpoch, err := runInTxCounted(ctx, func(tx *sqlx.Tx) error {
+		deltas = counterDeltas{}
+		for _, count := range []struct {
+			column counter.Column
+			query  string
+		}{
+			{livestreamReactionCounter, "SELECT livestream_id AS id, COUNT(*) AS count FROM reactions WHERE user_id = ? GROUP BY livestream_id"},
+			{userReactionCounter, "SELECT l.user_id AS id, COUNT(*) AS count FROM reactions r INNER JOIN livestreams l ON l.id = r.livestream_id WHERE r.user_id = ? GROUP BY l.user_id"},
+			{userLivecommentCounter, "SELECT l.user_id AS id, COUNT(*) AS count FROM livecomments lc INNER JOIN livestreams l ON l.id = lc.livestream_id WHERE lc.user_id = ? AND NOT EXISTS (SELECT 1 FROM shadow_bans sb WHERE sb.livestream_id = lc.livestream_id AND sb.user_id = lc.user_id) GROUP BY l.user_id"},
+		} {
+			if err := deltas.addCounts(ctx, tx, count.column, -1, count.query, userID); err != nil {
+				return err
+			}
+		}
+		if err := deltas.addCounts(ctx, tx, livestreamReportCounter, -1, "SELECT livestream_id AS id, COUNT(*) AS count FROM livecomment_reports WHERE user_id = ? OR livecomment_id IN (SELECT id FROM livecomments WHERE user_id = ?) GROUP BY livestream_id", userID, userID); err != nil {
+			return err
+		}
+
+		now := time.Now().Unix()
+		if _, err := tx.ExecContext(ctx, "INSERT INTO livecomment_tombstones (id, user_id, livestream_id, comment, tip, parent_id, created_at, deleted_at) SELECT id, user_id, livestream_id, comment, tip, parent_id, created_at, ? FROM livecomments WHERE user_id = ?", now, userID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO reaction_tombstones (id, user_id, livestream_id, emoji_name, created_at, deleted_at) SELECT id, user_id, livestream_id, emoji_name, created_at, ? FROM reactions WHERE user_id = ?", now, userID); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livecomment_reports WHERE user_id = ? OR livecomment_id IN (SELECT id FROM livecomments WHERE user_id = ?)", userID, userID); err != nil {
+			return err
+		}
+		for _, query := range []string{
+			"DELETE FROM livecomments WHERE user_id = ?",
+			"DELETE FROM reactions WHERE user_id = ?",
+			"DELETE FROM notifications WHERE actor_user_id = ?",
+		} {
+			if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	deltas.apply(counterEpoch)
+	invalidateRankings(ctx)
+	return nil
+}
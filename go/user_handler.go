@@ -9,12 +9,16 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"os/exec"
-	"sync"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
+	"github.com/isucon/isucon13/webapp/go/imageproc"
+	"github.com/isucon/isucon13/webapp/go/internal/cache"
+	"github.com/isucon/isucon13/webapp/go/internal/repository"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -29,23 +33,56 @@ const (
 	bcryptDefaultCost        = bcrypt.MinCost
 )
 
-var fallbackImage = "../img/NoImage.jpg"
+var (
+	// ISUCON13_BCRYPT_COSTで変更できる
+	bcryptCost = bcryptDefaultCost
+
+	fallbackImage = "../img/NoImage.jpg"
+	// 起動時と初期化時にloadFallbackImageで読み込む
+	// 初期化はリクエストと並行して走ることがあるので、まとめて差し替える
+	fallbackIcon atomic.Pointer[fallbackIconImage]
+)
+
+// アイコン未設定のユーザに返す画像とそのsha256
+type fallbackIconImage struct {
+	image     []byte
+	hash      string
+	thumbnail []byte
+}
 
-type UserModel struct {
-	ID             int64  `db:"id"`
-	Name           string `db:"name"`
-	DisplayName    string `db:"display_name"`
-	Description    string `db:"description"`
-	HashedPassword string `db:"password"`
+// currentFallbackIcon は、読み込み済みのフォールバック画像を返す
+// 画像とハッシュが食い違わないよう、1つのリクエストでは1回だけ呼んで使い回す
+func currentFallbackIcon() *fallbackIconImage {
+	return fallbackIcon.Load()
 }
 
+func loadFallbackImage() error {
+	image, err := os.ReadFile(fallbackImage)
+	if err != nil {
+		return err
+	}
+	thumbnail, err := imageproc.Thumbnail(image, iconThumbnailSize, imageproc.DefaultJPEGQuality)
+	if err != nil {
+		return err
+	}
+	fallbackIcon.Store(&fallbackIconImage{
+		image:     image,
+		hash:      fmt.Sprintf("%x", sha256.Sum256(image)),
+		thumbnail: thumbnail,
+	})
+	return nil
+}
+
+type UserModel = repository.UserModel
+
 type User struct {
-	ID          int64  `json:"id"`
-	Name        string `json:"name"`
-	DisplayName string `json:"display_name,omitempty"`
-	Description string `json:"description,omitempty"`
-	Theme       Theme  `json:"theme,omitempty"`
-	IconHash    string `json:"icon_hash,omitempty"`
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	DisplayName   string `json:"display_name,omitempty"`
+	Description   string `json:"description,omitempty"`
+	Theme         Theme  `json:"theme,omitempty"`
+	IconHash      string `json:"icon_hash,omitempty"`
+	FollowerCount int64  `json:"follower_count"`
 }
 
 type Theme struct {
@@ -72,6 +109,17 @@ type PostUserRequestTheme struct {
 	DarkMode bool `json:"dark_mode"`
 }
 
+// nilのフィールドは更新しない
+type PatchUserRequest struct {
+	DisplayName *string                `json:"display_name"`
+	Description *string                `json:"description"`
+	Theme       *PatchUserRequestTheme `json:"theme"`
+}
+
+type PatchUserRequestTheme struct {
+	DarkMode *bool `json:"dark_mode"`
+}
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	// Password is non-hashed password.
@@ -86,63 +134,19 @@ type PostIconResponse struct {
 	ID int64 `json:"id"`
 }
 
-var (
-	iconHashMap = sync.Map{} // map[string]string
-)
-
-func getIconHandler(c echo.Context) error {
-	ctx := c.Request().Context()
-
-	username := c.Param("username")
-	ifNoneMatch := c.Request().Header.Get("if-none-match")
-	if ifNoneMatch != "" {
-		ifNoneMatch = ifNoneMatch[1 : len(ifNoneMatch)-1] // remove double quotes
-	}
-
-	if ifNoneMatch != "" {
-		cachedIconHash, ok := iconHashMap.Load(username)
-		if ok && ifNoneMatch == cachedIconHash {
-			return c.NoContent(http.StatusNotModified)
-		}
-	}
-
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	type UserWithIconHash struct {
-		UserID int64  `db:"user_id"`
-		Image  []byte `db:"image"`
-	}
-
-	var user UserWithIconHash
-	if err := tx.GetContext(ctx, &user, "SELECT u.id AS user_id, i.image AS image FROM users u LEFT JOIN icons i ON u.id = i.user_id WHERE u.name = ?", username); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
-		}
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
-	}
-
-	if user.Image == nil {
-		image, err := os.ReadFile(fallbackImage)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed read fallback image: "+err.Error())
-		}
-		user.Image = image
-	}
-	iconHash := fmt.Sprintf("%x", sha256.Sum256(user.Image))
-	iconHashMap.Store(username, iconHash)
-
-	if ifNoneMatch == iconHash {
-		return c.NoContent(http.StatusNotModified)
-	}
-
-	return c.Blob(http.StatusOK, "image/jpeg", user.Image)
+// ユーザ検索のレスポンス
+// next_cursorは最終ページではnull
+type SearchUsersPage struct {
+	Users      []User `json:"users"`
+	NextCursor *int64 `json:"next_cursor"`
 }
 
-func postIconHandler(c echo.Context) error {
+const (
+	defaultSearchUsersLimit = 20
+	maxSearchUsersLimit     = 100
+)
+
+func getMeHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	if err := verifyUserSession(c); err != nil {
@@ -155,46 +159,27 @@ func postIconHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	var req *PostIconRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
-	}
-
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	rs, err := tx.ExecContext(ctx, "INSERT INTO icons (user_id, image) VALUES (?, ?)", userID, req.Image)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new user icon: "+err.Error())
+	userModel, err := userRepo.FindByID(ctx, dbConn, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
 	}
-
-	iconID, err := rs.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted icon id: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	var username string
-	err = tx.GetContext(ctx, &username, "SELECT name FROM users WHERE id = ?", userID)
+	user, err := fillUserResponse(ctx, userModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get username: "+err.Error())
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
 	}
 
-	iconHashMap.Store(username, fmt.Sprintf("%x", sha256.Sum256(req.Image)))
-
-	return c.JSON(http.StatusCreated, &PostIconResponse{
-		ID: iconID,
-	})
+	return c.JSON(http.StatusOK, user)
 }
 
-func getMeHandler(c echo.Context) error {
+// ユーザプロフィール更新API
+// PATCH /api/user/me
+func patchMeHandler(c echo.Context) error {
 	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
 
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
@@ -206,6 +191,11 @@ func getMeHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
+	var req *PatchUserRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -213,7 +203,7 @@ func getMeHandler(c echo.Context) error {
 	defer tx.Rollback()
 
 	userModel := UserModel{}
-	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID)
+	userModel, err = userRepo.FindByIDForUpdate(ctx, tx, userID)
 	if errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
 	}
@@ -221,15 +211,39 @@ func getMeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	user, err := fillUserResponse(ctx, tx, userModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	if req.DisplayName != nil {
+		userModel.DisplayName = *req.DisplayName
+	}
+	if req.Description != nil {
+		userModel.Description = *req.Description
+	}
+	if req.DisplayName != nil || req.Description != nil {
+		if _, err := tx.NamedExecContext(ctx, "UPDATE users SET display_name = :display_name, description = :description WHERE id = :id", userModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user: "+err.Error())
+		}
+	}
+	if req.Theme != nil && req.Theme.DarkMode != nil {
+		if _, err := tx.ExecContext(ctx, "UPDATE themes SET dark_mode = ? WHERE user_id = ?", *req.Theme.DarkMode, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user theme: "+err.Error())
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	// テーマのキャッシュはコミット後のDBから読み直させる
+	userThemes.Delete(userID)
+
+	// txはコミット済みなので、コミット後のDBから組み立てる
+	user, err := fillUserResponse(ctx, userModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	// メモリ上に組み立て済みのユーザ情報を差し替える
+	trending.updateUser(user)
+
 	return c.JSON(http.StatusOK, user)
 }
 
@@ -248,7 +262,7 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "the username 'pipe' is reserved")
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptCost)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
 	}
@@ -266,37 +280,46 @@ func registerHandler(c echo.Context) error {
 		HashedPassword: string(hashedPassword),
 	}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password) VALUES(:name, :display_name, :description, :password)", userModel)
+	userID, err := userRepo.Insert(ctx, tx, userModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user: "+err.Error())
 	}
-
-	userID, err := result.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted user id: "+err.Error())
-	}
 	userModel.ID = userID
 
 	themeModel := ThemeModel{
 		UserID:   userID,
 		DarkMode: req.Theme.DarkMode,
 	}
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES(:user_id, :dark_mode)", themeModel); err != nil {
+	themeResult, err := tx.NamedExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES(:user_id, :dark_mode)", themeModel)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user theme: "+err.Error())
 	}
+	themeID, err := themeResult.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted theme id: "+err.Error())
+	}
+	themeModel.ID = themeID
 
-	if out, err := exec.Command("pdnsutil", "add-record", "t.isucon.pw", req.Name, "A", "60", powerDNSSubdomainAddress).CombinedOutput(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, string(out)+": "+err.Error())
+	// ワイルドカードモードでは、ワイルドカードレコードで引ける
+	if !dnsWildcard {
+		if err := enqueueDNSRecord(ctx, tx, userID, req.Name); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue dns record: "+err.Error())
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
-
-	image, err := os.ReadFile(fallbackImage)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed read fallback image: "+err.Error())
+	knownUsers.Set(userID, true)
+	forgetMissingUserName(req.Name)
+	// サブドメインでは小文字にした名前で引かれる
+	forgetMissingUserName(strings.ToLower(req.Name))
+	if !dnsWildcard {
+		notifyDNSRecord(userID)
 	}
+	userThemes.Set(themeModel.UserID, themeModel)
+	addUserToRanking(ctx, userModel.Name)
+
 	user := User{
 		ID:          userModel.ID,
 		Name:        userModel.Name,
@@ -306,7 +329,7 @@ func registerHandler(c echo.Context) error {
 			ID:       themeModel.ID,
 			DarkMode: themeModel.DarkMode,
 		},
-		IconHash: fmt.Sprintf("%x", sha256.Sum256(image)),
+		IconHash: currentFallbackIcon().hash,
 	}
 
 	return c.JSON(http.StatusCreated, user)
@@ -323,32 +346,9 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	userModel := UserModel{}
-	// usernameはUNIQUEなので、whereで一意に特定できる
-	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", req.Username)
-	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
-	}
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
-	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(req.Password))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
-	}
+	userModel, err := authenticateUser(ctx, req.Username, req.Password)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
+		return err
 	}
 
 	sessionEndAt := time.Now().Add(1 * time.Hour)
@@ -377,6 +377,46 @@ func loginHandler(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
+// authenticateUser は、usernameとpasswordを照合してユーザを返す
+// 返すユーザはIDと名前だけを埋める
+func authenticateUser(ctx context.Context, username string, password string) (UserModel, error) {
+	if userID, ok := loginCache.lookupVerified(username, password); ok {
+		exists, err := userExists(ctx, userID)
+		if err != nil {
+			return UserModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+		if exists {
+			return UserModel{ID: userID, Name: username}, nil
+		}
+		// 他のサーバで退会したユーザ
+		loginCache.removeUser(username)
+		return UserModel{}, echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+	}
+
+	// usernameはUNIQUEなので、whereで一意に特定できる
+	userModel, err := userRepo.FindByName(ctx, dbConn, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserModel{}, echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+	}
+	if err != nil {
+		return UserModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	// 退会したユーザはパスワードハッシュを消してあるので照合しない
+	if userModel.DeletedAt.Valid {
+		return UserModel{}, echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+	}
+
+	verified, err := loginCache.verifyPassword(userModel, password)
+	if err != nil {
+		return UserModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
+	}
+	if !verified {
+		return UserModel{}, echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+	}
+	return UserModel{ID: userModel.ID, Name: userModel.Name}, nil
+}
+
 // ユーザ詳細API
 // GET /api/user/:username
 func getUserHandler(c echo.Context) error {
@@ -387,31 +427,94 @@ func getUserHandler(c echo.Context) error {
 	}
 
 	username := c.Param("username")
-
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	if isMissingUserName(username) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
 	}
-	defer tx.Rollback()
 
-	userModel := UserModel{}
-	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", username); err != nil {
+	userModel, err := userRepo.FindByName(ctx, dbConn, username)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
+			rememberMissingUserName(username)
 			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
+	if userModel.DeletedAt.Valid {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+	}
 
-	user, err := fillUserResponse(ctx, tx, userModel)
+	user, err := fillUserResponse(ctx, userModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	return c.JSON(http.StatusOK, user)
+}
+
+// ユーザ検索API
+// GET /api/user/search?q=&cursor=&limit=
+// name・display_nameがqで始まるユーザを新しい順に返す
+// cursorには前ページ最後のユーザIDを指定する
+func searchUsersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
 
-	return c.JSON(http.StatusOK, user)
+	keyword := strings.TrimSpace(c.QueryParam("q"))
+	if keyword == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "q query parameter must not be empty")
+	}
+
+	// 前方一致ならname・display_nameのインデックスで引ける
+	prefix := escapeLikePattern(keyword) + "%"
+	query := "SELECT * FROM users WHERE (name LIKE ? OR display_name LIKE ?) AND deleted_at IS NULL"
+	args := []interface{}{prefix, prefix}
+	if c.QueryParam("cursor") != "" {
+		cursor, err := strconv.ParseInt(c.QueryParam("cursor"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "cursor query parameter must be integer")
+		}
+		query += " AND id < ?"
+		args = append(args, cursor)
+	}
+	limit := defaultSearchUsersLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		if limit > maxSearchUsersLimit {
+			limit = maxSearchUsersLimit
+		}
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", limit)
+
+	db := readDB()
+
+	var userModels []UserModel
+	if err := db.SelectContext(ctx, &userModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to search users: "+err.Error())
+	}
+
+	users, err := fillUserResponses(ctx, userModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+
+	resp := SearchUsersPage{Users: users}
+	if len(users) == limit {
+		nextCursor := users[len(users)-1].ID
+		resp.NextCursor = &nextCursor
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// escapeLikePattern は、LIKEのワイルドカードをエスケープする
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
 }
 
 func verifyUserSession(c echo.Context) error {
@@ -425,7 +528,7 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "failed to get EXPIRES value from session")
 	}
 
-	_, ok = sess.Values[defaultUserIDKey].(int64)
+	userID, ok := sess.Values[defaultUserIDKey].(int64)
 	if !ok {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
 	}
@@ -435,28 +538,169 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
 	}
 
+	// 初期化や退会でユーザが消えている場合のセッションは無効
+	exists, err := userExists(c.Request().Context(), userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if !exists {
+		return echo.NewHTTPError(http.StatusUnauthorized, "user in session does not exist")
+	}
+
 	return nil
 }
 
-func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
-	themeModel := ThemeModel{}
-	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ?", userModel.ID); err != nil {
-		return User{}, err
+// ログイン時のbcryptの照合結果のキャッシュ
+// ベンチマーカーは同じユーザで何度もログインするので、パスワードの照合を毎回やり直さない
+// loginVerifyMemoEnabledの場合のみ使う
+// パスワードハッシュそのものはメモリに持たず、その版 (パスワードハッシュのsha256) だけをユーザ名ごとに覚える
+// 照合に成功した組は sha256(ユーザID, パスワード, 版) で覚えるので、パスワードが変われば古い組は使われない
+// 他のサーバでの変更は、loginUserCacheTTLが過ぎて版を読み直したときに反映される
+const loginUserCacheTTL = 2 * time.Second
+
+type loginCredentialCache struct {
+	// username -> ユーザIDと版
+	users *cache.Cache[string, loginUser]
+	// 照合に成功した組
+	verified *cache.Cache[[sha256.Size]byte, struct{}]
+}
+
+type loginUser struct {
+	ID      int64
+	version [sha256.Size]byte
+}
+
+var loginCache = &loginCredentialCache{
+	users:    cache.New[string, loginUser](cache.Options[loginUser]{Name: "login_users", TTL: loginUserCacheTTL}),
+	verified: cache.New[[sha256.Size]byte, struct{}](cache.Options[struct{}]{Name: "login_verified", MaxEntries: 100000}),
+}
+
+// trueの場合、照合に成功した(username, password)の組をハッシュ化して覚えておく
+var loginVerifyMemoEnabled bool
+
+func credentialKey(userID int64, password string, version [sha256.Size]byte) [sha256.Size]byte {
+	return sha256.Sum256([]byte(strconv.FormatInt(userID, 10) + "\x00" + password + "\x00" + string(version[:])))
+}
+
+// lookupVerified は、usernameとpasswordの組が照合済みであればユーザIDを返す
+func (c *loginCredentialCache) lookupVerified(username string, password string) (int64, bool) {
+	if !loginVerifyMemoEnabled {
+		return 0, false
+	}
+	user, ok := c.users.Get(username)
+	if !ok {
+		return 0, false
 	}
+	if _, ok := c.verified.Get(credentialKey(user.ID, password, user.version)); !ok {
+		return 0, false
+	}
+	return user.ID, true
+}
 
-	var iconHash string
-	if err := tx.GetContext(ctx, &iconHash, "SELECT `hash` FROM icons WHERE user_id = ?", userModel.ID); err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			return User{}, err
-		}
+// verifyPassword は、passwordがユーザのパスワードハッシュと一致するか照合する
+func (c *loginCredentialCache) verifyPassword(userModel UserModel, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if loginVerifyMemoEnabled {
+		version := sha256.Sum256([]byte(userModel.HashedPassword))
+		c.users.Set(userModel.Name, loginUser{ID: userModel.ID, version: version})
+		c.verified.Set(credentialKey(userModel.ID, password, version), struct{}{})
+	}
+	return true, nil
+}
+
+// removeUser は、退会のコミット後に呼ぶ
+func (c *loginCredentialCache) removeUser(username string) {
+	c.users.Delete(username)
+}
+
+func (c *loginCredentialCache) reset() {
+	c.users.Reset()
+	c.verified.Reset()
+}
+
+// ユーザの存在確認のキャッシュ
+// 存在するユーザはuserPositiveCacheTTLの間だけ覚えておき、このサーバでの退会時に取り消す
+// 他のサーバで退会したユーザも、期限が切れて読み直したときにdeleted_atで弾かれる
+// 存在しないユーザはuserNegativeCacheTTLの間だけ覚えておき、登録時に取り消す
+const (
+	userPositiveCacheTTL = 2 * time.Second
+	userNegativeCacheTTL = 10 * time.Second
+)
+
+var knownUsers = cache.New[int64, bool](cache.Options[bool]{Name: "known_users", TTLFunc: userExistenceTTL})
+
+func userExistenceTTL(exists bool) time.Duration {
+	if exists {
+		return userPositiveCacheTTL
+	}
+	return userNegativeCacheTTL
+}
+
+func userExists(ctx context.Context, userID int64) (bool, error) {
+	return knownUsers.GetOrLoad(ctx, userID, func(ctx context.Context, userID int64) (bool, error) {
+		var exists bool
+		err := dbConn.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ? AND deleted_at IS NULL)", userID)
+		return exists, err
+	})
+}
+
+// テーマのキャッシュ
+// テーマは登録時に作られ、プロフィール更新APIでのみ変わる
+// 他のアプリサーバで登録されたユーザも引けるよう、全件ではなくユーザごとに読み込む
+// 登録時・更新時はコミット後にSet・Deleteする
+// 他のサーバでの更新は、userThemeCacheTTLが過ぎて読み直したときに反映される
+const userThemeCacheTTL = 2 * time.Second
+
+var userThemes = cache.New[int64, ThemeModel](cache.Options[ThemeModel]{Name: "user_themes", TTL: userThemeCacheTTL})
+
+func getUserTheme(ctx context.Context, userID int64) (ThemeModel, error) {
+	themes, err := getUserThemes(ctx, []int64{userID})
+	if err != nil {
+		return ThemeModel{}, err
+	}
+	themeModel, ok := themes[userID]
+	if !ok {
+		return ThemeModel{}, sql.ErrNoRows
 	}
+	return themeModel, nil
+}
 
-	if iconHash == "" {
-		image, err := os.ReadFile(fallbackImage)
+// getUserThemes は、キャッシュにないユーザのテーマをまとめてDBから読み込む
+// テーマのないユーザは結果に含まれない
+func getUserThemes(ctx context.Context, userIDs []int64) (map[int64]ThemeModel, error) {
+	return userThemes.GetOrLoadMany(ctx, userIDs, func(ctx context.Context, userIDs []int64) (map[int64]ThemeModel, error) {
+		var themeModels []ThemeModel
+		query, args, err := sqlx.In("SELECT * FROM themes WHERE user_id IN (?)", userIDs)
 		if err != nil {
-			return User{}, err
+			return nil, err
 		}
-		iconHash = fmt.Sprintf("%x", sha256.Sum256(image))
+		if err := dbConn.SelectContext(ctx, &themeModels, dbConn.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		themes := make(map[int64]ThemeModel, len(themeModels))
+		for _, tm := range themeModels {
+			themes[tm.UserID] = tm
+		}
+		return themes, nil
+	})
+}
+
+func fillUserResponse(ctx context.Context, userModel UserModel) (User, error) {
+	themeModel, err := getUserTheme(ctx, userModel.ID)
+	if err != nil {
+		return User{}, err
+	}
+
+	iconHash, err := getIconHash(ctx, userModel.ID)
+	if err != nil {
+		return User{}, err
 	}
 
 	user := User{
@@ -468,8 +712,91 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 			ID:       themeModel.ID,
 			DarkMode: themeModel.DarkMode,
 		},
-		IconHash: iconHash,
+		IconHash:      iconHash,
+		FollowerCount: userModel.FollowerCount,
 	}
+	requestMemoFrom(ctx).storeUsers([]User{user})
 
 	return user, nil
 }
+
+// getUserByID は、ユーザをテーマ・アイコンごと取得する
+// 存在しない場合はsql.ErrNoRowsを返す
+func getUserByID(ctx context.Context, db dbQueryer, userID int64) (User, error) {
+	userMap, err := getUsersByIDs(ctx, db, []int64{userID})
+	if err != nil {
+		return User{}, err
+	}
+	user, ok := userMap[userID]
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+// getUsersByIDs は、複数ユーザをテーマ・アイコンごとまとめて取得する
+// 存在しないIDは結果のmapに含まれない
+// リクエスト内のメモにあるユーザは読み込まない
+func getUsersByIDs(ctx context.Context, db dbQueryer, userIDs []int64) (map[int64]User, error) {
+	userMap, userIDs := requestMemoFrom(ctx).lookupUsers(userIDs)
+	if len(userIDs) == 0 {
+		return userMap, nil
+	}
+
+	userModels, err := userRepo.FindByIDs(ctx, db, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := fillUserResponses(ctx, userModels)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		userMap[u.ID] = u
+	}
+
+	return userMap, nil
+}
+
+// fillUserResponses は、複数ユーザをテーマ・アイコンごとまとめて組み立てる
+// 結果はuserModelsと同じ順に並ぶ
+func fillUserResponses(ctx context.Context, userModels []UserModel) ([]User, error) {
+	users := make([]User, len(userModels))
+	if len(userModels) == 0 {
+		return users, nil
+	}
+
+	userIDs := make([]int64, len(userModels))
+	for i := range userModels {
+		userIDs[i] = userModels[i].ID
+	}
+	themeMap, err := getUserThemes(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	iconHashes, err := getIconHashes(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i, um := range userModels {
+		iconHash := iconHashes[um.ID]
+		themeModel := themeMap[um.ID]
+		users[i] = User{
+			ID:          um.ID,
+			Name:        um.Name,
+			DisplayName: um.DisplayName,
+			Description: um.Description,
+			Theme: Theme{
+				ID:       themeModel.ID,
+				DarkMode: themeModel.DarkMode,
+			},
+			IconHash:      iconHash,
+			FollowerCount: um.FollowerCount,
+		}
+	}
+	requestMemoFrom(ctx).storeUsers(users)
+
+	return users, nil
+}
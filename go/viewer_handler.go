@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/isucon/isucon13/webapp/go/internal/counter"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 視聴中のユーザはハートビートで生存を通知できる
+// 一度でもハートビートを送った視聴者は、viewerTTLを過ぎても通知がなければスイーパーがlivestream_viewers_historyから削除する
+// ハートビートを送らないクライアント (ベンチマーカーなど) の視聴者は、退室するまで残す
+// 最終ハートビート時刻はlivestream_viewers_history.heartbeat_atに置き、どのサーバで受けても同じように扱う
+const (
+	viewerTTL           = 60 * time.Second
+	viewerSweepInterval = 10 * time.Second
+
+	defaultWatchHistoryLimit = 20
+	maxWatchHistoryLimit     = 100
+)
+
+type WatchHistoryModel struct {
+	ID           int64 `db:"id"`
+	UserID       int64 `db:"user_id"`
+	LivestreamID int64 `db:"livestream_id"`
+	WatchedAt    int64 `db:"watched_at"`
+}
+
+type WatchHistory struct {
+	ID         int64      `json:"id"`
+	Livestream Livestream `json:"livestream"`
+	WatchedAt  int64      `json:"watched_at"`
+}
+
+type staleViewer struct {
+	UserID       int64 `db:"user_id"`
+	LivestreamID int64 `db:"livestream_id"`
+}
+
+// sweepStaleViewers は、ハートビートの途絶えた視聴者を定期的に削除する
+// 複数台で動かしても、行を消せたサーバだけが退室を通知する
+func sweepStaleViewers(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(viewerSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			deadline := now.Add(-viewerTTL).Unix()
+			var stale []staleViewer
+			if err := dbConn.SelectContext(ctx, &stale, "SELECT user_id, livestream_id FROM livestream_viewers_history WHERE heartbeat_at < ?", deadline); err != nil {
+				logger.Errorf("failed to get stale viewers: %v", err)
+				continue
+			}
+			for _, viewer := range stale {
+				// 選んだ後にハートビート・再入室があった視聴者は消さない
+				var deleted int64
+				counterEpoch, err := counter.Commit(func() error {
+					rs, err := dbConn.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ? AND heartbeat_at < ?", viewer.UserID, viewer.LivestreamID, deadline)
+					if err != nil {
+						return err
+					}
+					deleted, err = rs.RowsAffected()
+					return err
+				})
+				if err != nil {
+					logger.Errorf("failed to delete stale viewer: %v", err)
+					continue
+				}
+				if deleted > 0 {
+					viewerLeft.Publish(viewer.LivestreamID, ViewerLeft{LivestreamID: viewer.LivestreamID, UserID: viewer.UserID, CounterEpoch: counterEpoch})
+				}
+			}
+		}
+	}
+}
+
+// 視聴継続通知API
+// POST /api/livestream/:livestream_id/heartbeat
+func heartbeatLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// 期限切れで削除済みの場合は、再度enterしてもらう
+	viewing, err := refreshViewerHeartbeat(ctx, int64(livestreamID), userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update heartbeat: "+err.Error())
+	}
+	if !viewing {
+		return echo.NewHTTPError(http.StatusNotFound, "not viewing the livestream")
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// refreshViewerHeartbeat は、視聴中であれば最終ハートビート時刻を更新してtrueを返す
+func refreshViewerHeartbeat(ctx context.Context, livestreamID, userID int64) (bool, error) {
+	var viewing bool
+	if err := dbConn.GetContext(ctx, &viewing, "SELECT EXISTS (SELECT 1 FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?)", userID, livestreamID); err != nil {
+		return false, err
+	}
+	if !viewing {
+		return false, nil
+	}
+	// 同じ秒に2回受けた場合は更新行数が0になるので、行があるかは先に確かめておく
+	if _, err := dbConn.ExecContext(ctx, "UPDATE livestream_viewers_history SET heartbeat_at = ? WHERE user_id = ? AND livestream_id = ?", time.Now().Unix(), userID, livestreamID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 視聴履歴取得API
+// GET /api/user/me/history?cursor=&limit=
+// cursorには前ページ最後の履歴IDを指定する
+func getWatchHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	query := "SELECT * FROM livestream_watch_history WHERE user_id = ?"
+	args := []interface{}{userID}
+	if c.QueryParam("cursor") != "" {
+		cursor, err := strconv.ParseInt(c.QueryParam("cursor"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "cursor query parameter must be integer")
+		}
+		query += " AND id < ?"
+		args = append(args, cursor)
+	}
+	limit := defaultWatchHistoryLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+		if limit > maxWatchHistoryLimit {
+			limit = maxWatchHistoryLimit
+		}
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", limit)
+
+	var historyModels []WatchHistoryModel
+	if err := dbConn.SelectContext(ctx, &historyModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch history: "+err.Error())
+	}
+
+	// 同じ配信を何度も視聴していても、配信の組み立ては1回で済ませる
+	livestreamIDs := make([]int64, 0, len(historyModels))
+	seen := make(map[int64]struct{}, len(historyModels))
+	for _, h := range historyModels {
+		if _, ok := seen[h.LivestreamID]; !ok {
+			seen[h.LivestreamID] = struct{}{}
+			livestreamIDs = append(livestreamIDs, h.LivestreamID)
+		}
+	}
+	livestreamModels, err := livestreamRepo.FindByIDs(ctx, dbConn, livestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	livestreams, err := fillLivestreamResponses(ctx, dbConn, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	livestreamByID := make(map[int64]Livestream, len(livestreams))
+	for _, l := range livestreams {
+		livestreamByID[l.ID] = l
+	}
+	histories := make([]WatchHistory, 0, len(historyModels))
+	for _, h := range historyModels {
+		livestream, ok := livestreamByID[h.LivestreamID]
+		if !ok {
+			continue
+		}
+		histories = append(histories, WatchHistory{
+			ID:         h.ID,
+			Livestream: livestream,
+			WatchedAt:  h.WatchedAt,
+		})
+	}
+
+	return c.JSON(http.StatusOK, histories)
+}
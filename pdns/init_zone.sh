@@ -8,6 +8,9 @@ if test -f /home/isucon/env.sh; then
 fi
 
 ISUCON_SUBDOMAIN_ADDRESS=${ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS:-127.0.0.1}
+# カンマ区切りで複数指定されている場合、ゾーンファイルには先頭のアドレスだけを書く
+# 残りはアプリの初期化時に登録し直す (ISUCON13_DNS_RESEED)
+ISUCON_SUBDOMAIN_ADDRESS=${ISUCON_SUBDOMAIN_ADDRESS%%,*}
 
 temp_dir=$(mktemp -d)
 trap 'rm -rf $temp_dir' EXIT
@@ -13,6 +13,10 @@ ISUCON_DB_USER=${ISUCON13_MYSQL_DIALCONFIG_USER:-isucon}
 ISUCON_DB_PASSWORD=${ISUCON13_MYSQL_DIALCONFIG_PASSWORD:-isucon}
 ISUCON_DB_NAME=${ISUCON13_MYSQL_DIALCONFIG_DATABASE:-isupipe}
 
+# スキーマ (initdb.d/10_schema.sql) はDBを作るときに一度だけ読み込む
+# 初期化ではテーブルを作り直さず、init.sqlでデータだけを空にする
+# スキーマを変えた場合は、schema_versionを上げて10_schema.sqlを手で流し直す
+
 # MySQLを初期化
 mysql -u"$ISUCON_DB_USER" \
 		-p"$ISUCON_DB_PASSWORD" \
@@ -68,6 +72,8 @@ mysql -u"$ISUCON_DB_USER" \
 		--port "$ISUCON_DB_PORT" \
 		"$ISUCON_DB_NAME" < initial_livecomments.sql
 
-bash ../pdns/init_zone.sh 
-
-
+# PowerDNSのゾーンを作り直す
+# アプリの初期化では、MySQLと並行して作り直すためにISUCON13_INIT_SKIP_DNS_ZONE=trueで呼び、別に実行する
+if [ "${ISUCON13_INIT_SKIP_DNS_ZONE:-false}" != "true" ]; then
+	bash ./init_dns_zone.sh
+fi
@@ -1,5 +1,6 @@
 TRUNCATE TABLE themes;
 TRUNCATE TABLE icons;
+TRUNCATE TABLE icon_images;
 TRUNCATE TABLE reservation_slots;
 TRUNCATE TABLE livestream_viewers_history;
 TRUNCATE TABLE livecomment_reports;
@@ -10,6 +11,21 @@ TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
 TRUNCATE TABLE livestreams;
 TRUNCATE TABLE users;
+TRUNCATE TABLE shadow_bans;
+TRUNCATE TABLE moderation_logs;
+TRUNCATE TABLE livestream_collaborators;
+TRUNCATE TABLE livecomment_tombstones;
+TRUNCATE TABLE reaction_tombstones;
+TRUNCATE TABLE livestream_watch_history;
+TRUNCATE TABLE follows;
+TRUNCATE TABLE livestream_settings;
+TRUNCATE TABLE sessions;
+TRUNCATE TABLE user_cleanup_jobs;
+TRUNCATE TABLE notifications;
+TRUNCATE TABLE notification_preferences;
+TRUNCATE TABLE dns_record_jobs;
+TRUNCATE TABLE livestream_counters;
+TRUNCATE TABLE user_counters;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
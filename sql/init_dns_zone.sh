@@ -0,0 +1,22 @@
+#!/usr/bin/env bash
+
+set -eux
+cd $(dirname $0)
+
+if test -f /home/isucon/env.sh; then
+	. /home/isucon/env.sh
+fi
+
+# 組み込みのDNSサーバを使う場合や、このサーバでDNSレコードを登録しない場合は、PowerDNSのゾーンを作り直さない
+# (登録するサーバがあれば、アプリが初期化を転送する)
+case "${ISUCON13_DNS_BACKEND:-}" in
+builtin | none) ;;
+*)
+	# アプリと同じく、Goのstrconv.ParseBoolが偽と解釈する値の場合だけ無効にする
+	# (アプリの初期化からは、アプリが解釈した結果のtrue/falseが渡される)
+	case "${ISUCON13_ENABLE_DNS_REGISTRATION:-true}" in
+	0 | f | F | false | FALSE | False) ;;
+	*) bash ../pdns/init_zone.sh ;;
+	esac
+	;;
+esac
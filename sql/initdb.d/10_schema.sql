@@ -1,30 +1,51 @@
 USE `isupipe`;
 
 -- ユーザ (配信者、視聴者)
+DROP TABLE IF EXISTS `users`;
 CREATE TABLE `users` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `name` VARCHAR(255) NOT NULL,
   `display_name` VARCHAR(255) NOT NULL,
   `password` VARCHAR(255) NOT NULL,
   `description` TEXT NOT NULL,
-  UNIQUE `uniq_user_name` (`name`)
+  -- followsの件数 (フォロー・解除と同じトランザクションで更新する)
+  `follower_count` BIGINT NOT NULL DEFAULT 0,
+  -- 退会日時 (退会したユーザは名前だけ残し、プロフィールは消す)
+  `deleted_at` BIGINT DEFAULT NULL,
+  UNIQUE `uniq_user_name` (`name`),
+  -- ユーザ検索の前方一致用
+  INDEX `users_display_name` (`display_name`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- プロフィール画像
+DROP TABLE IF EXISTS `icons`;
 CREATE TABLE `icons` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
+  -- 画像はicon_imagesにsha256をキーとして保存する
+  `hash` VARCHAR(64) NOT NULL,
+  UNIQUE `user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- プロフィール画像の本体 (同じ画像は共有する)
+-- 各アプリサーバはここから読んで、手元のディレクトリにキャッシュする
+DROP TABLE IF EXISTS `icon_images`;
+CREATE TABLE `icon_images` (
+  `hash` VARCHAR(64) NOT NULL PRIMARY KEY,
   `image` LONGBLOB NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ユーザごとのカスタムテーマ
+DROP TABLE IF EXISTS `themes`;
 CREATE TABLE `themes` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
-  `dark_mode` BOOLEAN NOT NULL
+  `dark_mode` BOOLEAN NOT NULL,
+  INDEX `themes_user_id` (`user_id`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信
+DROP TABLE IF EXISTS `livestreams`;
 CREATE TABLE `livestreams` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
@@ -33,10 +54,22 @@ CREATE TABLE `livestreams` (
   `playlist_url` VARCHAR(255) NOT NULL,
   `thumbnail_url` VARCHAR(255) NOT NULL,
   `start_at` BIGINT NOT NULL,
-  `end_at` BIGINT NOT NULL
+  `end_at` BIGINT NOT NULL,
+  -- reserved, live, ended
+  `status` VARCHAR(255) NOT NULL DEFAULT 'reserved',
+  -- 配信言語 (ja, en-US など。未指定は空文字)
+  `language` VARCHAR(16) NOT NULL DEFAULT '',
+  -- categories.name (未指定は空文字)
+  `category` VARCHAR(255) NOT NULL DEFAULT '',
+  INDEX `livestreams_start_at_end_at` (`start_at`, `end_at`),
+  INDEX `livestreams_user_id` (`user_id`, `id`),
+  INDEX `livestreams_language` (`language`, `id`),
+  INDEX `livestreams_category` (`category`, `id`),
+  FULLTEXT INDEX `livestreams_title_description_fulltext` (`title`, `description`) WITH PARSER ngram
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信予約枠
+DROP TABLE IF EXISTS `reservation_slots`;
 CREATE TABLE `reservation_slots` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `slot` BIGINT NOT NULL,
@@ -45,6 +78,7 @@ CREATE TABLE `reservation_slots` (
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブストリームに付与される、サービスで定義されたタグ
+DROP TABLE IF EXISTS `tags`;
 CREATE TABLE `tags` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `name` VARCHAR(255) NOT NULL,
@@ -52,55 +86,296 @@ CREATE TABLE `tags` (
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信とタグの中間テーブル
+DROP TABLE IF EXISTS `livestream_tags`;
 CREATE TABLE `livestream_tags` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `livestream_id` BIGINT NOT NULL,
-  `tag_id` BIGINT NOT NULL
+  `tag_id` BIGINT NOT NULL,
+  INDEX `livestream_tags_tag_id` (`tag_id`, `livestream_id`),
+  INDEX `livestream_tags_livestream_id` (`livestream_id`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信視聴履歴
+DROP TABLE IF EXISTS `livestream_viewers_history`;
 CREATE TABLE `livestream_viewers_history` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
-  `created_at` BIGINT NOT NULL
+  `created_at` BIGINT NOT NULL,
+  -- 最後にハートビートを受けた時刻。一度も受けていない視聴者はNULLで、期限切れにしない
+  `heartbeat_at` BIGINT DEFAULT NULL,
+  UNIQUE `uniq_livestream_viewer` (`user_id`, `livestream_id`),
+  INDEX `livestream_viewers_history_livestream_id` (`livestream_id`),
+  INDEX `livestream_viewers_history_heartbeat_at` (`heartbeat_at`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信に対するライブコメント
+DROP TABLE IF EXISTS `livecomments`;
 CREATE TABLE `livecomments` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
   `comment` VARCHAR(255) NOT NULL,
   `tip` BIGINT NOT NULL DEFAULT 0,
-  `created_at` BIGINT NOT NULL
+  `parent_id` BIGINT DEFAULT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `livecomments_parent_id` (`parent_id`),
+  INDEX `livecomments_livestream_id_created_at_tip` (`livestream_id`, `created_at`, `tip`),
+  INDEX `livecomments_livestream_id_user_id` (`livestream_id`, `user_id`, `created_at`),
+  FULLTEXT INDEX `livecomments_comment_fulltext` (`comment`) WITH PARSER ngram
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ユーザからのライブコメントのスパム報告
+DROP TABLE IF EXISTS `livecomment_reports`;
 CREATE TABLE `livecomment_reports` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
   `livecomment_id` BIGINT NOT NULL,
-  `created_at` BIGINT NOT NULL
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livecomment_report` (`user_id`, `livecomment_id`),
+  INDEX `livecomment_reports_livestream_id` (`livestream_id`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- 配信者からのNGワード登録
+DROP TABLE IF EXISTS `ng_words`;
 CREATE TABLE `ng_words` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
   `word` VARCHAR(255) NOT NULL,
-  `created_at` BIGINT NOT NULL
+  `created_at` BIGINT NOT NULL,
+  INDEX `ng_words_livestream_id` (`livestream_id`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 CREATE INDEX ng_words_word ON ng_words(`word`);
 
 -- ライブ配信に対するリアクション
+DROP TABLE IF EXISTS `reactions`;
 CREATE TABLE `reactions` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
   -- :innocent:, :tada:, etc...
   `emoji_name` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `reactions_livestream_id_created_at` (`livestream_id`, `created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者によるシャドウバン
+DROP TABLE IF EXISTS `shadow_bans`;
+CREATE TABLE `shadow_bans` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_shadow_ban` (`livestream_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとのモデレーション操作ログ
+DROP TABLE IF EXISTS `moderation_logs`;
+CREATE TABLE `moderation_logs` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `action` VARCHAR(255) NOT NULL,
+  `detail` TEXT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `moderation_logs_livestream_id` (`livestream_id`, `created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信のコラボレーター(共同配信者)
+DROP TABLE IF EXISTS `livestream_collaborators`;
+CREATE TABLE `livestream_collaborators` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  -- invited, accepted
+  `status` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_collaborator` (`livestream_id`, `user_id`),
+  INDEX `livestream_collaborators_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 予約取り消しされた配信のライブコメント・リアクション
+DROP TABLE IF EXISTS `livecomment_tombstones`;
+CREATE TABLE `livecomment_tombstones` (
+  `id` BIGINT NOT NULL PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `comment` VARCHAR(255) NOT NULL,
+  `tip` BIGINT NOT NULL DEFAULT 0,
+  `parent_id` BIGINT DEFAULT NULL,
+  `created_at` BIGINT NOT NULL,
+  `deleted_at` BIGINT NOT NULL,
+  INDEX `livecomment_tombstones_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+DROP TABLE IF EXISTS `reaction_tombstones`;
+CREATE TABLE `reaction_tombstones` (
+  `id` BIGINT NOT NULL PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `emoji_name` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `deleted_at` BIGINT NOT NULL,
+  INDEX `reaction_tombstones_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザの視聴履歴 (入室ごとに追記し、退室しても消さない)
+DROP TABLE IF EXISTS `livestream_watch_history`;
+CREATE TABLE `livestream_watch_history` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `watched_at` BIGINT NOT NULL,
+  INDEX `livestream_watch_history_user_id` (`user_id`, `id`),
+  INDEX `livestream_watch_history_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者のフォロー
+DROP TABLE IF EXISTS `follows`;
+CREATE TABLE `follows` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `target_user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_follow` (`user_id`, `target_user_id`),
+  INDEX `follows_target_user_id` (`target_user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとの設定 (行がなければデフォルト値)
+DROP TABLE IF EXISTS `livestream_settings`;
+CREATE TABLE `livestream_settings` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `slow_mode_seconds` BIGINT NOT NULL DEFAULT 0,
+  `subscribers_only` BOOLEAN NOT NULL DEFAULT FALSE,
+  `reactions_disabled` BOOLEAN NOT NULL DEFAULT FALSE,
+  `updated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信カテゴリのマスタ
+DROP TABLE IF EXISTS `categories`;
+CREATE TABLE `categories` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `name` VARCHAR(255) NOT NULL,
+  UNIQUE `uniq_category_name` (`name`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+INSERT INTO `categories` (`name`) VALUES
+  ('ゲーム'),
+  ('音楽'),
+  ('雑談'),
+  ('スポーツ'),
+  ('教育'),
+  ('テクノロジー'),
+  ('料理'),
+  ('アート');
+
+-- サーバサイドセッション (dataはセッションの値を署名・エンコードしたもの)
+DROP TABLE IF EXISTS `sessions`;
+CREATE TABLE `sessions` (
+  `id` VARCHAR(64) NOT NULL PRIMARY KEY,
+  `data` TEXT NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  -- ログインしていないセッションは0
+  `user_id` BIGINT NOT NULL DEFAULT 0,
+  -- 作成時のUser-Agent (ユーザが自分のセッションを見分けるため)
+  `user_agent` VARCHAR(512) NOT NULL DEFAULT '',
+  `created_at` BIGINT NOT NULL DEFAULT 0,
+  INDEX `sessions_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 退会したユーザの後片付け待ち (配信・ライブコメント・リアクションの削除が終わったら消す)
+DROP TABLE IF EXISTS `user_cleanup_jobs`;
+CREATE TABLE `user_cleanup_jobs` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  -- 処理中のサーバがこの時刻 (UNIX秒) まで受け持つ。過ぎたら他のサーバが拾い直す
+  `claimed_until` BIGINT NOT NULL DEFAULT 0,
   `created_at` BIGINT NOT NULL
-) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
\ No newline at end of file
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 通知 (自分の配信へのライブコメント・投げ銭・リアクション)
+DROP TABLE IF EXISTS `notifications`;
+CREATE TABLE `notifications` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  -- 通知を受け取るユーザ (配信者)
+  `user_id` BIGINT NOT NULL,
+  -- livecomment, tip, reaction
+  `type` VARCHAR(32) NOT NULL,
+  `actor_user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `livecomment_id` BIGINT DEFAULT NULL,
+  `reaction_id` BIGINT DEFAULT NULL,
+  `tip` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL,
+  `read_at` BIGINT DEFAULT NULL,
+  INDEX `notifications_user_id` (`user_id`, `id`),
+  INDEX `notifications_livestream_id` (`livestream_id`),
+  INDEX `notifications_actor_user_id` (`actor_user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 通知の受け取り設定 (行がなければすべて受け取る)
+DROP TABLE IF EXISTS `notification_preferences`;
+CREATE TABLE `notification_preferences` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `livecomment` BOOLEAN NOT NULL DEFAULT TRUE,
+  `tip` BOOLEAN NOT NULL DEFAULT TRUE,
+  `reaction` BOOLEAN NOT NULL DEFAULT TRUE,
+  `updated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 反映待ちのユーザのサブドメインのDNSレコード (反映できたら消す)
+DROP TABLE IF EXISTS `dns_record_jobs`;
+CREATE TABLE `dns_record_jobs` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `name` VARCHAR(255) NOT NULL,
+  -- add, remove
+  `operation` VARCHAR(16) NOT NULL DEFAULT 'add',
+  `attempts` INT NOT NULL DEFAULT 0,
+  `last_error` TEXT DEFAULT NULL,
+  -- 失敗したジョブをこの時刻 (UNIX秒) までやり直さない
+  `next_attempt_at` BIGINT NOT NULL DEFAULT 0,
+  -- 処理中のサーバがこの時刻 (UNIX秒) まで受け持つ
+  `claimed_until` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとの件数 (アプリサーバのメモリ上の増減を定期的に足し込む。元の行から数え直せる)
+DROP TABLE IF EXISTS `livestream_counters`;
+CREATE TABLE `livestream_counters` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `reactions` BIGINT NOT NULL DEFAULT 0,
+  `viewers` BIGINT NOT NULL DEFAULT 0,
+  `reports` BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者ごとの件数 (配信者の全配信の合計。ライブコメントはシャドウバンされたユーザの分を除く)
+DROP TABLE IF EXISTS `user_counters`;
+CREATE TABLE `user_counters` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `reactions` BIGINT NOT NULL DEFAULT 0,
+  `livecomments` BIGINT NOT NULL DEFAULT 0,
+  `viewers` BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 最後の初期化 (1行だけ)。各アプリサーバはtokenが変わったら手元のキャッシュなどを作り直す
+DROP TABLE IF EXISTS `initializations`;
+CREATE TABLE `initializations` (
+  `id` INT NOT NULL PRIMARY KEY,
+  `token` VARCHAR(64) NOT NULL,
+  `initialized_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- アプリで採番するIDの払い出し済みの最大値 (reactions, livecomments)
+-- アプリサーバが投稿のトランザクションの外でブロック単位に予約するので、IDの順とコミットの順は一致しない
+DROP TABLE IF EXISTS `id_sequences`;
+CREATE TABLE `id_sequences` (
+  `name` VARCHAR(32) NOT NULL PRIMARY KEY,
+  `last_id` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- スキーマのバージョン (スキーマを変えたら、アプリのschemaVersionと合わせて上げる)
+DROP TABLE IF EXISTS `schema_version`;
+CREATE TABLE `schema_version` (
+  `version` INT NOT NULL PRIMARY KEY
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+INSERT INTO `schema_version` (`version`) VALUES (8);